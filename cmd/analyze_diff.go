@@ -0,0 +1,108 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// NewAnalyzeDiffCommand will report how effective a differential build is.
+func NewAnalyzeDiffCommand() *cobra.Command {
+	analyzeDiffCommand := &cobra.Command{
+		Use:              "analyze-diff [flags]",
+		Short:            "Report how much a differential build saves over a full build",
+		PreRunE:          logging.Init,
+		RunE:             analyzeDiff,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	analyzeDiffCommand.Flags().SetInterspersed(false)
+	analyzeDiffCommand.Flags().BoolP("help", "h", false, "show help")
+	analyzeDiffCommand.Flags().String("image", "", "OCI image to analyze")
+	analyzeDiffCommand.Flags().String("image-source", "", "source image to diff-out of the specified image")
+	analyzeDiffCommand.Flags().String("format", "", "output format, can be json")
+
+	return analyzeDiffCommand
+}
+
+func analyzeDiff(cmd *cobra.Command, arguments []string) error {
+	image, err := cmd.Flags().GetString("image")
+	if err != nil {
+		return err
+	}
+
+	imageSource, err := cmd.Flags().GetString("image-source")
+	if err != nil {
+		return err
+	}
+
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+
+	if image == "" || imageSource == "" {
+		return errors.New("missing required arguments: image and image-source must be specified")
+	}
+
+	if format != "" && format != "json" {
+		return fmt.Errorf("unsupported format %q", format)
+	}
+
+	for _, ref := range []string{image, imageSource} {
+		if !fileutils.Exist(imageutils.GetPath(ref)) {
+			_, err := imageutils.Pull(ref, true, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	stats, err := sysextutils.AnalyzeDiff(image, imageSource)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		out, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(out))
+
+		return nil
+	}
+
+	fmt.Printf("layers:          %d (%d skipped, %d shared with the source)\n",
+		stats.Layers, stats.SkippedLayers, stats.SharedLayers)
+	fmt.Printf("full build:      %s\n", formatBytes(stats.FullSize))
+	fmt.Printf("skipped layers:  %s\n", formatBytes(stats.SkippedSize))
+	fmt.Printf("overlay layers:  %s\n", formatBytes(stats.OverlaySize))
+	fmt.Printf("suggestion:      %s\n", stats.Suggestion)
+
+	return nil
+}
+
+// formatBytes returns a human readable representation of input size.
+func formatBytes(size int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(size)
+
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
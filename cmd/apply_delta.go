@@ -0,0 +1,34 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// NewApplyDeltaCommand will apply a binary delta to a raw image.
+func NewApplyDeltaCommand() *cobra.Command {
+	applyDeltaCommand := &cobra.Command{
+		Use:              "apply-delta [flags] OLD.raw DELTA OUTPUT.raw",
+		Short:            "Apply a binary delta to a sysext raw image, verifying the result",
+		PreRunE:          logging.Init,
+		RunE:             applyDelta,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	applyDeltaCommand.Flags().SetInterspersed(false)
+	applyDeltaCommand.Flags().BoolP("help", "h", false, "show help")
+
+	return applyDeltaCommand
+}
+
+func applyDelta(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) != 3 {
+		return cmd.Help()
+	}
+
+	return sysextutils.ApplyDelta(arguments[0], arguments[1], arguments[2])
+}
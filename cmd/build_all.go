@@ -0,0 +1,235 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// buildSysext builds the sysext of a spec, it's replaced in the tests.
+var buildSysext = sysextutils.CreateSysext
+
+// NewBuildAllCommand will build every sysext described by the specs in a directory.
+func NewBuildAllCommand() *cobra.Command {
+	buildAllCommand := &cobra.Command{
+		Use:              "build-all [flags] DIR",
+		Short:            "Build all the sysexts defined by the *.yaml specs in a directory",
+		PreRunE:          logging.Init,
+		RunE:             buildAll,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	buildAllCommand.Flags().SetInterspersed(false)
+	buildAllCommand.Flags().BoolP("help", "h", false, "show help")
+	buildAllCommand.Flags().IntP("jobs", "j", 1, "number of sysexts to build in parallel")
+	buildAllCommand.Flags().Bool("continue-on-error", false, "keep building the remaining specs after a failure")
+	buildAllCommand.Flags().Bool("resume", false, "skip the specs already built by a previous run, unless they changed")
+
+	return buildAllCommand
+}
+
+// buildResult is the outcome of building a single spec.
+type buildResult struct {
+	spec string
+	err  error
+}
+
+func buildAll(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) < 1 {
+		return cmd.Help()
+	}
+
+	jobs, err := cmd.Flags().GetInt("jobs")
+	if err != nil {
+		return err
+	}
+
+	if jobs < 1 {
+		return fmt.Errorf("invalid number of jobs: %d", jobs)
+	}
+
+	continueOnError, err := cmd.Flags().GetBool("continue-on-error")
+	if err != nil {
+		return err
+	}
+
+	resume, err := cmd.Flags().GetBool("resume")
+	if err != nil {
+		return err
+	}
+
+	state, err := sysextutils.LoadBuildState(arguments[0])
+	if err != nil {
+		return err
+	}
+
+	specs, err := filepath.Glob(filepath.Join(arguments[0], "*.yaml"))
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(specs)
+
+	if len(specs) == 0 {
+		return fmt.Errorf("no *.yaml specs found in %s", arguments[0])
+	}
+
+	err = sysextutils.CheckSpecCollisions(specs)
+	if err != nil {
+		return err
+	}
+
+	var (
+		results []buildResult
+		mutex   sync.Mutex
+		wg      sync.WaitGroup
+		failed  bool
+		resumed int
+	)
+
+	queue := make(chan string)
+
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for spec := range queue {
+				var key string
+
+				err := logging.Phase("spec", map[string]any{"spec": spec}, func() error {
+					var err error
+
+					key, err = sysextutils.SpecKey(spec)
+					if err != nil {
+						return err
+					}
+
+					return buildSpec(spec)
+				})
+
+				mutex.Lock()
+				results = append(results, buildResult{spec: spec, err: err})
+				failed = failed || err != nil
+
+				// checkpoint after each success, so that an interrupted
+				// run can be resumed.
+				if err == nil {
+					state[filepath.Base(spec)] = key
+
+					saveErr := sysextutils.SaveBuildState(arguments[0], state)
+					if saveErr != nil {
+						logging.LogWarning("cannot save build state: %v", saveErr)
+					}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, spec := range specs {
+		mutex.Lock()
+		stop := failed && !continueOnError
+		mutex.Unlock()
+
+		if stop {
+			break
+		}
+
+		if resume && isBuilt(spec, state) {
+			logging.Log("%s already built, skipping", spec)
+
+			mutex.Lock()
+			resumed++
+			mutex.Unlock()
+
+			continue
+		}
+
+		queue <- spec
+	}
+
+	close(queue)
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].spec < results[j].spec })
+
+	failures := 0
+
+	for _, result := range results {
+		if result.err != nil {
+			failures++
+		}
+	}
+
+	// the spec phase events already report each result
+	if !logging.JSONEvents() {
+		printBuildResults(cmd.OutOrStdout(), results, resumed, len(specs))
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d of %d sysexts failed to build", failures, len(specs))
+	}
+
+	return nil
+}
+
+// printBuildResults will print to out the result of each build, and a summary
+// of the specs built, failed, already built and skipped.
+func printBuildResults(out io.Writer, results []buildResult, resumed int, specs int) {
+	failures := 0
+
+	for _, result := range results {
+		if result.err != nil {
+			failures++
+
+			fmt.Fprintf(out, "FAIL %s: %v\n", result.spec, result.err)
+
+			continue
+		}
+
+		fmt.Fprintf(out, "OK   %s\n", result.spec)
+	}
+
+	fmt.Fprintf(out, "%d built, %d failed, %d already built, %d skipped\n",
+		len(results)-failures, failures, resumed, specs-len(results)-resumed)
+}
+
+// isBuilt returns whether input spec was built by a previous run, is unchanged
+// since, and its sysext still exists.
+func isBuilt(spec string, state sysextutils.BuildState) bool {
+	key, err := sysextutils.SpecKey(spec)
+	if err != nil || state[filepath.Base(spec)] != key {
+		return false
+	}
+
+	opts, err := sysextutils.LoadSpec(spec)
+	if err != nil {
+		return false
+	}
+
+	return fileutils.Exist(sysextutils.GetOutputPath(opts.Name, opts.OutputName))
+}
+
+// buildSpec will load and build a single spec file.
+func buildSpec(spec string) error {
+	opts, err := sysextutils.LoadSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	logging.Log("building %s from %s", opts.Name, spec)
+
+	return buildSysext(opts)
+}
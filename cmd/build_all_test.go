@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+func TestBuildAll(t *testing.T) {
+	t.Setenv("OCI_SYSEXT_HOME", t.TempDir())
+
+	var (
+		built []string
+		mutex sync.Mutex
+	)
+
+	buildSysext = func(opts sysextutils.CreateOptions) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		built = append(built, opts.Name)
+
+		return nil
+	}
+
+	t.Cleanup(func() { buildSysext = sysextutils.CreateSysext })
+
+	dir := t.TempDir()
+
+	for name, content := range map[string]string{
+		"a.yaml": "image: localhost/a:1\nname: a\n",
+		"b.yaml": "image: localhost/b:1\nname b\n",
+		"c.yaml": "image: localhost/c:1\nname: c\n",
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the logging flags are persistent flags of the root command
+	rootCmd := &cobra.Command{Use: "oci-sysext", SilenceUsage: true, SilenceErrors: true}
+	rootCmd.PersistentFlags().String("log-level", "", "")
+	rootCmd.PersistentFlags().Bool("no-color", false, "")
+	rootCmd.PersistentFlags().Bool("json-events", false, "")
+	rootCmd.PersistentFlags().Int("json-events-fd", 1, "")
+	rootCmd.AddCommand(NewBuildAllCommand())
+
+	var out bytes.Buffer
+
+	rootCmd.SetOut(&out)
+	rootCmd.SetArgs([]string{"build-all", "--continue-on-error", dir})
+
+	err := rootCmd.Execute()
+	if err == nil || err.Error() != "1 of 3 sysexts failed to build" {
+		t.Errorf("got %v, expected 1 of 3 sysexts to fail", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("unexpected summary:\n%s", out.String())
+	}
+
+	if lines[0] != "OK   "+filepath.Join(dir, "a.yaml") ||
+		!strings.HasPrefix(lines[1], "FAIL "+filepath.Join(dir, "b.yaml")+": ") ||
+		lines[2] != "OK   "+filepath.Join(dir, "c.yaml") ||
+		lines[3] != "2 built, 1 failed, 0 already built, 0 skipped" {
+		t.Errorf("unexpected summary:\n%s", out.String())
+	}
+
+	sort.Strings(built)
+
+	if !reflect.DeepEqual(built, []string{"a", "c"}) {
+		t.Errorf("got %q built, expected a and c", built)
+	}
+}
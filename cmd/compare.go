@@ -0,0 +1,78 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// NewCompareCommand will report the files changed between two sysexts.
+func NewCompareCommand() *cobra.Command {
+	compareCommand := &cobra.Command{
+		Use:              "compare [flags] OLD NEW",
+		Short:            "Report the files added, removed and changed between two sysexts",
+		PreRunE:          logging.Init,
+		RunE:             compare,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	compareCommand.Flags().SetInterspersed(false)
+	compareCommand.Flags().BoolP("help", "h", false, "show help")
+	compareCommand.Flags().String("format", "", "output format, can be json")
+
+	return compareCommand
+}
+
+func compare(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) != 2 {
+		return cmd.Help()
+	}
+
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+
+	if format != "" && format != "json" {
+		return fmt.Errorf("unsupported format %q", format)
+	}
+
+	comparison, err := sysextutils.CompareSysexts(arguments[0], arguments[1])
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		out, err := json.MarshalIndent(comparison, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(out))
+
+		return nil
+	}
+
+	for _, change := range comparison.Added {
+		fmt.Printf("+ %s\n", change.Path)
+	}
+
+	for _, change := range comparison.Removed {
+		fmt.Printf("- %s\n", change.Path)
+	}
+
+	for _, change := range comparison.Changed {
+		fmt.Printf("~ %s\n", change.Path)
+	}
+
+	fmt.Printf("%d added, %d removed, %d changed\n",
+		len(comparison.Added), len(comparison.Removed), len(comparison.Changed))
+
+	return nil
+}
@@ -0,0 +1,55 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// NewConvertCommand will repack an existing sysext using a different filesystem.
+func NewConvertCommand() *cobra.Command {
+	convertCommand := &cobra.Command{
+		Use:              "convert [flags]",
+		Short:            "Convert an existing sysext to a different filesystem",
+		PreRunE:          logging.Init,
+		RunE:             convert,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	convertCommand.Flags().SetInterspersed(false)
+	convertCommand.Flags().Bool("help", false, "show help")
+	convertCommand.Flags().String("name", "", "name of sysext to convert")
+	convertCommand.Flags().String("fs", "ext4", "fs to use for the converted raw image")
+	convertCommand.Flags().String("output", "", "name of the converted sysext, defaults to replacing the existing one")
+
+	return convertCommand
+}
+
+func convert(cmd *cobra.Command, arguments []string) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+
+	fs, err := cmd.Flags().GetString("fs")
+	if err != nil {
+		return err
+	}
+
+	output, _ := cmd.Flags().GetString("output") // Ignore error as it's optional
+
+	if name == "" {
+		out, _ := exec.Command("/proc/self/exe", []string{"convert", "--help"}...).CombinedOutput()
+		fmt.Println(string(out))
+		return errors.New("missing required arguments: name must be specified")
+	}
+
+	return sysextutils.ConvertSysext(name, fs, output)
+}
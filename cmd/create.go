@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"os/exec"
 
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
 	"github.com/89luca89/oci-sysext/pkg/logging"
 	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/89luca89/oci-sysext/pkg/utils"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // NewCreateCommand will create a new container environment ready to use.
@@ -26,9 +29,68 @@ func NewCreateCommand() *cobra.Command {
 	createCommand.Flags().SetInterspersed(false)
 	createCommand.Flags().Bool("help", false, "show help")
 	createCommand.Flags().String("image", "", "OCI image to use")
-	createCommand.Flags().String("name", "", "name of sysext")
-	createCommand.Flags().String("fs", "ext4", "fs to use for raw image")
+	createCommand.Flags().String("name", "", "name of sysext, optional with --use-image-labels if the image sets io.oci-sysext.name")
+	createCommand.Flags().String("fs", "ext4", "fs to use for raw image, a comma separated list packs the rootfs once per fs")
+	createCommand.Flags().Bool("use-image-labels", false, "use the image's io.oci-sysext.* labels as defaults for the build options")
 	createCommand.Flags().String("image-source", "", "source image to diff-out of the specified image")
+	createCommand.Flags().Bool("auto-source", false, "use the base image recorded in the image annotations as image source")
+	createCommand.Flags().Bool("minimal-diff", false, "drop the files identical to the ones of the image source from the sysext")
+	createCommand.Flags().String("verify-source-signature", "", "public key to verify the image's cosign signature with")
+	createCommand.Flags().Bool("verify-rootfs", false, "verify each layer against the image config's diff_ids while extracting")
+	createCommand.Flags().StringArray("release-field", nil, "additional KEY=VALUE line for the extension-release file, can be repeated")
+	createCommand.Flags().StringSlice("release-source-order", nil, "sources of the extension-release fields by precedence, among flags, image-labels, image-os-release and host, defaults to flags,image-os-release")
+	createCommand.Flags().StringArray("release-extra", nil, "SRC=DST file to copy to DST in the extension-release directory, can be repeated")
+	createCommand.Flags().Bool("keep-whiteouts", false, "debug: keep whiteout markers in the rootfs instead of applying them")
+	createCommand.Flags().BoolP("quiet", "q", false, "hide the progress of the image pull and of the packing")
+	createCommand.Flags().Bool("strict", false, "turn warnings about unsafe inputs, like unpinned images, into errors")
+	createCommand.Flags().String("ignore-file", "", "gitignore-style file of paths to remove from the rootfs, defaults to ./.sysextignore if present")
+	createCommand.Flags().String("tmpdir", "", "TMPDIR for the packing tools, defaults to the staging directory")
+	createCommand.Flags().String("min-free-space", "", "free space required on the staging and output volumes (e.g. 10G), overrides the estimate")
+	createCommand.Flags().Bool("skip-space-check", false, "skip the free space preflight check")
+	createCommand.Flags().Bool("no-cache", false, "pull the images again without reusing downloaded layers")
+	createCommand.Flags().Int("up-to-layer", 0, "only extract the first N layers of the image")
+	createCommand.Flags().Int("min-systemd-version", 0, "oldest systemd version the sysext targets, recorded in its metadata")
+	createCommand.Flags().Bool("sparse", false, "make zero-filled regions of big files sparse before packing")
+	createCommand.Flags().String("architecture", "", "ARCHITECTURE of the sysext (e.g. x86-64 or amd64), _any to match any architecture")
+	createCommand.Flags().String("release-id", "", "ID of the sysext, _any to match any host OS, defaults to the ID of the image's os-release")
+	createCommand.Flags().String("sysext-level", "", "SYSEXT_LEVEL of the sysext, matched against the one of the host")
+	createCommand.Flags().Bool("match-host", false, "restrict the sysext to hosts with the ID and SYSEXT_LEVEL, or VERSION_ID, of the build host")
+	createCommand.Flags().Bool("depmod", false, "regenerate the kernel modules dependency data in /usr/lib/modules")
+	createCommand.Flags().String("target-kernel", "", "oldest kernel version mounting the sysext, warn if it can't mount the compression")
+	createCommand.Flags().String("kernel-version", "", "kernel version to run depmod for, detected if there's only one")
+	createCommand.Flags().Bool("split-opt", false, "pack /opt in a separate NAME-opt sysext, NAME only keeps /usr")
+	createCommand.Flags().String("compression", "", "compression algorithm of the raw image, defaults to the configured one for the fs")
+	createCommand.Flags().Int("compression-level", 0, "compression level, the valid range depends on the compression algorithm")
+	createCommand.Flags().String("generate-unit", "", "write a systemd service unit running the image's entrypoint at this path")
+	createCommand.Flags().String("write-descriptor", "", "write a JSON descriptor of the sysext for deployment tools at this path")
+	createCommand.Flags().StringArray("requires", nil, "name of a sysext that must be merged along with this one, can be repeated")
+	createCommand.Flags().Bool("incremental", false, "only extract the layers changed since the previous build of the image")
+	createCommand.Flags().Bool("compress-snapshot", false, "store the --incremental snapshot as a compressed tar, to save space between builds")
+	createCommand.Flags().Bool("portable", false, "make the sysext usable as a portable service extension, with NAME as units prefix")
+	createCommand.Flags().Bool("reproducible", false, "lay out the files in a fixed order and set a fixed creation time, squashfs only")
+	createCommand.Flags().Bool("boot-optimized", false, "pack the sysext for the initrd and set SYSEXT_SCOPE=initrd, squashfs only")
+	createCommand.Flags().StringArray("tar-exclude", fileutils.DefaultTarExcludes, "tar pattern of paths not to extract from the layers, replaces the defaults")
+	createCommand.Flags().Bool("preserve-attrs", false, "apply the immutable, append-only and other file attributes of the layers, ext4 and btrfs only")
+	createCommand.Flags().Bool("preserve-hardlinks", true, "keep hard linked files as links in the raw image, set to false to copy them")
+	createCommand.Flags().Bool("preserve-acls", true, "keep the POSIX ACLs of the layers in the raw image, ext4 and btrfs only, set to false to drop them")
+	createCommand.Flags().Bool("dereference-symlinks", false, "replace symlinks with copies of their targets, warning about dangling ones")
+	createCommand.Flags().IntSlice("assert-uid", nil, "fail if any file of the rootfs is owned by another uid, can be repeated")
+	createCommand.Flags().IntSlice("assert-gid", nil, "fail if any file of the rootfs is owned by another gid, can be repeated")
+	createCommand.Flags().Bool("minimize", false, "remove the files of /usr and /opt not needed to run the entrypoints, following their shared libraries")
+	createCommand.Flags().StringArray("entrypoint", nil, "binary kept by --minimize, can be repeated, defaults to the image's entrypoint")
+	createCommand.Flags().Bool("check-symlinks", false, "report symlinks in /usr and /opt that don't resolve inside them, fails with --strict")
+	createCommand.Flags().Bool("prune-broken-symlinks", false, "remove the symlinks reported by --check-symlinks")
+	createCommand.Flags().String("max-uncompressed-size", "", "abort if the extracted layers exceed this size (e.g. 100G), defaults to 64G")
+	createCommand.Flags().Int("max-layers", 0, "abort if the image has more layers than this, defaults to 128")
+	createCommand.Flags().String("output-name", "", "file name of the raw image, including its extension, defaults to NAME.raw")
+	createCommand.Flags().Bool("no-extension-reload", false, "do not set EXTENSION_RELOAD_MANAGER=1, the service manager is not reloaded on merge")
+	createCommand.Flags().String("version", "", "semantic version of the build, set as SYSEXT_VERSION_ID and kept along the other versions")
+	createCommand.Flags().Bool("validate-extension-release-filename", true, "fail if systemd-sysext would never merge a sysext with the given name, set to false to only warn")
+	createCommand.Flags().Bool("fail-on-empty-release", false, "fail if the extension-release matches any host, with only ID=_any")
+	createCommand.Flags().Bool("overwrite", false, "replace an existing sysext with the same name built from a different image")
+	createCommand.Flags().String("smoke-test", "", "command to run with the built sysext overlaid on the host, fails the build on error")
+	createCommand.Flags().String("dedup-against", "", "reference image, list the files identical to its ones in NAME.dedup.json for deployment to hardlink them")
+	createCommand.Flags().String("set-mtime", "", "set the raw image's mtime (now, source-date, RFC3339 time or unix timestamp)")
 	return createCommand
 }
 
@@ -48,13 +110,176 @@ func create(cmd *cobra.Command, arguments []string) error {
 		return err
 	}
 
+	useImageLabels, _ := cmd.Flags().GetBool("use-image-labels")
 	imageSource, _ := cmd.Flags().GetString("image-source") // Ignore error as it's optional
+	autoSource, _ := cmd.Flags().GetBool("auto-source")
+	minimalDiff, _ := cmd.Flags().GetBool("minimal-diff")
+	signaturePublicKey, _ := cmd.Flags().GetString("verify-source-signature")
+	mtime, _ := cmd.Flags().GetString("set-mtime")
+	verifyRootfs, _ := cmd.Flags().GetBool("verify-rootfs")
+	releaseFields, _ := cmd.Flags().GetStringArray("release-field")
+	releaseSourceOrder, _ := cmd.Flags().GetStringSlice("release-source-order")
+	releaseExtras, _ := cmd.Flags().GetStringArray("release-extra")
+	keepWhiteouts, _ := cmd.Flags().GetBool("keep-whiteouts")
+	quiet, _ := cmd.Flags().GetBool("quiet")
+	strict, _ := cmd.Flags().GetBool("strict")
+	tmpDir, _ := cmd.Flags().GetString("tmpdir")
+	skipSpaceCheck, _ := cmd.Flags().GetBool("skip-space-check")
+	noCache, _ := cmd.Flags().GetBool("no-cache")
+	upToLayer, _ := cmd.Flags().GetInt("up-to-layer")
+	maxLayers, _ := cmd.Flags().GetInt("max-layers")
+	minSystemdVersion, _ := cmd.Flags().GetInt("min-systemd-version")
+	sparse, _ := cmd.Flags().GetBool("sparse")
+	architecture, _ := cmd.Flags().GetString("architecture")
+	releaseID, _ := cmd.Flags().GetString("release-id")
+	sysextLevel, _ := cmd.Flags().GetString("sysext-level")
+	matchHost, _ := cmd.Flags().GetBool("match-host")
+	depmod, _ := cmd.Flags().GetBool("depmod")
+	targetKernel, _ := cmd.Flags().GetString("target-kernel")
+	kernelVersion, _ := cmd.Flags().GetString("kernel-version")
+	splitOpt, _ := cmd.Flags().GetBool("split-opt")
+	compression, _ := cmd.Flags().GetString("compression")
+	compressionLevel, _ := cmd.Flags().GetInt("compression-level")
+	unit, _ := cmd.Flags().GetString("generate-unit")
+	descriptor, _ := cmd.Flags().GetString("write-descriptor")
+	requires, _ := cmd.Flags().GetStringArray("requires")
+	incremental, _ := cmd.Flags().GetBool("incremental")
+	compressSnapshot, _ := cmd.Flags().GetBool("compress-snapshot")
+	portable, _ := cmd.Flags().GetBool("portable")
+	reproducible, _ := cmd.Flags().GetBool("reproducible")
+	bootOptimized, _ := cmd.Flags().GetBool("boot-optimized")
+	tarExcludes, _ := cmd.Flags().GetStringArray("tar-exclude")
+	preserveAttrs, _ := cmd.Flags().GetBool("preserve-attrs")
+	preserveHardlinks, _ := cmd.Flags().GetBool("preserve-hardlinks")
+	preserveACLs, _ := cmd.Flags().GetBool("preserve-acls")
+	dereferenceSymlinks, _ := cmd.Flags().GetBool("dereference-symlinks")
+	allowedUIDs, _ := cmd.Flags().GetIntSlice("assert-uid")
+	allowedGIDs, _ := cmd.Flags().GetIntSlice("assert-gid")
+	minimize, _ := cmd.Flags().GetBool("minimize")
+	entrypoints, _ := cmd.Flags().GetStringArray("entrypoint")
+	checkSymlinks, _ := cmd.Flags().GetBool("check-symlinks")
+	pruneBrokenSymlinks, _ := cmd.Flags().GetBool("prune-broken-symlinks")
+	outputName, _ := cmd.Flags().GetString("output-name")
+	noExtensionReload, _ := cmd.Flags().GetBool("no-extension-reload")
+	version, _ := cmd.Flags().GetString("version")
+	validateName, _ := cmd.Flags().GetBool("validate-extension-release-filename")
+	failOnEmptyRelease, _ := cmd.Flags().GetBool("fail-on-empty-release")
+	overwrite, _ := cmd.Flags().GetBool("overwrite")
+	smokeTest, _ := cmd.Flags().GetString("smoke-test")
+	dedupAgainst, _ := cmd.Flags().GetString("dedup-against")
 
-	if image == "" || name == "" {
+	var minFreeSpace uint64
+
+	minFreeSpaceFlag, _ := cmd.Flags().GetString("min-free-space")
+	if minFreeSpaceFlag != "" {
+		minFreeSpace, err = utils.ParseSize(minFreeSpaceFlag)
+		if err != nil {
+			return err
+		}
+	}
+
+	var maxUncompressedSize uint64
+
+	maxUncompressedSizeFlag, _ := cmd.Flags().GetString("max-uncompressed-size")
+	if maxUncompressedSizeFlag != "" {
+		maxUncompressedSize, err = utils.ParseSize(maxUncompressedSizeFlag)
+		if err != nil {
+			return err
+		}
+	}
+
+	ignoreFile, _ := cmd.Flags().GetString("ignore-file")
+	if ignoreFile == "" && fileutils.Exist(".sysextignore") {
+		ignoreFile = ".sysextignore"
+	}
+
+	// the name can be declared by the image's io.oci-sysext.name label
+	if image == "" || (name == "" && !useImageLabels) {
 		out, _ := exec.Command("/proc/self/exe", []string{"create", "--help"}...).CombinedOutput()
 		fmt.Println(string(out))
 		return errors.New("missing required arguments: image and name must be specified")
 	}
 
-	return sysextutils.CreateSysext(image, name, fs, imageSource)
+	opts := sysextutils.CreateOptions{
+		Image:               image,
+		Name:                name,
+		Fs:                  fs,
+		ImageSource:         imageSource,
+		AutoSource:          autoSource,
+		MinimalDiff:         minimalDiff,
+		SignaturePublicKey:  signaturePublicKey,
+		Mtime:               mtime,
+		VerifyRootfs:        verifyRootfs,
+		ReleaseFields:       releaseFields,
+		ReleaseSourceOrder:  releaseSourceOrder,
+		ReleaseExtras:       releaseExtras,
+		KeepWhiteouts:       keepWhiteouts,
+		Quiet:               quiet,
+		Strict:              strict,
+		IgnoreFile:          ignoreFile,
+		TmpDir:              tmpDir,
+		MinFreeSpace:        minFreeSpace,
+		SkipSpaceCheck:      skipSpaceCheck,
+		NoCache:             noCache,
+		UpToLayer:           upToLayer,
+		MinSystemdVersion:   minSystemdVersion,
+		Sparse:              sparse,
+		Architecture:        architecture,
+		ReleaseID:           releaseID,
+		SysextLevel:         sysextLevel,
+		MatchHost:           matchHost,
+		Depmod:              depmod,
+		TargetKernel:        targetKernel,
+		KernelVersion:       kernelVersion,
+		SplitOpt:            splitOpt,
+		Compression:         compression,
+		CompressionLevel:    compressionLevel,
+		Unit:                unit,
+		Descriptor:          descriptor,
+		Requires:            requires,
+		Incremental:         incremental,
+		CompressSnapshot:    compressSnapshot,
+		Portable:            portable,
+		Reproducible:        reproducible,
+		BootOptimized:       bootOptimized,
+		TarExcludes:         tarExcludes,
+		PreserveAttrs:       preserveAttrs,
+		BreakHardlinks:      !preserveHardlinks,
+		DropACLs:            !preserveACLs,
+		DereferenceSymlinks: dereferenceSymlinks,
+		AllowedUIDs:         allowedUIDs,
+		AllowedGIDs:         allowedGIDs,
+		Minimize:            minimize,
+		Entrypoints:         entrypoints,
+		CheckSymlinks:       checkSymlinks,
+		PruneBrokenSymlinks: pruneBrokenSymlinks,
+		MaxUncompressedSize: maxUncompressedSize,
+		MaxLayers:           maxLayers,
+		OutputName:          outputName,
+		NoExtensionReload:   noExtensionReload,
+		Version:             version,
+		AllowInvalidName:    !validateName,
+		FailOnEmptyRelease:  failOnEmptyRelease,
+		Overwrite:           overwrite,
+		SmokeTest:           smokeTest,
+		DedupAgainst:        dedupAgainst,
+	}
+
+	if useImageLabels {
+		explicit := map[string]bool{}
+		cmd.Flags().Visit(func(flag *pflag.Flag) {
+			explicit[flag.Name] = true
+		})
+
+		opts, err = sysextutils.ApplyImageLabels(opts, explicit)
+		if err != nil {
+			return err
+		}
+
+		if opts.Name == "" {
+			return errors.New("missing required arguments: name must be specified, or set by the io.oci-sysext.name label")
+		}
+	}
+
+	return sysextutils.CreateSysext(opts)
 }
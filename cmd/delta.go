@@ -0,0 +1,34 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// NewDeltaCommand will create a binary delta between two raw images.
+func NewDeltaCommand() *cobra.Command {
+	deltaCommand := &cobra.Command{
+		Use:              "delta [flags] OLD.raw NEW.raw OUTPUT.delta",
+		Short:            "Create a binary delta turning a sysext raw image into a newer one",
+		PreRunE:          logging.Init,
+		RunE:             delta,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	deltaCommand.Flags().SetInterspersed(false)
+	deltaCommand.Flags().BoolP("help", "h", false, "show help")
+
+	return deltaCommand
+}
+
+func delta(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) != 3 {
+		return cmd.Help()
+	}
+
+	return sysextutils.CreateDelta(arguments[0], arguments[1], arguments[2])
+}
@@ -0,0 +1,90 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// NewEstimateCommand will estimate the size of a sysext before building it.
+func NewEstimateCommand() *cobra.Command {
+	estimateCommand := &cobra.Command{
+		Use:              "estimate [flags]",
+		Short:            "Estimate the size of the sysext built from an image, without building it",
+		PreRunE:          logging.Init,
+		RunE:             estimate,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	estimateCommand.Flags().SetInterspersed(false)
+	estimateCommand.Flags().BoolP("help", "h", false, "show help")
+	estimateCommand.Flags().String("image", "", "image to estimate the sysext of")
+	estimateCommand.Flags().StringArray("tar-exclude", fileutils.DefaultTarExcludes, "tar pattern of paths not to account for, replaces the defaults")
+	estimateCommand.Flags().String("format", "", "output format, can be json")
+
+	return estimateCommand
+}
+
+func estimate(cmd *cobra.Command, _ []string) error {
+	image, err := cmd.Flags().GetString("image")
+	if err != nil {
+		return err
+	}
+
+	if image == "" {
+		return cmd.Help()
+	}
+
+	tarExcludes, err := cmd.Flags().GetStringArray("tar-exclude")
+	if err != nil {
+		return err
+	}
+
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+
+	if format != "" && format != "json" {
+		return fmt.Errorf("unsupported format %q", format)
+	}
+
+	estimate, err := sysextutils.EstimateSysext(image, tarExcludes)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		out, err := json.MarshalIndent(estimate, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(out))
+
+		return nil
+	}
+
+	fmt.Printf("estimated sizes for %s (%d layers)\n\n", estimate.Image, estimate.Layers)
+	fmt.Printf("%-10s %-12s ~%s\n", "content", "uncompressed", formatBytes(estimate.Uncompressed))
+
+	for _, fs := range estimate.Filesystems {
+		compression := fs.Compression
+		if compression == "" {
+			compression = "uncompressed"
+		}
+
+		fmt.Printf("%-10s %-12s ~%s\n", fs.Fs, compression, formatBytes(fs.Size))
+	}
+
+	fmt.Println("\nthese are estimates based on typical compression ratios, the actual size depends on the content")
+
+	return nil
+}
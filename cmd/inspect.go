@@ -0,0 +1,59 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/spf13/cobra"
+)
+
+// NewInspectCommand will print the OCI config of an image.
+func NewInspectCommand() *cobra.Command {
+	inspectCommand := &cobra.Command{
+		Use:              "inspect [flags] IMAGE [IMAGE...]",
+		Short:            "Print the OCI config of an image, pulling it if necessary",
+		PreRunE:          logging.Init,
+		RunE:             inspect,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	inspectCommand.Flags().SetInterspersed(false)
+	inspectCommand.Flags().BoolP("help", "h", false, "show help")
+	inspectCommand.Flags().StringP("format", "f", "", "format the output using a go template, e.g. '{{.Architecture}}'")
+
+	return inspectCommand
+}
+
+func inspect(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) < 1 {
+		return cmd.Help()
+	}
+
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+
+	for _, image := range arguments {
+		if !fileutils.Exist(imageutils.GetPath(image)) {
+			_, err := imageutils.Pull(image, true, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	out, err := imageutils.Inspect(arguments, format)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(out)
+
+	return nil
+}
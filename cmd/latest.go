@@ -0,0 +1,89 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// NewLatestCommand will resolve the highest version of a sysext.
+func NewLatestCommand() *cobra.Command {
+	latestCommand := &cobra.Command{
+		Use:              "latest [flags] NAME",
+		Short:            "Print the highest version of a sysext built with --version",
+		PreRunE:          logging.Init,
+		RunE:             latest,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	latestCommand.Flags().SetInterspersed(false)
+	latestCommand.Flags().BoolP("help", "h", false, "show help")
+	latestCommand.Flags().Bool("all", false, "list all the versions, from the highest to the lowest")
+	latestCommand.Flags().String("format", "", "output format, can be json")
+
+	return latestCommand
+}
+
+func latest(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) != 1 {
+		return cmd.Help()
+	}
+
+	all, err := cmd.Flags().GetBool("all")
+	if err != nil {
+		return err
+	}
+
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+
+	if format != "" && format != "json" {
+		return fmt.Errorf("unsupported format %q", format)
+	}
+
+	versions, err := sysextutils.ListVersions(arguments[0])
+	if err != nil {
+		return err
+	}
+
+	if !all {
+		versions = versions[:1]
+	}
+
+	if format == "json" {
+		var out []byte
+		if all {
+			out, err = json.MarshalIndent(versions, "", "  ")
+		} else {
+			out, err = json.MarshalIndent(versions[0], "", "  ")
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(out))
+
+		return nil
+	}
+
+	if !all {
+		fmt.Printf("%s\t%s\n", versions[0].Version, sysextutils.GetVersionPath(versions[0].Name, versions[0].Version))
+
+		return nil
+	}
+
+	for _, version := range versions {
+		fmt.Printf("%-20s %-22s %s\n", version.Version, version.Created, version.Image)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// NewLoopGCCommand will detach loop devices left behind by interrupted operations.
+func NewLoopGCCommand() *cobra.Command {
+	loopGCCommand := &cobra.Command{
+		Use:              "loop-gc [flags]",
+		Short:            "Detach idle loop devices backed by deleted sysext images",
+		PreRunE:          logging.Init,
+		RunE:             loopGC,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	loopGCCommand.Flags().SetInterspersed(false)
+	loopGCCommand.Flags().BoolP("help", "h", false, "show help")
+	loopGCCommand.Flags().Bool("dry-run", false, "only list the loop devices that would be detached")
+
+	return loopGCCommand
+}
+
+func loopGC(cmd *cobra.Command, arguments []string) error {
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		devices, err := sysextutils.ListLoopDevices()
+		if err != nil {
+			return err
+		}
+
+		for _, device := range devices {
+			if device.Orphaned && device.Idle {
+				fmt.Printf("%s\t%s\n", device.Device, device.BackingFile)
+			}
+		}
+
+		return nil
+	}
+
+	detached, err := sysextutils.CollectLoopDevices()
+
+	for _, device := range detached {
+		fmt.Printf("%s\t%s\n", device.Device, device.BackingFile)
+	}
+
+	return err
+}
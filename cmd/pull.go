@@ -24,6 +24,8 @@ func NewPullCommand() *cobra.Command {
 	pullCommand.Flags().SetInterspersed(false)
 	pullCommand.Flags().BoolP("help", "h", false, "show help")
 	pullCommand.Flags().BoolP("quiet", "q", false, "suppress output")
+	pullCommand.Flags().Bool("no-cache", false, "download all layers again, ignoring the ones already present")
+	pullCommand.Flags().Bool("dry-pull", false, "print the image pinned to its current digest, without downloading it")
 
 	return pullCommand
 }
@@ -39,14 +41,55 @@ func pull(cmd *cobra.Command, arguments []string) error {
 		return err
 	}
 
+	noCache, err := cmd.Flags().GetBool("no-cache")
+	if err != nil {
+		return err
+	}
+
+	dryPull, err := cmd.Flags().GetBool("dry-pull")
+	if err != nil {
+		return err
+	}
+
+	if dryPull {
+		return resolve(arguments)
+	}
+
 	for _, image := range arguments {
-		id, err := imageutils.Pull(image, quiet)
+		id, err := imageutils.Pull(image, quiet, noCache)
 		if err != nil {
 			return err
 		}
 
+		if logging.JSONEvents() {
+			logging.Event(logging.EventImagePulled, map[string]any{"image": image, "id": id})
+
+			continue
+		}
+
 		fmt.Println(id)
 	}
 
 	return nil
 }
+
+// resolve will print input images pinned to their current digest, see
+// imageutils.Resolve.
+func resolve(images []string) error {
+	for _, image := range images {
+		reference, err := imageutils.Resolve(image)
+		if err != nil {
+			return err
+		}
+
+		if logging.JSONEvents() {
+			logging.Event(logging.EventImageResolved, map[string]any{"image": image, "reference": reference})
+
+			continue
+		}
+
+		fmt.Println(reference)
+	}
+
+	return nil
+}
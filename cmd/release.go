@@ -0,0 +1,89 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// NewReleaseCommand will manage the extension-release of a built sysext.
+func NewReleaseCommand() *cobra.Command {
+	releaseCommand := &cobra.Command{
+		Use:              "release",
+		Short:            "Print or edit the extension-release of a built sysext",
+		PreRunE:          logging.Init,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	releaseGetCommand := &cobra.Command{
+		Use:              "get [flags] NAME",
+		Short:            "Print the extension-release embedded in a sysext",
+		PreRunE:          logging.Init,
+		RunE:             releaseGet,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	releaseSetCommand := &cobra.Command{
+		Use:              "set [flags] NAME KEY=VALUE [KEY=VALUE...]",
+		Short:            "Set extension-release fields of a sysext, an empty value removes the key",
+		PreRunE:          logging.Init,
+		RunE:             releaseSet,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	for _, command := range []*cobra.Command{releaseCommand, releaseGetCommand, releaseSetCommand} {
+		command.Flags().SetInterspersed(false)
+		command.Flags().BoolP("help", "h", false, "show help")
+	}
+
+	releaseSetCommand.Flags().String("compression", "", "compression algorithm to repack with, overrides the one of the build")
+	releaseSetCommand.Flags().Int("compression-level", 0, "compression level to repack with, overrides the one of the build")
+	releaseSetCommand.Flags().String("tmpdir", "", "TMPDIR for the packing tools, overrides the one of the build")
+
+	releaseCommand.AddCommand(releaseGetCommand, releaseSetCommand)
+
+	return releaseCommand
+}
+
+func releaseGet(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) != 1 {
+		return cmd.Help()
+	}
+
+	content, err := sysextutils.GetExtensionRelease(arguments[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(content)
+
+	return nil
+}
+
+func releaseSet(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) < 2 {
+		return cmd.Help()
+	}
+
+	compression, _ := cmd.Flags().GetString("compression")
+	compressionLevel, _ := cmd.Flags().GetInt("compression-level")
+	tmpDir, _ := cmd.Flags().GetString("tmpdir")
+
+	// the options of the build are used unless overridden
+	overrides := sysextutils.CreateOptions{
+		Compression:      compression,
+		CompressionLevel: compressionLevel,
+		TmpDir:           tmpDir,
+	}
+
+	return sysextutils.SetExtensionRelease(arguments[0], arguments[1:], overrides)
+}
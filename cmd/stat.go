@@ -0,0 +1,83 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// NewStatCommand will report what takes space in a sysext.
+func NewStatCommand() *cobra.Command {
+	statCommand := &cobra.Command{
+		Use:              "stat [flags] NAME|RAW|ROOTFS",
+		Short:            "Report the largest directories and files of a sysext",
+		PreRunE:          logging.Init,
+		RunE:             stat,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	statCommand.Flags().SetInterspersed(false)
+	statCommand.Flags().BoolP("help", "h", false, "show help")
+	statCommand.Flags().Int("top", 10, "number of directories and files to report")
+	statCommand.Flags().String("format", "", "output format, can be json")
+
+	return statCommand
+}
+
+func stat(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) != 1 {
+		return cmd.Help()
+	}
+
+	top, err := cmd.Flags().GetInt("top")
+	if err != nil {
+		return err
+	}
+
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+
+	if format != "" && format != "json" {
+		return fmt.Errorf("unsupported format %q", format)
+	}
+
+	stats, err := sysextutils.StatSysext(arguments[0], top)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		out, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(out))
+
+		return nil
+	}
+
+	fmt.Printf("total: %s\n\n", formatBytes(stats.Total))
+
+	fmt.Println("largest directories:")
+
+	for _, entry := range stats.Directories {
+		fmt.Printf("%8s  %s\n", formatBytes(entry.Size), entry.Path)
+	}
+
+	fmt.Println("\nlargest files:")
+
+	for _, entry := range stats.Files {
+		fmt.Printf("%8s  %s\n", formatBytes(entry.Size), entry.Path)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+// Package cmd contains all the cobra commands for the CLI application.
+package cmd
+
+import (
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/sysextutils"
+	"github.com/spf13/cobra"
+)
+
+// NewTryCommand will run a sysext in a transient container.
+func NewTryCommand() *cobra.Command {
+	tryCommand := &cobra.Command{
+		Use:              "try [flags] NAME [COMMAND...]",
+		Short:            "Run a shell or command in a transient systemd-nspawn container with a sysext merged",
+		PreRunE:          logging.Init,
+		RunE:             try,
+		SilenceUsage:     true,
+		SilenceErrors:    true,
+		TraverseChildren: true,
+	}
+
+	tryCommand.Flags().SetInterspersed(false)
+	tryCommand.Flags().BoolP("help", "h", false, "show help")
+	tryCommand.Flags().String("base", "", "image the container runs, defaults to the image source of the sysext")
+	tryCommand.Flags().String("image", "", "build the sysext from this image first, with the default options")
+
+	return tryCommand
+}
+
+func try(cmd *cobra.Command, arguments []string) error {
+	if len(arguments) < 1 {
+		return cmd.Help()
+	}
+
+	base, err := cmd.Flags().GetString("base")
+	if err != nil {
+		return err
+	}
+
+	image, err := cmd.Flags().GetString("image")
+	if err != nil {
+		return err
+	}
+
+	if image != "" {
+		err = sysextutils.CreateSysext(sysextutils.CreateOptions{Image: image, Name: arguments[0], Fs: "ext4"})
+		if err != nil {
+			return err
+		}
+	}
+
+	return sysextutils.TrySysext(arguments[0], base, arguments[1:])
+}
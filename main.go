@@ -23,15 +23,29 @@ along with oci-sysext; if not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
 	"strings"
+	"syscall"
 
 	"github.com/89luca89/oci-sysext/cmd"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	"github.com/89luca89/oci-sysext/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
 var version = "development"
 
+// exitImageNotFound is the exit code used when an image doesn't exist, so that
+// scripts can tell it apart from other failures.
+const exitImageNotFound = 2
+
 func newApp() *cobra.Command {
 	rootCmd := &cobra.Command{
 		Use:              "oci-sysext",
@@ -40,22 +54,205 @@ func newApp() *cobra.Command {
 		SilenceUsage:     true,
 		SilenceErrors:    true,
 		TraverseChildren: true,
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			err := isolateMounts(cmd)
+			if err != nil {
+				return err
+			}
+
+			offline, err := cmd.Flags().GetBool("offline")
+			if err != nil {
+				return err
+			}
+
+			imageutils.Offline = offline
+
+			imageutils.DefaultRegistry, err = cmd.Flags().GetString("default-registry")
+			if err != nil {
+				return err
+			}
+
+			err = startProfiling(cmd)
+			if err != nil {
+				return err
+			}
+
+			return utils.CheckOciSysextHome()
+		},
 	}
 
 	rootCmd.AddCommand(
+		cmd.NewAnalyzeDiffCommand(),
+		cmd.NewApplyDeltaCommand(),
+		cmd.NewBuildAllCommand(),
+		cmd.NewCompareCommand(),
+		cmd.NewConvertCommand(),
 		cmd.NewCreateCommand(),
+		cmd.NewDeltaCommand(),
+		cmd.NewEstimateCommand(),
+		cmd.NewInspectCommand(),
+		cmd.NewLatestCommand(),
+		cmd.NewLoopGCCommand(),
 		cmd.NewPullCommand(),
+		cmd.NewReleaseCommand(),
+		cmd.NewStatCommand(),
+		cmd.NewTryCommand(),
 	)
 	rootCmd.PersistentFlags().
 		String("log-level", "", "log messages above specified level (debug, warn, warning, error)")
+	rootCmd.PersistentFlags().
+		Bool("no-color", false, "disable colored log output, also honors NO_COLOR")
+	rootCmd.PersistentFlags().
+		Bool("json-events", false, "emit the logs and build progress as newline-delimited JSON events, instead of human output")
+	rootCmd.PersistentFlags().
+		Int("json-events-fd", 1, "file descriptor to write the --json-events stream to, defaults to stdout")
+	rootCmd.PersistentFlags().
+		Bool("offline", false, "never contact a registry, all images must already be pulled")
+	rootCmd.PersistentFlags().
+		Bool("isolate-mounts", false, "run in a private mount namespace, so that no mount outlives the process, needs root and unshare")
+	rootCmd.PersistentFlags().
+		String("default-registry", "", "registry qualifying short image names, instead of searching registries.conf")
+
+	// profiling flags, useful to debug performance issues
+	rootCmd.PersistentFlags().String("cpuprofile", "", "write a CPU profile to file")
+	rootCmd.PersistentFlags().String("memprofile", "", "write a heap profile to file on exit")
+	rootCmd.PersistentFlags().String("trace", "", "write a runtime trace to file")
+
+	for _, flag := range []string{"cpuprofile", "memprofile", "trace"} {
+		_ = rootCmd.PersistentFlags().MarkHidden(flag)
+	}
 
 	return rootCmd
 }
 
+// isolatedMountsEnv marks the process started by isolateMounts, which is
+// already in its own mount namespace.
+const isolatedMountsEnv = "OCI_SYSEXT_ISOLATED_MOUNTS"
+
+// isolateMounts will replace the process with itself running in a private
+// mount namespace, through unshare, if --isolate-mounts is passed. The loop
+// mounts made by the command are then dropped along with the namespace when
+// the process exits, even if it crashes, and never reach the host mount
+// table. The process is replaced rather than spawned, so that its file
+// descriptors, like the one of --json-events-fd, and its exit code are kept.
+func isolateMounts(cmd *cobra.Command) error {
+	isolate, err := cmd.Flags().GetBool("isolate-mounts")
+	if err != nil || !isolate || os.Getenv(isolatedMountsEnv) != "" {
+		return err
+	}
+
+	if os.Geteuid() != 0 {
+		return errors.New("--isolate-mounts needs root privileges to create a mount namespace")
+	}
+
+	unshare, err := exec.LookPath("unshare")
+	if err != nil {
+		return fmt.Errorf("--isolate-mounts needs unshare: %w", err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"unshare", "--mount", "--propagation", "private", "--", executable}, os.Args[1:]...)
+
+	return syscall.Exec(unshare, args, append(os.Environ(), isolatedMountsEnv+"=1"))
+}
+
+// stopProfiling is set by startProfiling to stop all running profiles.
+var stopProfiling = func() {}
+
+// startProfiling will start the CPU profile and runtime trace, and arrange the
+// heap profile to be written, as requested by the profiling flags.
+func startProfiling(cmd *cobra.Command) error {
+	cpuProfile, _ := cmd.Flags().GetString("cpuprofile")
+	memProfile, _ := cmd.Flags().GetString("memprofile")
+	traceFile, _ := cmd.Flags().GetString("trace")
+
+	stops := []func(){}
+
+	if cpuProfile != "" {
+		file, err := os.Create(cpuProfile)
+		if err != nil {
+			return err
+		}
+
+		err = pprof.StartCPUProfile(file)
+		if err != nil {
+			_ = file.Close()
+
+			return err
+		}
+
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			_ = file.Close()
+		})
+	}
+
+	if traceFile != "" {
+		file, err := os.Create(traceFile)
+		if err != nil {
+			return err
+		}
+
+		err = trace.Start(file)
+		if err != nil {
+			_ = file.Close()
+
+			return err
+		}
+
+		stops = append(stops, func() {
+			trace.Stop()
+			_ = file.Close()
+		})
+	}
+
+	if memProfile != "" {
+		stops = append(stops, func() {
+			file, err := os.Create(memProfile)
+			if err != nil {
+				log.Printf("cannot write heap profile: %v", err)
+
+				return
+			}
+
+			defer func() { _ = file.Close() }()
+
+			runtime.GC()
+
+			err = pprof.WriteHeapProfile(file)
+			if err != nil {
+				log.Printf("cannot write heap profile: %v", err)
+			}
+		})
+	}
+
+	stopProfiling = func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+
+	return nil
+}
+
 func main() {
 	app := newApp()
 
 	err := app.Execute()
+
+	stopProfiling()
+
+	if errors.Is(err, imageutils.ErrImageNotFound) {
+		log.Printf("%+v\n", err)
+		log.Printf("the image does not exist, check its name and tag, short names are resolved using %s",
+			imageutils.RegistriesConf)
+		os.Exit(exitImageNotFound)
+	}
+
 	if err != nil {
 		log.Fatalf("%+v\n", err)
 	}
@@ -0,0 +1,51 @@
+package fileutils
+
+import (
+	"sort"
+	"strings"
+)
+
+// fflagsRecord is the PAX record storing the file flags of an entry, as
+// written by libarchive and star.
+const fflagsRecord = "SCHILY.fflags"
+
+// FileAttributes maps the file flags names found in layers to the chattr
+// attributes they are applied as. Only the attributes supported by both ext4
+// and btrfs are listed.
+var FileAttributes = map[string]byte{
+	"schg":       'i',
+	"uchg":       'i',
+	"immutable":  'i',
+	"simmutable": 'i',
+	"uimmutable": 'i',
+	"sappnd":     'a',
+	"uappnd":     'a',
+	"sappend":    'a',
+	"uappend":    'a',
+	"append":     'a',
+	"nodump":     'd',
+	"noatime":    'A',
+	"sync":       'S',
+}
+
+// parseFileFlags returns the chattr attributes of input comma separated
+// file flags.
+func parseFileFlags(flags string) string {
+	found := map[byte]bool{}
+
+	for _, flag := range strings.Split(flags, ",") {
+		attribute, ok := FileAttributes[strings.TrimSpace(flag)]
+		if ok {
+			found[attribute] = true
+		}
+	}
+
+	attributes := []string{}
+	for attribute := range found {
+		attributes = append(attributes, string(attribute))
+	}
+
+	sort.Strings(attributes)
+
+	return strings.Join(attributes, "")
+}
@@ -0,0 +1,209 @@
+package fileutils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrUnsupportedMediaType is returned for layers whose media type has no
+// registered Decompressor.
+var ErrUnsupportedMediaType = errors.New("unsupported layer media type")
+
+// Decompressor returns a reader of the uncompressed tar stream of a layer,
+// reading its compressed content from input reader.
+type Decompressor func(io.Reader) (io.ReadCloser, error)
+
+var (
+	decompressorsLock sync.RWMutex
+	decompressors     = map[string]Decompressor{
+		"application/vnd.oci.image.layer.v1.tar":            plainDecompressor,
+		"application/vnd.docker.image.rootfs.diff.tar":      plainDecompressor,
+		"application/vnd.oci.image.layer.v1.tar+gzip":       gzipDecompressor,
+		"application/vnd.docker.image.rootfs.diff.tar.gzip": gzipDecompressor,
+		"application/vnd.oci.image.layer.v1.tar+zstd":       zstdDecompressor,
+		"application/vnd.docker.image.rootfs.diff.tar.zstd": zstdDecompressor,
+	}
+)
+
+// RegisterDecompressor will register input decompressor for the layers with
+// input media type, replacing the existing one if any.
+// This is the way to support custom layer compressions when using oci-sysext
+// as a library, it should be called before building any sysext, for example
+// in an init function.
+func RegisterDecompressor(mediaType string, decompressor Decompressor) {
+	decompressorsLock.Lock()
+	defer decompressorsLock.Unlock()
+
+	decompressors[mediaType] = decompressor
+}
+
+// GetDecompressor returns the decompressor registered for input media type.
+func GetDecompressor(mediaType string) (Decompressor, bool) {
+	decompressorsLock.RLock()
+	defer decompressorsLock.RUnlock()
+
+	decompressor, found := decompressors[mediaType]
+
+	return decompressor, found
+}
+
+// OpenLayer returns a reader of the uncompressed content of the layer at
+// path, decompressed according to its media type.
+// Without a media type, gzip compressed layers are detected, and any other
+// layer is read as is.
+func OpenLayer(path string, mediaType string) (io.ReadCloser, error) {
+	if mediaType == "" {
+		mediaType = detectMediaType(path)
+	}
+
+	decompressor, found := GetDecompressor(mediaType)
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMediaType, mediaType)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := decompressor(file)
+	if err != nil {
+		_ = file.Close()
+
+		return nil, fmt.Errorf("cannot decompress %s as %s: %w", path, mediaType, err)
+	}
+
+	return &layerReader{ReadCloser: reader, file: file}, nil
+}
+
+// layerReader closes both the decompressor and the underlying file.
+type layerReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (r *layerReader) Close() error {
+	err := r.ReadCloser.Close()
+
+	return errors.Join(err, r.file.Close())
+}
+
+// detectMediaType returns the media type of the layer at path, gzip
+// compressed or uncompressed, by looking at its magic bytes.
+func detectMediaType(path string) string {
+	magic := make([]byte, 2)
+
+	file, err := os.Open(path)
+	if err == nil {
+		_, err = io.ReadFull(file, magic)
+		_ = file.Close()
+	}
+
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return "application/vnd.oci.image.layer.v1.tar+gzip"
+	}
+
+	return "application/vnd.oci.image.layer.v1.tar"
+}
+
+// tarLayerCommand returns a tar command run with input args on the layer at
+// path, and the function to call once the command is done.
+// Without a media type, the layer is read by tar directly, relying on its
+// own compression detection, otherwise it's decompressed by the registered
+// Decompressor and fed to tar's stdin.
+func tarLayerCommand(path string, mediaType string, args ...string) (*exec.Cmd, func(), error) {
+	if mediaType == "" {
+		return exec.Command("tar", append(args, "-f", path)...), func() {}, nil
+	}
+
+	reader, err := OpenLayer(path, mediaType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command("tar", append(args, "-f", "-")...)
+	cmd.Stdin = reader
+
+	return cmd, func() { _ = reader.Close() }, nil
+}
+
+func plainDecompressor(reader io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(reader), nil
+}
+
+func gzipDecompressor(reader io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(reader)
+}
+
+func zstdDecompressor(reader io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.IOReadCloser(), nil
+}
+
+// TarDirectory will write a zstd compressed tar of the content of input
+// directory to the file at path, which can be extracted by UntarFile with the
+// application/vnd.oci.image.layer.v1.tar+zstd media type.
+// The tar is written to a temporary file renamed over path once complete.
+func TarDirectory(dir string, path string) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := tmpFile.Name()
+
+	err = compressDirectory(dir, tmpFile)
+
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpPath)
+
+		return err
+	}
+
+	return nil
+}
+
+// compressDirectory writes the zstd compressed tar of input directory to
+// input writer.
+func compressDirectory(dir string, writer io.Writer) error {
+	encoder, err := zstd.NewWriter(writer)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("tar", "-C", dir, "--numeric-owner", "--xattrs", "-c", "-f", "-", ".")
+	cmd.Stdout = encoder
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		_ = encoder.Close()
+
+		return fmt.Errorf("cannot archive %s: %w: %s", dir, err, stderr.String())
+	}
+
+	return encoder.Close()
+}
@@ -0,0 +1,92 @@
+package fileutils
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// xorDecompressor undoes a toy compression flipping every bit.
+func xorDecompressor(reader io.Reader) (io.ReadCloser, error) {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range content {
+		content[i] ^= 0xff
+	}
+
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	const mediaType = "application/vnd.example.layer.v1.tar+xor"
+
+	t.Cleanup(func() {
+		decompressorsLock.Lock()
+		defer decompressorsLock.Unlock()
+
+		delete(decompressors, mediaType)
+	})
+
+	plain := writeLayer(t, []*tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "usr/bin/tool", Typeflag: tar.TypeReg, Size: 16},
+		{Name: "usr/bin/.wh.old", Typeflag: tar.TypeReg},
+	})
+
+	content, err := os.ReadFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range content {
+		content[i] ^= 0xff
+	}
+
+	layer := filepath.Join(t.TempDir(), "layer.tar.xor")
+
+	err = os.WriteFile(layer, content, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ListLayer(layer, mediaType, nil)
+	if !errors.Is(err, ErrUnsupportedMediaType) {
+		t.Fatalf("got %v, expected %v before registering", err, ErrUnsupportedMediaType)
+	}
+
+	RegisterDecompressor(mediaType, xorDecompressor)
+
+	listing, err := ListLayer(layer, mediaType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listing.Whiteouts) != 1 {
+		t.Errorf("got whiteouts %q, expected usr/bin/.wh.old", listing.Whiteouts)
+	}
+
+	target := t.TempDir()
+	writeTree(t, target, "usr/bin/old")
+
+	err = UntarLayer(layer, target, mediaType, listing, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(target, "usr/bin/tool"))
+	if err != nil || info.Size() != 16 {
+		t.Errorf("usr/bin/tool was not extracted through the decompressor: %v", err)
+	}
+
+	if Exist(filepath.Join(target, "usr/bin/old")) {
+		t.Error("the whiteout of the layer was not applied")
+	}
+}
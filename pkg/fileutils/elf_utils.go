@@ -0,0 +1,399 @@
+package fileutils
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxPathHops is the maximum number of symlinks followed to resolve a path,
+// like the kernel's limit.
+const maxPathHops = 40
+
+// defaultLibraryDirs are searched for the libraries not found in the
+// RUNPATH of a binary nor in ld.so.conf, after the multiarch ones.
+var defaultLibraryDirs = []string{"/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+
+// multiarchTriplets are the Debian multiarch directory names of the
+// libraries of each machine, searched in /lib and /usr/lib.
+var multiarchTriplets = map[elf.Machine]string{
+	elf.EM_X86_64:  "x86_64-linux-gnu",
+	elf.EM_386:     "i386-linux-gnu",
+	elf.EM_AARCH64: "aarch64-linux-gnu",
+	elf.EM_ARM:     "arm-linux-gnueabihf",
+	elf.EM_PPC64:   "powerpc64le-linux-gnu",
+	elf.EM_S390:    "s390x-linux-gnu",
+	elf.EM_RISCV:   "riscv64-linux-gnu",
+}
+
+// ELFClosure is the result of ResolveELFClosure, paths are absolute inside
+// the rootfs.
+type ELFClosure struct {
+	// Files are the binaries, their interpreters and libraries, and the
+	// symlinks followed to reach them.
+	Files []string
+	// Missing are the libraries not found, as "library (needed by path)".
+	Missing []string
+}
+
+// ResolveELFClosure returns the files input binaries of input rootfs need to
+// run: the binaries themselves, their program interpreter, and the shared
+// libraries they depend on through DT_NEEDED, transitively. Libraries are
+// looked up like ld.so does, in the RPATH or RUNPATH of the binary, the dirs
+// of the rootfs /etc/ld.so.conf and the default dirs, skipping libraries
+// built for another class or machine. Scripts bring their interpreter in.
+// Every path is resolved as if rootfs was the root directory.
+// Libraries loaded with dlopen can't be found this way.
+func ResolveELFClosure(rootfs string, binaries []string) (ELFClosure, error) {
+	closure := ELFClosure{}
+	seen := map[string]bool{}
+
+	keep := func(paths ...string) {
+		for _, path := range paths {
+			if !seen[path] {
+				seen[path] = true
+				closure.Files = append(closure.Files, path)
+			}
+		}
+	}
+
+	confDirs, err := readLdSoConf(rootfs, "/etc/ld.so.conf", 0)
+	if err != nil {
+		return closure, err
+	}
+
+	queue := []string{}
+
+	for _, binary := range binaries {
+		resolved, links, err := ResolveInRootfs(rootfs, binary)
+		if err != nil {
+			return closure, fmt.Errorf("cannot find %s: %w", binary, err)
+		}
+
+		keep(links...)
+		queue = append(queue, resolved)
+	}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if seen[current] {
+			continue
+		}
+
+		keep(current)
+
+		interpreter, err := readScriptInterpreter(filepath.Join(rootfs, current))
+		if err != nil {
+			return closure, err
+		}
+
+		if interpreter != "" {
+			resolved, links, err := ResolveInRootfs(rootfs, interpreter)
+			if err != nil {
+				closure.Missing = append(closure.Missing, fmt.Sprintf("%s (needed by %s)", interpreter, current))
+
+				continue
+			}
+
+			keep(links...)
+			queue = append(queue, resolved)
+
+			continue
+		}
+
+		file, err := elf.Open(filepath.Join(rootfs, current))
+		if err != nil {
+			// not an ELF binary, nothing more to follow
+			continue
+		}
+
+		dependencies, err := readELFDependencies(rootfs, current, file, confDirs)
+
+		_ = file.Close()
+
+		if err != nil {
+			return closure, err
+		}
+
+		for _, dependency := range dependencies {
+			if dependency.path == "" {
+				closure.Missing = append(closure.Missing,
+					fmt.Sprintf("%s (needed by %s)", dependency.name, current))
+
+				continue
+			}
+
+			keep(dependency.links...)
+			queue = append(queue, dependency.path)
+		}
+	}
+
+	return closure, nil
+}
+
+// elfDependency is a library or interpreter of a binary, path is empty if
+// it wasn't found.
+type elfDependency struct {
+	name  string
+	path  string
+	links []string
+}
+
+// readELFDependencies returns the interpreter and the DT_NEEDED libraries of
+// input ELF file, at path inside rootfs.
+func readELFDependencies(rootfs string, path string, file *elf.File, confDirs []string) ([]elfDependency, error) {
+	dependencies := []elfDependency{}
+
+	for _, prog := range file.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+
+		data, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return nil, err
+		}
+
+		interpreter := string(bytes.TrimRight(data, "\x00"))
+		dependency := elfDependency{name: interpreter}
+
+		resolved, links, err := ResolveInRootfs(rootfs, interpreter)
+		if err == nil {
+			dependency.path, dependency.links = resolved, links
+		}
+
+		dependencies = append(dependencies, dependency)
+	}
+
+	needed, err := file.ImportedLibraries()
+	if err != nil {
+		// static binaries have no dynamic section
+		return dependencies, nil
+	}
+
+	searchDirs := elfSearchDirs(path, file, confDirs)
+
+	for _, library := range needed {
+		dependency := elfDependency{name: library}
+
+		if strings.Contains(library, "/") {
+			resolved, links, err := ResolveInRootfs(rootfs, library)
+			if err == nil {
+				dependency.path, dependency.links = resolved, links
+			}
+
+			dependencies = append(dependencies, dependency)
+
+			continue
+		}
+
+		for _, dir := range searchDirs {
+			resolved, links, err := ResolveInRootfs(rootfs, filepath.Join(dir, library))
+			if err != nil || !isCompatibleELF(filepath.Join(rootfs, resolved), file) {
+				continue
+			}
+
+			dependency.path, dependency.links = resolved, links
+
+			break
+		}
+
+		dependencies = append(dependencies, dependency)
+	}
+
+	return dependencies, nil
+}
+
+// elfSearchDirs returns the dirs the libraries of input ELF file, at path
+// inside rootfs, are looked up in, in order.
+func elfSearchDirs(path string, file *elf.File, confDirs []string) []string {
+	dirs := []string{}
+
+	// RPATH is ignored when RUNPATH is set
+	runPaths, _ := file.DynString(elf.DT_RUNPATH)
+	if len(runPaths) == 0 {
+		runPaths, _ = file.DynString(elf.DT_RPATH)
+	}
+
+	origin := filepath.Dir(path)
+
+	for _, runPath := range runPaths {
+		for _, dir := range strings.Split(runPath, ":") {
+			dir = strings.ReplaceAll(dir, "${ORIGIN}", origin)
+			dir = strings.ReplaceAll(dir, "$ORIGIN", origin)
+
+			if dir != "" && !strings.Contains(dir, "$") {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+
+	dirs = append(dirs, confDirs...)
+
+	if triplet, ok := multiarchTriplets[file.Machine]; ok {
+		dirs = append(dirs, "/lib/"+triplet, "/usr/lib/"+triplet)
+	}
+
+	return append(dirs, defaultLibraryDirs...)
+}
+
+// isCompatibleELF returns whether the file at path is an ELF file of the
+// same class and machine as input one, the only ones ld.so loads.
+func isCompatibleELF(path string, file *elf.File) bool {
+	candidate, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+
+	defer func() { _ = candidate.Close() }()
+
+	return candidate.Class == file.Class && candidate.Machine == file.Machine
+}
+
+// readScriptInterpreter returns the interpreter of the script at path, from
+// its #! line, or an empty string if it's not a script.
+func readScriptInterpreter(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	if !strings.HasPrefix(line, "#!") {
+		return "", nil
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	return fields[0], nil
+}
+
+// readLdSoConf returns the library dirs listed in the ld.so.conf file at
+// path inside rootfs, following its include directives.
+func readLdSoConf(rootfs string, path string, depth int) ([]string, error) {
+	if depth > maxPathHops {
+		return nil, fmt.Errorf("%s: too many nested includes", path)
+	}
+
+	// a missing ld.so.conf adds no dir
+	resolved, _, err := ResolveInRootfs(rootfs, path)
+	if err != nil {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(rootfs, resolved))
+	if err != nil {
+		return nil, nil
+	}
+
+	dirs := []string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			continue
+		}
+
+		include, found := strings.CutPrefix(line, "include")
+		if !found || (include != "" && include[0] != ' ' && include[0] != '\t') {
+			dirs = append(dirs, line)
+
+			continue
+		}
+
+		for _, pattern := range strings.Fields(include) {
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+
+			matches, err := filepath.Glob(filepath.Join(rootfs, pattern))
+			if err != nil {
+				return nil, err
+			}
+
+			for _, match := range matches {
+				included, err := readLdSoConf(rootfs, strings.TrimPrefix(match, rootfs), depth+1)
+				if err != nil {
+					return nil, err
+				}
+
+				dirs = append(dirs, included...)
+			}
+		}
+	}
+
+	return dirs, scanner.Err()
+}
+
+// ResolveInRootfs returns input absolute path as resolved if rootfs was the
+// root directory, following the symlinks of each of its components inside
+// rootfs, along with the symlinks followed. Paths are absolute inside rootfs.
+func ResolveInRootfs(rootfs string, path string) (string, []string, error) {
+	links := []string{}
+	pending := strings.Split(strings.TrimPrefix(filepath.Clean("/"+path), "/"), "/")
+	current := "/"
+
+	for hops := 0; len(pending) > 0; {
+		component := pending[0]
+		pending = pending[1:]
+
+		if component == "" || component == "." {
+			continue
+		}
+
+		next := filepath.Join(current, component)
+
+		info, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", nil, err
+		}
+
+		if info.Mode()&fs.ModeSymlink == 0 {
+			current = next
+
+			continue
+		}
+
+		hops++
+		if hops > maxPathHops {
+			return "", nil, fmt.Errorf("%s: too many levels of symbolic links", path)
+		}
+
+		links = append(links, next)
+
+		target, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", nil, err
+		}
+
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+
+		// filepath.Join cleans "..", which can't go above the root
+		pending = append(strings.Split(filepath.Clean(target), "/"), pending...)
+	}
+
+	return current, links, nil
+}
@@ -2,18 +2,36 @@
 package fileutils
 
 import (
+	"bufio"
+	"compress/gzip"
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
+	"hash"
 	"io"
 	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/89luca89/oci-sysext/pkg/logging"
 )
 
+const (
+	// whiteoutPrefix marks a file deleted by an OCI layer.
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque marks a directory whose lower content is hidden by an OCI layer.
+	whiteoutOpaque = ".wh..wh..opq"
+	// unixWriteOK is the W_OK mode of access(2).
+	unixWriteOK = 0x2
+)
+
+// DefaultTarExcludes are the paths not extracted from the layers by default,
+// they're populated at runtime and don't belong in a sysext.
+var DefaultTarExcludes = []string{"dev/*", "proc/*", "sys/*", "run/*", "tmp/*"}
+
 // ReadFile will return the content of input file or error.
 // This is a linux-only implementation using syscalls for performance benefits.
 func ReadFile(path string) ([]byte, error) {
@@ -53,45 +71,77 @@ func ReadFile(path string) ([]byte, error) {
 }
 
 // WriteFile will write the content in input to file in path or error.
-// This is a linux-only implementation using syscalls for performance benefits.
+// The content is written to a temporary file in the same directory, which is
+// then renamed over path, so that readers never see a partially written
+// file, and concurrent writers never interleave: the last rename wins.
 func WriteFile(path string, content []byte, perm uint32) error {
-	var fd int
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		logging.LogError("%v", err)
+
+		return err
+	}
+
+	tmpPath := tmpFile.Name()
+
+	_, err = tmpFile.Write(content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmpPath, os.FileMode(perm))
+	}
+
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
 
-	var stat syscall.Stat_t
-	// ensure that file exists
-	err := syscall.Stat(path, &stat)
 	if err != nil {
-		fd, err = syscall.Creat(path, perm)
-		if err != nil {
-			logging.LogError("%v", err)
+		logging.LogError("%v", err)
 
-			return err
-		}
-	} else {
-		fd, err = syscall.Open(path, syscall.O_RDWR, perm)
-		if err != nil {
-			logging.LogError("%v", err)
+		_ = os.Remove(tmpPath)
 
-			return err
-		}
+		return err
+	}
 
-		err = syscall.Chmod(path, perm)
-		if err != nil {
-			logging.LogError("%v", err)
+	return nil
+}
 
-			return err
-		}
+// LockFile will take an exclusive lock on the file at path, created if
+// needed, waiting for other processes holding it. It returns the function
+// releasing the lock.
+func LockFile(path string) (func(), error) {
+	lockFile, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
 	}
 
-	defer func() { _ = syscall.Close(fd) }()
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		_ = lockFile.Close()
 
-	_, err = syscall.Write(fd, content)
+		return nil, err
+	}
 
-	return err
+	return func() {
+		_ = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		_ = lockFile.Close()
+	}, nil
 }
 
 // GetFileDigest will return the sha256sum of input file. Empty if error occurs.
 func GetFileDigest(path string) string {
+	return getFileDigest(path, sha256.New())
+}
+
+// getFileDigest will return the hex encoded sum of input file using input hasher.
+// Empty if error occurs.
+func getFileDigest(path string, hasher hash.Hash) string {
 	file, err := os.Open(path)
 	if err != nil {
 		return ""
@@ -99,7 +149,6 @@ func GetFileDigest(path string) string {
 
 	defer func() { _ = file.Close() }()
 
-	hasher := sha256.New()
 	if _, err := io.Copy(hasher, file); err != nil {
 		return ""
 	}
@@ -107,15 +156,81 @@ func GetFileDigest(path string) string {
 	return fmt.Sprintf("%x", hasher.Sum(nil))
 }
 
+// GetUncompressedDigest will return the sha256sum of the uncompressed content
+// of input file, decompressed according to input media type.
+// Without a media type, gzip compressed files are decompressed on the fly and
+// any other file is hashed as is.
+func GetUncompressedDigest(path string, mediaType string) (string, error) {
+	if mediaType != "" {
+		reader, err := OpenLayer(path, mediaType)
+		if err != nil {
+			return "", err
+		}
+
+		defer func() { _ = reader.Close() }()
+
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, reader); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	reader := bufio.NewReader(file)
+
+	var content io.Reader = reader
+
+	magic, err := reader.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return "", err
+		}
+
+		defer func() { _ = gzipReader.Close() }()
+
+		content = gzipReader
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, content); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
 // CheckFileDigest will compare input digest to the checksum of input file.
 // Returns whether the input digest is equal to the input file's one.
+// Both sha256 and sha512 digests are supported.
 func CheckFileDigest(path string, digest string) bool {
-	checksum := GetFileDigest(path)
+	algorithm, _, _ := strings.Cut(digest, ":")
+
+	var checksum string
+
+	switch algorithm {
+	case "sha256":
+		checksum = getFileDigest(path, sha256.New())
+	case "sha512":
+		checksum = getFileDigest(path, sha512.New())
+	default:
+		logging.LogDebug("unsupported digest algorithm: %s", algorithm)
+
+		return false
+	}
 
-	logging.LogDebug("input checksum is: %s", "sha256:"+checksum)
+	logging.LogDebug("input checksum is: %s", algorithm+":"+checksum)
 	logging.LogDebug("expected checksum is: %s", digest)
 
-	return "sha256:"+checksum == digest
+	return checksum != "" && algorithm+":"+checksum == digest
 }
 
 // Exist returns if a path exists or not.
@@ -126,11 +241,40 @@ func Exist(path string) bool {
 	return err == nil
 }
 
-// UntarFile will untar target file to target directory.
+// CheckWritable returns an error if the directory at path, or the nearest
+// of its parents that exists if it doesn't exist yet, can't be written to,
+// for example because it's on a read-only filesystem.
+func CheckWritable(path string) error {
+	dir := path
+	for !Exist(dir) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+	}
+
+	err := syscall.Access(dir, unixWriteOK)
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+
+	return nil
+}
+
+// aclArgs are the tar arguments restoring the POSIX ACLs of the entries, as
+// stored in their system.posix_acl_* xattrs, and no other xattr.
+var aclArgs = []string{
+	"--xattrs",
+	"--xattrs-include=system.posix_acl_access",
+	"--xattrs-include=system.posix_acl_default",
+}
+
+// UntarFile will untar target file to target directory, skipping the paths
+// matching the excludes patterns.
+// The file is decompressed according to input media type, see OpenLayer, or
+// by tar itself if the media type is empty.
+// If acls is true, the POSIX ACLs of the entries are restored too.
 // If userns is specified and it is keep-id, it will perform the
 // untarring in a new user namespace with user id maps set, in order to prevent
 // permission errors.
-func UntarFile(path string, target string) error {
+func UntarFile(path string, target string, mediaType string, acls bool, excludes []string) error {
 	// first ensure we can write
 	err := syscall.Access(path, 2)
 	if err != nil {
@@ -139,7 +283,18 @@ func UntarFile(path string, target string) error {
 		return err
 	}
 
-	cmd := exec.Command("tar", "--exclude=dev/*", "-xf", path, "-C", target)
+	args := excludeArgs(excludes)
+	if acls {
+		args = append(args, aclArgs...)
+	}
+
+	cmd, done, err := tarLayerCommand(path, mediaType, append(args, "-x", "-C", target)...)
+	if err != nil {
+		return err
+	}
+
+	defer done()
+
 	logging.LogDebug("no keep-id specified, simply perform %v", cmd.Args)
 
 	out, err := cmd.CombinedOutput()
@@ -150,15 +305,75 @@ func UntarFile(path string, target string) error {
 	return nil
 }
 
+// UntarLayer will untar target OCI layer to target directory, applying the
+// whiteouts of input listing of the layer to the content already present in
+// target, see ListLayer.
+// Whiteout markers (.wh.<name>) delete <name> from the lower layers, while
+// opaque markers (.wh..wh..opq) delete the whole content of their directory
+// from the lower layers. The markers themselves are not extracted.
+// If keepWhiteouts is true, whiteouts are not applied and the markers are
+// extracted, this is useful for debugging.
+// Paths matching the excludes patterns are not extracted.
+// If acls is true, the POSIX ACLs of the entries are restored too.
+// The layer is decompressed according to input media type.
+func UntarLayer(path string, target string, mediaType string, listing *LayerListing,
+	keepWhiteouts bool, acls bool, excludes []string,
+) error {
+	if keepWhiteouts {
+		return UntarFile(path, target, mediaType, acls, excludes)
+	}
+
+	// apply the whiteouts before extracting, so that we only delete content
+	// coming from the lower layers.
+	for _, whiteout := range listing.Whiteouts {
+		err := applyWhiteout(target, whiteout)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the markers are only meaningful to the lower layers
+	excludes = append(append([]string{}, excludes...), whiteoutPrefix+"*")
+
+	return UntarFile(path, target, mediaType, acls, excludes)
+}
+
+// excludeArgs returns the tar arguments to exclude input patterns.
+func excludeArgs(excludes []string) []string {
+	args := []string{}
+	for _, exclude := range excludes {
+		args = append(args, "--exclude="+exclude)
+	}
+
+	return args
+}
+
 // DiscUsageMegaBytes returns disk usage for input path in MB (rounded).
+// Hard links are only accounted for once.
 func DiscUsageMegaBytes(path string) (string, error) {
 	var discUsage int64
 
+	inodes := map[uint64]bool{}
+
 	readSize := func(path string, file os.FileInfo, err error) error {
-		if !file.IsDir() {
-			discUsage += file.Size()
+		if err != nil {
+			return err
+		}
+
+		if file.IsDir() {
+			return nil
 		}
 
+		if stat, ok := file.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			if inodes[stat.Ino] {
+				return nil
+			}
+
+			inodes[stat.Ino] = true
+		}
+
+		discUsage += file.Size()
+
 		return nil
 	}
 
@@ -173,3 +388,99 @@ func DiscUsageMegaBytes(path string) (string, error) {
 
 	return fmt.Sprintf("%.0fM", size), nil
 }
+
+// DiscUsageEntries returns the disk usage of each file and directory in input
+// path, keyed by path relative to it, directories accounting for their whole
+// content. The allocated size of files is used, and like DiscUsageMegaBytes
+// hard links are only accounted for once.
+func DiscUsageEntries(path string) (map[string]int64, error) {
+	entries := map[string]int64{}
+	inodes := map[uint64]bool{}
+
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			entries[relative] += 0
+
+			return nil
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			if inodes[stat.Ino] {
+				return nil
+			}
+
+			inodes[stat.Ino] = true
+		}
+
+		size := allocatedSize(info)
+		entries[relative] = size
+
+		for dir := filepath.Dir(relative); ; dir = filepath.Dir(dir) {
+			entries[dir] += size
+			if dir == "." {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// DigHoles will make sparse all the regular files in input path bigger than
+// minSize, by deallocating their zero-filled regions.
+// It returns the number of files processed.
+func DigHoles(path string, minSize int64) (int, error) {
+	files := []string{}
+
+	err := filepath.Walk(path, func(path string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if file.Mode().IsRegular() && file.Size() >= minSize {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, file := range files {
+		logging.LogDebug("digging holes in %s", file)
+
+		out, err := exec.Command("fallocate", "--dig-holes", file).CombinedOutput()
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s", err, string(out))
+		}
+	}
+
+	return len(files), nil
+}
+
+// allocatedSize returns the space allocated on disk for input file, falling
+// back to its apparent size if unknown.
+func allocatedSize(file os.FileInfo) int64 {
+	stat, ok := file.Sys().(*syscall.Stat_t)
+	if !ok {
+		return file.Size()
+	}
+
+	// st_blocks is always expressed in 512 bytes units
+	return stat.Blocks * 512
+}
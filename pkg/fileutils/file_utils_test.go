@@ -0,0 +1,113 @@
+package fileutils
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDigHoles(t *testing.T) {
+	_, err := exec.LookPath("fallocate")
+	if err != nil {
+		t.Skip("needs fallocate")
+	}
+
+	root := t.TempDir()
+
+	err = os.WriteFile(filepath.Join(root, "sparse"), make([]byte, 4*1024*1024), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(root, "small"), make([]byte, 1024), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := DigHoles(root, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("processed %d files, expected only the one above the minimum size", count)
+	}
+
+	info, err := os.Stat(filepath.Join(root, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != 4*1024*1024 {
+		t.Errorf("got size %d, digging holes should keep the apparent size", info.Size())
+	}
+
+	if allocatedSize(info) >= info.Size() {
+		t.Skip("the filesystem of the temporary directory doesn't support holes")
+	}
+
+	// images are sized on the apparent size, DiscUsageEntries reports the
+	// allocated one
+	usage, err := DiscUsageMegaBytes(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage != "36M" {
+		t.Errorf("got disk usage %s, expected 36M", usage)
+	}
+
+	entries, err := DiscUsageEntries(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entries["sparse"] >= 1024*1024 {
+		t.Errorf("got %d bytes allocated for the sparse file", entries["sparse"])
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	home := t.TempDir()
+
+	readOnly := filepath.Join(home, "read-only")
+
+	err := os.Mkdir(readOnly, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if os.Geteuid() == 0 {
+		// root writes to any directory, a read-only mount stops it
+		out, err := exec.Command("mount", "--bind", "-o", "ro", home, readOnly).CombinedOutput()
+		if err != nil {
+			t.Skipf("cannot mount a read-only home: %s", out)
+		}
+
+		t.Cleanup(func() { _ = exec.Command("umount", readOnly).Run() })
+	} else {
+		err = os.Chmod(readOnly, 0o555)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { _ = os.Chmod(readOnly, 0o755) })
+	}
+
+	// missing directories are checked on their nearest existing parent
+	for _, path := range []string{readOnly, filepath.Join(readOnly, "missing/sysexts")} {
+		err = CheckWritable(path)
+		if err == nil || !strings.Contains(err.Error(), readOnly+" is not writable") {
+			t.Errorf("%s: got %v, expected %s not to be writable", path, err, readOnly)
+		}
+	}
+
+	for _, path := range []string{home, filepath.Join(home, "missing/sysexts")} {
+		err = CheckWritable(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package fileutils
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// BreakHardlinks will replace the hard linked regular files in input rootfs
+// with independent copies, so that no two paths share an inode.
+// It returns the number of files copied.
+func BreakHardlinks(rootfs string) (int, error) {
+	links := []string{}
+
+	err := filepath.WalkDir(rootfs, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			links = append(links, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, link := range links {
+		logging.LogDebug("breaking hard link %s", link)
+
+		copied := link + ".oci-sysext-copy"
+
+		out, err := exec.Command("cp", "-a", "--sparse=always", link, copied).CombinedOutput()
+		if err != nil {
+			logging.LogError(string(out))
+			return 0, err
+		}
+
+		err = os.Rename(copied, link)
+		if err != nil {
+			_ = os.Remove(copied)
+
+			return 0, err
+		}
+	}
+
+	return len(links), nil
+}
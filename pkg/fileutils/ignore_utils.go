@@ -0,0 +1,261 @@
+package fileutils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// ignorePattern is a single parsed line of an ignore file.
+type ignorePattern struct {
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnoreFile will parse input gitignore-style file into a list of patterns.
+// Supported syntax:
+//   - blank lines and lines starting with # are ignored
+//   - trailing spaces are ignored, unless escaped with a backslash
+//   - a leading ! negates the pattern, re-including what it matches
+//   - a backslash escapes the next character, like a leading # or !
+//   - a pattern ending with a lone backslash is invalid and never matches
+//   - a trailing / only matches directories
+//   - a pattern containing a / is relative to the rootfs, otherwise it
+//     matches at any depth
+//   - *, ? and [...] match within a path component, ** matches across them
+func parseIgnoreFile(path string) ([]ignorePattern, error) {
+	content, err := ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := []ignorePattern{}
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(content, "\x00")))
+
+	for scanner.Scan() {
+		line := trimTrailingSpaces(strings.TrimSuffix(scanner.Text(), "\r"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if trailingBackslashes(line)%2 == 1 {
+			logging.LogWarning("ignore pattern %q ends with a backslash, skipping it", scanner.Text())
+
+			continue
+		}
+
+		pattern := ignorePattern{}
+
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+
+		expression := globToRegex(line)
+		if anchored {
+			expression = "^" + expression + "$"
+		} else {
+			expression = "(^|/)" + expression + "$"
+		}
+
+		pattern.regex, err = regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %q: %w", scanner.Text(), err)
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// ApplyIgnoreFile will remove from input rootfs all the files matching the
+// patterns in input ignore file.
+// A path inherits the ignored state of its parent directory, and each pattern
+// matching the path, in order, can flip it. This way a negated pattern can
+// re-include a file inside an ignored directory.
+// Ignored directories are removed only if they are empty afterwards.
+func ApplyIgnoreFile(ignoreFile string, rootfs string) error {
+	patterns, err := parseIgnoreFile(ignoreFile)
+	if err != nil {
+		return err
+	}
+
+	ignoredDirs := map[string]bool{}
+	removeDirs := []string{}
+	removeFiles := []string{}
+
+	err = filepath.WalkDir(rootfs, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == rootfs {
+			return nil
+		}
+
+		relative, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+
+		relative = filepath.ToSlash(relative)
+		ignored := ignoredDirs[filepath.ToSlash(filepath.Dir(relative))]
+
+		for _, pattern := range patterns {
+			if pattern.dirOnly && !entry.IsDir() {
+				continue
+			}
+
+			if pattern.regex.MatchString(relative) {
+				ignored = !pattern.negate
+			}
+		}
+
+		if entry.IsDir() {
+			ignoredDirs[relative] = ignored
+			if ignored {
+				removeDirs = append(removeDirs, path)
+			}
+
+			return nil
+		}
+
+		if ignored {
+			removeFiles = append(removeFiles, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range removeFiles {
+		logging.LogDebug("ignoring %s", file)
+
+		err = os.Remove(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	// remove deepest directories first, so that parents can be empty
+	sort.Sort(sort.Reverse(sort.StringSlice(removeDirs)))
+
+	removedDirs := 0
+
+	for _, dir := range removeDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) > 0 {
+			logging.LogDebug("keeping non-empty ignored directory %s", dir)
+
+			continue
+		}
+
+		logging.LogDebug("ignoring %s", dir)
+
+		err = os.Remove(dir)
+		if err != nil {
+			return err
+		}
+
+		removedDirs++
+	}
+
+	logging.Log("ignored %d files and %d directories", len(removeFiles), removedDirs)
+
+	return nil
+}
+
+// trimTrailingSpaces returns input line without its trailing spaces, but
+// the ones escaped with a backslash.
+func trimTrailingSpaces(line string) string {
+	end := 0
+
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+		case '\\':
+			// the escaped character is kept, even if a space
+			i = min(i+1, len(line)-1)
+			end = i + 1
+		default:
+			end = i + 1
+		}
+	}
+
+	return line[:end]
+}
+
+// trailingBackslashes returns the number of backslashes input line ends with.
+func trailingBackslashes(line string) int {
+	return len(line) - len(strings.TrimRight(line, "\\"))
+}
+
+// globToRegex will convert a gitignore-style glob to a regular expression.
+func globToRegex(glob string) string {
+	var expression strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		switch char := glob[i]; char {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				expression.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				expression.WriteString(".*")
+				i++
+			} else {
+				expression.WriteString("[^/]*")
+			}
+		case '?':
+			expression.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				expression.WriteString(regexp.QuoteMeta(string(char)))
+
+				continue
+			}
+
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			expression.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				expression.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+
+	return expression.String()
+}
@@ -0,0 +1,103 @@
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestApplyIgnoreFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		ignore  string
+		files   []string
+		removed []string
+	}{
+		{"glob at any depth", "*.log\n",
+			[]string{"a.log", "usr/lib/b.log", "usr/lib/b.txt"},
+			[]string{"a.log", "usr/lib/b.log"}},
+		{"anchored", "/usr/bin/a\n",
+			[]string{"usr/bin/a", "opt/usr/bin/a"},
+			[]string{"usr/bin/a"}},
+		{"negation in an ignored directory", "usr/share/doc/\n!usr/share/doc/keep\n",
+			[]string{"usr/share/doc/a", "usr/share/doc/keep"},
+			[]string{"usr/share/doc/a"}},
+		{"directory only", "cache/\n",
+			[]string{"usr/cache/a", "usr/lib/cache"},
+			[]string{"usr/cache/a"}},
+		{"double star", "**/tests\nusr/**/*.pyc\n",
+			[]string{"tests/a", "usr/lib/py/tests/b", "usr/lib/py/c.pyc", "opt/d.pyc"},
+			[]string{"tests/a", "usr/lib/py/tests/b", "usr/lib/py/c.pyc"}},
+		{"character class", "[!a]x\n",
+			[]string{"ax", "bx"},
+			[]string{"bx"}},
+		{"comments", "# a comment\n#notes\n",
+			[]string{"#notes", "# a comment"},
+			nil},
+		{"trailing spaces", "a.txt   \n",
+			[]string{"a.txt", "a.txt   "},
+			[]string{"a.txt"}},
+		{"escaped trailing space", "b\\ \n",
+			[]string{"b", "b "},
+			[]string{"b "}},
+		{"leading spaces", " c\n",
+			[]string{"c", " c"},
+			[]string{" c"}},
+		{"escaped hash and bang", "\\#notes\n\\!important\n",
+			[]string{"#notes", "!important", "important"},
+			[]string{"#notes", "!important"}},
+		{"trailing backslash", "keep\\\nkeep\\\\\n",
+			[]string{"keep", "keep\\"},
+			[]string{"keep\\"}},
+		{"crlf", "*.log\r\n!keep.log\r\n",
+			[]string{"a.log", "keep.log"},
+			[]string{"a.log"}},
+	}
+
+	for _, test := range tests {
+		rootfs := t.TempDir()
+		writeTree(t, rootfs, test.files...)
+
+		ignoreFile := filepath.Join(t.TempDir(), ".sysextignore")
+
+		err := os.WriteFile(ignoreFile, []byte(test.ignore), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ApplyIgnoreFile(ignoreFile, rootfs)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		for _, file := range test.files {
+			removed := slices.Contains(test.removed, file)
+
+			if Exist(filepath.Join(rootfs, file)) == removed {
+				t.Errorf("%s: %q removed %v, expected %v", test.name, file, !removed, removed)
+			}
+		}
+	}
+}
+
+func TestTrimTrailingSpaces(t *testing.T) {
+	tests := map[string]string{
+		"a":       "a",
+		"a  ":     "a",
+		"  a ":    "  a",
+		"a\\ ":    "a\\ ",
+		"a\\  ":   "a\\ ",
+		"a\\\\ ":  "a\\\\",
+		"a\\":     "a\\",
+		"   ":     "",
+		"a \\ b ": "a \\ b",
+	}
+
+	for line, expected := range tests {
+		trimmed := trimTrailingSpaces(line)
+		if trimmed != expected {
+			t.Errorf("trimTrailingSpaces(%q) = %q, expected %q", line, trimmed, expected)
+		}
+	}
+}
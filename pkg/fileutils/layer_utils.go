@@ -0,0 +1,212 @@
+package fileutils
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// LayerListing is what a single listing pass over a layer collects, so that
+// the layer is only decompressed once more to extract it.
+type LayerListing struct {
+	// Whiteouts are the whiteout markers of the layer, relative to the root.
+	Whiteouts []string
+	// Size is the total size of the regular files of the layer.
+	Size uint64
+	// DirSizes is Size split by top-level directory of the files, as in
+	// "usr", files at the root are accounted for "".
+	DirSizes map[string]uint64
+	// Attributes are the chattr attributes, as in "ia", of the entries of
+	// the layer, see FileAttributes. Entries without file flags are listed
+	// with no attributes, so that merging the layers in order clears the
+	// attributes of replaced files.
+	Attributes map[string]string
+}
+
+// ListLayer will read the entries of input layer, without extracting it, and
+// return its LayerListing. Paths matching the excludes patterns are skipped,
+// as tar does when extracting.
+// The layer is decompressed according to input media type.
+func ListLayer(path string, mediaType string, excludes []string) (*LayerListing, error) {
+	reader, err := OpenLayer(path, mediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = reader.Close() }()
+
+	matchers := compileExcludes(excludes)
+	listing := &LayerListing{Whiteouts: []string{}, DirSizes: map[string]uint64{}, Attributes: map[string]string{}}
+
+	tarReader := tar.NewReader(reader)
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(filepath.Clean("/"+header.Name), "/")
+		if name == "" || isExcluded(name, matchers) {
+			continue
+		}
+
+		if strings.HasPrefix(filepath.Base(name), whiteoutPrefix) {
+			listing.Whiteouts = append(listing.Whiteouts, name)
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			dir, _, found := strings.Cut(name, "/")
+			if !found {
+				dir = ""
+			}
+
+			listing.Size += uint64(header.Size)
+			listing.DirSizes[dir] += uint64(header.Size)
+		}
+
+		listing.Attributes[name] = parseFileFlags(header.PAXRecords[fflagsRecord])
+	}
+
+	return listing, nil
+}
+
+// applyWhiteout will delete from target the content hidden by input whiteout
+// marker, relative to target. The directory of the marker is resolved inside
+// target, so that symlinks in the lower layers can't make it delete anything
+// outside of it.
+func applyWhiteout(target string, whiteout string) error {
+	parent, _, err := ResolveInRootfs(target, filepath.Dir(whiteout))
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		// nothing to delete
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(target, parent)
+
+	info, err := os.Lstat(dir)
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+
+	if filepath.Base(whiteout) == whiteoutOpaque {
+		logging.LogDebug("applying opaque whiteout on %s", dir)
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// the deleted entry itself is never followed: os.RemoveAll removes a
+	// symlink, not its target.
+	deleted := filepath.Join(dir, strings.TrimPrefix(filepath.Base(whiteout), whiteoutPrefix))
+	logging.LogDebug("applying whiteout on %s", deleted)
+
+	return os.RemoveAll(deleted)
+}
+
+// compileExcludes returns the matchers of input tar exclude patterns.
+func compileExcludes(excludes []string) []*regexp.Regexp {
+	matchers := []*regexp.Regexp{}
+
+	for _, exclude := range excludes {
+		matcher, err := regexp.Compile("^" + globToRegexp(strings.Trim(exclude, "/")) + "(/.*)?$")
+		if err != nil {
+			matcher = regexp.MustCompile("^" + regexp.QuoteMeta(exclude) + "(/.*)?$")
+		}
+
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers
+}
+
+// isExcluded returns whether input path, relative to the root, matches one of
+// input matchers the way GNU tar matches its --exclude patterns by default:
+// wildcards match "/", the pattern may match any trailing part of the path
+// starting after a "/", and matching a directory excludes its content.
+func isExcluded(name string, matchers []*regexp.Regexp) bool {
+	for _, matcher := range matchers {
+		for suffix := name; ; {
+			if matcher.MatchString(suffix) {
+				return true
+			}
+
+			index := strings.Index(suffix, "/")
+			if index < 0 {
+				break
+			}
+
+			suffix = suffix[index+1:]
+		}
+	}
+
+	return false
+}
+
+// globToRegexp returns the regular expression of input shell glob, where "*"
+// and "?" match "/" too.
+func globToRegexp(glob string) string {
+	var expression strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			expression.WriteString(".*")
+		case '?':
+			expression.WriteString(".")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+
+			expression.WriteString(regexp.QuoteMeta(string(glob[i])))
+		case '[':
+			end := strings.Index(glob[i+1:], "]")
+			if end < 0 {
+				expression.WriteString(`\[`)
+
+				continue
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			expression.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+
+			i += end + 1
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(glob[i])))
+		}
+	}
+
+	return expression.String()
+}
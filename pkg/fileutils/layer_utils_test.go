@@ -0,0 +1,215 @@
+package fileutils
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const plainLayer = "application/vnd.oci.image.layer.v1.tar"
+
+// writeLayer writes an uncompressed layer made of input headers, regular
+// files get a body of their Size, and returns its path.
+func writeLayer(t *testing.T, headers []*tar.Header) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "layer.tar")
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	writer := tar.NewWriter(file)
+
+	for _, header := range headers {
+		if header.Mode == 0 {
+			header.Mode = 0o644
+		}
+
+		err = writer.WriteHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			_, err = writer.Write(make([]byte, header.Size))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// writeTree creates input files, relative to root, with their parents.
+func writeTree(t *testing.T, root string, files ...string) {
+	t.Helper()
+
+	for _, file := range files {
+		path := filepath.Join(root, file)
+
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(path, []byte(file), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func untarTestLayer(t *testing.T, target string, headers []*tar.Header) {
+	t.Helper()
+
+	layer := writeLayer(t, headers)
+
+	listing, err := ListLayer(layer, plainLayer, DefaultTarExcludes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = UntarLayer(layer, target, plainLayer, listing, false, false, DefaultTarExcludes)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUntarLayerWhiteouts(t *testing.T) {
+	target := t.TempDir()
+	writeTree(t, target, "usr/bin/removed", "usr/bin/kept", "usr/share/opaque/a", "usr/share/opaque/b")
+
+	untarTestLayer(t, target, []*tar.Header{
+		{Name: "usr/bin/.wh.removed", Typeflag: tar.TypeReg},
+		{Name: "usr/share/opaque/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "usr/share/opaque/c", Typeflag: tar.TypeReg, Size: 1},
+	})
+
+	for _, gone := range []string{"usr/bin/removed", "usr/bin/.wh.removed", "usr/share/opaque/a",
+		"usr/share/opaque/b", "usr/share/opaque/.wh..wh..opq"} {
+		if Exist(filepath.Join(target, gone)) {
+			t.Errorf("%s should have been removed", gone)
+		}
+	}
+
+	for _, kept := range []string{"usr/bin/kept", "usr/share/opaque/c"} {
+		if !Exist(filepath.Join(target, kept)) {
+			t.Errorf("%s should have been kept", kept)
+		}
+	}
+}
+
+func TestUntarLayerWhiteoutsStayInTarget(t *testing.T) {
+	outside := t.TempDir()
+	writeTree(t, outside, "victim", "dir/victim")
+
+	target := t.TempDir()
+	writeTree(t, target, "usr/bin/kept")
+
+	for link, destination := range map[string]string{
+		"absolute": outside,
+		"relative": "../../../../../../../../.." + outside,
+		"usr/lib":  outside,
+	} {
+		err := os.Symlink(destination, filepath.Join(target, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	untarTestLayer(t, target, []*tar.Header{
+		{Name: "absolute/.wh.victim", Typeflag: tar.TypeReg},
+		{Name: "relative/.wh.victim", Typeflag: tar.TypeReg},
+		{Name: "usr/lib/dir/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "usr/.wh.lib", Typeflag: tar.TypeReg},
+	})
+
+	for _, kept := range []string{"victim", "dir/victim"} {
+		if !Exist(filepath.Join(outside, kept)) {
+			t.Errorf("%s outside of the target was removed", kept)
+		}
+	}
+
+	if Exist(filepath.Join(target, "usr/lib")) {
+		t.Error("the whited out usr/lib symlink should have been removed")
+	}
+}
+
+func TestListLayer(t *testing.T) {
+	layer := writeLayer(t, []*tar.Header{
+		{Name: "./usr/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "./usr/.wh.old", Typeflag: tar.TypeReg},
+		{Name: "./dev/.wh.null", Typeflag: tar.TypeReg},
+		{Name: "usr/share/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "usr/bin/a", Typeflag: tar.TypeReg, Size: 1000,
+			PAXRecords: map[string]string{fflagsRecord: "uchg,nodump,hidden"}},
+		{Name: "usr/bin/b", Typeflag: tar.TypeLink, Linkname: "usr/bin/a"},
+		{Name: "usr/bin/c", Typeflag: tar.TypeSymlink, Linkname: "a"},
+		{Name: "tmp/big", Typeflag: tar.TypeReg, Size: 5000},
+	})
+
+	listing, err := ListLayer(layer, plainLayer, DefaultTarExcludes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"usr/.wh.old", "usr/share/.wh..wh..opq"}
+	if !reflect.DeepEqual(listing.Whiteouts, expected) {
+		t.Errorf("got whiteouts %v, expected %v", listing.Whiteouts, expected)
+	}
+
+	if listing.Attributes["usr/bin/a"] != "di" || listing.Attributes["usr/bin/c"] != "" {
+		t.Errorf("got attributes %v", listing.Attributes)
+	}
+
+	// hard links and excluded files are not accounted for
+	if listing.Size != 1000 {
+		t.Errorf("got size %d, expected 1000", listing.Size)
+	}
+
+	if !reflect.DeepEqual(listing.DirSizes, map[string]uint64{"usr": 1000}) {
+		t.Errorf("got sizes by directory %v", listing.DirSizes)
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	tests := []struct {
+		name     string
+		excludes []string
+		excluded bool
+	}{
+		{"dev/null", []string{"dev/*"}, true},
+		{"dev", []string{"dev/*"}, false},
+		{"dev/pts/0", []string{"dev/*"}, true},
+		{"usr/dev/null", []string{"dev/*"}, true},
+		{"usr/share/doc/a", []string{"usr/share/doc"}, true},
+		{"usr/share/docs", []string{"usr/share/doc"}, false},
+		{"usr/lib/a.pyc", []string{"*.pyc"}, true},
+		{"usr/lib/a.py", []string{"*.py[co]"}, false},
+		{"usr/lib/a.pyo", []string{"*.py[co]"}, true},
+		{"usr/lib/a.pyo", []string{"*.py[!co]"}, false},
+		{"usr/lib/a?b", []string{`a\?b`}, true},
+		{"usr/lib/axb", []string{`a\?b`}, false},
+		{"usr/lib/a.wh.b", []string{".wh.*"}, false},
+		{"usr/lib/.wh.b", []string{".wh.*"}, true},
+	}
+
+	for _, test := range tests {
+		excluded := isExcluded(test.name, compileExcludes(test.excludes))
+		if excluded != test.excluded {
+			t.Errorf("isExcluded(%q, %q) = %v, expected %v", test.name, test.excludes, excluded, test.excluded)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package fileutils
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// DereferenceSymlinks will replace the symlinks in input rootfs with copies
+// of their targets, resolved as if rootfs was the root directory, see
+// ResolveInRootfs: nothing outside of rootfs is ever copied.
+// Symlinks whose target doesn't exist in rootfs are left in place and
+// returned, so that callers can decide whether they're acceptable.
+// Directories are copied as they are, so the symlinks they contain are kept.
+func DereferenceSymlinks(rootfs string) ([]string, error) {
+	links := []string{}
+
+	err := filepath.WalkDir(rootfs, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.Type()&fs.ModeSymlink != 0 {
+			links = append(links, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	unresolved := []string{}
+
+	for _, link := range links {
+		target, err := resolveSymlink(rootfs, link)
+		if err != nil {
+			logging.LogDebug("not dereferencing %s: %v", link, err)
+
+			unresolved = append(unresolved, link)
+
+			continue
+		}
+
+		logging.LogDebug("dereferencing %s to %s", link, target)
+
+		err = os.Remove(link)
+		if err != nil {
+			return nil, err
+		}
+
+		out, err := exec.Command("cp", "-a", "--sparse=always", target, link).CombinedOutput()
+		if err != nil {
+			logging.LogError(string(out))
+			return nil, err
+		}
+	}
+
+	logging.Log("dereferenced %d symlinks", len(links)-len(unresolved))
+
+	return unresolved, nil
+}
+
+// resolveSymlink will return the path, inside rootfs, input symlink found in
+// rootfs points to, following chained symlinks as if rootfs was the root
+// directory, see ResolveInRootfs.
+func resolveSymlink(rootfs string, link string) (string, error) {
+	relative, err := filepath.Rel(rootfs, link)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, _, err := ResolveInRootfs(rootfs, relative)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(rootfs, resolved), nil
+}
+
+// FindBrokenSymlinks returns the symlinks under the dirs of input rootfs
+// that don't resolve to a path under one of those dirs, resolved as if
+// rootfs was the root directory: dangling ones, and ones pointing into the
+// rest of the rootfs, which is left out of the sysext.
+func FindBrokenSymlinks(rootfs string, dirs []string) ([]string, error) {
+	broken := []string{}
+
+	for _, dir := range dirs {
+		err := filepath.WalkDir(filepath.Join(rootfs, dir), func(path string, entry fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && path == filepath.Join(rootfs, dir) {
+				return filepath.SkipDir
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if entry.Type()&fs.ModeSymlink == 0 {
+				return nil
+			}
+
+			target, err := resolveSymlink(rootfs, path)
+			if err != nil {
+				logging.LogDebug("symlink %s doesn't resolve: %v", path, err)
+
+				broken = append(broken, path)
+
+				return nil
+			}
+
+			if !isUnderDirs(rootfs, target, dirs) {
+				logging.LogDebug("symlink %s resolves to %s, outside of %s", path, target, strings.Join(dirs, ", "))
+
+				broken = append(broken, path)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return broken, nil
+}
+
+// isUnderDirs returns whether path is inside one of the dirs of rootfs.
+func isUnderDirs(rootfs string, path string, dirs []string) bool {
+	relative, err := filepath.Rel(rootfs, path)
+	if err != nil {
+		return false
+	}
+
+	for _, dir := range dirs {
+		if relative == dir || strings.HasPrefix(relative, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,111 @@
+package fileutils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeSymlinks creates input symlinks, keyed by their path relative to root.
+func writeSymlinks(t *testing.T, root string, links map[string]string) {
+	t.Helper()
+
+	for link, target := range links {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(root, link)), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.Symlink(target, filepath.Join(root, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDereferenceSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	writeTree(t, outside, "shadow")
+
+	rootfs := t.TempDir()
+	writeTree(t, rootfs, "usr/bin/tool", "usr/share/data/file")
+	writeSymlinks(t, rootfs, map[string]string{
+		"evil":              outside,
+		"usr/bin/through":   "/evil/shadow",
+		"usr/bin/dotdot":    "../../../../../../../../.." + outside + "/shadow",
+		"usr/bin/relative":  "tool",
+		"usr/bin/absolute":  "/usr/bin/tool",
+		"usr/bin/chained":   "relative",
+		"usr/bin/clamped":   "../../../../usr/bin/tool",
+		"usr/share/dirlink": "data",
+		"usr/bin/dangling":  "missing",
+	})
+
+	unresolved, err := DereferenceSymlinks(rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relative := []string{}
+
+	for _, link := range unresolved {
+		path, _ := filepath.Rel(rootfs, link)
+		relative = append(relative, path)
+	}
+
+	sort.Strings(relative)
+
+	expected := []string{"evil", "usr/bin/dangling", "usr/bin/dotdot", "usr/bin/through"}
+	if !reflect.DeepEqual(relative, expected) {
+		t.Errorf("got unresolved %v, expected %v", relative, expected)
+	}
+
+	for _, path := range []string{"usr/bin/relative", "usr/bin/absolute", "usr/bin/chained", "usr/bin/clamped"} {
+		content, err := os.ReadFile(filepath.Join(rootfs, path))
+		if err != nil || string(content) != "usr/bin/tool" {
+			t.Errorf("%s should be a copy of usr/bin/tool, got %q, %v", path, content, err)
+		}
+	}
+
+	info, err := os.Lstat(filepath.Join(rootfs, "usr/share/dirlink/file"))
+	if err != nil || !info.Mode().IsRegular() {
+		t.Errorf("usr/share/dirlink should be a copy of usr/share/data: %v", err)
+	}
+}
+
+func TestFindBrokenSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	writeTree(t, outside, "shadow")
+
+	rootfs := t.TempDir()
+	writeTree(t, rootfs, "usr/bin/tool", "etc/config")
+	writeSymlinks(t, rootfs, map[string]string{
+		"evil":             outside,
+		"usr/bin/through":  "/evil/shadow",
+		"usr/bin/relative": "tool",
+		"usr/bin/etc":      "/etc/config",
+		"usr/bin/dangling": "missing",
+		"opt/tool":         "/usr/bin/tool",
+	})
+
+	broken, err := FindBrokenSymlinks(rootfs, []string{"usr", "opt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relative := []string{}
+
+	for _, link := range broken {
+		path, _ := filepath.Rel(rootfs, link)
+		relative = append(relative, path)
+	}
+
+	sort.Strings(relative)
+
+	expected := []string{"usr/bin/dangling", "usr/bin/etc", "usr/bin/through"}
+	if !reflect.DeepEqual(relative, expected) {
+		t.Errorf("got broken %v, expected %v", relative, expected)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -27,17 +28,35 @@ import (
 // ImageDir is the default location for downloaded images.
 var ImageDir = filepath.Join(utils.GetOciSysextHome(), "images")
 
+// Offline forbids any registry access when true, images must already be
+// present in ImageDir.
+var Offline bool
+
+// ErrOffline is returned when an operation would need to contact a registry
+// while Offline is set.
+var ErrOffline = errors.New("offline mode enabled")
+
+// checkOnline returns an error wrapping ErrOffline if Offline is set,
+// describing what needed network access.
+func checkOnline(format string, v ...any) error {
+	if Offline {
+		return fmt.Errorf("%s: %w", fmt.Sprintf(format, v...), ErrOffline)
+	}
+
+	return nil
+}
+
 // GetID returns the md5sum based ID for given image.
 // If a recognized ID is passed, it is returned.
 func GetID(image string) string {
 	// if an ID is already passed, just return
-	if fileutils.Exist(filepath.Join(ImageDir, image)) {
+	if isImageID(image) {
 		return image
 	}
 
 	// Normalize the name with full length registry
 	ref, err := name.ParseReference(image)
-	if err == nil {
+	if err == nil && !IsContainersStorage(image) {
 		image = ref.Name()
 	}
 
@@ -51,6 +70,63 @@ func GetID(image string) string {
 	return fmt.Sprintf("%x", hasher.Sum(nil))
 }
 
+// isImageID returns whether input image is the ID of an image of the store,
+// see GetID.
+func isImageID(image string) bool {
+	return image != "" && !strings.Contains(image, "/") && fileutils.Exist(filepath.Join(ImageDir, image))
+}
+
+// IsPinned returns whether input image reference is pinned by digest.
+func IsPinned(image string) bool {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return false
+	}
+
+	_, ok := ref.(name.Digest)
+
+	return ok
+}
+
+// GetDigest returns the digest of the manifest saved for given image name or id.
+func GetDigest(image string) (string, error) {
+	manifestPath := filepath.Join(GetPath(image), "manifest.json")
+	if !fileutils.Exist(manifestPath) {
+		return "", fmt.Errorf("manifest for %s not found", image)
+	}
+
+	return "sha256:" + fileutils.GetFileDigest(manifestPath), nil
+}
+
+// digestHexLength maps the supported digest algorithms to the length of their
+// hex encoded value.
+var digestHexLength = map[string]int{
+	"sha256": 64,
+	"sha512": 128,
+}
+
+// GetLayerFileName returns the name of the file a layer with given digest is
+// saved as in the image directory.
+// The digest is validated, so that it can be safely used as a file name.
+func GetLayerFileName(digest v1.Hash) (string, error) {
+	length, ok := digestHexLength[digest.Algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported digest algorithm %q in %s", digest.Algorithm, digest.String())
+	}
+
+	if len(digest.Hex) != length {
+		return "", fmt.Errorf("invalid digest %s: expected %d hex characters", digest.String(), length)
+	}
+
+	for _, char := range digest.Hex {
+		if (char < '0' || char > '9') && (char < 'a' || char > 'f') {
+			return "", fmt.Errorf("invalid digest %s: not lowercase hex", digest.String())
+		}
+	}
+
+	return digest.Hex + ".tar.gz", nil
+}
+
 // GetPath returns the path for given image name or id.
 func GetPath(name string) string {
 	return filepath.Join(ImageDir, GetID(name))
@@ -60,8 +136,25 @@ func GetPath(name string) string {
 // This function uses github.com/google/go-containerregistry/pkg/crane to pull
 // the image's manifest, and performs the downloading of each layer separately.
 // Each layer is deduplicated between images in order to save space, using hardlinks.
-// If quiet is specified, no output nor progress will be shown.
-func Pull(image string, quiet bool) (string, error) {
+// If quiet is specified, or the event stream is enabled, no output nor
+// progress will be shown.
+// If noCache is specified, all layers are downloaded again, ignoring the ones
+// already present in ImageDir.
+// The image has to be allowed by the policy in PolicyFile, if any.
+// Images prefixed with ContainersStoragePrefix are exported from the local
+// containers-storage instead.
+func Pull(image string, quiet bool, noCache bool) (string, error) {
+	quiet = quiet || logging.JSONEvents()
+
+	if IsContainersStorage(image) {
+		return pullContainersStorage(image, quiet, noCache)
+	}
+
+	image, err := ResolveShortName(image)
+	if err != nil {
+		return "", err
+	}
+
 	// First we try to get the fully qualified uri of the image
 	// eg alpine:latest -> index.docker.io/library/alpine:latest
 	ref, err := name.ParseReference(image)
@@ -69,24 +162,129 @@ func Pull(image string, quiet bool) (string, error) {
 		image = ref.Name()
 	}
 
+	signatures, err := checkPolicyBeforePull(image)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	if Offline {
+		if !noCache && fileutils.Exist(filepath.Join(GetPath(image), "manifest.json")) {
+			if !quiet {
+				fmt.Printf("image %s is cached, not pulling in offline mode\n", image)
+			}
+
+			// signatures can't be looked up offline, so an image that
+			// requires them is refused
+			err = checkPolicyAfterPull(image, signatures)
+			if err != nil {
+				logging.LogError("%+v", err)
+
+				return "", err
+			}
+
+			return GetID(image), nil
+		}
+
+		return "", checkOnline("image %s not cached", image)
+	}
+
 	if !quiet {
 		fmt.Printf("pulling image manifest: %s\n", image)
 	}
 	// Pull will just get us the v1.Image struct, from
 	// which we get all the information we need
-	imageManifest, err := crane.Pull(image)
+	var imageManifest v1.Image
+
+	err = withRetries(image, func() error {
+		imageManifest, err = crane.Pull(image)
+
+		return err
+	})
 	if err != nil {
 		logging.LogError("%+v", err)
 
 		return "", err
 	}
 
+	err = saveImage(image, imageManifest, quiet, noCache)
+	if err != nil {
+		return "", err
+	}
+
+	// signatures are verified against the saved manifest, an image failing
+	// them is removed so that it's never used from the cache
+	err = checkPolicyAfterPull(image, signatures)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		_ = os.RemoveAll(GetPath(image))
+
+		return "", err
+	}
+
+	if !quiet {
+		fmt.Println("done")
+	}
+
+	return GetID(image), nil
+}
+
+// Resolve returns input image pinned to the digest of its manifest in the
+// registry, as NAME@sha256:..., without downloading it: only the manifest is
+// queried. Short names are qualified like Pull does. Multi-platform images
+// are pinned to their index, so the pinned image resolves to the same
+// platform as input one.
+// Nothing being pulled, the policy in PolicyFile doesn't apply.
+func Resolve(image string) (string, error) {
+	if IsContainersStorage(image) {
+		return "", fmt.Errorf("cannot resolve %s: images in containers-storage have no registry", image)
+	}
+
+	image, err := ResolveShortName(image)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkOnline("cannot resolve %s", image)
+	if err != nil {
+		return "", err
+	}
+
+	var digest string
+
+	err = withRetries(image, func() error {
+		digest, err = crane.Digest(ref.Name())
+
+		return err
+	})
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	return ref.Context().Name() + "@" + digest, nil
+}
+
+// saveImage will save the layers, manifest and config of input image to its
+// directory in ImageDir, along with its name.
+// If noCache is specified, all layers are saved again, ignoring the ones
+// already present in ImageDir.
+func saveImage(image string, imageManifest v1.Image, quiet bool, noCache bool) error {
 	// We get the layers
 	layers, err := imageManifest.Layers()
+	err = classifyRegistryError(image, err)
 	if err != nil {
 		logging.LogError("%+v", err)
 
-		return "", err
+		return err
 	}
 
 	// Prepare the image path
@@ -96,18 +294,24 @@ func Pull(image string, quiet bool) (string, error) {
 		if err != nil {
 			logging.LogError("%+v", err)
 
-			return "", err
+			return err
 		}
 	}
 
 	keepFiles := []string{}
 	// Now we download the layers
 	for _, layer := range layers {
-		fileName, err := downloadLayer(targetDIR, quiet, layer)
+		var fileName string
+
+		err = withRetries(image, func() error {
+			fileName, err = downloadLayer(targetDIR, quiet, noCache, layer)
+
+			return err
+		})
 		if err != nil {
 			logging.LogError("%+v", err)
 
-			return "", err
+			return err
 		}
 
 		keepFiles = append(keepFiles, fileName)
@@ -120,7 +324,7 @@ func Pull(image string, quiet bool) (string, error) {
 	if err != nil {
 		logging.LogError("%+v", err)
 
-		return "", err
+		return err
 	}
 
 	for _, file := range fileList {
@@ -134,7 +338,7 @@ func Pull(image string, quiet bool) (string, error) {
 			if err != nil {
 				logging.LogError("%+v", err)
 
-				return "", err
+				return err
 			}
 		}
 	}
@@ -149,14 +353,14 @@ func Pull(image string, quiet bool) (string, error) {
 	if err != nil {
 		logging.LogError("%+v", err)
 
-		return "", err
+		return err
 	}
 
 	err = fileutils.WriteFile(filepath.Join(targetDIR, "manifest.json"), rawManifest, 0o644)
 	if err != nil {
 		logging.LogError("%+v", err)
 
-		return "", err
+		return err
 	}
 
 	if !quiet {
@@ -169,14 +373,14 @@ func Pull(image string, quiet bool) (string, error) {
 	if err != nil {
 		logging.LogError("%+v", err)
 
-		return "", err
+		return err
 	}
 
 	err = fileutils.WriteFile(filepath.Join(targetDIR, "config.json"), rawConfig, 0o644)
 	if err != nil {
 		logging.LogError("%+v", err)
 
-		return "", err
+		return err
 	}
 
 	if !quiet {
@@ -187,14 +391,10 @@ func Pull(image string, quiet bool) (string, error) {
 	if err != nil {
 		logging.LogError("%+v", err)
 
-		return "", err
-	}
-
-	if !quiet {
-		fmt.Println("done")
+		return err
 	}
 
-	return GetID(image), nil
+	return nil
 }
 
 // Inspect will return a JSON or a formatted string describing the input images.
@@ -254,7 +454,8 @@ func Inspect(images []string, format string) (string, error) {
 // to find matching layers, and hardlink them in order to save disk space.
 //
 // Each layer download is verified in order to ensure no corrupted downloads occur.
-func downloadLayer(targetDIR string, quiet bool, layer v1.Layer) (string, error) {
+// If noCache is specified, existing layers are neither reused nor linked.
+func downloadLayer(targetDIR string, quiet bool, noCache bool, layer v1.Layer) (string, error) {
 	// we use this as a path to download layers, in order to
 	// verify them and ensure we do not leave broken files
 	tmpdir := filepath.Join(targetDIR, ".temp")
@@ -272,16 +473,24 @@ func downloadLayer(targetDIR string, quiet bool, layer v1.Layer) (string, error)
 	// and after
 	defer func() { _ = os.RemoveAll(tmpdir) }()
 
-	layerDigest, _ := layer.Digest()
+	layerDigest, err := layer.Digest()
+	if err != nil {
+		logging.LogDebug("error: %+v", err)
+
+		return "", err
+	}
 
-	layerFileName := strings.Split(layerDigest.String(), ":")[1] + ".tar.gz"
+	layerFileName, err := GetLayerFileName(layerDigest)
+	if err != nil {
+		return "", err
+	}
 
 	if !quiet {
 		logging.Log("pulling layer %s", layerFileName)
 	}
 
 	// If a layer already exists, exit
-	if fileutils.Exist(filepath.Join(targetDIR, layerFileName)) &&
+	if !noCache && fileutils.Exist(filepath.Join(targetDIR, layerFileName)) &&
 		fileutils.CheckFileDigest(filepath.Join(targetDIR, layerFileName), layerDigest.String()) {
 		if !quiet {
 			logging.Log("layer %s already exists, skipping", layerFileName)
@@ -293,7 +502,7 @@ func downloadLayer(targetDIR string, quiet bool, layer v1.Layer) (string, error)
 	// But if a layer with the same name/digest exists in another directory
 	// let's deduplicate the disk usage by using hardlinks
 	matchingLayers := findExistingLayer(ImageDir, layerFileName)
-	if len(matchingLayers) > 0 &&
+	if !noCache && len(matchingLayers) > 0 &&
 		fileutils.CheckFileDigest(matchingLayers[0], layerDigest.String()) {
 		if !quiet {
 			logging.Log("layer %s already exists, linking", layerFileName)
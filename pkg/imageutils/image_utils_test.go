@@ -0,0 +1,98 @@
+package imageutils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestGetLayerFileName(t *testing.T) {
+	sha256Hex := strings.Repeat("ab", 32)
+	sha512Hex := strings.Repeat("cd", 64)
+
+	tests := []struct {
+		digest   v1.Hash
+		expected string
+	}{
+		{v1.Hash{Algorithm: "sha256", Hex: sha256Hex}, sha256Hex + ".tar.gz"},
+		{v1.Hash{Algorithm: "sha512", Hex: sha512Hex}, sha512Hex + ".tar.gz"},
+		{v1.Hash{Algorithm: "sha512", Hex: sha256Hex}, ""},
+		{v1.Hash{Algorithm: "sha256", Hex: sha512Hex}, ""},
+		{v1.Hash{Algorithm: "md5", Hex: strings.Repeat("ab", 16)}, ""},
+		{v1.Hash{Algorithm: "sha256", Hex: strings.ToUpper(sha256Hex)}, ""},
+		{v1.Hash{Algorithm: "sha256", Hex: "../" + sha256Hex[3:]}, ""},
+	}
+
+	for _, test := range tests {
+		fileName, err := GetLayerFileName(test.digest)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: got %s, expected an invalid digest", test.digest, fileName)
+			}
+
+			continue
+		}
+
+		if err != nil || fileName != test.expected {
+			t.Errorf("%s: got %s, %v, expected %s", test.digest, fileName, err, test.expected)
+		}
+	}
+
+}
+
+func TestPullOffline(t *testing.T) {
+	withPolicy(t, testPolicy)
+
+	previous := ImageDir
+	ImageDir = t.TempDir()
+	Offline = true
+
+	t.Cleanup(func() { ImageDir, Offline = previous, false })
+
+	for _, image := range []string{"docker.io/library/alpine:3", "quay.io/signed/app:latest"} {
+		err := os.MkdirAll(GetPath(image), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(filepath.Join(GetPath(image), "manifest.json"), []byte("{}"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, err := Pull("docker.io/library/alpine:3", true, false)
+	if err != nil {
+		t.Fatalf("a cached image should be usable offline: %v", err)
+	}
+
+	if id != GetID("docker.io/library/alpine:3") {
+		t.Errorf("got ID %s, expected %s", id, GetID("docker.io/library/alpine:3"))
+	}
+
+	tests := []struct {
+		image   string
+		noCache bool
+	}{
+		{"docker.io/library/busybox:1", false},
+		// pulling again needs the registry
+		{"docker.io/library/alpine:3", true},
+	}
+
+	for _, test := range tests {
+		_, err = Pull(test.image, true, test.noCache)
+		if !errors.Is(err, ErrOffline) {
+			t.Errorf("%s, no cache %v: got %v, expected %v", test.image, test.noCache, err, ErrOffline)
+		}
+	}
+
+	// the signatures of a cached image can't be verified offline
+	_, err = Pull("quay.io/signed/app:latest", true, false)
+	if !errors.Is(err, ErrOffline) {
+		t.Errorf("got %v, expected %v", err, ErrOffline)
+	}
+}
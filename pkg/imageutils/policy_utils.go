@@ -0,0 +1,288 @@
+package imageutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/utils"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// PolicyFile is the trust policy every image used for a build has to satisfy.
+// It follows loosely the containers policy.json format, only the docker and
+// containers-storage transports are read:
+//
+//	{
+//	  "default": [{"type": "reject"}],
+//	  "transports": {
+//	    "docker": {
+//	      "quay.io/myorg": [{"type": "sigstoreSigned", "keyPath": "/etc/pki/myorg.pub"}],
+//	      "docker.io/library": [{"type": "insecureAcceptAnything"}]
+//	    }
+//	  }
+//	}
+//
+// Scopes of docker.io match the images of index.docker.io, as they're the same
+// registry. Signatures can't be verified for containers-storage images, so a
+// sigstoreSigned requirement refuses them.
+// Without a policy file every image is accepted.
+var PolicyFile = filepath.Join(utils.GetOciSysextHome(), "policy.json")
+
+// storageTransport is the policy transport of containers-storage images.
+const storageTransport = "containers-storage"
+
+// ErrPolicyDenied is returned when the policy refuses an image.
+var ErrPolicyDenied = errors.New("image refused by policy")
+
+// Policy requirement types.
+const (
+	// PolicyAccept accepts any image.
+	PolicyAccept = "insecureAcceptAnything"
+	// PolicyReject refuses any image.
+	PolicyReject = "reject"
+	// PolicySigstoreSigned requires a valid cosign signature made with the
+	// key at KeyPath.
+	PolicySigstoreSigned = "sigstoreSigned"
+	// PolicyDigestPinned requires the image to be referenced by digest.
+	PolicyDigestPinned = "digestPinned"
+)
+
+// PolicyRequirement is a requirement an image has to satisfy to be pulled.
+type PolicyRequirement struct {
+	Type    string `json:"type"`
+	KeyPath string `json:"keyPath,omitempty"`
+}
+
+// Policy maps the images, by scope, to the requirements they must all
+// satisfy.
+type Policy struct {
+	// Default is used for images not matching any scope.
+	Default []PolicyRequirement `json:"default"`
+	// Transports maps each transport to its scopes, which are, from the most
+	// to the least specific: a full reference, a repository, a namespace of
+	// the repository, or a registry host.
+	Transports map[string]map[string][]PolicyRequirement `json:"transports"`
+}
+
+// ReadPolicy returns the policy in PolicyFile, and whether there is one.
+func ReadPolicy() (Policy, bool, error) {
+	var policy Policy
+
+	if !fileutils.Exist(PolicyFile) {
+		return policy, false, nil
+	}
+
+	content, err := fileutils.ReadFile(PolicyFile)
+	if err != nil {
+		return policy, false, err
+	}
+
+	err = json.Unmarshal(content, &policy)
+	if err != nil {
+		return policy, false, fmt.Errorf("%s: %w", PolicyFile, err)
+	}
+
+	for _, requirements := range append([][]PolicyRequirement{policy.Default}, policyScopes(policy)...) {
+		err = validateRequirements(requirements)
+		if err != nil {
+			return policy, false, fmt.Errorf("%s: %w", PolicyFile, err)
+		}
+	}
+
+	return policy, true, nil
+}
+
+// Requirements returns the requirements of the most specific scope matching
+// input image reference.
+func (p Policy) Requirements(ref name.Reference) []PolicyRequirement {
+	repository := ref.Context().Name()
+	candidates := []string{ref.Name(), repository}
+
+	for namespace := filepath.Dir(repository); namespace != "." && namespace != "/"; namespace = filepath.Dir(namespace) {
+		candidates = append(candidates, namespace)
+	}
+
+	return p.scopeRequirements("docker", candidates, ref.Name())
+}
+
+// storageRequirements returns the requirements of the most specific scope
+// matching input containers-storage reference, without its prefix.
+func (p Policy) storageRequirements(reference string) []PolicyRequirement {
+	candidates := []string{reference}
+
+	repository, _, _ := strings.Cut(reference, "@")
+	if index := strings.LastIndex(repository, ":"); index > strings.LastIndex(repository, "/") {
+		repository = repository[:index]
+	}
+
+	for namespace := repository; namespace != "." && namespace != "/"; namespace = filepath.Dir(namespace) {
+		candidates = append(candidates, namespace)
+	}
+
+	return p.scopeRequirements(storageTransport, candidates, reference)
+}
+
+// scopeRequirements returns the requirements of the first of input scopes
+// found in input transport of the policy, or the default ones.
+func (p Policy) scopeRequirements(transport string, candidates []string, image string) []PolicyRequirement {
+	scopes := map[string][]PolicyRequirement{}
+
+	for scope, requirements := range p.Transports[transport] {
+		scopes[normalizeScope(scope)] = requirements
+	}
+
+	for _, candidate := range candidates {
+		requirements, found := scopes[candidate]
+		if found {
+			logging.LogDebug("policy scope %s applies to %s", candidate, image)
+
+			return requirements
+		}
+	}
+
+	return p.Default
+}
+
+// normalizeScope returns input docker scope with docker.io spelled as
+// index.docker.io, the way references name it once parsed.
+func normalizeScope(scope string) string {
+	if scope == "docker.io" || strings.HasPrefix(scope, "docker.io/") {
+		return name.DefaultRegistry + strings.TrimPrefix(scope, "docker.io")
+	}
+
+	return scope
+}
+
+// CheckPolicy will verify that input image, already in ImageDir, satisfies
+// the policy in PolicyFile, if any, the same way Pull does for the images it
+// pulls. It's meant for the images used from the cache.
+func CheckPolicy(image string) error {
+	if !IsContainersStorage(image) {
+		resolved, err := ResolveShortName(image)
+		if err != nil {
+			return err
+		}
+
+		ref, err := name.ParseReference(resolved)
+		if err != nil {
+			return err
+		}
+
+		image = ref.Name()
+	}
+
+	signatures, err := checkPolicyBeforePull(image)
+	if err != nil {
+		return err
+	}
+
+	return checkPolicyAfterPull(image, signatures)
+}
+
+// checkPolicyBeforePull will evaluate the requirements of input image that
+// can be checked before pulling it, and return the ones to verify once
+// pulled.
+func checkPolicyBeforePull(image string) ([]PolicyRequirement, error) {
+	policy, found, err := ReadPolicy()
+	if err != nil || !found {
+		return nil, err
+	}
+
+	var requirements []PolicyRequirement
+
+	pinned := false
+
+	if IsContainersStorage(image) {
+		reference := strings.TrimPrefix(image, ContainersStoragePrefix)
+
+		requirements = policy.storageRequirements(reference)
+		pinned = strings.Contains(reference, "@")
+	} else {
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			return nil, err
+		}
+
+		requirements = policy.Requirements(ref)
+		_, pinned = ref.(name.Digest)
+	}
+
+	if len(requirements) == 0 {
+		return nil, fmt.Errorf("%w: %s: no requirement applies, add a default to %s",
+			ErrPolicyDenied, image, PolicyFile)
+	}
+
+	signatures := []PolicyRequirement{}
+
+	for _, requirement := range requirements {
+		switch requirement.Type {
+		case PolicyAccept:
+		case PolicyReject:
+			return nil, fmt.Errorf("%w: %s is rejected by %s", ErrPolicyDenied, image, PolicyFile)
+		case PolicyDigestPinned:
+			if !pinned {
+				return nil, fmt.Errorf("%w: %s must be referenced by digest", ErrPolicyDenied, image)
+			}
+		case PolicySigstoreSigned:
+			if IsContainersStorage(image) {
+				return nil, fmt.Errorf("%w: %s must be signed, which can't be verified in containers-storage",
+					ErrPolicyDenied, image)
+			}
+
+			signatures = append(signatures, requirement)
+		}
+	}
+
+	return signatures, nil
+}
+
+// checkPolicyAfterPull will verify the signatures required for input image,
+// once pulled.
+func checkPolicyAfterPull(image string, requirements []PolicyRequirement) error {
+	for _, requirement := range requirements {
+		logging.LogDebug("verifying signature of %s with %s", image, requirement.KeyPath)
+
+		err := VerifySignature(image, requirement.KeyPath)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrPolicyDenied, err)
+		}
+	}
+
+	return nil
+}
+
+// policyScopes returns the requirements of every scope of input policy.
+func policyScopes(policy Policy) [][]PolicyRequirement {
+	scopes := [][]PolicyRequirement{}
+
+	for _, transport := range policy.Transports {
+		for _, requirements := range transport {
+			scopes = append(scopes, requirements)
+		}
+	}
+
+	return scopes
+}
+
+// validateRequirements will ensure input requirements are known and complete.
+func validateRequirements(requirements []PolicyRequirement) error {
+	for _, requirement := range requirements {
+		switch requirement.Type {
+		case PolicyAccept, PolicyReject, PolicyDigestPinned:
+		case PolicySigstoreSigned:
+			if requirement.KeyPath == "" {
+				return fmt.Errorf("%s requires a keyPath", PolicySigstoreSigned)
+			}
+		default:
+			return fmt.Errorf("unsupported requirement type %q, expected one of %s", requirement.Type,
+				strings.Join([]string{PolicyAccept, PolicyReject, PolicySigstoreSigned, PolicyDigestPinned}, ", "))
+		}
+	}
+
+	return nil
+}
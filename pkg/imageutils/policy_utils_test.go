@@ -0,0 +1,107 @@
+package imageutils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const testPolicy = `{
+  "default": [{"type": "reject"}],
+  "transports": {
+    "docker": {
+      "docker.io/library": [{"type": "insecureAcceptAnything"}],
+      "docker.io/library/pinned": [{"type": "digestPinned"}],
+      "quay.io/signed": [{"type": "sigstoreSigned", "keyPath": "/etc/pki/signed.pub"}]
+    },
+    "containers-storage": {
+      "localhost/app": [{"type": "insecureAcceptAnything"}],
+      "localhost/signed": [{"type": "sigstoreSigned", "keyPath": "/etc/pki/signed.pub"}]
+    }
+  }
+}`
+
+// withPolicy sets PolicyFile to a policy of input content for the test.
+func withPolicy(t *testing.T, content string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+
+	err := os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := PolicyFile
+	PolicyFile = path
+
+	t.Cleanup(func() { PolicyFile = previous })
+}
+
+func TestPolicyRequirements(t *testing.T) {
+	withPolicy(t, testPolicy)
+
+	policy, found, err := ReadPolicy()
+	if err != nil || !found {
+		t.Fatalf("cannot read the policy: %v", err)
+	}
+
+	tests := map[string]string{
+		"alpine":                             PolicyAccept,
+		"docker.io/library/alpine:3":         PolicyAccept,
+		"index.docker.io/library/alpine":     PolicyAccept,
+		"docker.io/library/pinned":           PolicyDigestPinned,
+		"quay.io/signed/app:latest":          PolicySigstoreSigned,
+		"quay.io/other/app:latest":           PolicyReject,
+		"docker.io/someone/library/alpine:3": PolicyReject,
+	}
+
+	for image, expected := range tests {
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		requirements := policy.Requirements(ref)
+		if len(requirements) != 1 || requirements[0].Type != expected {
+			t.Errorf("%s: got %v, expected %s", image, requirements, expected)
+		}
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	withPolicy(t, testPolicy)
+
+	Offline = true
+
+	t.Cleanup(func() { Offline = false })
+
+	tests := map[string]bool{
+		"docker.io/library/alpine:3":                 true,
+		"docker.io/library/pinned:latest":            false,
+		"docker.io/library/pinned@sha256:" + zeroHex: true,
+		"quay.io/other/app:latest":                   false,
+		// signatures can't be looked up offline
+		"quay.io/signed/app:latest":                   false,
+		ContainersStoragePrefix + "localhost/app":     true,
+		ContainersStoragePrefix + "localhost/app:1.0": true,
+		ContainersStoragePrefix + "localhost/other":   false,
+		ContainersStoragePrefix + "localhost/signed":  false,
+	}
+
+	for image, allowed := range tests {
+		err := CheckPolicy(image)
+		if allowed && err != nil {
+			t.Errorf("%s should be allowed: %v", image, err)
+		}
+
+		if !allowed && !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("%s should be refused by the policy, got %v", image, err)
+		}
+	}
+}
+
+const zeroHex = "0000000000000000000000000000000000000000000000000000000000000000"
@@ -0,0 +1,250 @@
+package imageutils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/utils"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// ErrImageNotFound is returned when the registry reports that an image, or
+// its repository, doesn't exist.
+var ErrImageNotFound = errors.New("image not found")
+
+// ErrRegistryUnavailable is returned when a registry can't be reached or
+// fails temporarily, the operation can be retried.
+var ErrRegistryUnavailable = errors.New("registry unavailable")
+
+// registryRetries is how many times an operation failing with
+// ErrRegistryUnavailable is attempted.
+const registryRetries = 3
+
+// RegistriesConf is the configuration file listing the registries used to
+// resolve short image names. It follows the containers registries.conf
+// format, but only the unqualified-search-registries key is read:
+//
+//	unqualified-search-registries = ["docker.io", "quay.io"]
+var RegistriesConf = filepath.Join(utils.GetOciSysextHome(), "registries.conf")
+
+// DefaultRegistry, if set, is the registry qualifying short image names,
+// instead of searching the registries of RegistriesConf. It can also be set
+// with default-registry in the configuration file, DefaultRegistry takes
+// precedence over it.
+// Only short names are affected, qualified references are used as is.
+var DefaultRegistry string
+
+// defaultSearchRegistries is used when no configuration is found.
+var defaultSearchRegistries = []string{"docker.io"}
+
+// ResolveShortName will qualify input image with a registry if it lacks one.
+// The registries listed in RegistriesConf are tried in order, an image already
+// pulled from one of them is preferred, else the first registry where the
+// image exists is used.
+// Qualified references, containers-storage images and image IDs are returned
+// as is, and so are short names when only docker.io is configured, which is
+// the default.
+// If a default registry is set, see DefaultRegistry, short names are
+// qualified with it without searching.
+func ResolveShortName(image string) (string, error) {
+	if isQualified(image) || IsContainersStorage(image) || isImageID(image) {
+		return image, nil
+	}
+
+	registry, err := defaultRegistry()
+	if err != nil {
+		return "", err
+	}
+
+	if registry != "" {
+		logging.LogDebug("qualifying %s with the default registry %s", image, registry)
+
+		return registry + "/" + image, nil
+	}
+
+	registries, err := searchRegistries()
+	if err != nil {
+		return "", err
+	}
+
+	if len(registries) == 1 && registries[0] == "docker.io" {
+		return image, nil
+	}
+
+	candidates := []string{}
+	for _, registry := range registries {
+		candidates = append(candidates, registry+"/"+image)
+	}
+
+	for _, candidate := range candidates {
+		if fileutils.Exist(GetPath(candidate)) {
+			logging.Log("resolved %s to %s", image, candidate)
+
+			return candidate, nil
+		}
+	}
+
+	err = checkOnline("cannot resolve short name %s", image)
+	if err != nil {
+		return "", err
+	}
+
+	for _, candidate := range candidates {
+		_, err := crane.Digest(candidate)
+		if err != nil {
+			logging.LogDebug("%s not found: %+v", candidate, err)
+
+			continue
+		}
+
+		logging.Log("resolved %s to %s", image, candidate)
+
+		return candidate, nil
+	}
+
+	return "", fmt.Errorf("%w: %s not found in any of %s", ErrImageNotFound, image, strings.Join(registries, ", "))
+}
+
+// ----------------------------------------------------------------------------
+
+// isQualified returns whether input image starts with a registry host.
+func isQualified(image string) bool {
+	host, _, found := strings.Cut(image, "/")
+	if !found {
+		return false
+	}
+
+	return strings.ContainsAny(host, ".:") || host == "localhost"
+}
+
+// defaultRegistry returns the registry qualifying short names, from
+// DefaultRegistry or the configuration file, if any.
+func defaultRegistry() (string, error) {
+	registry := DefaultRegistry
+	if registry == "" {
+		config, err := utils.ReadConfig()
+		if err != nil {
+			return "", err
+		}
+
+		registry = config["default-registry"]
+	}
+
+	registry = strings.TrimSuffix(registry, "/")
+	if registry == "" {
+		return "", nil
+	}
+
+	if strings.Contains(registry, "://") || strings.Contains(registry, "/") {
+		return "", fmt.Errorf("invalid default registry %q: expected a registry host, like quay.io", registry)
+	}
+
+	return registry, nil
+}
+
+// searchRegistries returns the registries to try for short names, reading
+// them from RegistriesConf if present.
+func searchRegistries() ([]string, error) {
+	if !fileutils.Exist(RegistriesConf) {
+		return defaultSearchRegistries, nil
+	}
+
+	content, err := fileutils.ReadFile(RegistriesConf)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(content, "\x00")))
+
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found || strings.TrimSpace(key) != "unqualified-search-registries" {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+			return nil, fmt.Errorf("%s: unqualified-search-registries must be a list", RegistriesConf)
+		}
+
+		registries := []string{}
+
+		for _, registry := range strings.Split(strings.Trim(value, "[]"), ",") {
+			registry = strings.Trim(strings.TrimSpace(registry), `"'`)
+			if registry != "" {
+				registries = append(registries, registry)
+			}
+		}
+
+		if len(registries) > 0 {
+			return registries, nil
+		}
+	}
+
+	return defaultSearchRegistries, scanner.Err()
+}
+
+// classifyRegistryError will wrap input error, returned by a registry
+// operation on input image, into ErrImageNotFound or ErrRegistryUnavailable
+// when it's one of them. Other errors are returned as is.
+func classifyRegistryError(image string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var transportError *transport.Error
+	if errors.As(err, &transportError) {
+		if transportError.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s: %w", ErrImageNotFound, image, err)
+		}
+
+		for _, diagnostic := range transportError.Errors {
+			if diagnostic.Code == transport.ManifestUnknownErrorCode ||
+				diagnostic.Code == transport.NameUnknownErrorCode {
+				return fmt.Errorf("%w: %s: %w", ErrImageNotFound, image, err)
+			}
+		}
+
+		if transportError.Temporary() || transportError.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%w: %s: %w", ErrRegistryUnavailable, image, err)
+		}
+
+		return err
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) {
+		return fmt.Errorf("%w: %s: %w", ErrRegistryUnavailable, image, err)
+	}
+
+	return err
+}
+
+// withRetries will run input registry operation on input image, retrying it
+// with a growing delay as long as it fails with ErrRegistryUnavailable.
+func withRetries(image string, operation func() error) error {
+	var err error
+
+	for attempt := 1; attempt <= registryRetries; attempt++ {
+		err = classifyRegistryError(image, operation())
+		if !errors.Is(err, ErrRegistryUnavailable) || attempt == registryRetries {
+			break
+		}
+
+		delay := time.Duration(attempt) * 2 * time.Second
+		logging.LogWarning("%v, retrying in %s", err, delay)
+		time.Sleep(delay)
+	}
+
+	return err
+}
@@ -0,0 +1,109 @@
+package imageutils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestResolveShortName(t *testing.T) {
+	previous := []string{ImageDir, DefaultRegistry}
+	ImageDir, DefaultRegistry = t.TempDir(), "quay.io"
+
+	t.Cleanup(func() { ImageDir, DefaultRegistry = previous[0], previous[1] })
+
+	id := GetID("quay.io/tools:1")
+
+	err := os.MkdirAll(filepath.Join(ImageDir, id), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"tools:1":                       "quay.io/tools:1",
+		"library/alpine":                "quay.io/library/alpine",
+		"docker.io/library/alpine":      "docker.io/library/alpine",
+		"localhost/app":                 "localhost/app",
+		ContainersStoragePrefix + "app": ContainersStoragePrefix + "app",
+		// image IDs are never qualified
+		id: id,
+	}
+
+	for image, expected := range tests {
+		resolved, err := ResolveShortName(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resolved != expected {
+			t.Errorf("ResolveShortName(%q) = %q, expected %q", image, resolved, expected)
+		}
+	}
+
+	if GetID(id) != id {
+		t.Errorf("GetID(%q) = %q, expected the ID itself", id, GetID(id))
+	}
+}
+
+func TestClassifyRegistryError(t *testing.T) {
+	plain := errors.New("invalid reference")
+
+	tests := []struct {
+		err      error
+		expected error
+	}{
+		{&transport.Error{StatusCode: http.StatusNotFound}, ErrImageNotFound},
+		{&transport.Error{StatusCode: http.StatusUnauthorized, Errors: []transport.Diagnostic{
+			{Code: transport.NameUnknownErrorCode},
+		}}, ErrImageNotFound},
+		{&transport.Error{StatusCode: http.StatusBadRequest, Errors: []transport.Diagnostic{
+			{Code: transport.ManifestUnknownErrorCode},
+		}}, ErrImageNotFound},
+		{fmt.Errorf("GET manifest: %w", &transport.Error{StatusCode: http.StatusNotFound}), ErrImageNotFound},
+		{&transport.Error{StatusCode: http.StatusServiceUnavailable}, ErrRegistryUnavailable},
+		{&transport.Error{StatusCode: http.StatusNotImplemented}, ErrRegistryUnavailable},
+		{&transport.Error{StatusCode: http.StatusTooManyRequests, Errors: []transport.Diagnostic{
+			{Code: transport.TooManyRequestsErrorCode},
+		}}, ErrRegistryUnavailable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, ErrRegistryUnavailable},
+		{&net.DNSError{Err: "no such host", Name: "registry.invalid"}, ErrRegistryUnavailable},
+		{&transport.Error{StatusCode: http.StatusUnauthorized}, nil},
+		{plain, nil},
+	}
+
+	for _, test := range tests {
+		err := classifyRegistryError("quay.io/tools:1", test.err)
+
+		for _, class := range []error{ErrImageNotFound, ErrRegistryUnavailable} {
+			if errors.Is(err, class) != (class == test.expected) {
+				t.Errorf("%v: got %v, expected class %v", test.err, err, test.expected)
+			}
+		}
+
+		if !errors.Is(err, test.err) {
+			t.Errorf("%v: the registry error is not wrapped in %v", test.err, err)
+		}
+	}
+
+	if classifyRegistryError("quay.io/tools:1", nil) != nil {
+		t.Error("no error should stay no error")
+	}
+
+	// an image not found is not retried
+	attempts := 0
+
+	err := withRetries("quay.io/tools:1", func() error {
+		attempts++
+
+		return &transport.Error{StatusCode: http.StatusNotFound}
+	})
+	if !errors.Is(err, ErrImageNotFound) || attempts != 1 {
+		t.Errorf("got %v after %d attempts, expected %v after one", err, attempts, ErrImageNotFound)
+	}
+}
@@ -0,0 +1,255 @@
+package imageutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// cosignSignatureAnnotation is the layer annotation holding the base64
+// encoded signature of a cosign simple-signing payload.
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// ErrSignatureNotVerified is returned when no valid signature can be found
+// for an image.
+var ErrSignatureNotVerified = errors.New("no valid signature found for image")
+
+// simpleSigningPayload is the subset of the containers simple-signing payload
+// we need to bind a signature to an image manifest.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// VerifySignature will verify that input image, previously pulled in ImageDir,
+// carries a valid cosign signature made with the key in publicKeyPath.
+// The signature is looked up in the registry, using the cosign tag convention
+// sha256-<digest>.sig, and it has to reference either the pulled manifest or
+// the index it was resolved from.
+// Any failure in looking up or verifying the signature is returned as error,
+// so that callers fail closed.
+func VerifySignature(image string, publicKeyPath string) error {
+	err := checkOnline("cannot look up the signature of %s", image)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := readPublicKey(publicKeyPath)
+	if err != nil {
+		return err
+	}
+
+	imageDir := GetPath(image)
+
+	imageName, err := fileutils.ReadFile(filepath.Join(imageDir, "image_name"))
+	if err != nil {
+		return err
+	}
+
+	rawManifest, err := fileutils.ReadFile(filepath.Join(imageDir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+
+	ref, err := name.ParseReference(strings.TrimSpace(string(imageName)))
+	if err != nil {
+		return err
+	}
+
+	// digests we accept a signature for: the manifest we pulled and,
+	// if the reference points to an index, the index itself.
+	manifestDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(rawManifest))
+	allowedDigests := []string{manifestDigest}
+
+	remoteDigest, err := crane.Digest(ref.Name())
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return err
+	}
+
+	if remoteDigest != manifestDigest {
+		contains, err := indexContains(ref.Context().Digest(remoteDigest).String(), manifestDigest)
+		if err != nil {
+			return err
+		}
+
+		if !contains {
+			return fmt.Errorf("%w: %s no longer resolves to the pulled manifest %s",
+				ErrSignatureNotVerified, ref.Name(), manifestDigest)
+		}
+
+		allowedDigests = append(allowedDigests, remoteDigest)
+	}
+
+	for _, digest := range allowedDigests {
+		sigTag := ref.Context().Tag(strings.Replace(digest, ":", "-", 1) + ".sig")
+
+		logging.LogDebug("looking up signature %s", sigTag.String())
+
+		sigManifestFile, err := crane.Manifest(sigTag.String())
+		if err != nil {
+			logging.LogDebug("no signature found in %s: %+v", sigTag.String(), err)
+
+			continue
+		}
+
+		var sigManifest v1.Manifest
+
+		err = json.Unmarshal(sigManifestFile, &sigManifest)
+		if err != nil {
+			return err
+		}
+
+		for _, layer := range sigManifest.Layers {
+			err = verifySignatureLayer(ref.Context(), layer, digest, publicKey)
+			if err != nil {
+				logging.LogDebug("invalid signature layer %s: %+v", layer.Digest.String(), err)
+
+				continue
+			}
+
+			logging.Log("verified signature for %s", digest)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrSignatureNotVerified, ref.Name())
+}
+
+// ----------------------------------------------------------------------------
+
+// readPublicKey will read a PEM encoded PKIX public key from input path.
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	keyFile, err := fileutils.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyFile)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// indexContains returns whether the index at input reference lists a
+// manifest with input digest.
+func indexContains(indexRef string, digest string) (bool, error) {
+	indexFile, err := crane.Manifest(indexRef)
+	if err != nil {
+		return false, err
+	}
+
+	var index v1.IndexManifest
+
+	err = json.Unmarshal(indexFile, &index)
+	if err != nil {
+		return false, err
+	}
+
+	for _, manifest := range index.Manifests {
+		if manifest.Digest.String() == digest {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// verifySignatureLayer will download the simple-signing payload described by
+// input layer, verify its signature with input key and ensure it's bound to
+// input digest.
+func verifySignatureLayer(
+	repo name.Repository,
+	layer v1.Descriptor,
+	digest string,
+	publicKey crypto.PublicKey,
+) error {
+	encodedSignature, ok := layer.Annotations[cosignSignatureAnnotation]
+	if !ok {
+		return errors.New("missing signature annotation")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return err
+	}
+
+	payloadLayer, err := crane.PullLayer(repo.Digest(layer.Digest.String()).String())
+	if err != nil {
+		return err
+	}
+
+	payloadReader, err := payloadLayer.Compressed()
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = payloadReader.Close() }()
+
+	payload, err := io.ReadAll(payloadReader)
+	if err != nil {
+		return err
+	}
+
+	payloadDigest := sha256.Sum256(payload)
+	if fmt.Sprintf("sha256:%x", payloadDigest) != layer.Digest.String() {
+		return errors.New("payload digest mismatch")
+	}
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, payloadDigest[:], signature) {
+			return errors.New("invalid ecdsa signature")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, payloadDigest[:], signature)
+		if err != nil {
+			return err
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, signature) {
+			return errors.New("invalid ed25519 signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+
+	var simpleSigning simpleSigningPayload
+
+	err = json.Unmarshal(payload, &simpleSigning)
+	if err != nil {
+		return err
+	}
+
+	if simpleSigning.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signature is for %s, not %s",
+			simpleSigning.Critical.Image.DockerManifestDigest, digest)
+	}
+
+	return nil
+}
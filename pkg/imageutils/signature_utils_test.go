@@ -0,0 +1,218 @@
+package imageutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// testRegistry is a minimal read-only registry serving manifests and blobs
+// by path, e.g. "test/app/manifests/1" or "test/app/blobs/sha256:...".
+type testRegistry map[string][]byte
+
+func (registry testRegistry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	path := strings.TrimPrefix(request.URL.Path, "/v2/")
+	if path == "" {
+		return
+	}
+
+	content, ok := registry[path]
+	if !ok {
+		http.NotFound(writer, request)
+
+		return
+	}
+
+	mediaType := "application/octet-stream"
+	if strings.Contains(path, "/manifests/") {
+		mediaType = string(types.OCIManifestSchema1)
+	}
+
+	writer.Header().Set("Content-Type", mediaType)
+	writer.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	writer.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(content)))
+
+	if request.Method != http.MethodHead {
+		_, _ = writer.Write(content)
+	}
+}
+
+// signaturePayload returns a simple-signing payload bound to input digest.
+func signaturePayload(t *testing.T, digest string) []byte {
+	t.Helper()
+
+	var payload simpleSigningPayload
+
+	payload.Critical.Image.DockerManifestDigest = digest
+	payload.Critical.Type = "cosign container image signature"
+
+	content, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+// signatureManifest returns the manifest of a cosign signature made of
+// input payload and signature.
+func signatureManifest(t *testing.T, payload []byte, signature []byte) []byte {
+	t.Helper()
+
+	digest, err := v1.NewHash(fmt.Sprintf("sha256:%x", sha256.Sum256(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := v1.NewHash(fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("{}"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := json.Marshal(v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config:        v1.Descriptor{MediaType: types.OCIConfigJSON, Size: 2, Digest: config},
+		Layers: []v1.Descriptor{{
+			MediaType:   "application/vnd.dev.cosign.simplesigning.v1+json",
+			Size:        int64(len(payload)),
+			Digest:      digest,
+			Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content
+}
+
+func TestVerifySignature(t *testing.T) {
+	previous := ImageDir
+	ImageDir = t.TempDir()
+
+	t.Cleanup(func() { ImageDir = previous })
+
+	// throwaway keys, one signing the fixtures and one unrelated
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKeyPath := filepath.Join(t.TempDir(), "cosign.pub")
+
+	err = os.WriteFile(publicKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`)
+	manifestDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	sigTag := strings.Replace(manifestDigest, ":", "-", 1) + ".sig"
+
+	payload := signaturePayload(t, manifestDigest)
+	payloadDigest := sha256.Sum256(payload)
+
+	signature, err := ecdsa.SignASN1(rand.Reader, key, payloadDigest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherSignature, err := ecdsa.SignASN1(rand.Reader, otherKey, payloadDigest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a payload altered after signing
+	tampered := signaturePayload(t, manifestDigest)
+	tampered = append(tampered[:len(tampered)-1], []byte(`,"optional":{"tampered":true}}`)...)
+
+	// a valid signature, but of another manifest
+	otherPayload := signaturePayload(t, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other"))))
+	otherPayloadDigest := sha256.Sum256(otherPayload)
+
+	otherManifestSignature, err := ecdsa.SignASN1(rand.Reader, key, otherPayloadDigest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		signature []byte
+		valid     bool
+	}{
+		{"signed", payload, signature, true},
+		{"tampered payload", tampered, signature, false},
+		{"other key", payload, otherSignature, false},
+		{"other manifest", otherPayload, otherManifestSignature, false},
+		{"bad signature", payload, []byte("not a signature"), false},
+	}
+
+	for _, test := range tests {
+		registry := testRegistry{
+			"test/app/manifests/1":                                               manifest,
+			"test/app/manifests/" + manifestDigest:                               manifest,
+			"test/app/manifests/" + sigTag:                                       signatureManifest(t, test.payload, test.signature),
+			fmt.Sprintf("test/app/blobs/sha256:%x", sha256.Sum256(test.payload)): test.payload,
+		}
+
+		server := httptest.NewServer(registry)
+
+		image := strings.TrimPrefix(server.URL, "http://") + "/test/app:1"
+
+		err = os.MkdirAll(GetPath(image), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(filepath.Join(GetPath(image), "image_name"), []byte(image), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(filepath.Join(GetPath(image), "manifest.json"), manifest, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = VerifySignature(image, publicKeyPath)
+
+		server.Close()
+
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		if !test.valid && !errors.Is(err, ErrSignatureNotVerified) {
+			t.Errorf("%s: got %v, expected %v", test.name, err, ErrSignatureNotVerified)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package imageutils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+)
+
+// ContainersStoragePrefix marks the references to images in the local
+// containers-storage of podman and buildah, like
+// containers-storage:localhost/app:latest.
+const ContainersStoragePrefix = "containers-storage:"
+
+// ErrNoStorageExporter is returned when no tool able to export images from
+// containers-storage is installed.
+var ErrNoStorageExporter = errors.New("podman or skopeo is required to read images from containers-storage")
+
+// storageExporter is a tool exporting an image of containers-storage to an
+// OCI layout directory.
+type storageExporter struct {
+	name    string
+	command func(ref string, dir string) *exec.Cmd
+}
+
+// storageExporters are tried in order, the first one installed is used.
+// Exporting through them instead of reading the storage directly works with
+// any storage driver and configuration.
+var storageExporters = []storageExporter{
+	{
+		name: "podman",
+		command: func(ref string, dir string) *exec.Cmd {
+			return exec.Command("podman", "image", "save", "--format", "oci-dir", "-o", dir, ref)
+		},
+	},
+	{
+		name: "skopeo",
+		command: func(ref string, dir string) *exec.Cmd {
+			return exec.Command("skopeo", "copy", ContainersStoragePrefix+ref, "oci:"+dir)
+		},
+	},
+}
+
+// IsContainersStorage returns whether input image refers to an image in the
+// local containers-storage, see ContainersStoragePrefix.
+func IsContainersStorage(image string) bool {
+	return strings.HasPrefix(image, ContainersStoragePrefix)
+}
+
+// pullContainersStorage will save input containers-storage image to
+// ImageDir, like Pull does for registry images. No registry is contacted,
+// so it works offline. The image has to be allowed by the containers-storage
+// transport of the policy in PolicyFile, if any.
+func pullContainersStorage(image string, quiet bool, noCache bool) (string, error) {
+	_, err := checkPolicyBeforePull(image)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	if !quiet {
+		fmt.Printf("exporting image from containers-storage: %s\n", image)
+	}
+
+	imageManifest, cleanup, err := loadContainersStorage(image)
+	if err != nil {
+		logging.LogError("%+v", err)
+
+		return "", err
+	}
+
+	defer cleanup()
+
+	err = saveImage(image, imageManifest, quiet, noCache)
+	if err != nil {
+		return "", err
+	}
+
+	if !quiet {
+		fmt.Println("done")
+	}
+
+	return GetID(image), nil
+}
+
+// loadContainersStorage will export input containers-storage image to an
+// OCI layout in a temporary directory of ImageDir, and return the image with
+// the function removing the directory.
+func loadContainersStorage(image string) (v1.Image, func(), error) {
+	ref := strings.TrimPrefix(image, ContainersStoragePrefix)
+	if ref == "" {
+		return nil, nil, fmt.Errorf("invalid image %q: no reference after %s", image, ContainersStoragePrefix)
+	}
+
+	var exporter *storageExporter
+
+	for i := range storageExporters {
+		_, err := exec.LookPath(storageExporters[i].name)
+		if err == nil {
+			exporter = &storageExporters[i]
+
+			break
+		}
+	}
+
+	if exporter == nil {
+		return nil, nil, ErrNoStorageExporter
+	}
+
+	err := os.MkdirAll(ImageDir, os.ModePerm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpDIR, err := os.MkdirTemp(ImageDir, ".containers-storage-")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cleanup := func() { _ = os.RemoveAll(tmpDIR) }
+
+	layoutDIR := filepath.Join(tmpDIR, "oci")
+
+	logging.LogDebug("exporting %s with %s", ref, exporter.name)
+
+	out, err := exporter.command(ref, layoutDIR).CombinedOutput()
+	if err != nil {
+		cleanup()
+
+		return nil, nil, fmt.Errorf("cannot export %s with %s: %w: %s",
+			ref, exporter.name, err, strings.TrimSpace(string(out)))
+	}
+
+	index, err := layout.ImageIndexFromPath(layoutDIR)
+	if err != nil {
+		cleanup()
+
+		return nil, nil, err
+	}
+
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		cleanup()
+
+		return nil, nil, err
+	}
+
+	if len(indexManifest.Manifests) != 1 {
+		cleanup()
+
+		return nil, nil, fmt.Errorf("expected one image exported for %s, found %d",
+			ref, len(indexManifest.Manifests))
+	}
+
+	imageManifest, err := index.Image(indexManifest.Manifests[0].Digest)
+	if err != nil {
+		cleanup()
+
+		return nil, nil, err
+	}
+
+	return imageManifest, cleanup, nil
+}
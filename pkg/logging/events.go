@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// EventsVersion is the version of the event schema, bumped on any change
+// that isn't adding a new event type or payload key.
+const EventsVersion = 1
+
+// The event types, see Event.
+const (
+	// EventPhaseStarted marks the start of a build phase, its payload has
+	// the phase name and any context of the phase.
+	EventPhaseStarted = "phase-started"
+	// EventPhaseFinished marks the end of a build phase, its payload adds
+	// the error to the one of EventPhaseStarted, if the phase failed.
+	EventPhaseFinished = "phase-finished"
+	// EventImagePulled is emitted by the pull command for each image, with
+	// its name and id.
+	EventImagePulled = "image-pulled"
+	// EventImageResolved is emitted by pull --dry-pull for each image, with
+	// its name and the reference pinned by digest.
+	EventImageResolved = "image-resolved"
+	// EventLayerExtracted is emitted for each layer extracted in the rootfs,
+	// or reused from a base snapshot.
+	EventLayerExtracted = "layer-extracted"
+	// EventLog replaces the human log lines, with their level and message.
+	EventLog = "log"
+)
+
+// event is a line of the event stream.
+type event struct {
+	Version int            `json:"version"`
+	Time    string         `json:"time"`
+	Type    string         `json:"type"`
+	Payload map[string]any `json:"payload"`
+}
+
+// events is where the event stream is written, nil unless --json-events is
+// passed.
+var events io.Writer
+
+// eventsLock serializes the lines of the event stream.
+var eventsLock sync.Mutex
+
+// initEvents will enable the event stream on input file descriptor.
+func initEvents(fd int) error {
+	if fd < 0 {
+		return fmt.Errorf("invalid --json-events-fd %d", fd)
+	}
+
+	file := os.NewFile(uintptr(fd), "json-events")
+	if file == nil {
+		return fmt.Errorf("invalid --json-events-fd %d", fd)
+	}
+
+	_, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("invalid --json-events-fd %d: %w", fd, err)
+	}
+
+	SetEvents(file)
+
+	return nil
+}
+
+// SetEvents will write the event stream to input writer, or disable it if
+// nil.
+func SetEvents(writer io.Writer) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+
+	events = writer
+}
+
+// JSONEvents returns whether the event stream is enabled, in which case no
+// human output should be printed.
+func JSONEvents() bool {
+	return events != nil
+}
+
+// Event will emit an event of input type and payload as a line of JSON, if
+// the event stream is enabled.
+func Event(eventType string, payload map[string]any) {
+	if events == nil {
+		return
+	}
+
+	if payload == nil {
+		payload = map[string]any{}
+	}
+
+	line, err := json.Marshal(event{
+		Version: EventsVersion,
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Type:    eventType,
+		Payload: payload,
+	})
+	if err != nil {
+		return
+	}
+
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+
+	_, _ = events.Write(append(line, '\n'))
+}
+
+// Phase will run input function as the build phase of input name, emitting
+// its started and finished events with input payload, and return its error.
+func Phase(name string, payload map[string]any, phase func() error) error {
+	started := map[string]any{"phase": name}
+	for key, value := range payload {
+		started[key] = value
+	}
+
+	Event(EventPhaseStarted, started)
+
+	err := phase()
+
+	finished := map[string]any{}
+	for key, value := range started {
+		finished[key] = value
+	}
+
+	if err != nil {
+		finished["error"] = err.Error()
+	}
+
+	Event(EventPhaseFinished, finished)
+
+	return err
+}
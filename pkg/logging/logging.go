@@ -22,6 +22,11 @@ import (
 // Defaults to warn.
 var loglevel int
 
+// colored represents whether log prefixes are colored.
+// Colors are only used when stderr is a terminal, NO_COLOR is not set and
+// --no-color is not passed.
+var colored bool
+
 const (
 	mute  = 0
 	err   = 1
@@ -60,9 +65,42 @@ func Init(cmd *cobra.Command, _ []string) error {
 		return flagErr
 	}
 
-	level := strings.ToLower(flag)
+	noColor, flagErr := cmd.Flags().GetBool("no-color")
+	if flagErr != nil {
+		return flagErr
+	}
+
+	colored = !noColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stderr)
+
+	jsonEvents, flagErr := cmd.Flags().GetBool("json-events")
+	if flagErr != nil {
+		return flagErr
+	}
+
+	if jsonEvents {
+		// the levels are named in the events, not colored
+		colored = false
+
+		eventsFd, flagErr := cmd.Flags().GetInt("json-events-fd")
+		if flagErr != nil {
+			return flagErr
+		}
+
+		flagErr = initEvents(eventsFd)
+		if flagErr != nil {
+			return flagErr
+		}
+	}
+
+	SetLogLevel(flag)
+
+	return nil
+}
 
-	switch level {
+// SetLogLevel will set the logging level to input level name, defaulting to
+// warn if it's unknown.
+func SetLogLevel(level string) {
+	switch strings.ToLower(level) {
 	case levels[err]:
 		loglevel = err
 	case levels[warn]:
@@ -76,8 +114,6 @@ func Init(cmd *cobra.Command, _ []string) error {
 	default:
 		loglevel = warn
 	}
-
-	return nil
 }
 
 // GetLogLevel returns the logging level currently set.
@@ -194,35 +230,73 @@ func AppendStringToFile(path string, input string) error {
 // LogError will create an error log in the form of:
 // callerfile.go:line [error] message...
 func LogError(format string, v ...any) {
-	filteredLog(err, red+errorString+reset+format, v...)
+	filteredLog(err, colorize(red, errorString), format, v...)
 }
 
 // LogWarning will create a warning log in the form of:
 // callerfile.go:line [warn] message...
 func LogWarning(format string, v ...any) {
-	filteredLog(warn, yellow+warningString+reset+format, v...)
+	filteredLog(warn, colorize(yellow, warningString), format, v...)
 }
 
 // LogDebug will create a debug log in the form of:
 // callerfile.go:line [debug] message...
 func LogDebug(format string, v ...any) {
-	filteredLog(debug, green+debugString+reset+format, v...)
+	filteredLog(debug, colorize(green, debugString), format, v...)
 }
 
 // Log will create a plain log for input string.
 func Log(format string, v ...any) {
-	filteredLog(err, green+infoString+reset+format, v...)
+	filteredLog(err, colorize(green, infoString), format, v...)
+}
+
+// colorize will wrap input string with input color, if colors are enabled.
+func colorize(color string, input string) string {
+	if !colored {
+		return input
+	}
+
+	return color + input + reset
+}
+
+// isTerminal returns whether input file is a terminal.
+func isTerminal(file *os.File) bool {
+	stat, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return stat.Mode()&os.ModeCharDevice != 0
 }
 
 // print logs only if level is <= than the globally set level.
-func filteredLog(level int, format string, inputs ...any) {
+// With the event stream enabled, logs are emitted as EventLog events instead,
+// with the level named by input prefix.
+func filteredLog(level int, prefix string, format string, inputs ...any) {
 	if level <= loglevel {
 		// try to add the filename:line
 		_, file, line, ok := runtime.Caller(2)
 		if ok {
-			file = filepath.Base(file)
+			file = filepath.Base(file) + ":" + strconv.Itoa(line)
+		}
+
+		if JSONEvents() {
+			payload := map[string]any{
+				"level":   strings.Trim(prefix, "[] "),
+				"message": fmt.Sprintf(format, inputs...),
+			}
+			if ok {
+				payload["caller"] = file
+			}
 
-			format = file + ":" + strconv.Itoa(line) + " " + format
+			Event(EventLog, payload)
+
+			return
+		}
+
+		format = prefix + format
+		if ok {
+			format = file + " " + format
 		}
 
 		fmt.Fprintf(os.Stderr, format+"\n", inputs...)
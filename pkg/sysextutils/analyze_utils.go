@@ -0,0 +1,94 @@
+package sysextutils
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// DiffStats describes how much a differential build of Image against
+// ImageSource saves compared to a full build. Sizes are the compressed layer
+// sizes, as listed in the manifests.
+type DiffStats struct {
+	Image       string `json:"image"`
+	ImageSource string `json:"imageSource"`
+	// Layers is the number of layers of Image.
+	Layers int `json:"layers"`
+	// SkippedLayers is the number of layers skipped by a differential build.
+	SkippedLayers int `json:"skippedLayers"`
+	// SharedLayers is the number of leading layers Image and ImageSource
+	// have in common, by digest.
+	SharedLayers int `json:"sharedLayers"`
+	// FullSize is the size of all the layers of Image.
+	FullSize int64 `json:"fullSize"`
+	// SkippedSize is the size of the layers skipped by a differential build.
+	SkippedSize int64 `json:"skippedSize"`
+	// OverlaySize is the size of the layers extracted by a differential build.
+	OverlaySize int64 `json:"overlaySize"`
+	// Suggestion is a short advice on the best approach for this pair.
+	Suggestion string `json:"suggestion"`
+}
+
+// AnalyzeDiff will compare the manifests of input images, both already pulled,
+// and report how effective skipping ImageSource's layers is.
+func AnalyzeDiff(image string, imageSource string) (DiffStats, error) {
+	stats := DiffStats{Image: image, ImageSource: imageSource}
+
+	manifest, err := readManifest(image)
+	if err != nil {
+		return stats, err
+	}
+
+	sourceManifest, err := readManifest(imageSource)
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Layers = len(manifest.Layers)
+	stats.SkippedLayers = len(sourceManifest.Layers)
+
+	for i, layer := range manifest.Layers {
+		stats.FullSize += layer.Size
+
+		if i < len(sourceManifest.Layers) {
+			stats.SkippedSize += layer.Size
+
+			if stats.SharedLayers == i && layer.Digest == sourceManifest.Layers[i].Digest {
+				stats.SharedLayers++
+			}
+		}
+	}
+
+	stats.OverlaySize = stats.FullSize - stats.SkippedSize
+
+	switch {
+	case stats.SkippedLayers >= stats.Layers:
+		stats.Suggestion = "the image adds no layers on top of the source, a differential build would be empty"
+	case stats.SharedLayers < stats.SkippedLayers:
+		stats.Suggestion = "the image is not built on top of the source, skipping layers would drop unrelated content: " +
+			"build without --image-source"
+	case stats.SkippedSize == 0:
+		stats.Suggestion = "the source layers are empty, a differential build saves nothing"
+	default:
+		stats.Suggestion = "the image is built on top of the source, skipping its layers is effective"
+	}
+
+	return stats, nil
+}
+
+// readManifest returns the manifest saved for input image.
+func readManifest(image string) (v1.Manifest, error) {
+	var manifest v1.Manifest
+
+	manifestFile, err := fileutils.ReadFile(filepath.Join(imageutils.GetPath(image), "manifest.json"))
+	if err != nil {
+		return manifest, err
+	}
+
+	err = json.Unmarshal(manifestFile, &manifest)
+
+	return manifest, err
+}
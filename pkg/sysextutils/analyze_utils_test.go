@@ -0,0 +1,61 @@
+package sysextutils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeDiff(t *testing.T) {
+	withTestDirs(t)
+
+	base := []testFile{{Path: "usr/lib/base", Content: strings.Repeat("base\n", 1000)}}
+	top := []testFile{{Path: "usr/bin/tool", Content: "tool\n"}}
+	other := []testFile{{Path: "usr/lib/other", Content: "other\n"}}
+
+	writeTestImage(t, "localhost/base:1", nil, base)
+	writeTestImage(t, "localhost/other:1", nil, other)
+	writeTestImage(t, "localhost/app:1", nil, base, top)
+
+	manifest, err := readManifest("localhost/app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseSize, topSize := manifest.Layers[0].Size, manifest.Layers[1].Size
+
+	tests := []struct {
+		source     string
+		expected   DiffStats
+		suggestion string
+	}{
+		{"localhost/base:1", DiffStats{Layers: 2, SkippedLayers: 1, SharedLayers: 1,
+			FullSize: baseSize + topSize, SkippedSize: baseSize, OverlaySize: topSize}, "effective"},
+		{"localhost/other:1", DiffStats{Layers: 2, SkippedLayers: 1, SharedLayers: 0,
+			FullSize: baseSize + topSize, SkippedSize: baseSize, OverlaySize: topSize}, "without --image-source"},
+		{"localhost/app:1", DiffStats{Layers: 2, SkippedLayers: 2, SharedLayers: 2,
+			FullSize: baseSize + topSize, SkippedSize: baseSize + topSize, OverlaySize: 0}, "would be empty"},
+	}
+
+	for _, test := range tests {
+		stats, err := AnalyzeDiff("localhost/app:1", test.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(stats.Suggestion, test.suggestion) {
+			t.Errorf("%s: got suggestion %q, expected %q", test.source, stats.Suggestion, test.suggestion)
+		}
+
+		test.expected.Image, test.expected.ImageSource, test.expected.Suggestion =
+			"localhost/app:1", test.source, stats.Suggestion
+
+		if stats != test.expected {
+			t.Errorf("%s: got %+v, expected %+v", test.source, stats, test.expected)
+		}
+	}
+
+	_, err = AnalyzeDiff("localhost/app:1", "localhost/missing:1")
+	if err == nil {
+		t.Error("a source not pulled should be an error")
+	}
+}
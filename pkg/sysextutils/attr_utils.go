@@ -0,0 +1,87 @@
+package sysextutils
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// mergeAttributes will merge the chattr attributes of an upper layer into
+// the ones of the layers below it, files without attributes are dropped.
+func mergeAttributes(attributes map[string]string, layerAttributes map[string]string) {
+	for path, attribute := range layerAttributes {
+		if attribute == "" {
+			delete(attributes, path)
+
+			continue
+		}
+
+		attributes[path] = attribute
+	}
+}
+
+// applyAttributes will set input chattr attributes on the files of input raw
+// image, mounted read-write, that are present in input rootfs it was packed
+// from. Symlinks and special files are skipped, as they can't carry them, and
+// so are paths going through a symlink, which could point outside the image.
+// It returns the number of files changed.
+func applyAttributes(rawFile string, rootfsDIR string, attributes map[string]string) (int, error) {
+	paths := []string{}
+
+	for path, attribute := range attributes {
+		if attribute == "" || !isPlainPath(rootfsDIR, path) {
+			continue
+		}
+
+		paths = append(paths, path)
+	}
+
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	sort.Strings(paths)
+
+	mountDIR, unmount, err := mountRawWritable(rawFile)
+	if err != nil {
+		return 0, err
+	}
+
+	defer unmount()
+
+	count := 0
+
+	for _, path := range paths {
+		if !isPlainPath(mountDIR, path) {
+			continue
+		}
+
+		logging.LogDebug("setting attributes %s on /%s", attributes[path], path)
+
+		out, err := exec.Command("chattr", "+"+attributes[path], filepath.Join(mountDIR, path)).CombinedOutput()
+		if err != nil {
+			return 0, packToolError("chattr", err, out)
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// isPlainPath returns whether input path, relative to input root, is a
+// regular file or a directory reached without following any symlink.
+func isPlainPath(root string, path string) bool {
+	resolved, links, err := fileutils.ResolveInRootfs(root, path)
+	if err != nil || len(links) > 0 {
+		return false
+	}
+
+	info, err := os.Lstat(filepath.Join(root, resolved))
+
+	return err == nil && (info.Mode().IsRegular() || info.IsDir())
+}
@@ -0,0 +1,120 @@
+package sysextutils
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeAttributes(t *testing.T) {
+	attributes := map[string]string{}
+
+	mergeAttributes(attributes, map[string]string{"usr/bin/a": "i", "usr/bin/b": "a", "usr/bin/c": ""})
+	mergeAttributes(attributes, map[string]string{"usr/bin/a": "", "usr/bin/b": "A"})
+
+	expected := map[string]string{"usr/bin/b": "A"}
+	if !reflect.DeepEqual(attributes, expected) {
+		t.Errorf("got %v, expected %v", attributes, expected)
+	}
+}
+
+func TestIsPlainPath(t *testing.T) {
+	outside := t.TempDir()
+
+	root := t.TempDir()
+
+	for _, dir := range []string{"usr/bin", "usr/real"} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, file := range []string{filepath.Join(root, "usr/bin/tool"), filepath.Join(outside, "shadow")} {
+		err := os.WriteFile(file, nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for link, target := range map[string]string{
+		"usr/evil":      outside,
+		"usr/link":      "real",
+		"usr/bin/alias": "tool",
+	} {
+		err := os.Symlink(target, filepath.Join(root, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, plain := range map[string]bool{
+		"usr/bin/tool":    true,
+		"usr/bin":         true,
+		"usr/bin/alias":   false,
+		"usr/evil/shadow": false,
+		"usr/link":        false,
+		"usr/missing":     false,
+	} {
+		if isPlainPath(root, path) != plain {
+			t.Errorf("isPlainPath(%s) should be %v", path, plain)
+		}
+	}
+}
+
+func TestCreateSysextPreserveAttrs(t *testing.T) {
+	requireTools(t, "mkfs.ext4", "chattr", "lsattr")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/attrs:1", nil, []testFile{
+		{Path: "usr/lib/locked", Content: "locked\n", Flags: "schg"},
+		{Path: "usr/lib/log", Content: "log\n", Flags: "uappnd,nodump"},
+		{Path: "usr/lib/plain", Content: "plain\n"},
+	})
+
+	tests := []struct {
+		preserve bool
+		expected map[string]string
+	}{
+		{true, map[string]string{"usr/lib/locked": "i", "usr/lib/log": "a,d", "usr/lib/plain": ""}},
+		{false, map[string]string{"usr/lib/locked": "", "usr/lib/log": "", "usr/lib/plain": ""}},
+	}
+
+	for _, test := range tests {
+		err := CreateSysext(CreateOptions{Image: "localhost/attrs:1", Name: "attrs", Fs: "ext4",
+			PreserveAttrs: test.preserve})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mountDIR, unmount, err := mountRaw(GetRawPath("attrs"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for path, attributes := range test.expected {
+			out, err := exec.Command("lsattr", "-d", filepath.Join(mountDIR, path)).CombinedOutput()
+			if err != nil {
+				unmount()
+				t.Fatalf("%s: %s", path, out)
+			}
+
+			flags, _, _ := strings.Cut(string(out), " ")
+
+			for _, attribute := range strings.Split(attributes, ",") {
+				if attribute != "" && !strings.Contains(flags, attribute) {
+					t.Errorf("preserve %v: %s has attributes %s, expected %s", test.preserve, path, flags, attribute)
+				}
+			}
+
+			if attributes == "" && strings.ContainsAny(flags, "iadAS") {
+				t.Errorf("preserve %v: %s has attributes %s, expected none", test.preserve, path, flags)
+			}
+		}
+
+		unmount()
+	}
+}
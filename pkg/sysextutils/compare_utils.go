@@ -0,0 +1,144 @@
+package sysextutils
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+)
+
+// FileChange is a path differing between two sysexts, with the digests of
+// its old and new versions. Directories have no digest, and symlinks use
+// their target instead.
+type FileChange struct {
+	Path      string `json:"path"`
+	OldDigest string `json:"oldDigest,omitempty"`
+	NewDigest string `json:"newDigest,omitempty"`
+}
+
+// Comparison lists the paths added, removed and changed between two sysexts.
+type Comparison struct {
+	Added   []FileChange `json:"added"`
+	Removed []FileChange `json:"removed"`
+	Changed []FileChange `json:"changed"`
+}
+
+// CompareSysexts will compare the content of the old and new sysexts, each
+// one being the name of a sysext in SysextDir, a raw image, loop-mounted
+// read-only, or a rootfs directory.
+func CompareSysexts(oldTarget string, newTarget string) (Comparison, error) {
+	oldRootfs, oldUnmount, err := openSysext(oldTarget)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	defer oldUnmount()
+
+	newRootfs, newUnmount, err := openSysext(newTarget)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	defer newUnmount()
+
+	oldFiles, err := listDigests(oldRootfs)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	newFiles, err := listDigests(newRootfs)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	comparison := Comparison{Added: []FileChange{}, Removed: []FileChange{}, Changed: []FileChange{}}
+
+	for path, newDigest := range newFiles {
+		oldDigest, found := oldFiles[path]
+
+		switch {
+		case !found:
+			comparison.Added = append(comparison.Added, FileChange{Path: path, NewDigest: newDigest})
+		case oldDigest != newDigest:
+			comparison.Changed = append(comparison.Changed,
+				FileChange{Path: path, OldDigest: oldDigest, NewDigest: newDigest})
+		}
+	}
+
+	for path, oldDigest := range oldFiles {
+		if _, found := newFiles[path]; !found {
+			comparison.Removed = append(comparison.Removed, FileChange{Path: path, OldDigest: oldDigest})
+		}
+	}
+
+	for _, changes := range [][]FileChange{comparison.Added, comparison.Removed, comparison.Changed} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	}
+
+	return comparison, nil
+}
+
+// openSysext returns the rootfs of input target, which can be the name of a
+// sysext in SysextDir, a raw image or a rootfs directory, and the function to
+// call when done with it.
+// Raw images are loop-mounted read-only.
+func openSysext(target string) (string, func(), error) {
+	if !fileutils.Exist(target) && fileutils.Exist(GetRawPath(target)) {
+		target = GetRawPath(target)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return "", nil, fmt.Errorf("sysext %s not found: %w", target, err)
+	}
+
+	if info.IsDir() {
+		return target, func() {}, nil
+	}
+
+	return mountRaw(target)
+}
+
+// listDigests returns the paths in input rootfs, relative to it, with the
+// sha256 of regular files and the target of symlinks.
+func listDigests(rootfs string) (map[string]string, error) {
+	files := map[string]string{}
+
+	err := filepath.WalkDir(rootfs, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == rootfs {
+			return nil
+		}
+
+		relative, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+
+		digest := ""
+
+		switch {
+		case entry.Type().IsRegular():
+			digest = "sha256:" + fileutils.GetFileDigest(path)
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+
+			digest = "symlink:" + target
+		}
+
+		files["/"+relative] = digest
+
+		return nil
+	})
+
+	return files, err
+}
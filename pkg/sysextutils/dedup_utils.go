@@ -0,0 +1,264 @@
+package sysextutils
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// DedupSchemaVersion is the version of the DedupManifest format, it's only
+// increased on incompatible changes.
+const DedupSchemaVersion = 1
+
+// DedupManifest lists the files of a sysext identical to files of a reference
+// image, like the base image of the devices it's deployed to, so that a
+// deployment step can hardlink or reflink them instead of storing them twice.
+type DedupManifest struct {
+	// SchemaVersion is DedupSchemaVersion.
+	SchemaVersion int `json:"schemaVersion"`
+	// Name is the name of the sysext.
+	Name string `json:"name"`
+	// Reference and ReferenceDigest are the image the files were compared to.
+	Reference       string `json:"reference"`
+	ReferenceDigest string `json:"referenceDigest"`
+	// SharedSize is the total size of Files.
+	SharedSize int64 `json:"sharedSize"`
+	// Files are the shared files, sorted by path.
+	Files []DedupFile `json:"files"`
+}
+
+// DedupFile is a file of a sysext identical to one of the reference image.
+type DedupFile struct {
+	// Path is the absolute path of the file in the sysext.
+	Path string `json:"path"`
+	// ReferencePath is the absolute path of the identical file in the
+	// reference image, usually the same as Path.
+	ReferencePath string `json:"referencePath"`
+	// Sha256 and Size describe the content of both files.
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// GetDedupPath returns the path of the DedupManifest of given sysext name.
+func GetDedupPath(name string) string {
+	return filepath.Join(SysextDir, name+".dedup.json")
+}
+
+// dedupIndex is the extracted rootfs of a reference image, with its files
+// indexed by size, so that only the files of a sysext with a candidate of
+// the same size are hashed.
+type dedupIndex struct {
+	image     string
+	digest    string
+	rootfsDIR string
+	// bySize maps sizes to the paths of the reference files, relative to
+	// rootfsDIR.
+	bySize map[int64][]string
+	// digests caches the digests of the reference files already hashed.
+	digests map[string]string
+}
+
+// newDedupIndex will extract the rootfs of input reference image, which must
+// be pulled already, and index the regular files of its sysextDirs, the only
+// ones a sysext can share with it. Call remove once done.
+func newDedupIndex(image string) (*dedupIndex, error) {
+	manifest, err := readManifest(image)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := imageutils.GetDigest(image)
+	if err != nil {
+		return nil, err
+	}
+
+	rootfsDIR, err := extractBaseRootfs(image, manifest.Layers, ".dedup-base", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &dedupIndex{
+		image:     image,
+		digest:    digest,
+		rootfsDIR: rootfsDIR,
+		bySize:    map[int64][]string{},
+		digests:   map[string]string{},
+	}
+
+	err = walkRegularFiles(rootfsDIR, func(relative string, info fs.FileInfo) {
+		index.bySize[info.Size()] = append(index.bySize[info.Size()], relative)
+	})
+	if err != nil {
+		index.remove()
+
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// remove will delete the extracted rootfs of the reference image.
+func (index *dedupIndex) remove() {
+	_ = os.RemoveAll(index.rootfsDIR)
+}
+
+// find returns the path, relative to the reference rootfs, of a reference
+// file identical to the one at input path, relative to rootfsDIR, along with
+// its digest: same content, permissions and owner, so that linking one to
+// the other changes nothing. The reference file at the same path is
+// preferred.
+func (index *dedupIndex) find(rootfsDIR string, relative string, size int64) (string, string, bool) {
+	candidates := index.bySize[size]
+	if len(candidates) == 0 {
+		return "", "", false
+	}
+
+	var stat syscall.Stat_t
+
+	err := syscall.Lstat(filepath.Join(rootfsDIR, relative), &stat)
+	if err != nil {
+		return "", "", false
+	}
+
+	digest := fileutils.GetFileDigest(filepath.Join(rootfsDIR, relative))
+	if digest == "" {
+		return "", "", false
+	}
+
+	ordered := []string{}
+
+	for _, candidate := range candidates {
+		if candidate == relative {
+			ordered = append([]string{candidate}, ordered...)
+		} else {
+			ordered = append(ordered, candidate)
+		}
+	}
+
+	for _, candidate := range ordered {
+		var candidateStat syscall.Stat_t
+
+		err = syscall.Lstat(filepath.Join(index.rootfsDIR, candidate), &candidateStat)
+		if err != nil || !sameModeAndOwner(stat, candidateStat) {
+			continue
+		}
+
+		candidateDigest, cached := index.digests[candidate]
+		if !cached {
+			candidateDigest = fileutils.GetFileDigest(filepath.Join(index.rootfsDIR, candidate))
+			index.digests[candidate] = candidateDigest
+		}
+
+		if candidateDigest == digest {
+			return candidate, digest, true
+		}
+	}
+
+	return "", "", false
+}
+
+// writeDedupManifest will write the DedupManifest of the sysext of input
+// name, built from input rootfs, against input reference index. Without a
+// reference, a manifest left by a previous build is removed instead.
+func writeDedupManifest(name string, rootfsDIR string, index *dedupIndex) error {
+	path := GetDedupPath(name)
+
+	if index == nil {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	manifest := DedupManifest{
+		SchemaVersion:   DedupSchemaVersion,
+		Name:            name,
+		Reference:       index.image,
+		ReferenceDigest: index.digest,
+		Files:           []DedupFile{},
+	}
+
+	err := walkRegularFiles(rootfsDIR, func(relative string, info fs.FileInfo) {
+		referencePath, digest, found := index.find(rootfsDIR, relative, info.Size())
+		if !found {
+			return
+		}
+
+		manifest.Files = append(manifest.Files, DedupFile{
+			Path:          "/" + relative,
+			ReferencePath: "/" + referencePath,
+			Sha256:        digest,
+			Size:          info.Size(),
+		})
+		manifest.SharedSize += info.Size()
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+
+	logging.Log("%d files (%d bytes) shared with %s, writing %s",
+		len(manifest.Files), manifest.SharedSize, index.image, path)
+
+	manifestFile, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutils.WriteFile(path, append(manifestFile, '\n'), 0o644)
+}
+
+// walkRegularFiles will call input function for each non-empty regular file
+// in the sysextDirs of input rootfs, with its path relative to the rootfs.
+func walkRegularFiles(rootfsDIR string, visit func(relative string, info fs.FileInfo)) error {
+	for _, dir := range sysextDirs {
+		root := filepath.Join(rootfsDIR, dir)
+
+		if !fileutils.Exist(root) {
+			continue
+		}
+
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			if info.Size() == 0 {
+				return nil
+			}
+
+			relative, err := filepath.Rel(rootfsDIR, path)
+			if err != nil {
+				return err
+			}
+
+			visit(relative, info)
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package sysextutils
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDedupIndexFind(t *testing.T) {
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/reference:1", nil, []testFile{
+		{Path: "usr/lib/libshared.so", Content: "shared content", Mode: 0o755},
+		{Path: "usr/lib/libmoved.so", Content: "moved content", Mode: 0o644},
+		{Path: "usr/lib/libmode.so", Content: "mode content", Mode: 0o644},
+		{Path: "usr/lib/libowner.so", Content: "owner content", Mode: 0o644, UID: 1000},
+		{Path: "etc/config", Content: "config content"},
+	})
+
+	index, err := newDedupIndex("localhost/reference:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer index.remove()
+
+	rootfs := t.TempDir()
+
+	for path, mode := range map[string]os.FileMode{
+		"usr/lib/libshared.so":  0o755,
+		"usr/lib/other/moved":   0o644,
+		"usr/lib/libmode.so":    0o755,
+		"usr/lib/libowner.so":   0o644,
+		"usr/share/config-copy": 0o644,
+	} {
+		content := map[string]string{
+			"usr/lib/libshared.so":  "shared content",
+			"usr/lib/other/moved":   "moved content",
+			"usr/lib/libmode.so":    "mode content",
+			"usr/lib/libowner.so":   "owner content",
+			"usr/share/config-copy": "config content",
+		}[path]
+
+		writeTestFile(t, rootfs, path, content, mode)
+	}
+
+	found := map[string]string{}
+
+	err = walkRegularFiles(rootfs, func(relative string, info fs.FileInfo) {
+		referencePath, _, ok := index.find(rootfs, relative, info.Size())
+		if ok {
+			found[relative] = referencePath
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"usr/lib/libshared.so": "usr/lib/libshared.so",
+		"usr/lib/other/moved":  "usr/lib/libmoved.so",
+	}
+
+	// files can only be extracted with another owner as root
+	if os.Geteuid() != 0 {
+		delete(found, "usr/lib/libowner.so")
+	}
+
+	if len(found) != len(expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+
+	for path, referencePath := range expected {
+		if found[path] != referencePath {
+			t.Errorf("%s: got %q, expected %q", path, found[path], referencePath)
+		}
+	}
+}
+
+func TestExtractBaseRootfsIsUnique(t *testing.T) {
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/reference:1", nil, []testFile{{Path: "usr/bin/tool", Content: "tool"}})
+
+	manifest, err := readManifest("localhost/reference:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := extractBaseRootfs("localhost/reference:1", manifest.Layers, ".dedup-base", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := extractBaseRootfs("localhost/reference:1", manifest.Layers, ".dedup-base", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second {
+		t.Fatalf("two extractions share %s", first)
+	}
+
+	err = os.RemoveAll(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(first, "usr/bin/tool"))
+	if err != nil {
+		t.Errorf("removing a base rootfs affected another one: %v", err)
+	}
+}
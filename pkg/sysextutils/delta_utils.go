@@ -0,0 +1,178 @@
+package sysextutils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// deltaMagic is the first line of a delta file, followed by the sha256 of the
+// old and new raw images, one per line, an empty line and the xdelta3
+// payload:
+//
+//	oci-sysext-delta 1
+//	old <sha256>
+//	new <sha256>
+//
+//	<xdelta3 data>
+const deltaMagic = "oci-sysext-delta 1"
+
+// ErrDeltaMismatch is returned when a delta doesn't apply to the given raw
+// image, or doesn't produce the expected one.
+var ErrDeltaMismatch = errors.New("delta mismatch")
+
+// CreateDelta will write in output a binary delta turning the oldRaw image
+// into newRaw, so that only the delta needs to be transferred to update it.
+// The checksums of both images are stored in the delta header, to be verified
+// when applying it.
+func CreateDelta(oldRaw string, newRaw string, output string) error {
+	_, err := exec.LookPath("xdelta3")
+	if err != nil {
+		return fmt.Errorf("creating deltas needs xdelta3: %w", err)
+	}
+
+	oldDigest, newDigest := fileutils.GetFileDigest(oldRaw), fileutils.GetFileDigest(newRaw)
+	if oldDigest == "" || newDigest == "" {
+		return fmt.Errorf("cannot read %s or %s", oldRaw, newRaw)
+	}
+
+	tmpOutput := output + ".tmp"
+
+	deltaFile, err := os.Create(tmpOutput)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.Remove(tmpOutput) }()
+	defer func() { _ = deltaFile.Close() }()
+
+	_, err = fmt.Fprintf(deltaFile, "%s\nold %s\nnew %s\n\n", deltaMagic, oldDigest, newDigest)
+	if err != nil {
+		return err
+	}
+
+	logging.Log("computing delta from %s to %s", oldRaw, newRaw)
+
+	var stderr strings.Builder
+
+	cmd := exec.Command("xdelta3", "-e", "-9", "-c", "-s", oldRaw, newRaw)
+	cmd.Stdout = deltaFile
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		logging.LogError(stderr.String())
+		return err
+	}
+
+	err = deltaFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpOutput, output)
+}
+
+// ApplyDelta will apply input delta to oldRaw, writing the resulting image in
+// output. Both oldRaw and the result are verified against the checksums in
+// the delta header, output is only written if they match.
+func ApplyDelta(oldRaw string, delta string, output string) error {
+	_, err := exec.LookPath("xdelta3")
+	if err != nil {
+		return fmt.Errorf("applying deltas needs xdelta3: %w", err)
+	}
+
+	deltaFile, err := os.Open(delta)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = deltaFile.Close() }()
+
+	reader := bufio.NewReader(deltaFile)
+
+	oldDigest, newDigest, err := readDeltaHeader(reader)
+	if err != nil {
+		return fmt.Errorf("%s: %w", delta, err)
+	}
+
+	if fileutils.GetFileDigest(oldRaw) != oldDigest {
+		return fmt.Errorf("%w: %s is not the image the delta was made from", ErrDeltaMismatch, oldRaw)
+	}
+
+	tmpOutput := output + ".tmp"
+
+	outputFile, err := os.Create(tmpOutput)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.Remove(tmpOutput) }()
+	defer func() { _ = outputFile.Close() }()
+
+	logging.Log("applying delta %s to %s", delta, oldRaw)
+
+	var stderr strings.Builder
+
+	cmd := exec.Command("xdelta3", "-d", "-c", "-s", oldRaw)
+	cmd.Stdin = reader
+	cmd.Stdout = outputFile
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		logging.LogError(stderr.String())
+		return err
+	}
+
+	err = outputFile.Close()
+	if err != nil {
+		return err
+	}
+
+	if fileutils.GetFileDigest(tmpOutput) != newDigest {
+		return fmt.Errorf("%w: the patched image doesn't match the expected checksum", ErrDeltaMismatch)
+	}
+
+	return os.Rename(tmpOutput, output)
+}
+
+// readDeltaHeader will read the header of a delta file, returning the
+// checksums of the old and new images. Reader is left at the start of the
+// xdelta3 payload.
+func readDeltaHeader(reader *bufio.Reader) (string, string, error) {
+	lines := []string{}
+
+	for len(lines) < 4 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return "", "", errors.New("truncated delta header")
+			}
+
+			return "", "", err
+		}
+
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+
+	if lines[0] != deltaMagic {
+		return "", "", errors.New("not an oci-sysext delta")
+	}
+
+	oldDigest, oldFound := strings.CutPrefix(lines[1], "old ")
+	newDigest, newFound := strings.CutPrefix(lines[2], "new ")
+
+	if !oldFound || !newFound || lines[3] != "" {
+		return "", "", errors.New("invalid delta header")
+	}
+
+	return oldDigest, newDigest, nil
+}
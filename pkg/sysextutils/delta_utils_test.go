@@ -0,0 +1,128 @@
+package sysextutils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadDeltaHeader(t *testing.T) {
+	digest := strings.Repeat("a", 64)
+
+	tests := []struct {
+		header string
+		valid  bool
+	}{
+		{deltaMagic + "\nold " + digest + "\nnew " + digest + "\n\npayload", true},
+		{"oci-sysext-delta 2\nold " + digest + "\nnew " + digest + "\n\n", false},
+		{deltaMagic + "\nnew " + digest + "\nold " + digest + "\n\n", false},
+		{deltaMagic + "\nold " + digest + "\nnew " + digest + "\npayload\n", false},
+		{deltaMagic + "\nold " + digest + "\n", false},
+	}
+
+	for _, test := range tests {
+		reader := bufio.NewReader(strings.NewReader(test.header))
+
+		oldDigest, newDigest, err := readDeltaHeader(reader)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: got %v, expected valid %v", test.header, err, test.valid)
+
+			continue
+		}
+
+		if !test.valid {
+			continue
+		}
+
+		if oldDigest != digest || newDigest != digest {
+			t.Errorf("%q: got digests %s and %s", test.header, oldDigest, newDigest)
+		}
+
+		// the reader is left at the payload
+		rest, _ := reader.ReadString('\n')
+		if rest != "payload" {
+			t.Errorf("%q: reader left at %q", test.header, rest)
+		}
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	_, err := exec.LookPath("xdelta3")
+	if err != nil {
+		t.Skip("needs xdelta3")
+	}
+
+	dir := t.TempDir()
+	random := rand.New(rand.NewSource(1))
+
+	oldContent := make([]byte, 1024*1024)
+	random.Read(oldContent)
+
+	// the new image changes a block and grows
+	newContent := append([]byte{}, oldContent...)
+	random.Read(newContent[4096:8192])
+	newContent = append(newContent, bytes.Repeat([]byte("new"), 1000)...)
+
+	oldRaw, newRaw := filepath.Join(dir, "old.raw"), filepath.Join(dir, "new.raw")
+	delta, patched := filepath.Join(dir, "update.delta"), filepath.Join(dir, "patched.raw")
+
+	for path, content := range map[string][]byte{oldRaw: oldContent, newRaw: newContent} {
+		err = os.WriteFile(path, content, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = CreateDelta(oldRaw, newRaw, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ApplyDelta(oldRaw, delta, patched)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := os.ReadFile(patched)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(result, newContent) {
+		t.Fatal("the patched image doesn't match the new one byte-for-byte")
+	}
+
+	// the delta only applies to the image it was made from
+	err = ApplyDelta(newRaw, delta, filepath.Join(dir, "wrong.raw"))
+	if !errors.Is(err, ErrDeltaMismatch) {
+		t.Errorf("got %v applying the delta to another image, expected %v", err, ErrDeltaMismatch)
+	}
+
+	if fileExists(filepath.Join(dir, "wrong.raw")) {
+		t.Error("a mismatching delta should write nothing")
+	}
+
+	// the result is verified against the checksum in the header
+	content, err := os.ReadFile(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := bytes.Replace(content, []byte("new "), []byte("new 0"), 1)
+
+	err = os.WriteFile(delta, tampered, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ApplyDelta(oldRaw, delta, filepath.Join(dir, "tampered.raw"))
+	if !errors.Is(err, ErrDeltaMismatch) {
+		t.Errorf("got %v applying a tampered delta, expected %v", err, ErrDeltaMismatch)
+	}
+}
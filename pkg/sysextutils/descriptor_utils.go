@@ -0,0 +1,97 @@
+package sysextutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+)
+
+// DescriptorSchemaVersion is the version of the Descriptor format, it's only
+// increased on incompatible changes.
+const DescriptorSchemaVersion = 1
+
+// Descriptor is a stable description of a built sysext for deployment tools,
+// unlike Metadata it doesn't expose internal build options.
+type Descriptor struct {
+	// SchemaVersion is DescriptorSchemaVersion.
+	SchemaVersion int `json:"schemaVersion"`
+	// Name is the name of the sysext, its raw image is <Name>.raw.
+	Name string `json:"name"`
+	// Version is the SYSEXT_VERSION_ID of the extension-release, if any.
+	Version string `json:"version,omitempty"`
+	// ID, VersionID and SysextLevel are the fields matched against the host
+	// os-release.
+	ID          string `json:"id"`
+	VersionID   string `json:"versionId,omitempty"`
+	SysextLevel string `json:"sysextLevel,omitempty"`
+	// Architecture is the ARCHITECTURE of the extension-release, if any.
+	Architecture string `json:"architecture,omitempty"`
+	// Scope is the SYSEXT_SCOPE of the extension-release, if any.
+	Scope string `json:"scope,omitempty"`
+	// Sha256 and Size describe the raw image.
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// Fs is the filesystem of the raw image.
+	Fs string `json:"fs"`
+	// Image and ImageDigest are the OCI image the sysext was built from.
+	Image       string `json:"image"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+	// Created is the build time, in RFC3339 format.
+	Created string `json:"created"`
+}
+
+// WriteDescriptor will write at path the descriptor of the sysext built with
+// input metadata and extension-release fields.
+func WriteDescriptor(path string, metadata Metadata, fields []string) error {
+	rawFile := GetRawPath(metadata.Name)
+
+	info, err := os.Stat(rawFile)
+	if err != nil {
+		return err
+	}
+
+	digest := fileutils.GetFileDigest(rawFile)
+	if digest == "" {
+		return fmt.Errorf("cannot compute the digest of %s", rawFile)
+	}
+
+	values := map[string]string{}
+
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		values[key] = value
+	}
+
+	descriptor := Descriptor{
+		SchemaVersion: DescriptorSchemaVersion,
+		Name:          metadata.Name,
+		Version:       values["SYSEXT_VERSION_ID"],
+		ID:            values["ID"],
+		VersionID:     values["VERSION_ID"],
+		SysextLevel:   values["SYSEXT_LEVEL"],
+		Architecture:  values["ARCHITECTURE"],
+		Scope:         values["SYSEXT_SCOPE"],
+		Sha256:        digest,
+		Size:          info.Size(),
+		Fs:            metadata.Fs,
+		Image:         metadata.Image,
+		ImageDigest:   metadata.ImageDigest,
+		Created:       metadata.Created,
+	}
+
+	descriptorFile, err := json.MarshalIndent(descriptor, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return fileutils.WriteFile(path, append(descriptorFile, '\n'), 0o644)
+}
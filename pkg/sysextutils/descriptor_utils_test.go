@@ -0,0 +1,97 @@
+package sysextutils
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteDescriptor(t *testing.T) {
+	withTestDirs(t)
+
+	raw := []byte("raw image content")
+	writeTestFile(t, SysextDir, "tools_1.raw", string(raw), 0o644)
+
+	metadata := Metadata{
+		Name:        "tools",
+		Image:       "quay.io/example/tools:1",
+		ImageDigest: "sha256:" + fmt.Sprintf("%x", sha256.Sum256([]byte("manifest"))),
+		Fs:          "squashfs",
+		Created:     "2026-10-17T12:00:00Z",
+		Options:     CreateOptions{Name: "tools", OutputName: "tools_1.raw", Compression: "zstd"},
+	}
+
+	err := WriteMetadata(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{
+		"ID=fedora", "VERSION_ID=40", "SYSEXT_LEVEL=1.0", "ARCHITECTURE=x86-64",
+		"SYSEXT_SCOPE=initrd", "SYSEXT_VERSION_ID=1.2.3", "EXTENSION_RELOAD_MANAGER=1",
+	}
+
+	path := filepath.Join(t.TempDir(), "deploy/tools.json")
+
+	err = WriteDescriptor(path, metadata, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var descriptor Descriptor
+
+	err = json.Unmarshal(content, &descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Descriptor{
+		SchemaVersion: 1,
+		Name:          "tools",
+		Version:       "1.2.3",
+		ID:            "fedora",
+		VersionID:     "40",
+		SysextLevel:   "1.0",
+		Architecture:  "x86-64",
+		Scope:         "initrd",
+		Sha256:        fmt.Sprintf("%x", sha256.Sum256(raw)),
+		Size:          int64(len(raw)),
+		Fs:            "squashfs",
+		Image:         "quay.io/example/tools:1",
+		ImageDigest:   metadata.ImageDigest,
+		Created:       "2026-10-17T12:00:00Z",
+	}
+
+	if !reflect.DeepEqual(descriptor, expected) {
+		t.Errorf("got descriptor %+v, expected %+v", descriptor, expected)
+	}
+
+	// the build options are not part of the stable format
+	var keys map[string]any
+
+	err = json.Unmarshal(content, &keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := keys["options"]; found || keys["schemaVersion"] != float64(DescriptorSchemaVersion) {
+		t.Errorf("unexpected descriptor:\n%s", content)
+	}
+
+	// without a raw image there is nothing to describe
+	metadata.Name = "missing"
+
+	err = WriteDescriptor(filepath.Join(t.TempDir(), "missing.json"), metadata, fields)
+	if err == nil {
+		t.Error("a descriptor of a missing raw image should fail")
+	}
+}
@@ -0,0 +1,138 @@
+package sysextutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// compressionRatios are the rough ratios between the compressed and the
+// uncompressed size of a typical rootfs for each algorithm, used to estimate
+// the size of compressed images.
+var compressionRatios = map[string]float64{
+	"":     1,
+	"no":   1,
+	"gzip": 0.45,
+	"zlib": 0.45,
+	"lzo":  0.5,
+	"lz4":  0.55,
+	"zstd": 0.4,
+	"xz":   0.35,
+	"lzma": 0.35,
+}
+
+// fsOverheads are the rough ratios of metadata overhead of each fs, on top of
+// the size of the content.
+var fsOverheads = map[string]float64{
+	"squashfs": 0.01,
+	"btrfs":    0.1,
+	"ext4":     0.05,
+}
+
+// FsEstimate is the estimated size of the raw image for a fs.
+type FsEstimate struct {
+	Fs          string `json:"fs"`
+	Compression string `json:"compression,omitempty"`
+	Size        int64  `json:"size"`
+}
+
+// Estimate is the estimated size of a sysext built from an image.
+type Estimate struct {
+	Image string `json:"image"`
+	// Layers is the number of layers accounted for.
+	Layers int `json:"layers"`
+	// Uncompressed is the total size of the files of the layers in /usr and
+	// /opt, the only directories merged by systemd-sysext, without the
+	// excluded paths. Files replaced or deleted by upper layers are counted
+	// for each layer, so it can be larger than the actual rootfs.
+	Uncompressed int64 `json:"uncompressed"`
+	// Filesystems are the estimated raw image sizes for each fs.
+	Filesystems []FsEstimate `json:"filesystems"`
+}
+
+// EstimateSysext will estimate the size of the sysext built from input image,
+// without building it. The image is pulled if not already cached, and its
+// layers are listed to sum the size of their files in the sysextDirs, not
+// extracted.
+// Paths matching the excludes patterns are not accounted for, nil means
+// fileutils.DefaultTarExcludes.
+// Compressed sizes use the compression configured for each fs, if any, and
+// rough compression ratios, so they are only an indication.
+func EstimateSysext(image string, excludes []string) (Estimate, error) {
+	image, err := imageutils.ResolveShortName(image)
+	if err != nil {
+		return Estimate{}, err
+	}
+
+	err = ensureImage(image, true, false)
+	if err != nil {
+		return Estimate{}, err
+	}
+
+	imageDir := imageutils.GetPath(image)
+
+	manifestFile, err := fileutils.ReadFile(filepath.Join(imageDir, "manifest.json"))
+	if err != nil {
+		return Estimate{}, err
+	}
+
+	var manifest v1.Manifest
+
+	err = json.Unmarshal(manifestFile, &manifest)
+	if err != nil {
+		return Estimate{}, err
+	}
+
+	if excludes == nil {
+		excludes = fileutils.DefaultTarExcludes
+	}
+
+	estimate := Estimate{Image: image, Layers: len(manifest.Layers), Filesystems: []FsEstimate{}}
+
+	for _, layer := range manifest.Layers {
+		layerDigest, err := imageutils.GetLayerFileName(layer.Digest)
+		if err != nil {
+			return Estimate{}, err
+		}
+
+		listing, err := fileutils.ListLayer(filepath.Join(imageDir, layerDigest), string(layer.MediaType), excludes)
+		if err != nil {
+			return Estimate{}, err
+		}
+
+		for _, dir := range sysextDirs {
+			estimate.Uncompressed += int64(listing.DirSizes[dir])
+		}
+	}
+
+	for _, fs := range []string{"squashfs", "btrfs", "ext4"} {
+		compression := ""
+		if fs != "ext4" {
+			compression, err = defaultCompression(fs)
+			if err != nil {
+				return Estimate{}, err
+			}
+		}
+
+		// mksquashfs compresses with gzip unless told otherwise
+		if fs == "squashfs" && compression == "" {
+			compression = "gzip"
+		}
+
+		ratio, found := compressionRatios[compression]
+		if !found {
+			return Estimate{}, fmt.Errorf("no compression ratio known for %s", compression)
+		}
+
+		size := float64(estimate.Uncompressed) * ratio * (1 + fsOverheads[fs])
+
+		estimate.Filesystems = append(estimate.Filesystems,
+			FsEstimate{Fs: fs, Compression: compression, Size: int64(size)})
+	}
+
+	return estimate, nil
+}
@@ -0,0 +1,54 @@
+package sysextutils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimateSysext(t *testing.T) {
+	withTestDirs(t)
+	t.Setenv("OCI_SYSEXT_HOME", t.TempDir())
+
+	writeTestImage(t, "localhost/estimate:1", nil,
+		[]testFile{
+			{Path: "usr/bin/tool", Content: strings.Repeat("a", 1000)},
+			{Path: "opt/app/data", Content: strings.Repeat("b", 500)},
+			// not merged by systemd-sysext
+			{Path: "etc/big", Content: strings.Repeat("c", 5000)},
+			{Path: "var/lib/state", Content: strings.Repeat("d", 3000)},
+			// excluded from the extraction
+			{Path: "usr/share/doc/README", Content: strings.Repeat("e", 2000)},
+		},
+		[]testFile{
+			{Path: "usr/bin/other", Content: strings.Repeat("f", 300)},
+			{Path: "root.txt", Content: strings.Repeat("g", 700)},
+		},
+	)
+
+	estimate, err := EstimateSysext("localhost/estimate:1", []string{"usr/share/doc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if estimate.Layers != 2 || estimate.Uncompressed != 1800 {
+		t.Fatalf("got %d layers and %d bytes, expected 2 layers and 1800 bytes",
+			estimate.Layers, estimate.Uncompressed)
+	}
+
+	// 1800 bytes times the gzip ratio and the fs overhead
+	expected := map[string]FsEstimate{
+		"squashfs": {Fs: "squashfs", Compression: "gzip", Size: 818},
+		"btrfs":    {Fs: "btrfs", Size: 1980},
+		"ext4":     {Fs: "ext4", Size: 1890},
+	}
+
+	if len(estimate.Filesystems) != len(expected) {
+		t.Fatalf("got estimates %v", estimate.Filesystems)
+	}
+
+	for _, fs := range estimate.Filesystems {
+		if fs != expected[fs.Fs] {
+			t.Errorf("got estimate %v, expected %v", fs, expected[fs.Fs])
+		}
+	}
+}
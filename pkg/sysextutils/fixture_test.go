@@ -0,0 +1,362 @@
+package sysextutils
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// testFile is a file of a test layer: a regular file with Content, or a
+// symlink to Link, or a hard link to the earlier Hardlink path, or a
+// directory if its Path ends with "/". Xattrs, and the Flags file flags like
+// "schg", are stored as PAX records, like container engines do.
+type testFile struct {
+	Path     string
+	Content  string
+	Link     string
+	Hardlink string
+	Mode     int64
+	UID      int
+	Xattrs   map[string]string
+	Flags    string
+}
+
+// withTestDirs points the data directories of sysexts, rootfs and images to
+// temporary ones, with no pull policy, for the duration of the test.
+func withTestDirs(t *testing.T) {
+	t.Helper()
+
+	home := t.TempDir()
+
+	previous := []string{SysextDir, SysextRootfsDir, imageutils.ImageDir, imageutils.PolicyFile}
+
+	SysextDir = filepath.Join(home, "sysexts")
+	SysextRootfsDir = filepath.Join(home, "sysexts-rootfs")
+	imageutils.ImageDir = filepath.Join(home, "images")
+	imageutils.PolicyFile = filepath.Join(home, "policy.json")
+
+	t.Cleanup(func() {
+		SysextDir, SysextRootfsDir, imageutils.ImageDir, imageutils.PolicyFile =
+			previous[0], previous[1], previous[2], previous[3]
+	})
+}
+
+// writeTestLayer returns the gzip compressed tar of input files.
+func writeTestLayer(t *testing.T, files []testFile) []byte {
+	t.Helper()
+
+	var layer bytes.Buffer
+
+	compressor := gzip.NewWriter(&layer)
+	writer := tar.NewWriter(compressor)
+
+	for _, file := range files {
+		header := &tar.Header{Name: file.Path, Mode: file.Mode, Uid: file.UID, Gid: file.UID}
+
+		for name, value := range file.Xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = map[string]string{}
+			}
+
+			header.PAXRecords["SCHILY.xattr."+name] = value
+		}
+
+		if file.Flags != "" {
+			if header.PAXRecords == nil {
+				header.PAXRecords = map[string]string{}
+			}
+
+			header.PAXRecords["SCHILY.fflags"] = file.Flags
+		}
+
+		switch {
+		case file.Link != "":
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = file.Link
+		case file.Hardlink != "":
+			header.Typeflag = tar.TypeLink
+			header.Linkname = file.Hardlink
+		case file.Path[len(file.Path)-1] == '/':
+			header.Typeflag = tar.TypeDir
+		default:
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(file.Content))
+		}
+
+		if header.Mode == 0 {
+			header.Mode = 0o644
+			if header.Typeflag == tar.TypeDir {
+				header.Mode = 0o755
+			}
+		}
+
+		err := writer.WriteHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = writer.Write([]byte(file.Content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, closer := range []interface{ Close() error }{writer, compressor} {
+		err := closer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return layer.Bytes()
+}
+
+// writeTestImage saves an image made of input layers in the image store, as
+// if it was pulled, with input config labels.
+func writeTestImage(t *testing.T, image string, labels map[string]string, layers ...[]testFile) {
+	t.Helper()
+
+	imageDir := imageutils.GetPath(image)
+
+	err := os.MkdirAll(imageDir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := v1.ConfigFile{
+		Architecture: "amd64",
+		OS:           "linux",
+		Config:       v1.Config{Labels: labels},
+		RootFS:       v1.RootFS{Type: "layers"},
+	}
+
+	manifest := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+	}
+
+	for _, files := range layers {
+		layer := writeTestLayer(t, files)
+
+		uncompressed, err := gunzip(layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		digest := v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", sha256.Sum256(layer))}
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs,
+			v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", sha256.Sum256(uncompressed))})
+		manifest.Layers = append(manifest.Layers, v1.Descriptor{
+			MediaType: types.OCILayer,
+			Size:      int64(len(layer)),
+			Digest:    digest,
+		})
+
+		layerFile, err := imageutils.GetLayerFileName(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(filepath.Join(imageDir, layerFile), layer, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rawConfig, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest.Config = v1.Descriptor{
+		MediaType: types.OCIConfigJSON,
+		Size:      int64(len(rawConfig)),
+		Digest:    v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", sha256.Sum256(rawConfig))},
+	}
+
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, content := range map[string][]byte{
+		"config.json":   rawConfig,
+		"manifest.json": rawManifest,
+		"image_name":    []byte(image),
+	} {
+		err = os.WriteFile(filepath.Join(imageDir, file), content, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// gunzip returns the decompressed content of input gzip data.
+func gunzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var uncompressed bytes.Buffer
+
+	_, err = uncompressed.ReadFrom(reader)
+
+	return uncompressed.Bytes(), err
+}
+
+// requireTools skips the test unless it runs as root with input tools.
+func requireTools(t *testing.T, tools ...string) {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("needs root privileges")
+	}
+
+	for _, tool := range tools {
+		_, err := exec.LookPath(tool)
+		if err != nil {
+			t.Skipf("needs %s", tool)
+		}
+	}
+}
+
+// writeTestFile writes input file, relative to root, with input content and
+// mode, creating its parents.
+func writeTestFile(t *testing.T, root string, path string, content string, mode os.FileMode) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(root, path), []byte(content), mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chmod(filepath.Join(root, path), mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestLayout writes an OCI layout in dir with a single image made of
+// input layers, as exported from containers-storage, and returns the image.
+func writeTestLayout(t *testing.T, dir string, layers ...[]testFile) v1.Image {
+	t.Helper()
+
+	image := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	image = mutate.ConfigMediaType(image, types.OCIConfigJSON)
+
+	for _, files := range layers {
+		content := writeTestLayer(t, files)
+
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(content)), nil
+		}, tarball.WithMediaType(types.OCILayer))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		image, err = mutate.AppendLayers(image, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = path.AppendImage(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return image
+}
+
+// withFakePodman puts first in PATH a podman exporting the OCI layout in the
+// returned directory for any image, like podman image save does.
+func withFakePodman(t *testing.T) string {
+	t.Helper()
+
+	binDIR := t.TempDir()
+	layoutDIR := filepath.Join(t.TempDir(), "layout")
+
+	// podman image save --format oci-dir -o DIR REF
+	script := "#!/bin/sh\nmkdir -p \"$6\" && cp -r " + layoutDIR + "/. \"$6\"\n"
+
+	err := os.WriteFile(filepath.Join(binDIR, "podman"), []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", binDIR+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return layoutDIR
+}
+
+// captureWarnings runs input function with the event stream enabled, and
+// returns the warnings it logged.
+func captureWarnings(t *testing.T, fn func()) []string {
+	t.Helper()
+
+	var stream bytes.Buffer
+
+	previous := logging.GetLogLevel()
+
+	logging.SetLogLevel("warn")
+	logging.SetEvents(&stream)
+	t.Cleanup(func() {
+		logging.SetEvents(nil)
+		logging.SetLogLevel(previous)
+	})
+
+	fn()
+
+	logging.SetEvents(nil)
+	logging.SetLogLevel(previous)
+
+	warnings := []string{}
+
+	scanner := bufio.NewScanner(&stream)
+	for scanner.Scan() {
+		var event struct {
+			Type    string         `json:"type"`
+			Payload map[string]any `json:"payload"`
+		}
+
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			t.Fatalf("invalid event %q: %v", scanner.Text(), err)
+		}
+
+		if event.Type == logging.EventLog && event.Payload["level"] == "warn" {
+			warnings = append(warnings, fmt.Sprint(event.Payload["message"]))
+		}
+	}
+
+	return warnings
+}
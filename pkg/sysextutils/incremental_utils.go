@@ -0,0 +1,316 @@
+package sysextutils
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// baseSnapshot describes the rootfs saved after extracting some of the layers
+// of an image, so that the next build only has to extract the layers from the
+// first one that changed. A snapshot is saved for each layer but the topmost,
+// see getBaseSnapshotPath.
+type baseSnapshot struct {
+	// Layers are the layers extracted in the snapshot, in order.
+	Layers []string `json:"layers"`
+	// Sizes are the sizes of Layers, accounted for the maximum uncompressed
+	// size of the builds reusing them.
+	Sizes []uint64 `json:"sizes"`
+	// Attributes are the chattr attributes of the files of the snapshot.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// KeepWhiteouts and TarExcludes are the options the layers were
+	// extracted with.
+	KeepWhiteouts bool     `json:"keepWhiteouts"`
+	TarExcludes   []string `json:"tarExcludes"`
+	// ACLs is true if the POSIX ACLs of the layers were restored.
+	ACLs bool `json:"acls,omitempty"`
+	// Verified is true if the layers were verified against their diff_ids.
+	Verified bool `json:"verified"`
+	// Compressed is true if the snapshot is stored as a compressed tar
+	// instead of a hard linked directory, see getBaseSnapshotArchive.
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+// getBaseSnapshotsDir returns the directory of the base snapshots of input
+// image. It's named after the normalized image, so that all the names of an
+// image, like alpine and docker.io/library/alpine:latest, share it.
+func getBaseSnapshotsDir(image string) string {
+	return filepath.Join(SysextRootfsDir, imageutils.GetID(image)+".base")
+}
+
+// getBaseSnapshotPath returns the directory of the base snapshot of input
+// image made of its first depth layers, described by the marker of the same
+// path with a .json extension.
+func getBaseSnapshotPath(image string, depth int) string {
+	return filepath.Join(getBaseSnapshotsDir(image), strconv.Itoa(depth))
+}
+
+// getBaseSnapshotArchive returns the zstd compressed tar of the base snapshot
+// of input image and depth, used instead of its directory when the snapshot
+// is compressed.
+func getBaseSnapshotArchive(image string, depth int) string {
+	return getBaseSnapshotPath(image, depth) + ".tar.zst"
+}
+
+// lockBaseSnapshots will take the lock of the base snapshots of input image,
+// and return the function releasing it.
+// lockImage only serializes the builds of the same image name, while the
+// snapshots are shared by all the names of the image, so they have a lock of
+// their own.
+func lockBaseSnapshots(image string) (func(), error) {
+	err := os.MkdirAll(SysextRootfsDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileutils.LockFile(getBaseSnapshotsDir(image) + ".lock")
+}
+
+// readBaseSnapshot returns the base snapshot of input image and depth, and
+// whether it's made of the first depth of input layers and was extracted
+// with the options of input snapshot.
+func readBaseSnapshot(image string, depth int, layers []string, snapshot baseSnapshot) (baseSnapshot, bool) {
+	markerFile, err := fileutils.ReadFile(getBaseSnapshotPath(image, depth) + ".json")
+	if err != nil {
+		return baseSnapshot{}, false
+	}
+
+	var saved baseSnapshot
+
+	err = json.Unmarshal(markerFile, &saved)
+	if err != nil {
+		logging.LogWarning("invalid base snapshot %d for %s, ignoring it: %v", depth, image, err)
+
+		return baseSnapshot{}, false
+	}
+
+	if len(saved.Layers) != depth || depth > len(layers) || len(saved.Sizes) != depth ||
+		!reflect.DeepEqual(saved.Layers, layers[:depth]) {
+		logging.LogDebug("base snapshot %d for %s doesn't match its layers", depth, image)
+
+		return baseSnapshot{}, false
+	}
+
+	if saved.KeepWhiteouts != snapshot.KeepWhiteouts || saved.ACLs != snapshot.ACLs ||
+		!reflect.DeepEqual(saved.TarExcludes, snapshot.TarExcludes) ||
+		(snapshot.Verified && !saved.Verified) {
+		logging.LogDebug("base snapshot %d for %s was extracted with different options", depth, image)
+
+		return baseSnapshot{}, false
+	}
+
+	return saved, true
+}
+
+// restoreBaseSnapshot will fill rootfsDIR with the deepest base snapshot of
+// input image whose layers are the first of input ones, extracted with the
+// same options, and return it, with no layers if none was restored. The
+// layers up to the first changed one are then reused.
+// The snapshot is hard linked, so restoring it is cheap, unless it's
+// compressed: then it's extracted in rootfsDIR. A hard linked rootfs has to be
+// detached once extracted, see detachRootfs.
+func restoreBaseSnapshot(image string, rootfsDIR string, layers []string, snapshot baseSnapshot) (baseSnapshot, error) {
+	unlock, err := lockBaseSnapshots(image)
+	if err != nil {
+		return baseSnapshot{}, err
+	}
+
+	defer unlock()
+
+	for depth := len(layers); depth > 0; depth-- {
+		saved, found := readBaseSnapshot(image, depth, layers, snapshot)
+		if !found {
+			continue
+		}
+
+		logging.Log("reusing %d unchanged layers from the base snapshot", depth)
+
+		if saved.Compressed {
+			err = fileutils.UntarFile(getBaseSnapshotArchive(image, depth), rootfsDIR,
+				"application/vnd.oci.image.layer.v1.tar+zstd", saved.ACLs, nil)
+			if err != nil {
+				return baseSnapshot{}, err
+			}
+
+			return saved, nil
+		}
+
+		out, err := exec.Command("cp", "-al", getBaseSnapshotPath(image, depth)+"/.", rootfsDIR).CombinedOutput()
+		if err != nil {
+			logging.LogError(string(out))
+			return baseSnapshot{}, err
+		}
+
+		return saved, nil
+	}
+
+	return baseSnapshot{}, nil
+}
+
+// saveBaseSnapshot will save a hard linked copy of rootfsDIR as the base
+// snapshot of input image made of the layers listed in snapshot, replacing
+// the one of the same depth, unless it's already made of them.
+// Extraction replaces files instead of writing them in place, so the
+// snapshot is not affected by the layers extracted afterwards. The steps
+// after the extraction may write files in place, so the rootfs is detached
+// from the snapshots first, see detachRootfs.
+// If snapshot is compressed, a compressed tar of rootfsDIR is saved instead,
+// which takes less space once the staging rootfs is gone.
+func saveBaseSnapshot(image string, rootfsDIR string, snapshot baseSnapshot) error {
+	unlock, err := lockBaseSnapshots(image)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	depth := len(snapshot.Layers)
+
+	saved, found := readBaseSnapshot(image, depth, snapshot.Layers, snapshot)
+	if found && saved.Compressed == snapshot.Compressed {
+		logging.LogDebug("base snapshot %d for %s is up to date", depth, image)
+
+		return nil
+	}
+
+	err = removeBaseSnapshot(image, depth)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(getBaseSnapshotsDir(image), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	if snapshot.Compressed {
+		logging.Log("saving compressed base snapshot of %d layers", depth)
+
+		err = fileutils.TarDirectory(rootfsDIR, getBaseSnapshotArchive(image, depth))
+		if err != nil {
+			return err
+		}
+
+		return writeBaseSnapshotMarker(image, snapshot)
+	}
+
+	snapshotDIR := getBaseSnapshotPath(image, depth)
+
+	err = os.MkdirAll(snapshotDIR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	logging.Log("saving base snapshot of %d layers", depth)
+
+	out, err := exec.Command("cp", "-al", rootfsDIR+"/.", snapshotDIR).CombinedOutput()
+	if err != nil {
+		logging.LogError(string(out))
+		return err
+	}
+
+	return writeBaseSnapshotMarker(image, snapshot)
+}
+
+// removeBaseSnapshot will remove the base snapshot of input image and depth,
+// its marker first, so that a failure leaves none.
+func removeBaseSnapshot(image string, depth int) error {
+	err := os.Remove(getBaseSnapshotPath(image, depth) + ".json")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.RemoveAll(getBaseSnapshotPath(image, depth))
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(getBaseSnapshotArchive(image, depth))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// pruneBaseSnapshots will remove the base snapshots of input image deeper
+// than maxDepth, left by builds of an older image with more layers.
+func pruneBaseSnapshots(image string, maxDepth int) error {
+	unlock, err := lockBaseSnapshots(image)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	entries, err := os.ReadDir(getBaseSnapshotsDir(image))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	for _, entry := range entries {
+		depth, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(entry.Name(), ".json"), ".tar.zst"))
+		if err != nil || depth <= maxDepth {
+			continue
+		}
+
+		logging.LogDebug("removing stale base snapshot %d for %s", depth, image)
+
+		err = removeBaseSnapshot(image, depth)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeBaseSnapshotMarker will write the marker describing input base
+// snapshot of input image, which makes it valid.
+func writeBaseSnapshotMarker(image string, snapshot baseSnapshot) error {
+	markerFile, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutils.WriteFile(getBaseSnapshotPath(image, len(snapshot.Layers))+".json", markerFile, 0o644)
+}
+
+// detachRootfs will replace input rootfs with a copy of itself, reflinked if
+// the filesystem supports it, so that its files aren't hard linked to the
+// base snapshots anymore and can be written in place.
+func detachRootfs(rootfsDIR string) error {
+	logging.Log("detaching the rootfs from the base snapshots")
+
+	tmpDIR := rootfsDIR + ".detach"
+
+	_ = os.RemoveAll(tmpDIR)
+
+	out, err := exec.Command("cp", "-a", "--reflink=auto", rootfsDIR, tmpDIR).CombinedOutput()
+	if err != nil {
+		_ = os.RemoveAll(tmpDIR)
+
+		logging.LogError(string(out))
+
+		return err
+	}
+
+	err = os.RemoveAll(rootfsDIR)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpDIR, rootfsDIR)
+}
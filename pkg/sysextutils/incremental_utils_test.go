@@ -0,0 +1,275 @@
+package sysextutils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// saveTestSnapshots saves a base snapshot of image for each depth of input
+// layers, with a file per layer.
+func saveTestSnapshots(t *testing.T, image string, layers []string) {
+	t.Helper()
+
+	rootfsDIR := t.TempDir()
+
+	for depth := 1; depth <= len(layers); depth++ {
+		writeTestFile(t, rootfsDIR, "usr/share/"+layers[depth-1], layers[depth-1], 0o644)
+
+		err := saveBaseSnapshot(image, rootfsDIR, baseSnapshot{
+			Layers: layers[:depth],
+			Sizes:  make([]uint64, depth),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRestoreBaseSnapshot(t *testing.T) {
+	withTestDirs(t)
+
+	saveTestSnapshots(t, "localhost/app:1", []string{"a", "b", "c"})
+
+	tests := []struct {
+		layers []string
+		reused int
+	}{
+		{[]string{"a", "b", "c", "d"}, 3},
+		{[]string{"a", "b", "x", "d"}, 2},
+		{[]string{"a", "x", "c", "d"}, 1},
+		{[]string{"x", "b", "c", "d"}, 0},
+	}
+
+	for _, test := range tests {
+		rootfsDIR := t.TempDir()
+
+		restored, err := restoreBaseSnapshot("localhost/app:1", rootfsDIR, test.layers, baseSnapshot{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(restored.Layers) != test.reused {
+			t.Errorf("layers %v: reused %d layers, expected %d", test.layers, len(restored.Layers), test.reused)
+		}
+
+		for i, layer := range test.layers {
+			if i < test.reused != fileExists(filepath.Join(rootfsDIR, "usr/share", layer)) {
+				t.Errorf("layers %v: unexpected content for layer %s", test.layers, layer)
+			}
+		}
+	}
+
+	// options changing the extracted content invalidate the snapshots
+	restored, err := restoreBaseSnapshot("localhost/app:1", t.TempDir(), []string{"a"}, baseSnapshot{KeepWhiteouts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(restored.Layers) != 0 {
+		t.Error("a snapshot extracted with other options should not be reused")
+	}
+}
+
+func TestPruneBaseSnapshots(t *testing.T) {
+	withTestDirs(t)
+
+	saveTestSnapshots(t, "localhost/app:1", []string{"a", "b", "c"})
+
+	err := pruneBaseSnapshots("localhost/app:1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for depth, kept := range map[int]bool{1: true, 2: false, 3: false} {
+		if fileExists(getBaseSnapshotPath("localhost/app:1", depth)+".json") != kept {
+			t.Errorf("snapshot %d kept: %v, expected %v", depth, !kept, kept)
+		}
+	}
+}
+
+func TestDetachRootfs(t *testing.T) {
+	withTestDirs(t)
+
+	saveTestSnapshots(t, "localhost/app:1", []string{"a"})
+
+	rootfsDIR := filepath.Join(t.TempDir(), "rootfs")
+
+	err := os.Mkdir(rootfsDIR, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = restoreBaseSnapshot("localhost/app:1", rootfsDIR, []string{"a"}, baseSnapshot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = detachRootfs(rootfsDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stat syscall.Stat_t
+
+	err = syscall.Stat(filepath.Join(rootfsDIR, "usr/share/a"), &stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Nlink != 1 {
+		t.Errorf("the rootfs file still has %d links", stat.Nlink)
+	}
+
+	// writing in place doesn't reach the snapshot anymore
+	err = os.WriteFile(filepath.Join(rootfsDIR, "usr/share/a"), []byte("changed"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(getBaseSnapshotPath("localhost/app:1", 1), "usr/share/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "a" {
+		t.Errorf("the snapshot was changed to %q", content)
+	}
+}
+
+func TestCreateSysextIncremental(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	base := []testFile{{Path: "usr/bin/old", Content: "old\n"}, {Path: "usr/bin/kept", Content: "kept\n"}}
+	top := []testFile{{Path: "usr/bin/top", Content: "top\n"}}
+
+	for _, middle := range []string{"1", "2"} {
+		// the middle layer changes, and removes a file of the reused one
+		writeTestImage(t, "localhost/incremental:1", nil, base, []testFile{
+			{Path: "usr/bin/.wh.old"},
+			{Path: "usr/bin/middle", Content: middle},
+		}, top)
+
+		err := CreateSysext(CreateOptions{Image: "localhost/incremental:1", Name: "incremental",
+			Fs: "ext4", Incremental: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mountDIR, unmount, err := mountRaw(GetRawPath("incremental"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := os.ReadFile(filepath.Join(mountDIR, "usr/bin/middle"))
+		if err != nil || string(content) != middle {
+			t.Errorf("build %s: got middle %q, %v", middle, content, err)
+		}
+
+		for file, expected := range map[string]bool{"usr/bin/old": false, "usr/bin/kept": true, "usr/bin/top": true} {
+			if fileExists(filepath.Join(mountDIR, file)) != expected {
+				t.Errorf("build %s: %s exists: %v, expected %v", middle, file, !expected, expected)
+			}
+		}
+
+		unmount()
+	}
+
+	// one snapshot per layer but the topmost
+	for depth, expected := range map[int]bool{1: true, 2: true, 3: false} {
+		if fileExists(getBaseSnapshotPath("localhost/incremental:1", depth)+".json") != expected {
+			t.Errorf("snapshot %d exists: %v, expected %v", depth, !expected, expected)
+		}
+	}
+}
+
+func TestCreateSysextEvents(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/events:1", nil,
+		[]testFile{{Path: "usr/bin/base", Content: "base\n"}},
+		[]testFile{{Path: "usr/bin/top", Content: "top\n"}})
+
+	opts := CreateOptions{Image: "localhost/events:1", Name: "events", Fs: "ext4", Incremental: true}
+
+	// the first build saves the snapshot of the base layer
+	err := CreateSysext(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+
+	logging.SetEvents(&stream)
+	t.Cleanup(func() { logging.SetEvents(nil) })
+
+	err = CreateSysext(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logging.SetEvents(nil)
+
+	sequence := []string{}
+
+	scanner := bufio.NewScanner(&stream)
+	for scanner.Scan() {
+		var event struct {
+			Version int            `json:"version"`
+			Type    string         `json:"type"`
+			Payload map[string]any `json:"payload"`
+		}
+
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			t.Fatalf("invalid event %q: %v", scanner.Text(), err)
+		}
+
+		if event.Version != logging.EventsVersion {
+			t.Errorf("got event version %d, expected %d", event.Version, logging.EventsVersion)
+		}
+
+		switch event.Type {
+		case logging.EventLog:
+			continue
+		case logging.EventLayerExtracted:
+			sequence = append(sequence, fmt.Sprintf("%s %v reused=%v",
+				event.Type, event.Payload["index"], event.Payload["reused"] == true))
+		default:
+			sequence = append(sequence, event.Type+" "+event.Payload["phase"].(string))
+		}
+	}
+
+	expected := []string{
+		"phase-started build",
+		"phase-started rootfs",
+		"layer-extracted 0 reused=true",
+		"layer-extracted 1 reused=false",
+		"phase-finished rootfs",
+		"phase-started pack",
+		"phase-finished pack",
+		"phase-finished build",
+	}
+
+	if !reflect.DeepEqual(sequence, expected) {
+		t.Errorf("got events:\n%s\nexpected:\n%s", strings.Join(sequence, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+// fileExists returns whether input path exists, without following it.
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+
+	return err == nil
+}
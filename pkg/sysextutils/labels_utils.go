@@ -0,0 +1,177 @@
+package sysextutils
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// ImageLabelPrefix is the namespace of the image labels declaring build
+// options, as in io.oci-sysext.fs=squashfs.
+const ImageLabelPrefix = "io.oci-sysext."
+
+// sysextScopes are the values allowed in SYSEXT_SCOPE.
+var sysextScopes = []string{"initrd", "system", "portable"}
+
+// ApplyImageLabels returns input options completed with the build options
+// declared by the image in its io.oci-sysext.* labels:
+//
+//	io.oci-sysext.name, io.oci-sysext.fs, io.oci-sysext.compression,
+//	io.oci-sysext.compression-level, io.oci-sysext.architecture,
+//	io.oci-sysext.min-systemd-version and io.oci-sysext.scope
+//
+// Labels are named after the create flags, but scope, which sets
+// SYSEXT_SCOPE. The options listed in explicit, by flag name, are kept as
+// they are, as explicit flags take precedence over labels.
+// The image is pulled if it's not already.
+func ApplyImageLabels(opts CreateOptions, explicit map[string]bool) (CreateOptions, error) {
+	image, err := imageutils.ResolveShortName(opts.Image)
+	if err != nil {
+		return opts, err
+	}
+
+	err = ensureImage(image, opts.Quiet, false)
+	if err != nil {
+		return opts, err
+	}
+
+	config, err := readImageConfig(image)
+	if err != nil {
+		return opts, err
+	}
+
+	keys := []string{}
+
+	for label := range config.Labels {
+		if strings.HasPrefix(label, ImageLabelPrefix) {
+			keys = append(keys, label)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, label := range keys {
+		key, value := strings.TrimPrefix(label, ImageLabelPrefix), config.Labels[label]
+
+		if explicit[key] {
+			logging.LogDebug("label %s overridden by --%s", label, key)
+
+			continue
+		}
+
+		logging.Log("using label %s=%s", label, value)
+
+		switch key {
+		case "name":
+			opts.Name = value
+		case "fs":
+			opts.Fs = value
+		case "compression":
+			opts.Compression = value
+		case "compression-level":
+			opts.CompressionLevel, err = strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("label %s: invalid number %q", label, value)
+			}
+		case "architecture":
+			opts.Architecture = value
+		case "sysext-level":
+			opts.SysextLevel = value
+		case "min-systemd-version":
+			opts.MinSystemdVersion, err = strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("label %s: invalid number %q", label, value)
+			}
+		case "scope":
+			if explicit["boot-optimized"] || hasReleaseField(opts.ReleaseFields, "SYSEXT_SCOPE") {
+				logging.LogDebug("label %s overridden by the explicit SYSEXT_SCOPE", label)
+
+				continue
+			}
+
+			err = checkScopeLabel(label, value)
+			if err != nil {
+				return opts, err
+			}
+
+			opts.ReleaseFields = append(opts.ReleaseFields, "SYSEXT_SCOPE="+value)
+		default:
+			logging.LogWarning("ignoring unknown label %s", label)
+		}
+	}
+
+	return opts, nil
+}
+
+// hasReleaseField returns whether input release fields set input key.
+func hasReleaseField(fields []string, key string) bool {
+	for _, field := range fields {
+		if strings.HasPrefix(field, key+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// labelReleaseFields maps the image labels that set extension-release fields
+// to their key, see readLabelReleaseFields.
+var labelReleaseFields = map[string]string{
+	ImageLabelPrefix + "architecture": "ARCHITECTURE",
+	ImageLabelPrefix + "sysext-level": "SYSEXT_LEVEL",
+	ImageLabelPrefix + "scope":        "SYSEXT_SCOPE",
+}
+
+// readLabelReleaseFields returns the extension-release fields set by the
+// io.oci-sysext.architecture, sysext-level and scope labels of input image,
+// as KEY=VALUE fields sorted by key. The image must be pulled already.
+func readLabelReleaseFields(image string) ([]string, error) {
+	image, err := imageutils.ResolveShortName(image)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := readImageConfig(image)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []string{}
+
+	for label, key := range labelReleaseFields {
+		value := config.Labels[label]
+		if value == "" || (key == "ARCHITECTURE" && value == anyArchitecture) {
+			continue
+		}
+
+		if key == "SYSEXT_SCOPE" {
+			err = checkScopeLabel(label, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		fields = append(fields, key+"="+value)
+	}
+
+	sort.Strings(fields)
+
+	return fields, nil
+}
+
+// checkScopeLabel will ensure input scope label only lists sysextScopes.
+func checkScopeLabel(label string, value string) error {
+	for _, scope := range strings.Fields(value) {
+		if !slices.Contains(sysextScopes, scope) {
+			return fmt.Errorf("label %s: invalid scope %q, expected one of %s",
+				label, scope, strings.Join(sysextScopes, ", "))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package sysextutils
+
+import (
+	"testing"
+)
+
+func TestApplyImageLabels(t *testing.T) {
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/labeled:1", map[string]string{
+		ImageLabelPrefix + "name":  "labeled",
+		ImageLabelPrefix + "fs":    "squashfs",
+		ImageLabelPrefix + "scope": "initrd system",
+	}, []testFile{{Path: "usr/bin/tool", Content: "tool\n"}})
+
+	// the name can come from the label alone
+	opts, err := ApplyImageLabels(CreateOptions{Image: "localhost/labeled:1", Fs: "ext4"}, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Name != "labeled" || opts.Fs != "squashfs" || !hasReleaseField(opts.ReleaseFields, "SYSEXT_SCOPE") {
+		t.Errorf("got name %q, fs %q and fields %q from the labels", opts.Name, opts.Fs, opts.ReleaseFields)
+	}
+
+	// explicit flags take precedence
+	opts, err = ApplyImageLabels(CreateOptions{Image: "localhost/labeled:1", Name: "explicit", Fs: "ext4"},
+		map[string]bool{"name": true, "fs": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Name != "explicit" || opts.Fs != "ext4" {
+		t.Errorf("got name %q and fs %q, expected the explicit ones", opts.Name, opts.Fs)
+	}
+}
+
+func TestApplyImageLabelsInvalidScope(t *testing.T) {
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/labeled:1", map[string]string{ImageLabelPrefix + "scope": "everywhere"},
+		[]testFile{{Path: "usr/bin/tool", Content: "tool\n"}})
+
+	_, err := ApplyImageLabels(CreateOptions{Image: "localhost/labeled:1"}, map[string]bool{})
+	if err == nil {
+		t.Error("expected an invalid scope error")
+	}
+}
@@ -0,0 +1,173 @@
+package sysextutils
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// sysBlockDir is where the kernel exposes block devices.
+const sysBlockDir = "/sys/block"
+
+// LoopDevice describes a loop device backed by a file in SysextDir or
+// SysextRootfsDir.
+type LoopDevice struct {
+	Device      string
+	BackingFile string
+	Orphaned    bool
+	Idle        bool
+}
+
+// ListLoopDevices returns the loop devices whose backing file is, or was,
+// inside SysextDir or SysextRootfsDir.
+// A device is orphaned if its backing file doesn't exist anymore, and idle if
+// it's neither mounted nor held by another device.
+func ListLoopDevices() ([]LoopDevice, error) {
+	loops, err := filepath.Glob(filepath.Join(sysBlockDir, "loop*"))
+	if err != nil {
+		return nil, err
+	}
+
+	// mountinfo can be much bigger than what fileutils.ReadFile reads
+	mountInfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []LoopDevice{}
+
+	for _, loop := range loops {
+		backingFile, err := os.ReadFile(filepath.Join(loop, "loop", "backing_file"))
+		if err != nil {
+			// not attached
+			continue
+		}
+
+		device := LoopDevice{
+			Device:      filepath.Join("/dev", filepath.Base(loop)),
+			BackingFile: strings.TrimSuffix(strings.TrimSpace(string(backingFile)), " (deleted)"),
+		}
+
+		if !strings.HasPrefix(device.BackingFile, SysextDir+"/") &&
+			!strings.HasPrefix(device.BackingFile, SysextRootfsDir+"/") {
+			continue
+		}
+
+		device.Orphaned = !fileutils.Exist(device.BackingFile)
+		device.Idle = isLoopIdle(loop, mountInfo)
+
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+// CollectLoopDevices will detach the orphaned and idle loop devices returned
+// by ListLoopDevices, and return the detached ones.
+func CollectLoopDevices() ([]LoopDevice, error) {
+	devices, err := ListLoopDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	detached := []LoopDevice{}
+
+	for _, device := range devices {
+		if !device.Orphaned {
+			continue
+		}
+
+		if !device.Idle {
+			logging.LogWarning("%s is orphaned but still in use, skipping", device.Device)
+
+			continue
+		}
+
+		logging.Log("detaching %s (%s)", device.Device, device.BackingFile)
+
+		out, err := exec.Command("losetup", "-d", device.Device).CombinedOutput()
+		if err != nil {
+			logging.LogError(string(out))
+
+			return detached, err
+		}
+
+		detached = append(detached, device)
+	}
+
+	return detached, nil
+}
+
+// isLoopIdle returns whether input loop device, as a /sys/block path, is
+// neither mounted, according to input mountinfo, nor held by another device.
+func isLoopIdle(loop string, mountInfo []byte) bool {
+	holders, err := os.ReadDir(filepath.Join(loop, "holders"))
+	if err != nil || len(holders) > 0 {
+		return false
+	}
+
+	majorMinor, err := os.ReadFile(filepath.Join(loop, "dev"))
+	if err != nil {
+		return false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(mountInfo))
+	for scanner.Scan() {
+		// mountinfo fields: id parent major:minor root mountpoint ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 2 && fields[2] == strings.TrimSpace(string(majorMinor)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mountRaw will loop-mount input raw image read-only in a new temporary
+// directory, and return it along with the function to unmount it.
+func mountRaw(rawFile string) (string, func(), error) {
+	return mountRawOptions(rawFile, "loop,ro")
+}
+
+// mountRawWritable will loop-mount input raw image read-write, see mountRaw.
+func mountRawWritable(rawFile string) (string, func(), error) {
+	return mountRawOptions(rawFile, "loop")
+}
+
+// mountRawOptions will mount input raw image with input mount options, see
+// mountRaw.
+func mountRawOptions(rawFile string, options string) (string, func(), error) {
+	mountDIR, err := os.MkdirTemp("", "oci-sysext-mount-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	logging.LogDebug("mounting %s", rawFile)
+	out, err := exec.Command("mount", []string{"-o", options, rawFile, mountDIR}...).CombinedOutput()
+	if err != nil {
+		logging.LogError(string(out))
+		_ = os.RemoveAll(mountDIR)
+
+		return "", nil, err
+	}
+
+	unmount := func() {
+		logging.LogDebug("unmounting %s", rawFile)
+		out, err := exec.Command("umount", mountDIR).CombinedOutput()
+		if err != nil {
+			logging.LogError(string(out))
+
+			return
+		}
+
+		_ = os.RemoveAll(mountDIR)
+	}
+
+	return mountDIR, unmount, nil
+}
@@ -0,0 +1,62 @@
+package sysextutils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLoop creates a /sys/block like directory of a loop device with input
+// major:minor and holders.
+func writeLoop(t *testing.T, majorMinor string, holders ...string) string {
+	t.Helper()
+
+	loop := filepath.Join(t.TempDir(), "loop3")
+
+	err := os.MkdirAll(filepath.Join(loop, "holders"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, holder := range holders {
+		err = os.WriteFile(filepath.Join(loop, "holders", holder), nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(loop, "dev"), []byte(majorMinor+"\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return loop
+}
+
+func TestIsLoopIdle(t *testing.T) {
+	// a mountinfo bigger than a single read, with the loop mounted last
+	var mountInfo strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&mountInfo, "%d 1 0:%d / /run/mount%d rw,relatime shared:1 - tmpfs tmpfs rw\n", i+100, i+50, i)
+	}
+
+	fmt.Fprintln(&mountInfo, "999 1 7:3 / /var/lib/extensions/app rw - ext4 /dev/loop3 ro")
+
+	if mountInfo.Len() < 20000 {
+		t.Fatalf("the test mountinfo is too small: %d bytes", mountInfo.Len())
+	}
+
+	if isLoopIdle(writeLoop(t, "7:3"), []byte(mountInfo.String())) {
+		t.Error("a loop device mounted at the end of mountinfo is not idle")
+	}
+
+	if !isLoopIdle(writeLoop(t, "7:4"), []byte(mountInfo.String())) {
+		t.Error("a loop device not mounted nor held is idle")
+	}
+
+	if isLoopIdle(writeLoop(t, "7:4", "dm-0"), []byte(mountInfo.String())) {
+		t.Error("a loop device held by another device is not idle")
+	}
+}
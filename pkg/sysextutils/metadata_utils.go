@@ -0,0 +1,136 @@
+package sysextutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+)
+
+// Metadata describes how a sysext was built, it's saved next to the raw image
+// in SysextDir as <name>.json.
+type Metadata struct {
+	Name        string `json:"name"`
+	Image       string `json:"image"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+	ImageSource string `json:"imageSource,omitempty"`
+	Fs          string `json:"fs"`
+	Created     string `json:"created"`
+	Version     string `json:"version,omitempty"`
+	// Entrypoint, Cmd and Env are read from the image's config, to run the
+	// service the sysext ships.
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	// Variants are the other filesystems the sysext is packed in, each raw
+	// image written next to the main one, see getFsVariantPath.
+	Variants []string `json:"variants,omitempty"`
+	// Options are the effective options used for the build, so that it can
+	// be reproduced, along with the ones only recorded, like
+	// MinSystemdVersion.
+	Options CreateOptions `json:"options"`
+}
+
+// overrideOptions returns input stored build options with the fields set in
+// input overrides replacing them, like explicit flags do on a rebuild. Zero
+// values can't override, they are the ones of flags that are not set.
+func overrideOptions(stored CreateOptions, overrides CreateOptions) CreateOptions {
+	result := reflect.ValueOf(&stored).Elem()
+	values := reflect.ValueOf(overrides)
+
+	for i := 0; i < values.NumField(); i++ {
+		if !values.Field(i).IsZero() {
+			result.Field(i).Set(values.Field(i))
+		}
+	}
+
+	return stored
+}
+
+// GetMetadataPath returns the path of the metadata file for given sysext name.
+func GetMetadataPath(name string) string {
+	return filepath.Join(SysextDir, name+".json")
+}
+
+// GetRawPath returns the path of the raw image of given sysext name, which is
+// <name>.raw in SysextDir unless it was built with a different output name.
+func GetRawPath(name string) string {
+	metadata, err := ReadMetadata(name)
+	if err == nil {
+		return GetOutputPath(name, metadata.Options.OutputName)
+	}
+
+	return GetOutputPath(name, "")
+}
+
+// GetOutputPath returns the path of the raw image of given sysext name built
+// with input output name, <name>.raw in SysextDir if it's empty.
+func GetOutputPath(name string, outputName string) string {
+	if outputName != "" {
+		return filepath.Join(SysextDir, outputName)
+	}
+
+	return filepath.Join(SysextDir, name+".raw")
+}
+
+// checkOutputCollision will ensure input raw image path doesn't belong to a
+// sysext other than the ones named in names, according to the metadata in
+// SysextDir, as writing it would silently replace the other sysext's image.
+func checkOutputCollision(target string, names ...string) error {
+	entries, err := os.ReadDir(SysextDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	for _, entry := range entries {
+		other, found := strings.CutSuffix(entry.Name(), ".json")
+		if !found || entry.IsDir() || slices.Contains(names, other) {
+			continue
+		}
+
+		metadata, err := ReadMetadata(other)
+		if err != nil {
+			continue
+		}
+
+		if GetOutputPath(other, metadata.Options.OutputName) == target {
+			return fmt.Errorf("%s is the raw image of sysext %s, choose another name or output name",
+				target, other)
+		}
+	}
+
+	return nil
+}
+
+// ReadMetadata will return the metadata saved for given sysext name.
+func ReadMetadata(name string) (Metadata, error) {
+	var metadata Metadata
+
+	metadataFile, err := fileutils.ReadFile(GetMetadataPath(name))
+	if err != nil {
+		return metadata, err
+	}
+
+	err = json.Unmarshal(metadataFile, &metadata)
+
+	return metadata, err
+}
+
+// WriteMetadata will save input metadata for its sysext.
+func WriteMetadata(metadata Metadata) error {
+	metadataFile, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutils.WriteFile(GetMetadataPath(metadata.Name), append(metadataFile, '\n'), 0o644)
+}
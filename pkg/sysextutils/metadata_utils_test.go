@@ -0,0 +1,203 @@
+package sysextutils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckOutputCollision(t *testing.T) {
+	withTestDirs(t)
+
+	err := os.MkdirAll(SysextDir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, metadata := range []Metadata{
+		{Name: "foo", Options: CreateOptions{OutputName: "bar.raw"}},
+		{Name: "baz"},
+	} {
+		err := WriteMetadata(metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		target   string
+		names    []string
+		collides bool
+	}{
+		// bar.raw is the raw image of foo
+		{"bar.raw", []string{"bar"}, true},
+		{"bar.raw", []string{"foo"}, false},
+		{"baz.raw", []string{"foo"}, true},
+		{"baz.raw", []string{"baz"}, false},
+		{"foo.raw", []string{"qux"}, false},
+		{"qux.raw", []string{"qux", "qux-opt"}, false},
+	}
+
+	for _, test := range tests {
+		err := checkOutputCollision(filepath.Join(SysextDir, test.target), test.names...)
+		if (err != nil) != test.collides {
+			t.Errorf("checkOutputCollision(%s, %v) = %v, expected a collision %v",
+				test.target, test.names, err, test.collides)
+		}
+	}
+}
+
+func TestConvertSysextOutputName(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/convert:1", nil, []testFile{{Path: "usr/bin/tool", Content: "tool\n"}})
+
+	err := CreateSysext(CreateOptions{Image: "localhost/convert:1", Name: "convert", Fs: "ext4",
+		OutputName: "convert_1.raw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// converting in place keeps the output name
+	err = ConvertSysext("convert", "ext4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fileExists(filepath.Join(SysextDir, "convert.raw")) || GetRawPath("convert") != filepath.Join(SysextDir, "convert_1.raw") {
+		t.Errorf("the converted image should have replaced convert_1.raw")
+	}
+
+	// a new sysext gets the default output name
+	err = ConvertSysext("convert", "ext4", "converted")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if GetRawPath("converted") != filepath.Join(SysextDir, "converted.raw") || !fileExists(GetRawPath("converted")) {
+		t.Errorf("the new sysext should be converted.raw, got %s", GetRawPath("converted"))
+	}
+
+	// another sysext's raw image is never replaced
+	err = CreateSysext(CreateOptions{Image: "localhost/convert:1", Name: "other", Fs: "ext4",
+		OutputName: "converted.raw"})
+	if err == nil {
+		t.Error("building over the raw image of another sysext should fail")
+	}
+}
+
+func TestConvertSysextCleanup(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/convert:1", nil, []testFile{{Path: "usr/bin/tool", Content: "tool\n"}})
+
+	err := CreateSysext(CreateOptions{Image: "localhost/convert:1", Name: "convert", Fs: "ext4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// copying the rootfs, or packing it, fails once the staging rootfs
+	// is created
+	path := os.Getenv("PATH")
+
+	for _, tool := range []string{"cp", "mkfs.ext4"} {
+		binDIR := t.TempDir()
+		writeTestFile(t, binDIR, tool, "#!/bin/sh\nexit 1\n", 0o755)
+
+		for _, output := range []string{"convert", "converted"} {
+			t.Setenv("PATH", binDIR+string(os.PathListSeparator)+path)
+
+			err = ConvertSysext("convert", "ext4", output)
+			if err == nil {
+				t.Fatalf("converting to %s with a failing %s should fail", output, tool)
+			}
+
+			if fileExists(filepath.Join(SysextRootfsDir, getID(output))) {
+				t.Errorf("converting to %s with a failing %s left its staging rootfs behind", output, tool)
+			}
+		}
+	}
+
+	if !fileExists(GetRawPath("convert")) {
+		t.Error("a failed conversion in place should keep the original image")
+	}
+}
+
+func TestConvertSysextPackingOptions(t *testing.T) {
+	requireTools(t, "mksquashfs", "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/convert:1", nil, []testFile{{Path: "usr/bin/tool", Content: "tool\n"}})
+
+	err := CreateSysext(CreateOptions{Image: "localhost/convert:1", Name: "convert", Fs: "squashfs",
+		Compression: "zstd", CompressionLevel: 19, BootOptimized: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ConvertSysext("convert", "ext4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rebuilding from the metadata packs for ext4
+	err = SetExtensionRelease("convert", []string{"FOO=bar"}, CreateOptions{})
+	if err != nil {
+		t.Fatalf("releasing a converted sysext: %v", err)
+	}
+
+	metadata, err := ReadMetadata("convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata.Options.Compression != "" || metadata.Options.CompressionLevel != 0 || metadata.Options.BootOptimized {
+		t.Errorf("got compression %q level %d boot optimized %v, expected the ext4 defaults",
+			metadata.Options.Compression, metadata.Options.CompressionLevel, metadata.Options.BootOptimized)
+	}
+
+	release, err := GetExtensionRelease("convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(release, "SYSEXT_SCOPE=initrd\n") || !strings.Contains(release, "FOO=bar\n") {
+		t.Errorf("unexpected extension-release:\n%s", release)
+	}
+}
+
+func TestMetadataMinSystemdVersion(t *testing.T) {
+	withTestDirs(t)
+
+	err := os.MkdirAll(SysextDir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = WriteMetadata(Metadata{Name: "tools", Options: CreateOptions{Name: "tools", MinSystemdVersion: 252}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(GetMetadataPath("tools"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// recorded once, with the build options
+	if count := strings.Count(string(content), `"minSystemdVersion"`); count != 1 {
+		t.Errorf("minSystemdVersion is recorded %d times:\n%s", count, content)
+	}
+
+	metadata, err := ReadMetadata("tools")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata.Options.MinSystemdVersion != 252 {
+		t.Errorf("got min systemd version %d, expected 252", metadata.Options.MinSystemdVersion)
+	}
+}
@@ -0,0 +1,152 @@
+package sysextutils
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// extractBaseRootfs will extract input layers of input image, like the ones
+// it shares with its image source, in a new directory next to its rootfs,
+// named after input suffix, and return it. The directory is unique, so that
+// concurrent builds never share it, and it's up to the caller to remove it.
+func extractBaseRootfs(image string, layers []v1.Descriptor, suffix string, tarExcludes []string) (string, error) {
+	err := os.MkdirAll(SysextRootfsDir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	baseDIR, err := os.MkdirTemp(SysextRootfsDir, getID(image)+suffix+"-")
+	if err != nil {
+		return "", err
+	}
+
+	imageDir := imageutils.GetPath(image)
+
+	for _, layer := range layers {
+		layerDigest, err := imageutils.GetLayerFileName(layer.Digest)
+		if err != nil {
+			_ = os.RemoveAll(baseDIR)
+
+			return "", err
+		}
+
+		logging.Log("extracting base layer %s", layerDigest)
+
+		listing, err := fileutils.ListLayer(filepath.Join(imageDir, layerDigest), string(layer.MediaType), tarExcludes)
+		if err != nil {
+			_ = os.RemoveAll(baseDIR)
+
+			return "", err
+		}
+
+		err = fileutils.UntarLayer(filepath.Join(imageDir, layerDigest), baseDIR,
+			string(layer.MediaType), listing, false, false, tarExcludes)
+		if err != nil {
+			_ = os.RemoveAll(baseDIR)
+
+			return "", err
+		}
+	}
+
+	return baseDIR, nil
+}
+
+// dropUnchangedFiles will remove from input rootfs the files identical to
+// the ones at the same path in baseDIR, which the host already gets from the
+// base image: regular files with the same permissions, owner and digest, and
+// symlinks with the same target. Directories are kept, as they may be needed
+// by the files left. It returns the number of files removed.
+func dropUnchangedFiles(rootfsDIR string, baseDIR string) (int, error) {
+	removed := 0
+
+	err := filepath.WalkDir(rootfsDIR, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(rootfsDIR, path)
+		if err != nil {
+			return err
+		}
+
+		same, err := sameFile(path, filepath.Join(baseDIR, relative))
+		if err != nil || !same {
+			return err
+		}
+
+		logging.LogDebug("dropping /%s, unchanged from the base image", relative)
+
+		removed++
+
+		return os.Remove(path)
+	})
+
+	return removed, err
+}
+
+// sameFile returns whether the files at input paths are identical, see
+// dropUnchangedFiles. A missing base file is just different.
+func sameFile(path string, basePath string) (bool, error) {
+	var stat, baseStat syscall.Stat_t
+
+	err := syscall.Lstat(basePath, &baseStat)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ENOTDIR) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	err = syscall.Lstat(path, &stat)
+	if err != nil {
+		return false, err
+	}
+
+	if !sameModeAndOwner(stat, baseStat) {
+		return false, nil
+	}
+
+	switch stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		if stat.Size != baseStat.Size {
+			return false, nil
+		}
+
+		digest := fileutils.GetFileDigest(path)
+
+		return digest != "" && digest == fileutils.GetFileDigest(basePath), nil
+	case syscall.S_IFLNK:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return false, err
+		}
+
+		baseTarget, err := os.Readlink(basePath)
+		if err != nil {
+			return false, err
+		}
+
+		return target == baseTarget, nil
+	default:
+		return false, nil
+	}
+}
+
+// sameModeAndOwner returns whether input stats have the same type,
+// permissions and owner.
+func sameModeAndOwner(stat syscall.Stat_t, baseStat syscall.Stat_t) bool {
+	return stat.Mode == baseStat.Mode && stat.Uid == baseStat.Uid && stat.Gid == baseStat.Gid
+}
@@ -0,0 +1,177 @@
+package sysextutils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// defaultSearchPath is the PATH binaries are looked up in when the image
+// config doesn't set one.
+const defaultSearchPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// sysextDirs are the directories of the rootfs merged by systemd-sysext.
+var sysextDirs = []string{"usr", "opt"}
+
+// minimizeEntrypoints returns the binaries --minimize keeps for input
+// options: the --entrypoint ones, or else the image's entrypoint, or its
+// command. Relative names are looked up in the PATH of the image config.
+func minimizeEntrypoints(opts CreateOptions, rootfsDIR string) ([]string, error) {
+	if len(opts.Entrypoints) > 0 {
+		return opts.Entrypoints, nil
+	}
+
+	config, err := readImageConfig(opts.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	command := append(append([]string{}, config.Entrypoint...), config.Cmd...)
+	if len(command) == 0 {
+		return nil, errors.New("--minimize needs an --entrypoint, the image sets no entrypoint nor command")
+	}
+
+	if filepath.IsAbs(command[0]) {
+		return command[:1], nil
+	}
+
+	searchPath := defaultSearchPath
+
+	for _, env := range config.Env {
+		if value, found := strings.CutPrefix(env, "PATH="); found {
+			searchPath = value
+		}
+	}
+
+	for _, dir := range strings.Split(searchPath, ":") {
+		candidate := filepath.Join("/", dir, command[0])
+
+		resolved, _, err := fileutils.ResolveInRootfs(rootfsDIR, candidate)
+		if err != nil {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(rootfsDIR, resolved))
+		if err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0o111 != 0 {
+			return []string{candidate}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("cannot find the image's entrypoint %s in %s, use --entrypoint", command[0], searchPath)
+}
+
+// minimizeRootfs will remove from the sysextDirs of input rootfs every file
+// input entrypoints don't need to run, see fileutils.ResolveELFClosure, and
+// the directories left empty. Libraries that can't be found are reported,
+// and are an error if strict is true. It returns the number of files removed.
+func minimizeRootfs(rootfsDIR string, entrypoints []string, strict bool) (int, error) {
+	closure, err := fileutils.ResolveELFClosure(rootfsDIR, entrypoints)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, missing := range closure.Missing {
+		logging.LogWarning("cannot find %s in the image", missing)
+	}
+
+	if len(closure.Missing) > 0 && strict {
+		return 0, fmt.Errorf("%d dependencies of %s are missing", len(closure.Missing), strings.Join(entrypoints, ", "))
+	}
+
+	// the extension-release may be composed from it again, see
+	// composeReleaseFields.
+	keep := map[string]bool{"/usr/lib/os-release": true}
+
+	for _, path := range closure.Files {
+		if !isUnderSysextDirs(path) {
+			// like /lib64 -> usr/lib64, the host has its own
+			info, err := os.Lstat(filepath.Join(rootfsDIR, path))
+			if err == nil && info.Mode()&fs.ModeSymlink == 0 {
+				logging.LogWarning("%s is needed but outside of /usr and /opt, the host one will be used", path)
+			}
+
+			continue
+		}
+
+		logging.LogDebug("keeping %s", path)
+
+		keep[path] = true
+	}
+
+	removed := 0
+	dirs := []string{}
+
+	for _, dir := range sysextDirs {
+		root := filepath.Join(rootfsDIR, dir)
+
+		if !fileutils.Exist(root) {
+			continue
+		}
+
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if entry.IsDir() {
+				dirs = append(dirs, path)
+
+				return nil
+			}
+
+			relative, err := filepath.Rel(rootfsDIR, path)
+			if err != nil {
+				return err
+			}
+
+			if keep["/"+relative] {
+				return nil
+			}
+
+			removed++
+
+			return os.Remove(path)
+		})
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	// deepest first, so that parents are empty once their children are gone
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return removed, err
+		}
+
+		if len(entries) == 0 && filepath.Dir(dir) != rootfsDIR {
+			err = os.Remove(dir)
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// isUnderSysextDirs returns whether input absolute path, inside the rootfs,
+// is under one of the sysextDirs.
+func isUnderSysextDirs(path string) bool {
+	for _, dir := range sysextDirs {
+		if strings.HasPrefix(path, "/"+dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
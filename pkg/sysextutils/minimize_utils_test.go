@@ -0,0 +1,119 @@
+package sysextutils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestRootfs writes input files to a new rootfs directory.
+func writeTestRootfs(t *testing.T, files []testFile) string {
+	t.Helper()
+
+	rootfsDIR := t.TempDir()
+
+	for _, file := range files {
+		if file.Link == "" {
+			writeTestFile(t, rootfsDIR, file.Path, file.Content, os.FileMode(file.Mode))
+
+			continue
+		}
+
+		err := os.MkdirAll(filepath.Dir(filepath.Join(rootfsDIR, file.Path)), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.Symlink(file.Link, filepath.Join(rootfsDIR, file.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return rootfsDIR
+}
+
+func TestMinimizeRootfs(t *testing.T) {
+	files, shell := hostShellLayer(t)
+
+	libc := ""
+
+	for _, file := range files {
+		if strings.HasPrefix(filepath.Base(file.Path), "libc.so") {
+			libc = file.Path
+		}
+	}
+
+	if libc == "" {
+		t.Skipf("%s isn't linked to libc", shell)
+	}
+
+	// a library of the same dir the shell doesn't need
+	unusedLibrary, err := os.ReadFile(filepath.Join(filepath.Dir("/"+libc), "libm.so.6"))
+	if err != nil {
+		t.Skipf("no libm on the host: %v", err)
+	}
+
+	unused := []string{
+		filepath.Join(filepath.Dir(libc), "libm.so.6"),
+		"usr/share/doc/shell/README",
+		"opt/tool/bin/tool",
+	}
+
+	rootfsDIR := writeTestRootfs(t, append(files,
+		testFile{Path: unused[0], Content: string(unusedLibrary), Mode: 0o755},
+		testFile{Path: unused[1], Content: "readme\n", Mode: 0o644},
+		testFile{Path: unused[2], Content: "#!/bin/sh\n", Mode: 0o755},
+		testFile{Path: "etc/shell.conf", Content: "conf\n", Mode: 0o644},
+	))
+
+	removed, err := minimizeRootfs(rootfsDIR, []string{shell}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != len(unused) {
+		t.Errorf("removed %d files, expected %d", removed, len(unused))
+	}
+
+	for _, file := range files {
+		if !fileExists(filepath.Join(rootfsDIR, file.Path)) {
+			t.Errorf("%s is needed by %s but was removed", file.Path, shell)
+		}
+	}
+
+	for _, path := range append(unused, "usr/share", "opt/tool") {
+		if fileExists(filepath.Join(rootfsDIR, path)) {
+			t.Errorf("%s isn't needed by %s but was kept", path, shell)
+		}
+	}
+
+	if !fileExists(filepath.Join(rootfsDIR, "etc/shell.conf")) {
+		t.Error("files outside of /usr and /opt should be left alone")
+	}
+
+	// without libc
+	rootfsDIR = writeTestRootfs(t, files)
+
+	err = os.Remove(filepath.Join(rootfsDIR, libc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = minimizeRootfs(rootfsDIR, []string{shell}, true)
+	if err == nil {
+		t.Error("a missing library should fail a strict build")
+	}
+
+	warnings := captureWarnings(t, func() {
+		_, err = minimizeRootfs(rootfsDIR, []string{shell}, false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(warnings) == 0 || !strings.Contains(strings.Join(warnings, "\n"), "libc.so") {
+		t.Errorf("got warnings %q, expected the missing libc", warnings)
+	}
+}
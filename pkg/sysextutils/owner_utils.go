@@ -0,0 +1,83 @@
+package sysextutils
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// maxReportedOwners is the number of unexpectedly owned files listed in the
+// error of checkOwners, the others are only counted.
+const maxReportedOwners = 10
+
+// checkOwners will ensure every file of input rootfs is owned by one of
+// input uids, if any, and one of input gids, if any, logging each file that
+// isn't and failing if any is found.
+func checkOwners(rootfsDIR string, uids []int, gids []int) error {
+	logging.Log("checking file owners")
+
+	unexpected := []string{}
+
+	err := filepath.WalkDir(rootfsDIR, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		var stat syscall.Stat_t
+
+		err = syscall.Lstat(path, &stat)
+		if err != nil {
+			return err
+		}
+
+		uidAllowed := len(uids) == 0 || containsID(uids, int(stat.Uid))
+		gidAllowed := len(gids) == 0 || containsID(gids, int(stat.Gid))
+
+		if uidAllowed && gidAllowed {
+			return nil
+		}
+
+		relative, _ := filepath.Rel(rootfsDIR, path)
+		if relative == "." {
+			relative = ""
+		}
+
+		owner := fmt.Sprintf("/%s (%d:%d)", relative, stat.Uid, stat.Gid)
+
+		logging.LogWarning("unexpected owner of %s", owner)
+
+		unexpected = append(unexpected, owner)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(unexpected) == 0 {
+		return nil
+	}
+
+	reported := unexpected
+	if len(reported) > maxReportedOwners {
+		reported = reported[:maxReportedOwners]
+	}
+
+	return fmt.Errorf("%d files have an owner outside of the allowed ones: %s",
+		len(unexpected), strings.Join(reported, ", "))
+}
+
+// containsID returns whether input ids contain input id.
+func containsID(ids []int, id int) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,46 @@
+package sysextutils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateSysextAllowedOwners(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/owners:1", nil, []testFile{
+		{Path: "usr/bin/tool", Content: "tool\n", Mode: 0o755},
+		{Path: "usr/share/tool/user.conf", Content: "user\n", UID: 1000},
+	})
+
+	tests := []struct {
+		uids    []int
+		gids    []int
+		allowed bool
+	}{
+		{[]int{0}, nil, false},
+		{nil, []int{0}, false},
+		{[]int{0}, []int{0}, false},
+		{[]int{0, 1000}, []int{0, 1000}, true},
+		{[]int{0, 1000}, nil, true},
+	}
+
+	for _, test := range tests {
+		err := CreateSysext(CreateOptions{Image: "localhost/owners:1", Name: "owners", Fs: "ext4",
+			AllowedUIDs: test.uids, AllowedGIDs: test.gids})
+		if test.allowed {
+			if err != nil {
+				t.Errorf("uids %v, gids %v: %v", test.uids, test.gids, err)
+			}
+
+			continue
+		}
+
+		// the root owned files and directories are allowed
+		if err == nil || !strings.Contains(err.Error(), "1 files have an owner outside of the allowed ones") ||
+			!strings.Contains(err.Error(), "/usr/share/tool/user.conf (1000:1000)") {
+			t.Errorf("uids %v, gids %v: got %v, expected the UID 1000 file to be reported", test.uids, test.gids, err)
+		}
+	}
+}
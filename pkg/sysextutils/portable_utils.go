@@ -0,0 +1,59 @@
+package sysextutils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// portableUnitDirs are the directories portablectl looks for units in.
+var portableUnitDirs = []string{"usr/lib/systemd/system", "etc/systemd/system"}
+
+// portableUnitTypes are the unit types portablectl attaches.
+var portableUnitTypes = []string{".service", ".socket", ".target", ".timer", ".path"}
+
+// findPortableUnits returns the units in input rootfs that portablectl would
+// attach for input prefix: units named after the prefix, followed by ".",
+// "-" or "@".
+func findPortableUnits(rootfsDIR string, prefix string) ([]string, error) {
+	units := []string{}
+
+	for _, dir := range portableUnitDirs {
+		entries, err := os.ReadDir(filepath.Join(rootfsDIR, dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			unit := entry.Name()
+			if !isPortableUnit(unit, prefix) {
+				continue
+			}
+
+			units = append(units, "/"+filepath.Join(dir, unit))
+		}
+	}
+
+	return units, nil
+}
+
+// isPortableUnit returns whether input unit name matches input prefix and
+// has one of portableUnitTypes.
+func isPortableUnit(unit string, prefix string) bool {
+	rest, found := strings.CutPrefix(unit, prefix)
+	if !found || rest == "" || !strings.ContainsAny(rest[:1], ".-@") {
+		return false
+	}
+
+	for _, unitType := range portableUnitTypes {
+		if strings.HasSuffix(unit, unitType) {
+			return true
+		}
+	}
+
+	return false
+}
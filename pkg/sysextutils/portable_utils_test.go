@@ -0,0 +1,82 @@
+package sysextutils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindPortableUnits(t *testing.T) {
+	rootfsDIR := t.TempDir()
+
+	for _, unit := range []string{
+		"usr/lib/systemd/system/app.service",
+		"usr/lib/systemd/system/app@.service",
+		"usr/lib/systemd/system/app-worker.timer",
+		"etc/systemd/system/app.socket",
+		// not matching the prefix, or not a portable unit type
+		"usr/lib/systemd/system/application.service",
+		"usr/lib/systemd/system/other.service",
+		"usr/lib/systemd/system/app.conf",
+		"usr/lib/systemd/system/app.mount",
+		"usr/share/systemd/app.service",
+	} {
+		writeTestFile(t, rootfsDIR, unit, "[Unit]\n", 0o644)
+	}
+
+	units, err := findPortableUnits(rootfsDIR, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"/usr/lib/systemd/system/app-worker.timer",
+		"/usr/lib/systemd/system/app.service",
+		"/usr/lib/systemd/system/app@.service",
+		"/etc/systemd/system/app.socket",
+	}
+
+	if !reflect.DeepEqual(units, expected) {
+		t.Errorf("got %q, expected %q", units, expected)
+	}
+
+	units, err = findPortableUnits(rootfsDIR, "missing")
+	if err != nil || len(units) != 0 {
+		t.Errorf("got %q, %v, expected no unit", units, err)
+	}
+}
+
+func TestCreateSysextPortable(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/portable:1", nil, []testFile{
+		{Path: "usr/bin/app", Content: "app\n", Mode: 0o755},
+		{Path: "usr/lib/systemd/system/app.service", Content: "[Service]\nExecStart=/usr/bin/app\n"},
+		{Path: "usr/lib/systemd/system/other.service", Content: "[Service]\n"},
+	})
+
+	err := CreateSysext(CreateOptions{Image: "localhost/portable:1", Name: "app", Fs: "ext4", Portable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := GetExtensionRelease("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(release, "PORTABLE_PREFIXES=app\n") {
+		t.Errorf("unexpected extension-release:\n%s", release)
+	}
+
+	// no unit named after the sysext
+	err = CreateSysext(CreateOptions{Image: "localhost/portable:1", Name: "tool", Fs: "ext4", Portable: true})
+	if err == nil || !strings.Contains(err.Error(), "--portable requires unit files named tool.service") {
+		t.Errorf("got %v, expected the missing units error", err)
+	}
+
+	if fileExists(GetRawPath("tool")) {
+		t.Error("a sysext without portable units was built")
+	}
+}
@@ -0,0 +1,134 @@
+package sysextutils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/schollz/progressbar/v3"
+)
+
+// squashfsProgress matches the progress bar of mksquashfs, as in
+// "[=====|     ] 1234/5678  21%", capturing the done and total counts.
+var squashfsProgress = regexp.MustCompile(`\]\s*(\d+)/(\d+)\s+\d+%`)
+
+// parseSquashfsProgress returns the done and total counts of input
+// mksquashfs progress line, and whether it's a progress line at all.
+func parseSquashfsProgress(line string) (int64, int64, bool) {
+	match := squashfsProgress.FindStringSubmatch(line)
+	if match == nil {
+		return 0, 0, false
+	}
+
+	done, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	total, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil || total == 0 {
+		return 0, 0, false
+	}
+
+	return done, total, true
+}
+
+// scanOutputLines splits the output of a packing tool on both line feeds
+// and carriage returns, as progress bars are redrawn with the latter.
+func scanOutputLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// runPackCommand will run input packing command, streaming its output while
+// it runs: mksquashfs progress lines drive a progress bar with an ETA, shown
+// if progress is true, and any other line is logged at debug level.
+// The output is returned in the error if the command fails.
+func runPackCommand(cmd *exec.Cmd, target string, progress bool) error {
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	waitErr := make(chan error, 1)
+
+	go func() {
+		err := cmd.Wait()
+		_ = writer.CloseWithError(err)
+		waitErr <- err
+	}()
+
+	var bar *progressbar.ProgressBar
+
+	output := []string{}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Split(scanOutputLines)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		done, total, ok := parseSquashfsProgress(line)
+		if !ok {
+			logging.LogDebug("%s", line)
+
+			output = append(output, line)
+
+			continue
+		}
+
+		if bar == nil {
+			bar = progressbar.NewOptions64(total,
+				progressbar.OptionEnableColorCodes(true),
+				progressbar.OptionShowCount(),
+				progressbar.OptionSetPredictTime(true),
+				progressbar.OptionSetWidth(30),
+				progressbar.OptionSetVisibility(progress),
+				progressbar.OptionSetDescription("Packing "+filepath.Base(target)),
+				progressbar.OptionOnCompletion(func() {
+					println("")
+				}),
+			)
+		}
+
+		_ = bar.Set64(done)
+	}
+
+	// drain the pipe in case of a scanner error, so that the command can exit
+	_, _ = io.Copy(io.Discard, reader)
+
+	err = <-waitErr
+	if err != nil {
+		return packToolError(filepath.Base(cmd.Path), err, []byte(strings.Join(output, "\n")))
+	}
+
+	if bar != nil {
+		_ = bar.Finish()
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,102 @@
+package sysextutils
+
+import (
+	"bufio"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// squashfsOutput is the output of a mksquashfs run, with its progress bar
+// redrawn with carriage returns.
+const squashfsOutput = "Parallel mksquashfs: Using 8 processors\n" +
+	"Creating 4.0 filesystem on tools.raw, block size 131072.\n" +
+	"\r[                                        ]     0/1234   0%" +
+	"\r[=========|                              ]   309/1234  25%" +
+	"\r[===================================/    ]  1200/1234  97%" +
+	"\r[========================================]  1234/1234 100%\n" +
+	"Exportable Squashfs 4.0 filesystem, zstd compressed, data block size 131072\n"
+
+func TestParseSquashfsProgress(t *testing.T) {
+	tests := []struct {
+		line  string
+		done  int64
+		total int64
+		ok    bool
+	}{
+		{"[=========|                              ]   309/1234  25%", 309, 1234, true},
+		{"[========================================]  1234/1234 100%", 1234, 1234, true},
+		{"[]0/10 0%", 0, 10, true},
+		{"[                                        ]     0/0   0%", 0, 0, false},
+		{"Parallel mksquashfs: Using 8 processors", 0, 0, false},
+		{"Creating 4.0 filesystem on tools.raw, block size 131072.", 0, 0, false},
+		{"Number of files 12/34 100%", 0, 0, false},
+		{"[====]  99999999999999999999/1 1%", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		done, total, ok := parseSquashfsProgress(test.line)
+		if done != test.done || total != test.total || ok != test.ok {
+			t.Errorf("parseSquashfsProgress(%q) = %d, %d, %v, expected %d, %d, %v",
+				test.line, done, total, ok, test.done, test.total, test.ok)
+		}
+	}
+}
+
+func TestScanOutputLines(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader(squashfsOutput))
+	scanner.Split(scanOutputLines)
+
+	progress := [][2]int64{}
+	others := []string{}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		done, total, ok := parseSquashfsProgress(line)
+		if ok {
+			progress = append(progress, [2]int64{done, total})
+		} else {
+			others = append(others, line)
+		}
+	}
+
+	if scanner.Err() != nil {
+		t.Fatal(scanner.Err())
+	}
+
+	expected := [][2]int64{{0, 1234}, {309, 1234}, {1200, 1234}, {1234, 1234}}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Errorf("got progress %v, expected %v", progress, expected)
+	}
+
+	if len(others) != 3 {
+		t.Errorf("got other lines %q, expected the 3 messages", others)
+	}
+}
+
+func TestRunPackCommand(t *testing.T) {
+	// the progress lines are not part of the error
+	cmd := exec.Command("sh", "-c", "printf '%s' \"$0\"; echo 'FATAL ERROR: no space left' >&2; exit 1", squashfsOutput)
+
+	err := runPackCommand(cmd, "tools.raw", false)
+	if err == nil {
+		t.Fatal("a failing packing tool should fail")
+	}
+
+	if !strings.Contains(err.Error(), "FATAL ERROR: no space left") || strings.Contains(err.Error(), "1234/1234") {
+		t.Errorf("unexpected error %q", err)
+	}
+
+	cmd = exec.Command("sh", "-c", "printf '%s' \"$0\"", squashfsOutput)
+
+	err = runPackCommand(cmd, "tools.raw", false)
+	if err != nil {
+		t.Error(err)
+	}
+}
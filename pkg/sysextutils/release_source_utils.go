@@ -0,0 +1,274 @@
+package sysextutils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// The sources of the extension-release fields, see ReleaseSourceOrder.
+const (
+	// releaseSourceFlags are the fields set by the build options, like
+	// --architecture and --release-field.
+	releaseSourceFlags = "flags"
+	// releaseSourceLabels are the fields set by the image's io.oci-sysext
+	// labels, see readLabelReleaseFields.
+	releaseSourceLabels = "image-labels"
+	// releaseSourceImage are the osReleaseFields of the image's os-release.
+	releaseSourceImage = "image-os-release"
+	// releaseSourceHost are the osReleaseFields of the host's os-release.
+	releaseSourceHost = "host"
+)
+
+// defaultReleaseSourceOrder completes the build options with the image's
+// os-release, so that the sysext matches hosts like the image unless they
+// set ID. See releaseSourceOrder.
+var defaultReleaseSourceOrder = []string{releaseSourceFlags, releaseSourceImage}
+
+// hostRootDir is the root directory of the host, whose os-release is read by
+// the host source and --match-host.
+var hostRootDir = "/"
+
+// osReleaseFields are the os-release fields taken from the image and host
+// sources, the ones systemd matches against the host.
+var osReleaseFields = []string{"ID", "VERSION_ID", "SYSEXT_LEVEL"}
+
+// validateReleaseSourceOrder will ensure input order only lists known
+// sources, once each.
+func validateReleaseSourceOrder(order []string) error {
+	seen := map[string]bool{}
+
+	for _, source := range order {
+		switch source {
+		case releaseSourceFlags, releaseSourceLabels, releaseSourceImage, releaseSourceHost:
+		default:
+			return fmt.Errorf("invalid release source %q: expected %s, %s, %s or %s",
+				source, releaseSourceFlags, releaseSourceLabels, releaseSourceImage, releaseSourceHost)
+		}
+
+		if seen[source] {
+			return fmt.Errorf("release source %s is listed more than once", source)
+		}
+
+		seen[source] = true
+	}
+
+	return nil
+}
+
+// releaseSourceOrder returns the release sources of input options: their
+// ReleaseSourceOrder, or else the defaultReleaseSourceOrder. The image's
+// os-release isn't used by default when the options set ID themselves, as
+// its VERSION_ID only makes sense along with its ID.
+func releaseSourceOrder(opts CreateOptions) []string {
+	if len(opts.ReleaseSourceOrder) > 0 {
+		return opts.ReleaseSourceOrder
+	}
+
+	if opts.ReleaseID != "" || hasReleaseField(opts.ReleaseFields, "ID") || len(opts.ExtensionRelease) > 0 {
+		return []string{releaseSourceFlags}
+	}
+
+	return defaultReleaseSourceOrder
+}
+
+// isFlagsReleaseSourceOrder returns whether the extension-release of input
+// options only depends on the options themselves.
+func isFlagsReleaseSourceOrder(opts CreateOptions) bool {
+	order := releaseSourceOrder(opts)
+
+	return len(order) == 1 && order[0] == releaseSourceFlags
+}
+
+// composeReleaseFields returns the extension-release fields for input
+// options, merging the sources of their releaseSourceOrder: for each key,
+// the value of the first source setting it wins. Within the flags source the
+// last value of a key wins, so --release-field overrides the generated
+// fields. ID defaults to _any if no source sets it, like for images without
+// an os-release.
+// The image-os-release source is read from input rootfs, the image-labels one
+// from the image config.
+// If the options record a whole ExtensionRelease, it's returned as is.
+func composeReleaseFields(opts CreateOptions, rootfsDIR string) ([]string, error) {
+	if len(opts.ExtensionRelease) > 0 {
+		return append([]string{}, opts.ExtensionRelease...), nil
+	}
+
+	order := releaseSourceOrder(opts)
+
+	keys := []string{"ID"}
+	values := map[string]string{}
+
+	for _, source := range order {
+		var (
+			fields []string
+			err    error
+		)
+
+		switch source {
+		case releaseSourceFlags:
+			fields = flagReleaseFields(opts)
+		case releaseSourceLabels:
+			fields, err = readLabelReleaseFields(opts.Image)
+		case releaseSourceImage:
+			fields, err = readOSReleaseFields(rootfsDIR)
+			if err == nil && len(fields) == 0 {
+				logging.LogDebug("no os-release found in the image")
+			}
+		case releaseSourceHost:
+			fields, err = readOSReleaseFields(hostRootDir)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		sourceKeys, sourceValues := collapseReleaseFields(fields)
+
+		for _, key := range sourceKeys {
+			if _, set := values[key]; set {
+				continue
+			}
+
+			values[key] = sourceValues[key]
+
+			if key != "ID" {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	if values["ID"] == "" {
+		values["ID"] = "_any"
+	}
+
+	composed := []string{}
+	for _, key := range keys {
+		composed = append(composed, key+"="+values[key])
+	}
+
+	return composed, nil
+}
+
+// matchHost will restrict input options to hosts like the build host: ID is
+// set to the host one, and SYSEXT_LEVEL too unless set already. Hosts
+// without SYSEXT_LEVEL are matched on their VERSION_ID instead. The fields
+// are added before the --release-field ones, which still override them.
+func matchHost(opts CreateOptions) (CreateOptions, error) {
+	fields, err := readOSReleaseFields(hostRootDir)
+	if err != nil {
+		return opts, err
+	}
+
+	_, host := collapseReleaseFields(fields)
+
+	if host["ID"] == "" {
+		return opts, errors.New("the host os-release sets no ID to match")
+	}
+
+	matched := []string{"ID=" + host["ID"]}
+
+	switch {
+	case opts.SysextLevel != "":
+	case host["SYSEXT_LEVEL"] != "":
+		opts.SysextLevel = host["SYSEXT_LEVEL"]
+	case host["VERSION_ID"] != "":
+		logging.LogWarning("the host os-release sets no SYSEXT_LEVEL, matching its VERSION_ID %s instead",
+			host["VERSION_ID"])
+
+		matched = append(matched, "VERSION_ID="+host["VERSION_ID"])
+	}
+
+	if opts.SysextLevel != "" {
+		logging.Log("matching hosts with %s and SYSEXT_LEVEL=%s", strings.Join(matched, ", "), opts.SysextLevel)
+	} else {
+		logging.Log("matching hosts with %s", strings.Join(matched, ", "))
+	}
+
+	opts.ReleaseFields = append(matched, opts.ReleaseFields...)
+
+	return opts, nil
+}
+
+// collapseReleaseFields returns the keys of input KEY=VALUE fields, in order
+// of first appearance, and the last value of each.
+func collapseReleaseFields(fields []string) ([]string, map[string]string) {
+	keys := []string{}
+	values := map[string]string{}
+
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		if _, set := values[key]; !set {
+			keys = append(keys, key)
+		}
+
+		values[key] = value
+	}
+
+	return keys, values
+}
+
+// readOSReleaseFields returns the osReleaseFields set in the os-release of
+// input root directory, /etc/os-release or else /usr/lib/os-release, as
+// KEY=VALUE fields. Without an os-release no field is returned.
+func readOSReleaseFields(root string) ([]string, error) {
+	var content []byte
+
+	for _, path := range []string{"etc/os-release", "usr/lib/os-release"} {
+		path = filepath.Join(root, path)
+
+		// /etc/os-release is usually a symlink to ../usr/lib/os-release,
+		// don't follow it out of an image's rootfs.
+		if root != hostRootDir {
+			info, err := os.Lstat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+		} else if !fileutils.Exist(path) {
+			continue
+		}
+
+		var err error
+
+		content, err = os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		break
+	}
+
+	fields := []string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found || !slices.Contains(osReleaseFields, key) {
+			continue
+		}
+
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+
+		fields = append(fields, key+"="+value)
+	}
+
+	return fields, scanner.Err()
+}
@@ -0,0 +1,188 @@
+package sysextutils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// GetExtensionRelease will return the content of the extension-release file
+// embedded in the sysext with input name.
+func GetExtensionRelease(name string) (string, error) {
+	source := GetRawPath(name)
+	if !fileutils.Exist(source) {
+		return "", fmt.Errorf("sysext %s not found in %s", name, SysextDir)
+	}
+
+	mountDIR, unmount, err := mountRaw(source)
+	if err != nil {
+		return "", err
+	}
+
+	defer unmount()
+
+	content, err := os.ReadFile(filepath.Join(mountDIR, "usr/lib/extension-release.d", "extension-release."+name))
+	if err != nil {
+		return "", fmt.Errorf("cannot read the extension-release of %s: %w", name, err)
+	}
+
+	return string(content), nil
+}
+
+// SetExtensionRelease will update the extension-release file of the sysext
+// with input name with input KEY=VALUE fields, and repack it.
+// Existing keys are replaced, new ones appended, and an empty value removes
+// the key. The raw image is read-only, so its content is copied in a staging
+// rootfs and packed again with the same fs and compression, along with its fs
+// variants. The build options recorded in the metadata are used for packing,
+// with the ones set in input overrides replacing them, see overrideOptions.
+func SetExtensionRelease(name string, fields []string, overrides CreateOptions) error {
+	for _, field := range fields {
+		err := validateReleaseField(field)
+		if err != nil {
+			return err
+		}
+	}
+
+	source := GetRawPath(name)
+	if !fileutils.Exist(source) {
+		return fmt.Errorf("sysext %s not found in %s", name, SysextDir)
+	}
+
+	metadata, err := ReadMetadata(name)
+	if err != nil {
+		return fmt.Errorf("no metadata found for %s, can't repack it: %w", name, err)
+	}
+
+	metadata.Options = overrideOptions(metadata.Options, overrides)
+
+	// the fs variants are repacked too, so that they keep matching the main
+	// raw image.
+	filesystems := append([]string{metadata.Fs}, metadata.Variants...)
+	targets := append([]string{source}, getFsVariantPaths(source, metadata.Variants)...)
+	compressions := []string{}
+
+	for _, fs := range filesystems {
+		fsOpts := metadata.Options
+		fsOpts.Fs = fs
+
+		compression, err := resolveCompression(fsOpts)
+		if err != nil {
+			return err
+		}
+
+		err = validateCompression(fs, compression, fsOpts.CompressionLevel)
+		if err != nil {
+			return err
+		}
+
+		compressions = append(compressions, compression)
+	}
+
+	mountDIR, unmount, err := mountRaw(source)
+	if err != nil {
+		return err
+	}
+
+	sysextRootfsDIR := filepath.Join(SysextRootfsDir, getID(name)+"-release")
+
+	err = copyRootfs(mountDIR, sysextRootfsDIR)
+
+	unmount()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.RemoveAll(sysextRootfsDIR) }()
+
+	releaseFile := filepath.Join(sysextRootfsDIR, "usr/lib/extension-release.d", "extension-release."+name)
+
+	content, err := os.ReadFile(releaseFile)
+	if err != nil {
+		return fmt.Errorf("cannot read the extension-release of %s: %w", name, err)
+	}
+
+	current := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	updated := updateReleaseFields(current, fields)
+
+	err = checkReleaseMatching(updated, false)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(releaseFile)
+	if err != nil {
+		return err
+	}
+
+	err = writeExtensionRelease(sysextRootfsDIR, name, updated)
+	if err != nil {
+		return err
+	}
+
+	for i, fs := range filesystems {
+		fsOpts := metadata.Options
+		fsOpts.Fs = fs
+
+		tmpTarget := targets[i] + ".tmp"
+		_ = os.Remove(tmpTarget)
+
+		logging.Log("repacking %s", targets[i])
+
+		err = PackRootfs(sysextRootfsDIR, tmpTarget, fs, packOptions(fsOpts, compressions[i]))
+		if err != nil {
+			_ = os.Remove(tmpTarget)
+			return err
+		}
+
+		err = os.Rename(tmpTarget, targets[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	// record the resolved extension-release, so that rebuilding from the
+	// metadata gives the same one, removed keys included.
+	metadata.Options.ExtensionRelease = updated
+
+	return WriteMetadata(metadata)
+}
+
+// updateReleaseFields returns input extension-release lines with input
+// KEY=VALUE fields applied: existing keys are replaced in place, new ones
+// appended, and fields with an empty value remove their key.
+func updateReleaseFields(lines []string, fields []string) []string {
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		updated := []string{}
+		found := false
+
+		for _, line := range lines {
+			lineKey, _, _ := strings.Cut(line, "=")
+			if lineKey != key {
+				updated = append(updated, line)
+
+				continue
+			}
+
+			if !found && value != "" {
+				updated = append(updated, field)
+			}
+
+			found = true
+		}
+
+		if !found && value != "" {
+			updated = append(updated, field)
+		}
+
+		lines = updated
+	}
+
+	return lines
+}
@@ -0,0 +1,492 @@
+package sysextutils
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpdateReleaseFields(t *testing.T) {
+	lines := []string{"ID=_any", "EXTENSION_RELOAD_MANAGER=1", "SYSEXT_LEVEL=1.0"}
+
+	tests := []struct {
+		fields   []string
+		expected []string
+	}{
+		{nil, lines},
+		{[]string{"SYSEXT_LEVEL=2.0"}, []string{"ID=_any", "EXTENSION_RELOAD_MANAGER=1", "SYSEXT_LEVEL=2.0"}},
+		{[]string{"FOO=bar"}, []string{"ID=_any", "EXTENSION_RELOAD_MANAGER=1", "SYSEXT_LEVEL=1.0", "FOO=bar"}},
+		{[]string{"EXTENSION_RELOAD_MANAGER="}, []string{"ID=_any", "SYSEXT_LEVEL=1.0"}},
+		{[]string{"MISSING="}, lines},
+		{[]string{"FOO=bar", "FOO="}, lines},
+	}
+
+	for _, test := range tests {
+		updated := updateReleaseFields(append([]string{}, lines...), test.fields)
+		if !reflect.DeepEqual(updated, test.expected) {
+			t.Errorf("updateReleaseFields(%q) = %q, expected %q", test.fields, updated, test.expected)
+		}
+	}
+}
+
+func TestComposeReleaseFieldsExtensionRelease(t *testing.T) {
+	recorded := []string{"ID=_any", "FOO=bar"}
+
+	opts := CreateOptions{ReleaseFields: []string{"BAR=baz"}, ExtensionRelease: recorded}
+
+	// the recorded extension-release wins over flags and os-release, and
+	// keeps the keys the flags would add back removed.
+	fields, err := composeReleaseFields(opts, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(fields, recorded) {
+		t.Errorf("got %q, expected %q", fields, recorded)
+	}
+
+	if !reflect.DeepEqual(releaseFields(opts), recorded) {
+		t.Errorf("got %q from releaseFields, expected %q", releaseFields(opts), recorded)
+	}
+}
+
+func TestSetExtensionReleaseRebuild(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/release:1", nil, []testFile{
+		{Path: "usr/bin/tool", Content: "tool\n", Mode: 0o755},
+	})
+
+	err := CreateSysext(CreateOptions{Image: "localhost/release:1", Name: "release", Fs: "ext4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SetExtensionRelease("release", []string{"EXTENSION_RELOAD_MANAGER=", "FOO=bar"}, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited, err := GetExtensionRelease("release")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(edited, "EXTENSION_RELOAD_MANAGER") || !strings.Contains(edited, "FOO=bar\n") {
+		t.Fatalf("unexpected edited extension-release:\n%s", edited)
+	}
+
+	metadata, err := ReadMetadata("release")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = CreateSysext(metadata.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt, err := GetExtensionRelease("release")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rebuilt != edited {
+		t.Errorf("rebuilding gave extension-release:\n%s\nexpected:\n%s", rebuilt, edited)
+	}
+}
+
+func TestComposeReleaseFieldsOrder(t *testing.T) {
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/release:1", map[string]string{
+		ImageLabelPrefix + "architecture": "arm64",
+		ImageLabelPrefix + "sysext-level": "2.0",
+		ImageLabelPrefix + "scope":        "portable",
+	}, []testFile{{Path: "usr/bin/tool", Content: "tool\n"}})
+
+	rootfsDIR := t.TempDir()
+	writeTestFile(t, rootfsDIR, "etc/os-release", "NAME=Fedora\nID=fedora\nVERSION_ID=\"40\"\nSYSEXT_LEVEL=1.0\n", 0o644)
+
+	tests := []struct {
+		order    []string
+		expected []string
+	}{
+		{[]string{"flags"}, []string{"ID=_any", "SYSEXT_LEVEL=3.0"}},
+		{[]string{"flags", "image-labels", "image-os-release"},
+			[]string{"ID=fedora", "SYSEXT_LEVEL=3.0", "ARCHITECTURE=arm64", "SYSEXT_SCOPE=portable", "VERSION_ID=40"}},
+		{[]string{"image-labels", "flags"},
+			[]string{"ID=_any", "ARCHITECTURE=arm64", "SYSEXT_LEVEL=2.0", "SYSEXT_SCOPE=portable"}},
+		{[]string{"image-os-release", "image-labels", "flags"},
+			[]string{"ID=fedora", "VERSION_ID=40", "SYSEXT_LEVEL=1.0", "ARCHITECTURE=arm64", "SYSEXT_SCOPE=portable"}},
+	}
+
+	for _, test := range tests {
+		err := validateReleaseSourceOrder(test.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts := CreateOptions{
+			Image:              "localhost/release:1",
+			NoExtensionReload:  true,
+			ReleaseFields:      []string{"SYSEXT_LEVEL=3.0"},
+			ReleaseSourceOrder: test.order,
+		}
+
+		fields, err := composeReleaseFields(opts, rootfsDIR)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("order %q: got %q, expected %q", test.order, fields, test.expected)
+		}
+	}
+
+	err := validateReleaseSourceOrder([]string{"image-labels", "image-labels"})
+	if err == nil {
+		t.Error("a source listed twice should be refused")
+	}
+}
+
+func TestReadLabelReleaseFields(t *testing.T) {
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/any:1", map[string]string{
+		ImageLabelPrefix + "architecture": anyArchitecture,
+		ImageLabelPrefix + "fs":           "ext4",
+	})
+
+	writeTestImage(t, "localhost/scope:1", map[string]string{
+		ImageLabelPrefix + "scope": "initrd everywhere",
+	})
+
+	fields, err := readLabelReleaseFields("localhost/any:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fields) != 0 {
+		t.Errorf("got %q, expected no field from the _any architecture and the fs label", fields)
+	}
+
+	_, err = readLabelReleaseFields("localhost/scope:1")
+	if err == nil {
+		t.Error("an invalid scope label should be refused")
+	}
+}
+
+func TestWriteExtensionRelease(t *testing.T) {
+	releaseFile := "usr/lib/extension-release.d/extension-release.crlf"
+
+	tests := []struct {
+		fields   []string
+		expected string
+	}{
+		{[]string{"ID=_any", "SYSEXT_LEVEL=1.0"}, "ID=_any\nSYSEXT_LEVEL=1.0\n"},
+		{[]string{"ID=_any\r\n", "SYSEXT_LEVEL=1.0\r", "FOO=bar\n\n"}, "ID=_any\nSYSEXT_LEVEL=1.0\nFOO=bar\n"},
+		{[]string{"FOO=a\r\nBAR=b"}, ""},
+		{[]string{"FOO=a\rb"}, ""},
+		{[]string{"FOO=a\nb"}, ""},
+	}
+
+	for _, test := range tests {
+		rootfsDIR := t.TempDir()
+
+		err := writeExtensionRelease(rootfsDIR, "crlf", test.fields)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%q: embedded line breaks should be refused", test.fields)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%q: %v", test.fields, err)
+		}
+
+		content, err := os.ReadFile(filepath.Join(rootfsDIR, releaseFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(content) != test.expected {
+			t.Errorf("%q: got %q, expected %q", test.fields, content, test.expected)
+		}
+	}
+
+	// an os-release with CRLF line endings gives clean fields
+	rootfsDIR := t.TempDir()
+	writeTestFile(t, rootfsDIR, "etc/os-release", "ID=fedora\r\nVERSION_ID=40\r\n", 0o644)
+
+	fields, err := composeReleaseFields(CreateOptions{
+		NoExtensionReload:  true,
+		ReleaseSourceOrder: []string{releaseSourceImage},
+	}, rootfsDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeExtensionRelease(rootfsDIR, "crlf", fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(rootfsDIR, releaseFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "ID=fedora\nVERSION_ID=40\n" {
+		t.Errorf("got %q from a CRLF os-release", content)
+	}
+}
+
+func TestSysextLevel(t *testing.T) {
+	for level, valid := range map[string]bool{"1.0": true, "fedora-40_1": true, "1.0 beta": false, "A": false} {
+		err := validateSysextLevel(level)
+		if (err == nil) != valid {
+			t.Errorf("validateSysextLevel(%q) = %v, expected valid %v", level, err, valid)
+		}
+	}
+
+	// explicit
+	fields, err := composeReleaseFields(CreateOptions{NoExtensionReload: true, SysextLevel: "2.0"}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(fields, []string{"ID=_any", "SYSEXT_LEVEL=2.0"}) {
+		t.Errorf("got %q with an explicit level", fields)
+	}
+
+	// derived from the host
+	previous := hostRootDir
+	t.Cleanup(func() { hostRootDir = previous })
+
+	tests := []struct {
+		osRelease string
+		level     string
+		matched   []string
+	}{
+		{"ID=fedora\nVERSION_ID=40\nSYSEXT_LEVEL=1.2\n", "1.2", []string{"ID=fedora"}},
+		{"ID=fedora\nVERSION_ID=40\n", "", []string{"ID=fedora", "VERSION_ID=40"}},
+		{"ID=fedora\n", "", []string{"ID=fedora"}},
+	}
+
+	for _, test := range tests {
+		hostRootDir = t.TempDir()
+		writeTestFile(t, hostRootDir, "usr/lib/os-release", test.osRelease, 0o644)
+
+		opts, err := matchHost(CreateOptions{ReleaseFields: []string{"FOO=bar"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if opts.SysextLevel != test.level || !reflect.DeepEqual(opts.ReleaseFields, append(test.matched, "FOO=bar")) {
+			t.Errorf("%q: got level %q and fields %q", test.osRelease, opts.SysextLevel, opts.ReleaseFields)
+		}
+
+		// an explicit level wins over the host one
+		opts, err = matchHost(CreateOptions{SysextLevel: "3.0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if opts.SysextLevel != "3.0" {
+			t.Errorf("%q: got level %q, expected the explicit one", test.osRelease, opts.SysextLevel)
+		}
+	}
+
+	hostRootDir = t.TempDir()
+
+	_, err = matchHost(CreateOptions{})
+	if err == nil {
+		t.Error("a host without os-release ID can't be matched")
+	}
+
+	// missing
+	var matchErr error
+
+	warnings := captureWarnings(t, func() {
+		matchErr = checkReleaseMatching([]string{"ID=fedora"}, false)
+	})
+	if matchErr != nil || len(warnings) != 1 {
+		t.Errorf("got %v and warnings %q, expected one warning without SYSEXT_LEVEL nor VERSION_ID", matchErr, warnings)
+	}
+
+	err = checkReleaseMatching([]string{"ID=fedora"}, true)
+	if err == nil {
+		t.Error("neither SYSEXT_LEVEL nor VERSION_ID should fail a strict build")
+	}
+
+	for _, fields := range [][]string{{"ID=fedora", "SYSEXT_LEVEL=1.2"}, {"ID=fedora", "VERSION_ID=40"}} {
+		err = checkReleaseMatching(fields, true)
+		if err != nil {
+			t.Errorf("%q: %v", fields, err)
+		}
+	}
+}
+
+func TestComposeReleaseFieldsDefault(t *testing.T) {
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/release:1", nil, []testFile{{Path: "usr/bin/tool", Content: "tool\n"}})
+
+	etcRootfsDIR := t.TempDir()
+	writeTestFile(t, etcRootfsDIR, "etc/os-release", "NAME=Fedora\nID=fedora\nVERSION_ID=40\n", 0o644)
+
+	usrRootfsDIR := t.TempDir()
+	writeTestFile(t, usrRootfsDIR, "usr/lib/os-release", "ID=debian\nVERSION_ID=\"12\"\n", 0o644)
+
+	tests := []struct {
+		rootfsDIR string
+		opts      CreateOptions
+		expected  []string
+	}{
+		{etcRootfsDIR, CreateOptions{}, []string{"ID=fedora", "VERSION_ID=40"}},
+		{usrRootfsDIR, CreateOptions{}, []string{"ID=debian", "VERSION_ID=12"}},
+		{etcRootfsDIR, CreateOptions{ReleaseID: "_any"}, []string{"ID=_any"}},
+		{etcRootfsDIR, CreateOptions{ReleaseFields: []string{"ID=_any"}}, []string{"ID=_any"}},
+		{etcRootfsDIR, CreateOptions{ReleaseID: "centos", SysextLevel: "1.0"}, []string{"ID=centos", "SYSEXT_LEVEL=1.0"}},
+		// no os-release
+		{t.TempDir(), CreateOptions{}, []string{"ID=_any"}},
+	}
+
+	for _, test := range tests {
+		test.opts.Image = "localhost/release:1"
+		test.opts.NoExtensionReload = true
+
+		fields, err := composeReleaseFields(test.opts, test.rootfsDIR)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("release ID %q, fields %q: got %q, expected %q",
+				test.opts.ReleaseID, test.opts.ReleaseFields, fields, test.expected)
+		}
+	}
+}
+
+func TestSetExtensionReleaseOptions(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/release:1", nil, []testFile{
+		{Path: "usr/bin/tool", Content: "tool\n", Mode: 0o755},
+	})
+
+	// a mkfs.ext4 recording the TMPDIR it runs with
+	mkfs, err := exec.LookPath("mkfs.ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binDIR := t.TempDir()
+	logFile := filepath.Join(binDIR, "tmpdirs")
+	writeTestFile(t, binDIR, "mkfs.ext4",
+		"#!/bin/sh\necho \"$TMPDIR\" >> "+logFile+"\nexec "+mkfs+" \"$@\"\n", 0o755)
+	t.Setenv("PATH", binDIR+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	lastTmpDir := func() string {
+		content, err := os.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+
+		return lines[len(lines)-1]
+	}
+
+	buildTmpDir, overrideTmpDir := t.TempDir(), t.TempDir()
+
+	err = CreateSysext(CreateOptions{Image: "localhost/release:1", Name: "release", Fs: "ext4", TmpDir: buildTmpDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rebuild uses the options of the build
+	err = SetExtensionRelease("release", []string{"FOO=bar"}, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lastTmpDir() != buildTmpDir {
+		t.Errorf("repacked with TMPDIR %s, expected the build one %s", lastTmpDir(), buildTmpDir)
+	}
+
+	// explicit options override them, and are recorded
+	err = SetExtensionRelease("release", []string{"FOO=baz"}, CreateOptions{TmpDir: overrideTmpDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lastTmpDir() != overrideTmpDir {
+		t.Errorf("repacked with TMPDIR %s, expected the override %s", lastTmpDir(), overrideTmpDir)
+	}
+
+	metadata, err := ReadMetadata("release")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata.Options.TmpDir != overrideTmpDir || metadata.Options.Image != "localhost/release:1" {
+		t.Errorf("got recorded TMPDIR %s and image %s", metadata.Options.TmpDir, metadata.Options.Image)
+	}
+
+	// an override invalid for the fs fails before repacking
+	err = SetExtensionRelease("release", []string{"FOO=qux"}, CreateOptions{Compression: "zstd"})
+	if err == nil {
+		t.Error("ext4 can't be repacked with zstd compression")
+	}
+
+	release, err := GetExtensionRelease("release")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(release, "FOO=baz\n") {
+		t.Errorf("a failed repack changed the extension-release:\n%s", release)
+	}
+}
+
+func TestValidateReleaseField(t *testing.T) {
+	tests := map[string]bool{
+		"FOO=bar":              true,
+		"_WEIGHT=10":           true,
+		"VENDOR_KEY_2=x":       true,
+		"EMPTY=":               true,
+		`NAME="My Extension"`:  true,
+		"NAME='My Extension'":  true,
+		"URL=https://a.b/?c=d": true,
+		`NOTE=say "hi"`:        true,
+		"foo=bar":              false,
+		"Foo=bar":              false,
+		"FOO-BAR=x":            false,
+		"2FOO=x":               false,
+		"=bar":                 false,
+		"FOO":                  false,
+		"FOO bar":              false,
+		"FOO=bar\nBAR=baz":     false,
+		"FOO=bar\r":            false,
+		`NAME="My Extension`:   false,
+		"NAME='My Extension":   false,
+		`NAME="`:               false,
+		`NAME="My Extension'`:  false,
+	}
+
+	for field, valid := range tests {
+		err := validateReleaseField(field)
+		if (err == nil) != valid {
+			t.Errorf("validateReleaseField(%q) = %v, expected valid %v", field, err, valid)
+		}
+	}
+}
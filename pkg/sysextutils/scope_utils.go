@@ -0,0 +1,73 @@
+package sysextutils
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// fullUserlandMarker is content giving away a sysext meant for a full
+// userland, see fullUserlandMarkers.
+type fullUserlandMarker struct {
+	// pattern is a glob relative to the rootfs.
+	pattern string
+	reason  string
+}
+
+// fullUserlandMarkers are the content unlikely to work in the minimal
+// environment of the initrd, which usually comes from building a sysext from
+// a full distro image.
+var fullUserlandMarkers = []fullUserlandMarker{
+	{"usr/lib/systemd/system/multi-user.target.wants/*", "units pulled in by multi-user.target, never reached in the initrd"},
+	{"usr/lib/systemd/system/graphical.target.wants/*", "units pulled in by graphical.target, never reached in the initrd"},
+	{"usr/lib/systemd/user", "user units, there are no user sessions in the initrd"},
+	{"usr/share/applications", "desktop applications"},
+	{"usr/share/xsessions", "graphical sessions"},
+	{"usr/share/wayland-sessions", "graphical sessions"},
+	{"usr/lib/sysimage/rpm", "a package database"},
+	{"usr/bin/dnf", "a package manager"},
+	{"usr/bin/apt", "a package manager"},
+	{"usr/bin/zypper", "a package manager"},
+	{"usr/lib/python3*", "a Python runtime"},
+	{"usr/lib64/python3*", "a Python runtime"},
+}
+
+// checkInitrdScope will warn about the content of input rootfs needing a full
+// userland, see fullUserlandMarkers, if input extension-release fields scope
+// the sysext to the initrd. It's a heuristic, and advisory unless strict.
+func checkInitrdScope(rootfsDIR string, fields []string, strict bool) error {
+	_, values := collapseReleaseFields(fields)
+
+	if !slices.Contains(strings.Fields(values["SYSEXT_SCOPE"]), "initrd") {
+		return nil
+	}
+
+	logging.Log("checking the content against SYSEXT_SCOPE=%s", values["SYSEXT_SCOPE"])
+
+	found := 0
+
+	for _, marker := range fullUserlandMarkers {
+		matches, err := filepath.Glob(filepath.Join(rootfsDIR, marker.pattern))
+		if err != nil {
+			return err
+		}
+
+		if len(matches) == 0 {
+			continue
+		}
+
+		found++
+
+		relative, _ := filepath.Rel(rootfsDIR, matches[0])
+		logging.LogWarning("/%s looks like %s, which may not work in the initrd", relative, marker.reason)
+	}
+
+	if found > 0 && strict {
+		return fmt.Errorf("%d signs of a full userland in an initrd sysext, check its SYSEXT_SCOPE", found)
+	}
+
+	return nil
+}
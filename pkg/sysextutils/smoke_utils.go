@@ -0,0 +1,85 @@
+package sysextutils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// smokeTestHierarchies are the hierarchies a sysext can extend, they're
+// overlaid on the host ones when running a smoke test.
+var smokeTestHierarchies = []string{"usr", "opt"}
+
+// RunSmokeTest will loop-mount input raw images read-only and run input
+// command in a private mount namespace, where each hierarchy of the images is
+// overlaid on the host one, the same way systemd-sysext merges them.
+// The host acts as the base tree, and nothing is visible outside the
+// namespace. The images are unmounted whatever the outcome, and an error is
+// returned if the command exits non-zero.
+func RunSmokeTest(rawFiles []string, command string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("the smoke test needs root privileges to mount the sysext")
+	}
+
+	_, err := exec.LookPath("unshare")
+	if err != nil {
+		return fmt.Errorf("the smoke test needs unshare: %w", err)
+	}
+
+	lowerDirs := map[string][]string{}
+
+	for _, rawFile := range rawFiles {
+		mountDIR, unmount, err := mountRaw(rawFile)
+		if err != nil {
+			return err
+		}
+
+		defer unmount()
+
+		for _, hierarchy := range smokeTestHierarchies {
+			if fileutils.Exist(filepath.Join(mountDIR, hierarchy)) {
+				lowerDirs[hierarchy] = append(lowerDirs[hierarchy], filepath.Join(mountDIR, hierarchy))
+			}
+		}
+	}
+
+	script := []string{"set -e"}
+
+	for _, hierarchy := range smokeTestHierarchies {
+		if len(lowerDirs[hierarchy]) == 0 {
+			continue
+		}
+
+		if !fileutils.Exist("/" + hierarchy) {
+			logging.LogWarning("/%s doesn't exist on the host, not overlaying it", hierarchy)
+
+			continue
+		}
+
+		// the first lowerdir is the topmost, so the host one goes last
+		lower := strings.Join(append(lowerDirs[hierarchy], "/"+hierarchy), ":")
+		script = append(script, fmt.Sprintf("mount -t overlay overlay -o ro,lowerdir=%s /%s", lower, hierarchy))
+	}
+
+	script = append(script, `exec sh -c "$1"`)
+
+	logging.Log("running smoke test: %s", command)
+	out, err := exec.Command("unshare",
+		"--mount", "--propagation", "private", "--",
+		"sh", "-c", strings.Join(script, "\n"), "sh", command).CombinedOutput()
+	if err != nil {
+		logging.LogError(string(out))
+		return fmt.Errorf("smoke test %q failed: %w", command, err)
+	}
+
+	logging.LogDebug(string(out))
+	logging.Log("smoke test passed")
+
+	return nil
+}
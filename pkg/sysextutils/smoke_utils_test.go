@@ -0,0 +1,60 @@
+package sysextutils
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateSysextSmokeTest(t *testing.T) {
+	requireTools(t, "mkfs.ext4", "unshare")
+	withTestDirs(t)
+
+	tmpDIR := t.TempDir()
+	t.Setenv("TMPDIR", tmpDIR)
+
+	writeTestImage(t, "localhost/smoke:1", nil, []testFile{
+		{Path: "usr/bin/smoke-tool", Content: "#!/bin/sh\necho smoke\n", Mode: 0o755},
+	})
+
+	opts := CreateOptions{
+		Image:     "localhost/smoke:1",
+		Name:      "smoke",
+		Fs:        "ext4",
+		SmokeTest: "test -x /usr/bin/smoke-tool",
+	}
+
+	err := CreateSysext(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fileExists(GetRawPath("smoke")) {
+		t.Fatal("the sysext passing its smoke test is missing")
+	}
+
+	opts.SmokeTest = "test ! -e /usr/bin/smoke-tool"
+
+	err = CreateSysext(opts)
+	if err == nil {
+		t.Fatal("a failed smoke test should fail the build")
+	}
+
+	for _, path := range []string{GetOutputPath("smoke", ""), GetMetadataPath("smoke")} {
+		if fileExists(path) {
+			t.Errorf("%s was left behind by the failed smoke test", path)
+		}
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(tmpDIR, "oci-sysext-mount-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leftovers) > 0 {
+		t.Errorf("mount directories left behind: %q", leftovers)
+	}
+
+	if fileExists("/usr/bin/smoke-tool") {
+		t.Error("the sysext leaked out of the smoke test namespace")
+	}
+}
@@ -0,0 +1,75 @@
+package sysextutils
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Annotations recording the base image an image was built from, as set by
+// buildkit and buildah either on the manifest or as labels.
+const (
+	baseNameAnnotation   = "org.opencontainers.image.base.name"
+	baseDigestAnnotation = "org.opencontainers.image.base.digest"
+)
+
+// detectImageSource returns the base image recorded in the manifest
+// annotations or in the labels of input image, pulled, pinned by digest when
+// the digest is recorded too. An empty string is returned if the image
+// records no base.
+func detectImageSource(image string, quiet bool) (string, error) {
+	err := ensureImage(image, quiet, false)
+	if err != nil {
+		return "", err
+	}
+
+	manifestFile, err := fileutils.ReadFile(filepath.Join(imageutils.GetPath(image), "manifest.json"))
+	if err != nil {
+		return "", err
+	}
+
+	var manifest v1.Manifest
+
+	err = json.Unmarshal(manifestFile, &manifest)
+	if err != nil {
+		return "", err
+	}
+
+	config, err := readImageConfig(image)
+	if err != nil {
+		return "", err
+	}
+
+	// manifest annotations take precedence, labels may be inherited from
+	// the base image itself.
+	for _, annotations := range []map[string]string{manifest.Annotations, config.Labels} {
+		baseName := annotations[baseNameAnnotation]
+		if baseName == "" {
+			continue
+		}
+
+		ref, err := name.ParseReference(baseName)
+		if err != nil {
+			logging.LogWarning("ignoring invalid base image %q recorded in %s: %v", baseName, image, err)
+
+			continue
+		}
+
+		source := ref.Name()
+
+		if digest := annotations[baseDigestAnnotation]; digest != "" {
+			if _, pinned := ref.(name.Digest); !pinned {
+				source = ref.Context().Digest(digest).Name()
+			}
+		}
+
+		return source, nil
+	}
+
+	return "", nil
+}
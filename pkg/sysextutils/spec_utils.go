@@ -0,0 +1,449 @@
+package sysextutils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/utils"
+)
+
+// LoadSpec will read a build spec from input path and return the matching
+// CreateOptions.
+// A spec is a flat YAML mapping of the create command's flags, for example:
+//
+//	image: cgr.dev/chainguard/wolfi-base
+//	name: wolfi
+//	fs: squashfs
+//
+// Only plain "key: value" lines and comments are supported, including
+// trailing comments starting with " #" outside of quotes, as in YAML.
+func LoadSpec(path string) (CreateOptions, error) {
+	opts := CreateOptions{Fs: "ext4"}
+
+	specFile, err := fileutils.ReadFile(path)
+	if err != nil {
+		return opts, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(specFile, "\x00")))
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return opts, fmt.Errorf("%s:%d: expected key: value", path, lineNumber)
+		}
+
+		key = strings.TrimSpace(key)
+		value = unquoteSpecValue(stripSpecComment(strings.TrimSpace(value)))
+
+		switch key {
+		case "image":
+			opts.Image = value
+		case "name":
+			opts.Name = value
+		case "fs":
+			opts.Fs = value
+		case "image-source":
+			opts.ImageSource = value
+		case "minimal-diff":
+			opts.MinimalDiff, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "verify-source-signature":
+			opts.SignaturePublicKey = value
+		case "set-mtime":
+			opts.Mtime = value
+		case "ignore-file":
+			opts.IgnoreFile = value
+		case "tmpdir":
+			opts.TmpDir = value
+		case "min-free-space":
+			opts.MinFreeSpace, err = utils.ParseSize(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+			}
+		case "skip-space-check":
+			opts.SkipSpaceCheck, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "no-cache":
+			opts.NoCache, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "sysext-level":
+			opts.SysextLevel = value
+		case "release-id":
+			opts.ReleaseID = value
+		case "match-host":
+			opts.MatchHost, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "max-layers":
+			opts.MaxLayers, err = strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid number %q", path, lineNumber, value)
+			}
+		case "up-to-layer":
+			opts.UpToLayer, err = strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid number %q", path, lineNumber, value)
+			}
+		case "min-systemd-version":
+			opts.MinSystemdVersion, err = strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid number %q", path, lineNumber, value)
+			}
+		case "sparse":
+			opts.Sparse, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "architecture":
+			opts.Architecture = value
+		case "depmod":
+			opts.Depmod, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "target-kernel":
+			opts.TargetKernel = value
+		case "kernel-version":
+			opts.KernelVersion = value
+		case "split-opt":
+			opts.SplitOpt, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "compression":
+			opts.Compression = value
+		case "tar-exclude":
+			opts.TarExcludes = append(opts.TarExcludes, value)
+		case "preserve-attrs":
+			opts.PreserveAttrs, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "preserve-hardlinks":
+			preserve, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+
+			opts.BreakHardlinks = !preserve
+		case "preserve-acls":
+			preserve, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+
+			opts.DropACLs = !preserve
+		case "validate-extension-release-filename":
+			validate, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+
+			opts.AllowInvalidName = !validate
+		case "dereference-symlinks":
+			opts.DereferenceSymlinks, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "assert-uid", "assert-gid":
+			id, err := strconv.Atoi(value)
+			if err != nil || id < 0 {
+				return opts, fmt.Errorf("%s:%d: invalid id %q", path, lineNumber, value)
+			}
+
+			if key == "assert-uid" {
+				opts.AllowedUIDs = append(opts.AllowedUIDs, id)
+			} else {
+				opts.AllowedGIDs = append(opts.AllowedGIDs, id)
+			}
+		case "check-symlinks":
+			opts.CheckSymlinks, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "prune-broken-symlinks":
+			opts.PruneBrokenSymlinks, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "max-uncompressed-size":
+			opts.MaxUncompressedSize, err = utils.ParseSize(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+			}
+		case "no-extension-reload":
+			opts.NoExtensionReload, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "output-name":
+			opts.OutputName = value
+		case "fail-on-empty-release":
+			opts.FailOnEmptyRelease, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "overwrite":
+			opts.Overwrite, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "compression-level":
+			opts.CompressionLevel, err = strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid number %q", path, lineNumber, value)
+			}
+		case "generate-unit":
+			opts.Unit = value
+		case "write-descriptor":
+			opts.Descriptor = value
+		case "minimize":
+			opts.Minimize, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "entrypoint":
+			opts.Entrypoints = append(opts.Entrypoints, value)
+		case "requires":
+			opts.Requires = append(opts.Requires, value)
+		case "incremental":
+			opts.Incremental, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "compress-snapshot":
+			opts.CompressSnapshot, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "portable":
+			opts.Portable, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "reproducible":
+			opts.Reproducible, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "boot-optimized":
+			opts.BootOptimized, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "dedup-against":
+			opts.DedupAgainst = value
+		case "smoke-test":
+			opts.SmokeTest = value
+		case "release-field":
+			opts.ReleaseFields = append(opts.ReleaseFields, value)
+		case "release-source-order":
+			opts.ReleaseSourceOrder = strings.Split(value, ",")
+		case "release-extra":
+			opts.ReleaseExtras = append(opts.ReleaseExtras, value)
+		case "verify-rootfs":
+			opts.VerifyRootfs, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "quiet":
+			opts.Quiet, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		case "strict":
+			opts.Strict, err = strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s:%d: invalid boolean %q", path, lineNumber, value)
+			}
+		default:
+			return opts, fmt.Errorf("%s:%d: unknown key %q", path, lineNumber, key)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return opts, err
+	}
+
+	if opts.Image == "" || opts.Name == "" {
+		return opts, fmt.Errorf("%s: image and name must be specified", path)
+	}
+
+	return opts, nil
+}
+
+// stripSpecComment returns input value without its trailing comment, if
+// any: a # at its start or preceded by a space or tab, after the closing
+// quote for quoted values.
+func stripSpecComment(value string) string {
+	start := 0
+
+	if len(value) > 0 && (value[0] == '"' || value[0] == '\'') {
+		end := strings.IndexByte(value[1:], value[0])
+		if end < 0 {
+			return value
+		}
+
+		start = end + 2
+	}
+
+	for i := start; i < len(value); i++ {
+		if value[i] == '#' && (i == 0 || value[i-1] == ' ' || value[i-1] == '\t') {
+			return strings.TrimSpace(value[:i])
+		}
+	}
+
+	return value
+}
+
+// unquoteSpecValue will strip matching single or double quotes around input value.
+func unquoteSpecValue(value string) string {
+	if len(value) >= 2 &&
+		(value[0] == '"' && value[len(value)-1] == '"' ||
+			value[0] == '\'' && value[len(value)-1] == '\'') {
+		return value[1 : len(value)-1]
+	}
+
+	return value
+}
+
+// CheckSpecCollisions will ensure no two of input specs build the same
+// sysext, by name or raw image, as building them concurrently would race on
+// the same files, and one would replace the other anyway. Specs that can't be
+// loaded are skipped, their build fails on its own.
+func CheckSpecCollisions(specs []string) error {
+	owners := map[string]string{}
+
+	for _, spec := range specs {
+		opts, err := LoadSpec(spec)
+		if err != nil {
+			continue
+		}
+
+		builds := []string{"sysext " + opts.Name, GetOutputPath(opts.Name, opts.OutputName)}
+		if opts.SplitOpt {
+			builds = append(builds, "sysext "+opts.Name+"-opt", GetOutputPath(opts.Name+"-opt", ""))
+		}
+
+		for _, build := range builds {
+			owner, found := owners[build]
+			if found && owner != spec {
+				return fmt.Errorf("%s and %s both build %s", owner, spec, build)
+			}
+
+			owners[build] = spec
+		}
+	}
+
+	return nil
+}
+
+// BuildState records the specs of a directory that were built successfully,
+// mapping each spec file name to its key, see SpecKey.
+type BuildState map[string]string
+
+// SpecKey returns a key identifying the content of input spec, so that a
+// changed spec can be told apart from an already built one.
+func SpecKey(path string) (string, error) {
+	digest := fileutils.GetFileDigest(path)
+	if digest == "" {
+		return "", fmt.Errorf("cannot read spec %s", path)
+	}
+
+	return digest, nil
+}
+
+// getBuildStatePath returns where the build state for input specs directory
+// is saved.
+func getBuildStatePath(dir string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(utils.GetOciSysextHome(), "build-state", getID(absDir)+".json"), nil
+}
+
+// LoadBuildState returns the build state saved for input specs directory,
+// an empty state is returned if none was saved.
+func LoadBuildState(dir string) (BuildState, error) {
+	state := BuildState{}
+
+	statePath, err := getBuildStatePath(dir)
+	if err != nil {
+		return state, err
+	}
+
+	if !fileutils.Exist(statePath) {
+		return state, nil
+	}
+
+	stateFile, err := fileutils.ReadFile(statePath)
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(stateFile, &state)
+
+	return state, err
+}
+
+// SaveBuildState will save input build state for input specs directory.
+// The saved state is updated under a lock, keeping the specs recorded by
+// other runs in the meantime, and written atomically, so that an interruption
+// never leaves a corrupted state behind.
+func SaveBuildState(dir string, state BuildState) error {
+	statePath, err := getBuildStatePath(dir)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(statePath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := fileutils.LockFile(statePath + ".lock")
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	saved, err := LoadBuildState(dir)
+	if err != nil {
+		return err
+	}
+
+	for spec, key := range state {
+		saved[spec] = key
+	}
+
+	stateFile, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutils.WriteFile(statePath, stateFile, 0o644)
+}
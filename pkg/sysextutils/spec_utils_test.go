@@ -0,0 +1,74 @@
+package sysextutils
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStripSpecComment(t *testing.T) {
+	tests := map[string]string{
+		"squashfs":                 "squashfs",
+		"squashfs # or ext4":       "squashfs",
+		"squashfs\t# or ext4":      "squashfs",
+		"# nothing":                "",
+		"a#b":                      "a#b",
+		`"a # b" # comment`:        `"a # b"`,
+		`'a # b'`:                  `'a # b'`,
+		`"unterminated # comment`:  `"unterminated # comment`,
+		"FOO=bar # comment # more": "FOO=bar",
+	}
+
+	for value, expected := range tests {
+		stripped := stripSpecComment(value)
+		if stripped != expected {
+			t.Errorf("stripSpecComment(%q) = %q, expected %q", value, stripped, expected)
+		}
+	}
+}
+
+func TestLoadSpecInlineComments(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "tools.yaml",
+		"image: alpine:3.19 # pinned\nname: \"tools\" # quoted\nfs: squashfs\t# tab\n", 0o644)
+
+	opts, err := LoadSpec(filepath.Join(dir, "tools.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.Image != "alpine:3.19" || opts.Name != "tools" || opts.Fs != "squashfs" {
+		t.Errorf("got image %q, name %q and fs %q", opts.Image, opts.Name, opts.Fs)
+	}
+}
+
+func TestCheckSpecCollisions(t *testing.T) {
+	withTestDirs(t)
+
+	tests := []struct {
+		specs    map[string]string
+		collides bool
+	}{
+		{map[string]string{"a": "name: a", "b": "name: b"}, false},
+		{map[string]string{"a": "name: same", "b": "name: same"}, true},
+		{map[string]string{"a": "name: a\noutput-name: out.raw", "b": "name: b\noutput-name: out.raw"}, true},
+		{map[string]string{"a": "name: a\noutput-name: b.raw", "b": "name: b"}, true},
+		{map[string]string{"a": "name: a\nsplit-opt: true", "b": "name: a-opt"}, true},
+		// specs that can't be loaded fail on their own
+		{map[string]string{"a": "name: a", "b": "invalid"}, false},
+	}
+
+	for i, test := range tests {
+		dir := t.TempDir()
+		specs := []string{}
+
+		for spec, content := range test.specs {
+			writeTestFile(t, dir, spec+".yaml", "image: alpine\n"+content+"\n", 0o644)
+			specs = append(specs, filepath.Join(dir, spec+".yaml"))
+		}
+
+		err := CheckSpecCollisions(specs)
+		if (err != nil) != test.collides {
+			t.Errorf("test %d: got %v, expected a collision %v", i, err, test.collides)
+		}
+	}
+}
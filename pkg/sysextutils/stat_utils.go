@@ -0,0 +1,95 @@
+package sysextutils
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+)
+
+// SizeEntry is the disk usage of a path of a sysext.
+type SizeEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// SizeStats is the size breakdown of a sysext.
+type SizeStats struct {
+	// Total is the disk usage of the whole sysext content.
+	Total int64 `json:"total"`
+	// Directories are the largest directories, biggest first.
+	Directories []SizeEntry `json:"directories"`
+	// Files are the largest files, biggest first.
+	Files []SizeEntry `json:"files"`
+}
+
+// StatSysext will report the largest directories and files of input target,
+// limited to top entries each.
+// Target can be the name of a sysext in SysextDir, a raw image, which is
+// loop-mounted read-only to be analyzed, or a rootfs directory. The sysexts
+// required by a sysext of SysextDir are checked, see CheckRequires.
+func StatSysext(target string, top int) (SizeStats, error) {
+	// a sysext is only useful along with the ones it requires
+	metadata, err := ReadMetadata(target)
+	if err == nil {
+		err = CheckRequires(target, metadata.Options.Requires, false)
+		if err != nil {
+			return SizeStats{}, err
+		}
+	}
+
+	rootfsDIR, closeSysext, err := openSysext(target)
+	if err != nil {
+		return SizeStats{}, err
+	}
+
+	defer closeSysext()
+
+	entries, err := fileutils.DiscUsageEntries(rootfsDIR)
+	if err != nil {
+		return SizeStats{}, err
+	}
+
+	stats := SizeStats{Total: entries["."], Directories: []SizeEntry{}, Files: []SizeEntry{}}
+
+	for path, size := range entries {
+		if path == "." {
+			continue
+		}
+
+		info, err := os.Lstat(filepath.Join(rootfsDIR, path))
+		if err != nil {
+			return SizeStats{}, err
+		}
+
+		entry := SizeEntry{Path: "/" + path, Size: size}
+		if info.IsDir() {
+			stats.Directories = append(stats.Directories, entry)
+		} else {
+			stats.Files = append(stats.Files, entry)
+		}
+	}
+
+	stats.Directories = largestEntries(stats.Directories, top)
+	stats.Files = largestEntries(stats.Files, top)
+
+	return stats, nil
+}
+
+// largestEntries returns the top biggest of input entries, biggest first.
+func largestEntries(entries []SizeEntry, top int) []SizeEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Size != entries[j].Size {
+			return entries[i].Size > entries[j].Size
+		}
+
+		return entries[i].Path < entries[j].Path
+	})
+
+	if top > 0 && len(entries) > top {
+		entries = entries[:top]
+	}
+
+	return entries
+}
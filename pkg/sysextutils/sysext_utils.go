@@ -11,15 +11,29 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/89luca89/oci-sysext/pkg/fileutils"
 	"github.com/89luca89/oci-sysext/pkg/imageutils"
 	"github.com/89luca89/oci-sysext/pkg/logging"
 	"github.com/89luca89/oci-sysext/pkg/utils"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
+// ErrNoContent is returned when an image has no filesystem content to build
+// a sysext from.
+var ErrNoContent = errors.New("image has no filesystem content to build an extension from")
+
+// sparseMinSize is the minimum size of the files made sparse after extraction.
+const sparseMinSize = 1024 * 1024
+
 // SysextDir is the default location for downloaded images.
 var (
 	SysextDir       = filepath.Join(utils.GetOciSysextHome(), "sysexts")
@@ -38,24 +52,73 @@ func getID(name string) string {
 	return fmt.Sprintf("%x", hasher.Sum(nil))
 }
 
+// lockImage will take an exclusive lock on input image's rootfs, so that
+// concurrent builds of the same image are serialized.
+// The returned function releases the lock.
+func lockImage(image string) (func(), error) {
+	err := os.MkdirAll(SysextRootfsDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileutils.LockFile(filepath.Join(SysextRootfsDir, getID(image)+".lock"))
+}
+
 func cleanRootfs(image, name string) error {
 	sysextRootfsDIR := filepath.Join(SysextRootfsDir, getID(image))
 	return os.RemoveAll(sysextRootfsDIR)
 }
 
+// preserveACLs returns whether the POSIX ACLs of the layers are restored in
+// the rootfs for input options. squashfs can't store them, mksquashfs skips
+// them when packing squashfs along with other filesystems.
+func preserveACLs(opts CreateOptions) bool {
+	return !opts.DropACLs && !onlySquashfs(opts)
+}
+
+// ensureImage will pull input image if its manifest is not in the image
+// store yet, or again without reusing any layer if noCache is true.
+// Images of containers-storage are always exported again, as their local tag
+// may point to another image since the last export, only the layers already
+// saved are reused.
+// The pull policy applies to images already pulled too.
+func ensureImage(image string, quiet bool, noCache bool) error {
+	pull := func() error {
+		_, err := imageutils.Pull(image, quiet, noCache)
+
+		return err
+	}
+
+	if noCache {
+		logging.Log("pulling %s without using the cache", image)
+
+		return logging.Phase("pull", map[string]any{"image": image}, pull)
+	}
+
+	if imageutils.IsContainersStorage(image) {
+		logging.Log("exporting %s", image)
+
+		return logging.Phase("pull", map[string]any{"image": image}, pull)
+	}
+
+	if fileutils.Exist(filepath.Join(imageutils.GetPath(image), "manifest.json")) {
+		logging.LogDebug("image %s is already pulled", image)
+
+		// the policy may have changed since the image was pulled
+		return imageutils.CheckPolicy(image)
+	}
+
+	logging.Log("pulling %s", image)
+
+	return logging.Phase("pull", map[string]any{"image": image}, pull)
+}
+
 func calcSkipLayers(image, imageSource string) (int, error) {
 	if image == imageSource || imageSource == "" {
 		// No layers to skip if there is no differential source
 		return 0, nil
 	}
 
-	logging.Log("reading %s's manifest", image)
-	imageDir := imageutils.GetPath(image)
-	manifestFile, err := fileutils.ReadFile(filepath.Join(imageDir, "manifest.json"))
-	if err != nil {
-		return 0, err
-	}
-
 	sourceImageDir := imageutils.GetPath(imageSource)
 	logging.Log("reading %s's manifest", imageSource)
 	sourceManifestFile, err := fileutils.ReadFile(filepath.Join(sourceImageDir, "manifest.json"))
@@ -63,22 +126,17 @@ func calcSkipLayers(image, imageSource string) (int, error) {
 		return 0, err
 	}
 
-	var manifest v1.Manifest
 	var sourceManifest v1.Manifest
 
-	logging.Log("parsing %s's manifest", image)
-	err = json.Unmarshal(manifestFile, &manifest)
-	if err != nil {
-		return 0, err
-	}
-
 	logging.Log("parsing %s's manifest", imageSource)
 	err = json.Unmarshal(sourceManifestFile, &sourceManifest)
 	if err != nil {
 		return 0, err
 	}
 
-	return len(manifest.Layers) - len(sourceManifest.Layers), nil
+	// the image is built on top of the source, so its first layers are the
+	// source ones.
+	return len(sourceManifest.Layers), nil
 }
 
 // createRootfs will generate a chrootable rootfs from input oci image reference, with input name and config.
@@ -86,7 +144,13 @@ func calcSkipLayers(image, imageSource string) (int, error) {
 // This function will read the oci-image manifest and properly unpack the layers in the right order to generate
 // a valid rootfs.
 // Untarring process will follow the keep-id option if specified in order to ensure no permission problems.
-func createRootfs(image string, name string, imageSource string) error {
+// Input attributes are filled with the chattr attributes of the extracted
+// files, keyed by their path relative to the rootfs, see applyAttributes.
+func createRootfs(opts CreateOptions, attributes map[string]string) error {
+	image := opts.Image
+	name := opts.Name
+	imageSource := opts.ImageSource
+
 	logging.Log("preparing rootfs for new sysext %s", name)
 
 	skip, err := calcSkipLayers(image, imageSource)
@@ -116,168 +180,2817 @@ func createRootfs(image string, name string, imageSource string) error {
 		return err
 	}
 
+	if len(manifest.Layers) == 0 {
+		return fmt.Errorf("%w: %s has no layers", ErrNoContent, image)
+	}
+
+	maxLayers := opts.MaxLayers
+	if maxLayers == 0 {
+		maxLayers = defaultMaxLayers
+	}
+
+	if len(manifest.Layers) > maxLayers {
+		return fmt.Errorf("%s has %d layers, more than the maximum of %d, see --max-layers",
+			image, len(manifest.Layers), maxLayers)
+	}
+
 	logging.Log("extracting image's layers, skipping %d layers...", skip)
 	if skip < 0 || skip > len(manifest.Layers) {
-		return errors.New("Invalid number of layers to skip")
+		return fmt.Errorf("invalid number of layers to skip: %s has %d layers, %s has %d",
+			image, len(manifest.Layers), imageSource, skip)
+	}
+
+	if skip == len(manifest.Layers) {
+		return fmt.Errorf("%w: %s adds no layers on top of %s", ErrNoContent, image, imageSource)
+	}
+
+	var config v1.ConfigFile
+
+	if opts.VerifyRootfs || opts.UpToLayer != 0 {
+		logging.Log("reading %s's config", image)
+
+		configFile, err := fileutils.ReadFile(filepath.Join(imageDir, "config.json"))
+		if err != nil {
+			return err
+		}
+
+		err = json.Unmarshal(configFile, &config)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.VerifyRootfs && len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("image has %d layers but config lists %d diff_ids",
+			len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	upTo := len(manifest.Layers)
+	if opts.UpToLayer != 0 {
+		if opts.UpToLayer < 0 || opts.UpToLayer > len(manifest.Layers) {
+			return fmt.Errorf("invalid layer %d: image has %d layers", opts.UpToLayer, len(manifest.Layers))
+		}
+
+		if opts.UpToLayer <= skip {
+			return fmt.Errorf("invalid layer %d: the first %d layers are skipped by the image source",
+				opts.UpToLayer, skip)
+		}
+
+		history := layerHistory(config)
+
+		switch {
+		case len(history) == len(manifest.Layers):
+			logging.Log("extracting up to layer %d of %d, created by: %s",
+				opts.UpToLayer, len(manifest.Layers), history[opts.UpToLayer-1].CreatedBy)
+		case len(history) > 0:
+			logging.LogWarning("the image history describes %d layers instead of %d, extracting up to layer %d",
+				len(history), len(manifest.Layers), opts.UpToLayer)
+		default:
+			logging.Log("extracting up to layer %d of %d", opts.UpToLayer, len(manifest.Layers))
+		}
+
+		upTo = opts.UpToLayer
+	}
+
+	tarExcludes := opts.TarExcludes
+	if tarExcludes == nil {
+		tarExcludes = fileutils.DefaultTarExcludes
+	}
+
+	maxUncompressedSize := opts.MaxUncompressedSize
+	if maxUncompressedSize == 0 {
+		maxUncompressedSize = defaultMaxUncompressedSize
+	}
+
+	var uncompressedSize uint64
+
+	// the layers to extract, identified by their file names
+	layers := []string{}
+
+	for _, layer := range manifest.Layers[skip:upTo] {
+		layerDigest, err := imageutils.GetLayerFileName(layer.Digest)
+		if err != nil {
+			return err
+		}
+
+		layers = append(layers, layerDigest)
+	}
+
+	snapshot := baseSnapshot{
+		KeepWhiteouts: opts.KeepWhiteouts,
+		TarExcludes:   tarExcludes,
+		ACLs:          preserveACLs(opts),
+		Verified:      opts.VerifyRootfs,
+		Compressed:    opts.CompressSnapshot,
+	}
+
+	// the sizes of the layers extracted, or restored from the snapshot
+	sizes := []uint64{}
+
+	var restored baseSnapshot
+
+	if opts.Incremental && !opts.NoCache {
+		restored, err = restoreBaseSnapshot(image, sysextRootfsDIR, layers, snapshot)
+		if err != nil {
+			return err
+		}
+
+		sizes = restored.Sizes
+		mergeAttributes(attributes, restored.Attributes)
+	}
+
+	reused := len(sizes)
+
+	// checkSize will account input layer size, failing before anything more
+	// is extracted if the layers exceed the limit.
+	checkSize := func(layerDigest string, layerSize uint64) error {
+		uncompressedSize += layerSize
+		if uncompressedSize > maxUncompressedSize {
+			_ = os.RemoveAll(sysextRootfsDIR)
+
+			return fmt.Errorf("layer %s exceeds the maximum uncompressed size: %d MB extracted, limit is %d MB",
+				layerDigest, uncompressedSize/1024/1024, maxUncompressedSize/1024/1024)
+		}
+
+		return nil
 	}
 
-	for i, layer := range manifest.Layers {
+	for i, layer := range manifest.Layers[:upTo] {
 		if i < skip {
 			logging.Log("skipping layer %s", layer.Digest)
 			continue
 		}
 
-		layerDigest := strings.Split(layer.Digest.String(), ":")[1] + ".tar.gz"
+		layerDigest := layers[i-skip]
+
+		if i-skip < reused {
+			logging.Log("reusing layer %s", layerDigest)
+
+			err = checkSize(layerDigest, sizes[i-skip])
+			if err != nil {
+				return err
+			}
+
+			logging.Event(logging.EventLayerExtracted, map[string]any{
+				"digest": layer.Digest.String(),
+				"index":  i,
+				"layers": len(manifest.Layers),
+				"size":   sizes[i-skip],
+				"reused": true,
+			})
+
+			continue
+		}
+
+		if opts.VerifyRootfs {
+			logging.Log("verifying layer %s against diff_id %s", layerDigest, config.RootFS.DiffIDs[i])
+
+			diffID, err := fileutils.GetUncompressedDigest(filepath.Join(imageDir, layerDigest), string(layer.MediaType))
+			if err != nil {
+				return err
+			}
+
+			if "sha256:"+diffID != config.RootFS.DiffIDs[i].String() {
+				return fmt.Errorf("layer %s does not match diff_id %s", layerDigest, config.RootFS.DiffIDs[i])
+			}
+		}
+
+		// list the layer before extracting anything, so that a layer
+		// decompressing to an enormous size can't fill the disk.
+		listing, err := fileutils.ListLayer(filepath.Join(imageDir, layerDigest),
+			string(layer.MediaType), tarExcludes)
+		if err != nil {
+			return err
+		}
+
+		err = checkSize(layerDigest, listing.Size)
+		if err != nil {
+			return err
+		}
+
+		sizes = append(sizes, listing.Size)
+		mergeAttributes(attributes, listing.Attributes)
+
 		logging.Log("extracting layer %s in %s", layerDigest, sysextRootfsDIR)
 
-		err = fileutils.UntarFile(filepath.Join(imageDir, layerDigest), sysextRootfsDIR)
+		err = fileutils.UntarLayer(filepath.Join(imageDir, layerDigest), sysextRootfsDIR,
+			string(layer.MediaType), listing, opts.KeepWhiteouts, preserveACLs(opts), tarExcludes)
 		if err != nil {
 			return err
 		}
-	}
 
-	dirs, err := os.ReadDir(sysextRootfsDIR)
-	if err != nil {
-		return err
+		logging.Event(logging.EventLayerExtracted, map[string]any{
+			"digest": layer.Digest.String(),
+			"index":  i,
+			"layers": len(manifest.Layers),
+			"size":   listing.Size,
+		})
+
+		// snapshot every layer but the topmost, which is the most likely to
+		// change between builds, so that the next build reuses the layers
+		// up to the first changed one.
+		if opts.Incremental && i < upTo-1 {
+			snapshot.Layers = layers[:i-skip+1]
+			snapshot.Sizes = sizes
+			snapshot.Attributes = attributes
+
+			err = saveBaseSnapshot(image, sysextRootfsDIR, snapshot)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	for _, dir := range dirs {
-		if dir.Name() != "usr" && dir.Name() != "opt" {
-			logging.Log("removing unneeded dir: %s", dir.Name())
-			// os.RemoveAll(filepath.Join(sysextRootfsDIR, dir.Name()))
+	if opts.Incremental {
+		err = pruneBaseSnapshots(image, len(layers)-1)
+		if err != nil {
+			return err
+		}
+
+		// the rootfs is hard linked to the snapshots it was restored from
+		// or saved to, the next steps may write its files in place.
+		linked := (reused > 0 && !restored.Compressed) || (!opts.CompressSnapshot && len(layers) > 1)
+		if linked {
+			err = detachRootfs(sysextRootfsDIR)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	err = os.MkdirAll(filepath.Join(sysextRootfsDIR, "/usr/lib/extension-release.d/"), os.ModePerm)
+	extracted, err := os.ReadDir(sysextRootfsDIR)
 	if err != nil {
 		return err
 	}
 
-	filePath := filepath.Join(sysextRootfsDIR, "/usr/lib/extension-release.d/", "extension-release."+name)
-	content := "ID=_any\nEXTENSION_RELOAD_MANAGER=1\n"
+	if len(extracted) == 0 {
+		return fmt.Errorf("%w: the extracted layers of %s are empty", ErrNoContent, image)
+	}
 
-	// Write the string to the file
-	err = os.WriteFile(filePath, []byte(content), 0644)
-	if err != nil {
-		return err
+	if opts.MinimalDiff && skip == 0 {
+		logging.LogWarning("no image source to diff against, --minimal-diff has no effect")
 	}
 
-	logging.Log("rootfs creation done")
-	return nil
-}
+	if opts.MinimalDiff && skip > 0 {
+		baseDIR, err := extractBaseRootfs(image, manifest.Layers[:skip], ".minimal-base", tarExcludes)
+		if err != nil {
+			return err
+		}
 
-func CreateSysext(image string, name string, fs string, imageSource string) error {
-	if fs != "squashfs" && fs != "btrfs" && fs != "ext4" {
-		return errors.New("Unsupported fs type")
+		removed, err := dropUnchangedFiles(sysextRootfsDIR, baseDIR)
+
+		_ = os.RemoveAll(baseDIR)
+
+		if err != nil {
+			return err
+		}
+
+		logging.Log("dropped %d files unchanged from %s", removed, imageSource)
 	}
 
-	// If imageSource is empty, use the full image and skip differential processing
-	if imageSource == "" {
-		imageSource = image // Optional: Set imageSource to image if you want to use the same image for some operations
+	if opts.Depmod {
+		err = runDepmod(sysextRootfsDIR, opts.KernelVersion)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Ensure the image source directory only if imageSource is not the same as image
-	if imageSource != image {
-		sourceImageDir := imageutils.GetPath(imageSource)
-		if !fileutils.Exist(sourceImageDir) {
-			_, err := imageutils.Pull(imageSource, false)
-			if err != nil {
-				return err
-			}
+	if opts.Sparse {
+		logging.Log("making big files sparse")
+
+		count, err := fileutils.DigHoles(sysextRootfsDIR, sparseMinSize)
+		if err != nil {
+			return err
 		}
+
+		logging.LogDebug("%d files processed", count)
 	}
 
-	logging.Log("cleaning up rootfs dir...")
-	err := cleanRootfs(image, name)
-	if err != nil {
-		return err
+	if opts.IgnoreFile != "" {
+		logging.Log("applying ignore file %s", opts.IgnoreFile)
+
+		err = fileutils.ApplyIgnoreFile(opts.IgnoreFile, sysextRootfsDIR)
+		if err != nil {
+			return err
+		}
 	}
 
-	logging.Log("ensuring image %s ...", imageSource)
-	sourceImageDir := imageutils.GetPath(imageSource)
-	if !fileutils.Exist(sourceImageDir) {
-		_, err := imageutils.Pull(imageSource, false)
+	if opts.DereferenceSymlinks {
+		logging.Log("dereferencing symlinks")
+
+		unresolved, err := fileutils.DereferenceSymlinks(sysextRootfsDIR)
 		if err != nil {
 			return err
 		}
+
+		for _, link := range unresolved {
+			relative, _ := filepath.Rel(sysextRootfsDIR, link)
+			logging.LogWarning("symlink /%s is dangling", relative)
+		}
+
+		if len(unresolved) > 0 && opts.Strict {
+			return fmt.Errorf("%d symlinks can't be dereferenced", len(unresolved))
+		}
 	}
 
-	err = createRootfs(image, name, imageSource)
-	if err != nil {
-		return err
+	if opts.BreakHardlinks {
+		logging.Log("breaking hard links")
+
+		count, err := fileutils.BreakHardlinks(sysextRootfsDIR)
+		if err != nil {
+			return err
+		}
+
+		logging.LogDebug("%d hard linked files copied", count)
 	}
 
-	err = os.MkdirAll(SysextDir, os.ModePerm)
+	dirs, err := os.ReadDir(sysextRootfsDIR)
 	if err != nil {
 		return err
 	}
 
-	_ = os.Remove(filepath.Join(SysextDir, name+".raw"))
+	for _, dir := range dirs {
+		if dir.Name() != "usr" && dir.Name() != "opt" {
+			logging.Log("removing unneeded dir: %s", dir.Name())
+			// os.RemoveAll(filepath.Join(sysextRootfsDIR, dir.Name()))
+		}
+	}
 
-	sysextRootfsDIR := filepath.Join(SysextRootfsDir, getID(image))
-	logging.Log("creating raw file")
-	cmd := exec.Command("", "")
+	if opts.CheckSymlinks {
+		err = checkSymlinks(sysextRootfsDIR, opts.PruneBrokenSymlinks, opts.Strict)
+		if err != nil {
+			return err
+		}
+	}
 
-	if fs == "squashfs" {
-		cmd = exec.Command("mksquashfs", []string{
-			sysextRootfsDIR,
-			filepath.Join(SysextDir, name+".raw"),
-		}...)
-	} else if fs == "btrfs" {
-		cmd = exec.Command("mkfs.btrfs", []string{
-			"--mixed",
-			"-m",
-			"single",
-			"-d",
-			"single",
-			"--shrink",
-			"--rootdir",
-			sysextRootfsDIR,
-			filepath.Join(SysextDir, name+".raw"),
-		}...)
-	} else if fs == "ext4" {
-		size, err := fileutils.DiscUsageMegaBytes(sysextRootfsDIR)
+	if len(opts.AllowedUIDs) > 0 || len(opts.AllowedGIDs) > 0 {
+		err = checkOwners(sysextRootfsDIR, opts.AllowedUIDs, opts.AllowedGIDs)
 		if err != nil {
 			return err
 		}
+	}
 
-		logging.Log("creating image of size %s", size)
-		out, err := exec.Command("truncate", []string{
-			"-s", size, filepath.Join(SysextDir, name+".raw"),
-		}...).CombinedOutput()
+	if opts.Portable {
+		units, err := findPortableUnits(sysextRootfsDIR, name)
 		if err != nil {
-			logging.LogError(string(out))
 			return err
 		}
 
-		logging.Log("mkfs.ext4")
-		out, err = exec.Command("mkfs.ext4", []string{
-			"-E",
-			"root_owner=0:0",
-			"-d",
-			sysextRootfsDIR,
-			filepath.Join(SysextDir, name+".raw"),
-		}...).CombinedOutput()
+		if len(units) == 0 {
+			return fmt.Errorf("--portable requires unit files named %s.service, %s-*.service or %s@.service "+
+				"(or other unit types) in /usr/lib/systemd/system or /etc/systemd/system", name, name, name)
+		}
+
+		logging.Log("found portable units: %s", strings.Join(units, ", "))
+	}
+
+	fields, err := composeReleaseFields(opts, sysextRootfsDIR)
+	if err != nil {
+		return err
+	}
+
+	if !isFlagsReleaseSourceOrder(opts) {
+		logging.Log("composed extension-release from %s: %s",
+			strings.Join(releaseSourceOrder(opts), ", "), strings.Join(fields, " "))
+
+		err = checkReleaseFields(fields, opts)
 		if err != nil {
-			logging.LogError(string(out))
 			return err
 		}
+	}
 
-		logging.Log("resize2fs")
-		out, err = exec.Command("resize2fs", []string{"-M", filepath.Join(SysextDir, name+".raw")}...).CombinedOutput()
+	// after composing the extension-release, which may need the image's
+	// os-release.
+	if opts.Minimize {
+		entrypoints, err := minimizeEntrypoints(opts, sysextRootfsDIR)
 		if err != nil {
-			logging.LogError(string(out))
 			return err
 		}
 
-		return nil
-	} else {
-		return errors.New("Unsupported fs type")
+		logging.Log("minimizing the rootfs for %s", strings.Join(entrypoints, ", "))
+
+		removed, err := minimizeRootfs(sysextRootfsDIR, entrypoints, opts.Strict)
+		if err != nil {
+			return err
+		}
+
+		logging.Log("removed %d files not needed by %s", removed, strings.Join(entrypoints, ", "))
+	}
+
+	err = checkInitrdScope(sysextRootfsDIR, fields, opts.Strict)
+	if err != nil {
+		return err
 	}
 
-	output, err := cmd.CombinedOutput()
+	err = writeExtensionRelease(sysextRootfsDIR, name, fields)
 	if err != nil {
-		logging.LogError(string(output))
+		return err
+	}
+
+	for _, extra := range opts.ReleaseExtras {
+		err = copyReleaseExtra(sysextRootfsDIR, name, extra)
+		if err != nil {
+			return err
+		}
 	}
-	return err
+
+	logging.Log("rootfs creation done")
+	return nil
+}
+
+// runDepmod will regenerate the kernel modules dependency data in input rootfs
+// for input kernel version. If kernelVersion is empty, it's detected from the
+// modules directory, which must then contain a single kernel version.
+func runDepmod(rootfsDIR string, kernelVersion string) error {
+	modulesDIR := filepath.Join(rootfsDIR, "usr/lib/modules")
+
+	if kernelVersion == "" {
+		versions, err := os.ReadDir(modulesDIR)
+		if err != nil {
+			return fmt.Errorf("cannot find kernel modules in /usr/lib/modules: %w", err)
+		}
+
+		if len(versions) != 1 {
+			return fmt.Errorf("found %d kernel versions in /usr/lib/modules, specify one with --kernel-version",
+				len(versions))
+		}
+
+		kernelVersion = versions[0].Name()
+	}
+
+	if !fileutils.Exist(filepath.Join(modulesDIR, kernelVersion)) {
+		return fmt.Errorf("kernel modules for %s not found in /usr/lib/modules", kernelVersion)
+	}
+
+	logging.Log("running depmod for kernel %s", kernelVersion)
+
+	args := []string{"-b", rootfsDIR}
+
+	// without --moduledir, depmod reads and writes <rootfs>/lib/modules, a
+	// symlink of the image could make it reach the host modules.
+	help, _ := exec.Command("depmod", "--help").CombinedOutput()
+	if strings.Contains(string(help), "--moduledir") {
+		args = append(args, "--moduledir", "/usr/lib/modules")
+	} else {
+		cleanup, err := linkModulesDir(rootfsDIR)
+		if err != nil {
+			return err
+		}
+
+		defer cleanup()
+	}
+
+	out, err := exec.Command("depmod", append(args, kernelVersion)...).CombinedOutput()
+	if err != nil {
+		logging.LogError(string(out))
+		return err
+	}
+
+	return nil
+}
+
+// linkModulesDir will ensure /lib/modules of input rootfs is /usr/lib/modules
+// of the rootfs itself, for the versions of depmod without --moduledir, and
+// return the function undoing it. A rootfs without /lib gets a relative
+// symlink to usr/lib, removed afterwards, while any other /lib must resolve to
+// usr/lib of the rootfs on the host already, as depmod follows it there.
+func linkModulesDir(rootfsDIR string) (func(), error) {
+	libDIR := filepath.Join(rootfsDIR, "lib")
+
+	_, err := os.Lstat(libDIR)
+	if os.IsNotExist(err) {
+		err = os.Symlink("usr/lib", libDIR)
+		if err != nil {
+			return nil, err
+		}
+
+		return func() { _ = os.Remove(libDIR) }, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(libDIR, "modules"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot run depmod: /lib/modules of the rootfs doesn't resolve: %w", err)
+	}
+
+	expected, err := filepath.EvalSymlinks(filepath.Join(rootfsDIR, "usr/lib/modules"))
+	if err != nil {
+		return nil, err
+	}
+
+	if resolved != expected {
+		return nil, fmt.Errorf("cannot run depmod: /lib/modules of the rootfs resolves to %s instead of its "+
+			"/usr/lib/modules, and depmod doesn't support --moduledir", resolved)
+	}
+
+	return func() {}, nil
+}
+
+// releaseFields returns the extension-release fields for input options,
+// without any other release source, see composeReleaseFields.
+func releaseFields(opts CreateOptions) []string {
+	if len(opts.ExtensionRelease) > 0 {
+		return append([]string{}, opts.ExtensionRelease...)
+	}
+
+	return append([]string{"ID=_any"}, flagReleaseFields(opts)...)
+}
+
+// layerHistory returns the history entries of input image config that
+// created a layer, in the order of the layers. The entries marked with
+// empty_layer, like the ones of ENV or CMD instructions, are skipped.
+func layerHistory(config v1.ConfigFile) []v1.History {
+	history := []v1.History{}
+
+	for _, entry := range config.History {
+		if !entry.EmptyLayer {
+			history = append(history, entry)
+		}
+	}
+
+	return history
+}
+
+// flagReleaseFields returns the extension-release fields set by input
+// options, the default ID=_any excluded.
+func flagReleaseFields(opts CreateOptions) []string {
+	fields := []string{}
+	if opts.ReleaseID != "" {
+		fields = append(fields, "ID="+opts.ReleaseID)
+	}
+
+	if !opts.NoExtensionReload {
+		fields = append(fields, "EXTENSION_RELOAD_MANAGER=1")
+	}
+
+	if opts.Architecture != "" && opts.Architecture != anyArchitecture {
+		fields = append(fields, "ARCHITECTURE="+opts.Architecture)
+	}
+
+	if opts.SysextLevel != "" {
+		fields = append(fields, "SYSEXT_LEVEL="+opts.SysextLevel)
+	}
+
+	if opts.BootOptimized {
+		fields = append(fields, "SYSEXT_SCOPE=initrd")
+	}
+
+	if opts.Portable {
+		fields = append(fields, "PORTABLE_PREFIXES="+opts.Name)
+	}
+
+	if opts.Version != "" {
+		fields = append(fields, "SYSEXT_VERSION_ID="+opts.Version)
+	}
+
+	return append(fields, opts.ReleaseFields...)
+}
+
+// writeExtensionRelease will write the extension-release file for sysext name
+// in input rootfs, with one line for each of input KEY=VALUE fields.
+// Content is normalized to LF line endings with exactly one trailing newline,
+// and fields containing line breaks are rejected.
+func writeExtensionRelease(rootfsDIR string, name string, fields []string) error {
+	lines := []string{}
+
+	for _, field := range fields {
+		field = strings.TrimRight(field, "\r\n")
+		if strings.ContainsAny(field, "\r\n") {
+			return fmt.Errorf("invalid extension-release field %q: line breaks are not allowed", field)
+		}
+
+		lines = append(lines, field)
+	}
+
+	releaseDIR := filepath.Join(rootfsDIR, "/usr/lib/extension-release.d/")
+
+	err := os.MkdirAll(releaseDIR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	releaseFile := filepath.Join(releaseDIR, "extension-release."+name)
+
+	// the rootfs can be hard linked to a base snapshot, so replace the file
+	// instead of writing it in place.
+	err = os.Remove(releaseFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.WriteFile(releaseFile, []byte(content), 0o644)
+}
+
+// defaultMaxUncompressedSize is the default limit to the size of the
+// extracted layers.
+const defaultMaxUncompressedSize = 64 << 30
+
+// defaultMaxLayers is the default limit to the number of layers of an image,
+// well above what container engines can stack with overlayfs.
+const defaultMaxLayers = 128
+
+// parseReleaseExtra will split input SRC=DST release extra, ensuring DST is a
+// path inside the extension-release directory other than the managed
+// extension-release file of sysext name.
+func parseReleaseExtra(name string, extra string) (string, string, error) {
+	source, target, found := strings.Cut(extra, "=")
+	if !found || source == "" || target == "" {
+		return "", "", fmt.Errorf("invalid release extra %q: expected SRC=DST", extra)
+	}
+
+	target = filepath.Clean(target)
+	if filepath.IsAbs(target) || target == "." || target == ".." || strings.HasPrefix(target, "../") {
+		return "", "", fmt.Errorf("invalid release extra %q: DST must be relative to the extension-release directory",
+			extra)
+	}
+
+	if target == "extension-release."+name {
+		return "", "", fmt.Errorf("invalid release extra %q: extension-release.%s is managed by oci-sysext, "+
+			"use --release-field", extra, name)
+	}
+
+	return source, target, nil
+}
+
+// copyReleaseExtra will copy the SRC file of input SRC=DST release extra to
+// DST in the extension-release directory of input rootfs.
+func copyReleaseExtra(rootfsDIR string, name string, extra string) error {
+	source, target, err := parseReleaseExtra(name, extra)
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(source)
+	if err != nil {
+		return err
+	}
+
+	target = filepath.Join(rootfsDIR, "usr/lib/extension-release.d", target)
+
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	logging.Log("copying %s to %s", source, target)
+
+	// the rootfs can be hard linked to a base snapshot, so replace the file
+	// instead of writing it in place.
+	err = os.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.WriteFile(target, content, 0o644)
+}
+
+// CreateOptions holds the settings used by CreateSysext.
+type CreateOptions struct {
+	// Image is the OCI image to create the sysext from.
+	Image string `json:"image,omitempty"`
+	// Name is the name of the sysext.
+	Name string `json:"name,omitempty"`
+	// Fs is the filesystem of the raw image.
+	Fs string `json:"fs,omitempty"`
+	// ImageSource is an optional image to diff-out of Image.
+	ImageSource string `json:"imageSource,omitempty"`
+	// AutoSource uses the base image recorded in the annotations of Image
+	// as ImageSource, building the full image if none is recorded.
+	AutoSource bool `json:"autoSource,omitempty"`
+	// SignaturePublicKey is an optional path to a public key used to verify
+	// Image's signature before extraction.
+	SignaturePublicKey string `json:"signaturePublicKey,omitempty"`
+	// Mtime optionally sets the modification time of the raw image, it can
+	// be "now", "source-date", an RFC3339 time or a unix timestamp.
+	Mtime string `json:"mtime,omitempty"`
+	// VerifyRootfs verifies each extracted layer against the diff_ids
+	// listed in the image's config.
+	VerifyRootfs bool `json:"verifyRootfs,omitempty"`
+	// ReleaseFields are additional KEY=VALUE lines appended to the
+	// extension-release file.
+	ReleaseFields []string `json:"releaseFields,omitempty"`
+	// ReleaseSourceOrder lists the sources of the extension-release fields,
+	// from the highest priority: flags, image-os-release and host, see
+	// composeReleaseFields. It defaults to flags then image-os-release, see
+	// releaseSourceOrder.
+	ReleaseSourceOrder []string `json:"releaseSourceOrder,omitempty"`
+	// ExtensionRelease, if set, is the whole extension-release as KEY=VALUE
+	// lines, used as is instead of composing it. It's recorded by
+	// SetExtensionRelease, so that rebuilding from the metadata gives the
+	// edited extension-release.
+	ExtensionRelease []string `json:"extensionRelease,omitempty"`
+	// ReleaseExtras are SRC=DST files copied to DST in the
+	// extension-release directory, along with the extension-release file.
+	ReleaseExtras []string `json:"releaseExtras,omitempty"`
+	// KeepWhiteouts leaves the layers' whiteout markers in the rootfs
+	// without applying them, for debugging.
+	KeepWhiteouts bool `json:"keepWhiteouts,omitempty"`
+	// Quiet hides the progress of the image pull and of the packing.
+	Quiet bool `json:"quiet,omitempty"`
+	// Strict turns warnings about unsafe inputs into errors.
+	Strict bool `json:"strict,omitempty"`
+	// IgnoreFile is an optional gitignore-style file listing paths to remove
+	// from the rootfs after extraction.
+	IgnoreFile string `json:"ignoreFile,omitempty"`
+	// TmpDir is the TMPDIR used by the packing tools, defaults to a
+	// directory in SysextRootfsDir.
+	TmpDir string `json:"tmpDir,omitempty"`
+	// MinFreeSpace overrides the estimated free space, in bytes, required
+	// on the staging and output volumes.
+	MinFreeSpace uint64 `json:"minFreeSpace,omitempty"`
+	// SkipSpaceCheck disables the free space preflight check.
+	SkipSpaceCheck bool `json:"skipSpaceCheck,omitempty"`
+	// NoCache pulls Image and ImageSource again, without reusing any layer
+	// already downloaded.
+	NoCache bool `json:"noCache,omitempty"`
+	// UpToLayer, if not zero, only extracts the first UpToLayer layers of
+	// Image, building from an earlier point of its history.
+	UpToLayer int `json:"upToLayer,omitempty"`
+	// MinSystemdVersion is the oldest systemd version the sysext targets,
+	// it's recorded in the metadata and checked against the release fields.
+	MinSystemdVersion int `json:"minSystemdVersion,omitempty"`
+	// Sparse deallocates the zero-filled regions of big files after
+	// extraction, so that they are packed as sparse files.
+	Sparse bool `json:"sparse,omitempty"`
+	// Architecture is the ARCHITECTURE= of the extension-release file,
+	// "_any" or empty leave it unset so the sysext matches any architecture.
+	Architecture string `json:"architecture,omitempty"`
+	// ReleaseID is the ID of the extension-release, "_any" to match any host
+	// OS. If empty, the ID of the image's os-release is used, see
+	// releaseSourceOrder.
+	ReleaseID string `json:"releaseId,omitempty"`
+	// SysextLevel is the SYSEXT_LEVEL of the extension-release, matched
+	// against the one of the host.
+	SysextLevel string `json:"sysextLevel,omitempty"`
+	// MatchHost restricts the sysext to hosts like the build host, see
+	// matchHost.
+	MatchHost bool `json:"matchHost,omitempty"`
+	// Depmod regenerates the kernel modules dependency data in the rootfs.
+	Depmod bool `json:"depmod,omitempty"`
+	// TargetKernel is the oldest kernel version the sysext is meant to be
+	// mounted by, its compression is checked against it.
+	TargetKernel string `json:"targetKernel,omitempty"`
+	// KernelVersion is the kernel version to run depmod for, it's detected
+	// from the modules directory if empty.
+	KernelVersion string `json:"kernelVersion,omitempty"`
+	// SplitOpt packs /opt in a separate <Name>-opt sysext.
+	SplitOpt bool `json:"splitOpt,omitempty"`
+	// Compression is the compression algorithm of the raw image, it
+	// defaults to the one configured for Fs.
+	Compression string `json:"compression,omitempty"`
+	// CompressionLevel is the level of Compression, zero uses the packing
+	// tool's default.
+	CompressionLevel int `json:"compressionLevel,omitempty"`
+	// Unit is an optional path where to write a systemd service unit running
+	// the image's entrypoint.
+	Unit string `json:"unit,omitempty"`
+	// Descriptor is an optional path where to write the sysext's Descriptor.
+	Descriptor string `json:"descriptor,omitempty"`
+	// Requires are the sysexts that must be merged along with this one,
+	// they're recorded in the metadata.
+	Requires []string `json:"requires,omitempty"`
+	// Incremental reuses the layers extracted by the previous build of Image,
+	// up to the first changed one, and saves them for the next build.
+	Incremental bool `json:"incremental,omitempty"`
+	// CompressSnapshot stores the snapshot saved by Incremental as a zstd
+	// compressed tar, extracted again by the next build.
+	CompressSnapshot bool `json:"compressSnapshot,omitempty"`
+	// Portable makes the sysext usable as a portable service extension,
+	// with Name as its units prefix.
+	Portable bool `json:"portable,omitempty"`
+	// Reproducible packs squashfs images with a fixed file layout and
+	// creation time, see PackOptions.
+	Reproducible bool `json:"reproducible,omitempty"`
+	// BootOptimized packs the sysext for the initrd, see bootCompression,
+	// and sets SYSEXT_SCOPE=initrd.
+	BootOptimized bool `json:"bootOptimized,omitempty"`
+	// TarExcludes are the tar patterns of the paths not extracted from the
+	// layers, they default to fileutils.DefaultTarExcludes.
+	TarExcludes []string `json:"tarExcludes,omitempty"`
+	// DereferenceSymlinks replaces the symlinks in the rootfs with copies of
+	// their targets.
+	DereferenceSymlinks bool `json:"dereferenceSymlinks,omitempty"`
+	// AllowedUIDs and AllowedGIDs, if not empty, are the only owners
+	// allowed for the files of the rootfs, see checkOwners.
+	AllowedUIDs []int `json:"allowedUids,omitempty"`
+	AllowedGIDs []int `json:"allowedGids,omitempty"`
+	// MinimalDiff drops the files of the differential layers identical to
+	// the ones of ImageSource, see dropUnchangedFiles.
+	MinimalDiff bool `json:"minimalDiff,omitempty"`
+	// CheckSymlinks reports the symlinks in /usr and /opt that don't resolve
+	// inside them, see checkSymlinks.
+	CheckSymlinks bool `json:"checkSymlinks,omitempty"`
+	// PruneBrokenSymlinks removes the symlinks reported by CheckSymlinks.
+	PruneBrokenSymlinks bool `json:"pruneBrokenSymlinks,omitempty"`
+	// Minimize removes the files of /usr and /opt not needed to run the
+	// Entrypoints, see minimizeRootfs.
+	Minimize bool `json:"minimize,omitempty"`
+	// Entrypoints are the binaries kept by Minimize, they default to the
+	// image's entrypoint.
+	Entrypoints []string `json:"entrypoints,omitempty"`
+	// PreserveAttrs applies the file attributes of the layers, like
+	// immutable or append-only, to the files of ext4 and btrfs images, see
+	// fileutils.FileAttributes.
+	PreserveAttrs bool `json:"preserveAttrs,omitempty"`
+	// BreakHardlinks replaces the hard linked files in the rootfs with
+	// independent copies, instead of preserving the links in the raw image.
+	BreakHardlinks bool `json:"breakHardlinks,omitempty"`
+	// DropACLs drops the POSIX ACLs of the layers, which are otherwise
+	// preserved in ext4 and btrfs images, see preserveACLs.
+	DropACLs bool `json:"dropACLs,omitempty"`
+	// MaxUncompressedSize is the limit, in bytes, to the total size of the
+	// extracted layers, it defaults to defaultMaxUncompressedSize.
+	MaxUncompressedSize uint64 `json:"maxUncompressedSize,omitempty"`
+	// MaxLayers is the limit to the number of layers of the image, it
+	// defaults to defaultMaxLayers.
+	MaxLayers int `json:"maxLayers,omitempty"`
+	// NoExtensionReload omits EXTENSION_RELOAD_MANAGER=1 from the
+	// extension-release, so that the service manager is not reloaded when the
+	// sysext is merged.
+	NoExtensionReload bool `json:"noExtensionReload,omitempty"`
+	// OutputName is the file name of the raw image in SysextDir, including its
+	// extension, it defaults to <Name>.raw. The extension-release is still
+	// named after Name.
+	OutputName string `json:"outputName,omitempty"`
+	// Version is the semantic version of the build, it's set as
+	// SYSEXT_VERSION_ID and the raw image is kept in SysextVersionsDir, see
+	// ListVersions.
+	Version string `json:"version,omitempty"`
+	// AllowInvalidName only warns about a Name that systemd-sysext would
+	// never merge, instead of failing, see validateExtensionName.
+	AllowInvalidName bool `json:"allowInvalidName,omitempty"`
+	// FailOnEmptyRelease makes an extension-release not restricting the
+	// hosts the sysext is merged on an error.
+	FailOnEmptyRelease bool `json:"failOnEmptyRelease,omitempty"`
+	// Overwrite allows replacing an existing sysext with the same name built
+	// from a different image.
+	Overwrite bool `json:"overwrite,omitempty"`
+	// DedupAgainst is a reference image, the sysext files identical to
+	// its ones are listed in a DedupManifest, see GetDedupPath.
+	DedupAgainst string `json:"dedupAgainst,omitempty"`
+	// SmokeTest is an optional command run with the built sysext overlaid
+	// on the host, failing the build if it exits non-zero.
+	SmokeTest string `json:"smokeTest,omitempty"`
+}
+
+// CreateSysext will create a sysext raw image from the input options.
+// With the event stream enabled, no progress is shown.
+func CreateSysext(opts CreateOptions) error {
+	opts.Quiet = opts.Quiet || logging.JSONEvents()
+
+	return logging.Phase("build", map[string]any{"name": opts.Name, "image": opts.Image}, func() error {
+		return createSysext(opts)
+	})
+}
+
+// createSysext is CreateSysext, within its build phase.
+func createSysext(opts CreateOptions) error {
+	image := opts.Image
+	name := opts.Name
+	imageSource := opts.ImageSource
+
+	filesystems, err := splitFilesystems(opts.Fs)
+	if err != nil {
+		return err
+	}
+
+	// the first fs is the main one, the others are packed as variants.
+	fs := filesystems[0]
+
+	err = validateFlags(opts)
+	if err != nil {
+		return err
+	}
+
+	err = validateExtensionName(name, !opts.AllowInvalidName)
+	if err != nil {
+		return err
+	}
+
+	if opts.SplitOpt {
+		err = validateExtensionName(name+"-opt", !opts.AllowInvalidName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.MaxLayers < 0 {
+		return fmt.Errorf("invalid maximum number of layers %d", opts.MaxLayers)
+	}
+
+	if opts.Version != "" {
+		_, err := utils.ParseSemver(opts.Version)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Mtime != "" {
+		_, err := parseMtime(opts.Mtime)
+		if err != nil {
+			return err
+		}
+	}
+
+	compressions := map[string]string{}
+
+	for _, fs := range filesystems {
+		err = validateCompression(fs, opts.Compression, 0)
+		if err != nil {
+			return err
+		}
+
+		fsOpts := opts
+		fsOpts.Fs = fs
+
+		compression, err := resolveCompression(fsOpts)
+		if err != nil {
+			return err
+		}
+
+		err = validateCompression(fs, compression, opts.CompressionLevel)
+		if err != nil {
+			return err
+		}
+
+		err = checkKernelCompression(fs, compression, opts.TargetKernel, opts.Strict)
+		if err != nil {
+			return err
+		}
+
+		compressions[fs] = compression
+	}
+
+	if opts.MatchHost {
+		opts, err = matchHost(opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.SysextLevel != "" {
+		err = validateSysextLevel(opts.SysextLevel)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.ReleaseID != "" {
+		err = validateReleaseField("ID=" + opts.ReleaseID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, field := range opts.ReleaseFields {
+		err := validateReleaseField(field)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, extra := range opts.ReleaseExtras {
+		_, _, err := parseReleaseExtra(name, extra)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.OutputName != "" {
+		err = validateOutputName(name, opts.OutputName, opts.Strict)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Architecture != "" {
+		architecture, err := normalizeArchitecture(opts.Architecture)
+		if err != nil {
+			return err
+		}
+
+		opts.Architecture = architecture
+	}
+
+	err = validateReleaseSourceOrder(opts.ReleaseSourceOrder)
+	if err != nil {
+		return err
+	}
+
+	// with other release sources, the fields are only known once the
+	// rootfs is extracted.
+	if isFlagsReleaseSourceOrder(opts) {
+		err = checkReleaseFields(releaseFields(opts), opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkWritableStore(opts)
+	if err != nil {
+		return err
+	}
+
+	image, err = imageutils.ResolveShortName(image)
+	if err != nil {
+		return err
+	}
+
+	if imageSource != "" {
+		imageSource, err = imageutils.ResolveShortName(imageSource)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.DedupAgainst != "" {
+		opts.DedupAgainst, err = imageutils.ResolveShortName(opts.DedupAgainst)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.AutoSource {
+		imageSource, err = detectImageSource(image, opts.Quiet)
+		if err != nil {
+			return err
+		}
+
+		if imageSource == "" {
+			logging.LogWarning("%s records no base image, building the full image", image)
+		} else {
+			logging.Log("using base image %s as image source", imageSource)
+		}
+	}
+
+	opts.Image = image
+
+	names := []string{name}
+	if opts.SplitOpt {
+		names = append(names, name+"-opt")
+	}
+
+	for _, name := range names {
+		err = checkNameCollision(name, image, opts.Strict, opts.Overwrite)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkOutputCollision(GetOutputPath(name, opts.OutputName), names...)
+	if err != nil {
+		return err
+	}
+
+	if opts.SplitOpt {
+		err = checkOutputCollision(GetOutputPath(name+"-opt", ""), names...)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = CheckRequires(name, opts.Requires, opts.Strict)
+	if err != nil {
+		return err
+	}
+
+	// If imageSource is empty, use the full image and skip differential processing
+	if imageSource == "" {
+		imageSource = image // Optional: Set imageSource to image if you want to use the same image for some operations
+	}
+
+	unlock, err := lockImage(image)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	logging.Log("cleaning up rootfs dir...")
+	err = cleanRootfs(image, name)
+	if err != nil {
+		return err
+	}
+
+	// every manifest read from here on needs both images.
+	err = ensureImage(image, opts.Quiet, opts.NoCache)
+	if err != nil {
+		return err
+	}
+
+	if imageSource != image {
+		err = ensureImage(imageSource, opts.Quiet, opts.NoCache)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.DedupAgainst != "" {
+		err = ensureImage(opts.DedupAgainst, opts.Quiet, opts.NoCache)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkPinned(image, opts.Strict)
+	if err != nil {
+		return err
+	}
+
+	if !opts.SkipSpaceCheck {
+		err = checkFreeSpace(image, opts.MinFreeSpace)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.SignaturePublicKey != "" {
+		logging.Log("verifying signature of %s ...", image)
+
+		err = imageutils.VerifySignature(image, opts.SignaturePublicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	opts.ImageSource = imageSource
+
+	// the chattr attributes of the extracted files
+	attributes := map[string]string{}
+
+	err = logging.Phase("rootfs", map[string]any{"image": image}, func() error {
+		return createRootfs(opts, attributes)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(SysextDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	sysextRootfsDIR := filepath.Join(SysextRootfsDir, getID(image))
+
+	// each sysext to pack, with its rootfs
+	type output struct {
+		name      string
+		rootfsDIR string
+	}
+
+	outputs := []output{{name: name, rootfsDIR: sysextRootfsDIR}}
+
+	// composed before splitting /opt, which leaves only /usr in the rootfs
+	fields, err := composeReleaseFields(opts, sysextRootfsDIR)
+	if err != nil {
+		return err
+	}
+
+	if opts.SplitOpt {
+		optRootfsDIR, err := splitOpt(sysextRootfsDIR, name+"-opt", opts, fields)
+		if err != nil {
+			return err
+		}
+
+		defer func() { _ = os.RemoveAll(optRootfsDIR) }()
+
+		outputs = append(outputs, output{name: name + "-opt", rootfsDIR: optRootfsDIR})
+	}
+
+	imageDigest, err := imageutils.GetDigest(image)
+	if err != nil {
+		return err
+	}
+
+	config, err := readImageConfig(image)
+	if err != nil {
+		return err
+	}
+
+	// squashfs is read-only, file attributes are meaningless there
+	if !opts.PreserveAttrs || onlySquashfs(opts) {
+		attributes = nil
+	}
+
+	var dedup *dedupIndex
+
+	if opts.DedupAgainst != "" {
+		logging.Log("indexing the files of %s", opts.DedupAgainst)
+
+		dedup, err = newDedupIndex(opts.DedupAgainst)
+		if err != nil {
+			return err
+		}
+
+		defer dedup.remove()
+	}
+
+	rawFiles := []string{}
+	outputTargets := map[string][]string{}
+
+	for _, output := range outputs {
+		outputName, rootfsDIR := output.name, output.rootfsDIR
+
+		target := GetOutputPath(outputName, "")
+		if outputName == name {
+			target = GetOutputPath(name, opts.OutputName)
+		}
+
+		removeStaleVariants(outputName, filesystems)
+
+		// the same rootfs is packed once per fs
+		targets := []string{target}
+
+		for i, fs := range filesystems {
+			fsTarget := target
+			if i > 0 {
+				fsTarget = getFsVariantPath(target, fs)
+
+				err = os.MkdirAll(filepath.Dir(fsTarget), os.ModePerm)
+				if err != nil {
+					return err
+				}
+
+				targets = append(targets, fsTarget)
+			}
+
+			_ = os.Remove(fsTarget)
+
+			logging.Log("creating raw file %s", fsTarget)
+
+			err = logging.Phase("pack", map[string]any{"target": fsTarget, "fs": fs}, func() error {
+				return PackRootfs(rootfsDIR, fsTarget, fs, packOptions(opts, compressions[fs]))
+			})
+			if err != nil {
+				// the staging rootfs is rebuilt from scratch anyway, don't
+				// leave it behind, nor the raw images already packed, which
+				// have no metadata yet.
+				_ = os.RemoveAll(sysextRootfsDIR)
+
+				for _, packed := range outputTargets {
+					for _, packedTarget := range packed {
+						_ = os.Remove(packedTarget)
+					}
+				}
+
+				for _, packedTarget := range targets {
+					_ = os.Remove(packedTarget)
+				}
+
+				return fmt.Errorf("cannot pack %s: %w", fsTarget, err)
+			}
+
+			if len(attributes) > 0 && fs != "squashfs" {
+				count, err := applyAttributes(fsTarget, rootfsDIR, attributes)
+				if err != nil {
+					_ = os.Remove(fsTarget)
+
+					return fmt.Errorf("cannot set the file attributes of %s: %w", fsTarget, err)
+				}
+
+				logging.Log("set the file attributes of %d files", count)
+			}
+		}
+
+		rawFiles = append(rawFiles, target)
+		outputTargets[outputName] = targets
+	}
+
+	if opts.SmokeTest != "" {
+		err = logging.Phase("smoke-test", nil, func() error {
+			return RunSmokeTest(rawFiles, opts.SmokeTest)
+		})
+		if err != nil {
+			// a sysext failing its smoke test must not be published: drop
+			// its raw images, and the metadata a previous build left for
+			// them.
+			for outputName, targets := range outputTargets {
+				for _, target := range targets {
+					_ = os.Remove(target)
+				}
+
+				_ = os.Remove(GetMetadataPath(outputName))
+			}
+
+			return err
+		}
+	}
+
+	for _, output := range outputs {
+		outputName, rootfsDIR := output.name, output.rootfsDIR
+		targets := outputTargets[outputName]
+		target := targets[0]
+
+		metadata := Metadata{
+			Name:        outputName,
+			Image:       image,
+			ImageDigest: imageDigest,
+			Fs:          fs,
+			Created:     time.Now().UTC().Format(time.RFC3339),
+			Version:     opts.Version,
+			Entrypoint:  config.Entrypoint,
+			Cmd:         config.Cmd,
+			Env:         config.Env,
+			Variants:    append([]string{}, filesystems[1:]...),
+			Options:     opts,
+		}
+		if imageSource != image {
+			metadata.ImageSource = imageSource
+		}
+
+		logging.Log("saving metadata")
+
+		err = WriteMetadata(metadata)
+		if err != nil {
+			return err
+		}
+
+		if opts.Version != "" {
+			logging.Log("saving version %s of %s", opts.Version, outputName)
+
+			err = saveVersion(metadata, target)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = writeDedupManifest(outputName, rootfsDIR, dedup)
+		if err != nil {
+			return err
+		}
+
+		if opts.Descriptor != "" {
+			// the main sysext's descriptor is written at the requested
+			// path, the others next to it.
+			descriptorPath := opts.Descriptor
+			if outputName != name {
+				descriptorPath = filepath.Join(filepath.Dir(opts.Descriptor), outputName+".descriptor.json")
+			}
+
+			logging.Log("writing descriptor %s", descriptorPath)
+
+			err = WriteDescriptor(descriptorPath, metadata, fields)
+			if err != nil {
+				return err
+			}
+		}
+
+		if opts.Unit != "" && outputName == name {
+			logging.Log("writing unit %s", opts.Unit)
+
+			err = WriteUnit(opts.Unit, metadata)
+			if err != nil {
+				return err
+			}
+		}
+
+		if opts.Mtime != "" {
+			// parse again now that the build is done, so that "now" is
+			// actually the time the image was finished.
+			mtime, err := parseMtime(opts.Mtime)
+			if err != nil {
+				return err
+			}
+
+			logging.Log("setting modification time to %s", mtime.Format(time.RFC3339))
+
+			for _, target := range targets {
+				err = os.Chtimes(target, mtime, mtime)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// splitFilesystems returns the filesystems listed in input comma separated
+// fs option, in order, ensuring each is supported and listed once.
+func splitFilesystems(value string) ([]string, error) {
+	filesystems := []string{}
+
+	for _, fs := range strings.Split(value, ",") {
+		fs = strings.TrimSpace(fs)
+
+		if fs != "squashfs" && fs != "btrfs" && fs != "ext4" {
+			return nil, fmt.Errorf("Unsupported fs type %q", fs)
+		}
+
+		if slices.Contains(filesystems, fs) {
+			return nil, fmt.Errorf("fs %s is listed more than once", fs)
+		}
+
+		filesystems = append(filesystems, fs)
+	}
+
+	return filesystems, nil
+}
+
+// getFsVariantPath returns where the raw image of input fs is written, when
+// packing the target raw image in more than one fs: in a directory named
+// after the fs next to target, so that its file name still matches the
+// extension-release.
+func getFsVariantPath(target string, fs string) string {
+	return filepath.Join(filepath.Dir(target), fs, filepath.Base(target))
+}
+
+// getFsVariantPaths returns the raw images of input fs variants of the
+// target raw image, see getFsVariantPath.
+func getFsVariantPaths(target string, variants []string) []string {
+	paths := []string{}
+	for _, fs := range variants {
+		paths = append(paths, getFsVariantPath(target, fs))
+	}
+
+	return paths
+}
+
+// removeStaleVariants will remove the fs variants recorded in the metadata of
+// sysext name that input filesystems don't pack anymore, so that a rebuild
+// doesn't leave raw images of an older build behind.
+func removeStaleVariants(name string, filesystems []string) {
+	metadata, err := ReadMetadata(name)
+	if err != nil {
+		return
+	}
+
+	for _, fs := range metadata.Variants {
+		if slices.Contains(filesystems[1:], fs) {
+			continue
+		}
+
+		variant := getFsVariantPath(GetRawPath(name), fs)
+		logging.LogDebug("removing stale variant %s", variant)
+
+		_ = os.Remove(variant)
+	}
+}
+
+// onlySquashfs returns whether input options only pack squashfs images, their
+// Fs listing no other fs, see splitFilesystems.
+func onlySquashfs(opts CreateOptions) bool {
+	for _, fs := range strings.Split(opts.Fs, ",") {
+		if strings.TrimSpace(fs) != "squashfs" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// splitOpt will move /opt out of input rootfs into a new rootfs for the
+// sysext optName, with its own extension-release file made of input fields,
+// and return it. Everything but /usr is then removed from input rootfs, so
+// that each sysext only ships its own hierarchy.
+func splitOpt(rootfsDIR string, optName string, opts CreateOptions, fields []string) (string, error) {
+	if !fileutils.Exist(filepath.Join(rootfsDIR, "opt")) {
+		return "", errors.New("--split-opt requested but the image has no /opt")
+	}
+
+	optRootfsDIR := filepath.Join(SysextRootfsDir, getID(opts.Image)+"-opt")
+
+	err := os.RemoveAll(optRootfsDIR)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(optRootfsDIR, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	logging.Log("moving /opt to %s", optRootfsDIR)
+
+	err = os.Rename(filepath.Join(rootfsDIR, "opt"), filepath.Join(optRootfsDIR, "opt"))
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(rootfsDIR)
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == "usr" {
+			continue
+		}
+
+		logging.LogDebug("removing /%s from the /usr sysext", entry.Name())
+
+		err = os.RemoveAll(filepath.Join(rootfsDIR, entry.Name()))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return optRootfsDIR, writeExtensionRelease(optRootfsDIR, optName, fields)
+}
+
+// checkSymlinks will report the symlinks in /usr and /opt of input rootfs
+// that are dangling, or that point to the rest of the rootfs, which is not
+// merged by systemd-sysext: on the host they'd point to its own files, if
+// any. With prune they're removed, otherwise they fail the build if strict.
+func checkSymlinks(rootfsDIR string, prune bool, strict bool) error {
+	logging.Log("checking for broken symlinks")
+
+	broken, err := fileutils.FindBrokenSymlinks(rootfsDIR, []string{"usr", "opt"})
+	if err != nil {
+		return err
+	}
+
+	for _, link := range broken {
+		relative, _ := filepath.Rel(rootfsDIR, link)
+		target, _ := os.Readlink(link)
+
+		if prune {
+			logging.LogWarning("removing broken symlink /%s -> %s", relative, target)
+
+			err = os.Remove(link)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		logging.LogWarning("symlink /%s -> %s is broken in the sysext", relative, target)
+	}
+
+	if len(broken) > 0 && strict && !prune {
+		return fmt.Errorf("%d broken symlinks in /usr and /opt", len(broken))
+	}
+
+	return nil
+}
+
+// checkWritableStore will ensure the directories written by a build can be
+// written to, before anything is pulled, so that a read-only data home fails
+// early with a hint instead of halfway through the build.
+func checkWritableStore(opts CreateOptions) error {
+	dirs := []string{imageutils.ImageDir, SysextRootfsDir, SysextDir}
+	if opts.Version != "" {
+		dirs = append(dirs, SysextVersionsDir)
+	}
+
+	for _, dir := range dirs {
+		err := fileutils.CheckWritable(dir)
+		if err != nil {
+			return fmt.Errorf("%w: set OCI_SYSEXT_HOME to a writable directory", err)
+		}
+	}
+
+	if opts.TmpDir != "" {
+		err := fileutils.CheckWritable(opts.TmpDir)
+		if err != nil {
+			return fmt.Errorf("invalid --tmpdir: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// checkFreeSpace will ensure there is enough free space to build input image.
+// Layers are stored compressed, so the staging rootfs is estimated at twice
+// the image size, and the output raw image at the image size. If staging and
+// output live on the same volume the estimates add up.
+// If minFreeSpace is not zero, it's used instead of the estimate for both.
+func checkFreeSpace(image string, minFreeSpace uint64) error {
+	manifestFile, err := fileutils.ReadFile(filepath.Join(imageutils.GetPath(image), "manifest.json"))
+	if err != nil {
+		return err
+	}
+
+	var manifest v1.Manifest
+
+	err = json.Unmarshal(manifestFile, &manifest)
+	if err != nil {
+		return err
+	}
+
+	var imageSize uint64
+	for _, layer := range manifest.Layers {
+		imageSize += uint64(layer.Size)
+	}
+
+	stagingRequired := 2 * imageSize
+	outputRequired := imageSize
+
+	if minFreeSpace > 0 {
+		stagingRequired = minFreeSpace
+		outputRequired = minFreeSpace
+	}
+
+	for _, dir := range []string{SysextRootfsDir, SysextDir} {
+		err = os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	var stagingStat, outputStat syscall.Stat_t
+
+	err = syscall.Stat(SysextRootfsDir, &stagingStat)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Stat(SysextDir, &outputStat)
+	if err != nil {
+		return err
+	}
+
+	if stagingStat.Dev == outputStat.Dev && minFreeSpace == 0 {
+		stagingRequired += outputRequired
+		outputRequired = stagingRequired
+	}
+
+	for dir, required := range map[string]uint64{
+		SysextRootfsDir: stagingRequired,
+		SysextDir:       outputRequired,
+	} {
+		var statfs syscall.Statfs_t
+
+		err = syscall.Statfs(dir, &statfs)
+		if err != nil {
+			return err
+		}
+
+		available := statfs.Bavail * uint64(statfs.Bsize)
+
+		logging.LogDebug("%s: %d bytes available, %d bytes required", dir, available, required)
+
+		if available < required {
+			return fmt.Errorf(
+				"not enough free space in %s: %dM available, %dM required "+
+					"(use --min-free-space to override the estimate or --skip-space-check to skip)",
+				dir, available/1024/1024, required/1024/1024)
+		}
+	}
+
+	return nil
+}
+
+// checkPinned will warn if input image is not pinned by digest, as building
+// from a floating tag is not reproducible.
+// The resolved digest is printed so that it can be used to pin the image.
+// If strict is true, an unpinned image is an error.
+func checkPinned(image string, strict bool) error {
+	// local images can't be pinned, they're not pulled from a registry.
+	if imageutils.IsPinned(image) || imageutils.IsContainersStorage(image) {
+		return nil
+	}
+
+	digest, err := imageutils.GetDigest(image)
+	if err != nil {
+		return err
+	}
+
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return err
+	}
+
+	pinned := ref.Context().Digest(digest).String()
+
+	if strict {
+		return fmt.Errorf("image %s is not pinned by digest, use %s", image, pinned)
+	}
+
+	logging.LogWarning("image %s is not pinned by digest, builds may not be reproducible", image)
+	logging.Log("resolved %s to %s", image, pinned)
+
+	return nil
+}
+
+// checkNameCollision will warn if a sysext with input name already exists and
+// was built from an image other than input one, as building would silently
+// change what the name refers to.
+// If strict is true that's an error, unless overwrite is true.
+func checkNameCollision(name string, image string, strict bool, overwrite bool) error {
+	if overwrite || !fileutils.Exist(GetMetadataPath(name)) {
+		return nil
+	}
+
+	metadata, err := ReadMetadata(name)
+	if err != nil {
+		return err
+	}
+
+	if metadata.Image == image {
+		return nil
+	}
+
+	if strict {
+		return fmt.Errorf("sysext %s was built from %s, not %s, use --overwrite to replace it",
+			name, metadata.Image, image)
+	}
+
+	logging.LogWarning("sysext %s was built from %s, replacing it with one from %s",
+		name, metadata.Image, image)
+
+	return nil
+}
+
+// maxFileNameLength is NAME_MAX, the longest file name allowed by Linux.
+const maxFileNameLength = 255
+
+// validateExtensionName will ensure systemd-sysext merges a sysext named
+// name: both NAME.raw and its extension-release.NAME must be valid file
+// names, and the name must be a valid image name for systemd, without
+// control characters and not starting with ".#", which marks temporary
+// files. Otherwise the image is either not created or never merged.
+// If validate is false, an invalid name is only warned about.
+func validateExtensionName(name string, validate bool) error {
+	var problem string
+
+	switch {
+	case name == "." || name == ".." || strings.ContainsAny(name, "/\x00"):
+		problem = "it must be a plain file name"
+	case strings.HasPrefix(name, ".#"):
+		problem = "systemd ignores images starting with .#"
+	case !utf8.ValidString(name) || strings.ContainsFunc(name, unicode.IsControl):
+		problem = "systemd ignores images with control characters or invalid UTF-8 in their name"
+	case len("extension-release."+name) > maxFileNameLength:
+		problem = fmt.Sprintf("extension-release.%s exceeds the %d characters limit of file names",
+			name, maxFileNameLength)
+	default:
+		return nil
+	}
+
+	if validate {
+		return fmt.Errorf("invalid sysext name %q: %s", name, problem)
+	}
+
+	logging.LogWarning("sysext name %q won't be merged by systemd-sysext: %s", name, problem)
+
+	return nil
+}
+
+// validateOutputName will ensure input output name is a plain file name for
+// the raw image of sysext name.
+// systemd-sysext only picks up .raw images, and by default requires the
+// image file name without .raw to match the extension-release name, so other
+// names are warned about, or rejected if strict is true.
+func validateOutputName(name string, outputName string, strict bool) error {
+	if outputName == "." || outputName == ".." || strings.HasPrefix(outputName, ".") ||
+		strings.ContainsAny(outputName, "/\x00") {
+		return fmt.Errorf("invalid output name %q: expected a file name, like %s.raw", outputName, name)
+	}
+
+	if strings.HasSuffix(outputName, ".json") || strings.HasSuffix(outputName, ".tmp") {
+		return fmt.Errorf("invalid output name %q: .json and .tmp are reserved", outputName)
+	}
+
+	stem, isRaw := strings.CutSuffix(outputName, ".raw")
+
+	var warning string
+
+	switch {
+	case !isRaw:
+		warning = fmt.Sprintf("output name %s doesn't end with .raw, systemd-sysext won't pick it up as is",
+			outputName)
+	case stem != name:
+		warning = fmt.Sprintf("output name %s doesn't match extension-release.%s, systemd-sysext will refuse it "+
+			"unless the user.extension-release.strict xattr is set to false", outputName, name)
+	default:
+		return nil
+	}
+
+	if strict {
+		return errors.New(warning)
+	}
+
+	logging.LogWarning("%s", warning)
+
+	return nil
+}
+
+// CheckRequires will warn about the sysexts required by the one with input
+// name that are not present in SysextDir, as systemd doesn't track
+// dependencies between extensions.
+// If strict is true, a missing dependency is an error.
+func CheckRequires(name string, requires []string, strict bool) error {
+	missing := []string{}
+
+	for _, required := range requires {
+		if required == name {
+			return fmt.Errorf("sysext %s can't require itself", name)
+		}
+
+		if !fileutils.Exist(GetRawPath(required)) {
+			missing = append(missing, required)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if strict {
+		return fmt.Errorf("sysext %s requires %s, not found in %s", name, strings.Join(missing, ", "), SysextDir)
+	}
+
+	logging.LogWarning("sysext %s requires %s, not found in %s, it must be merged along with them",
+		name, strings.Join(missing, ", "), SysextDir)
+
+	return nil
+}
+
+// anyArchitecture is the value to explicitly build an architecture
+// independent sysext.
+const anyArchitecture = "_any"
+
+// systemdArchitectures are the architectures known by systemd.
+var systemdArchitectures = []string{
+	"alpha", "arc", "arc-be", "arm", "arm-be", "arm64", "arm64-be", "cris",
+	"ia64", "loongarch64", "m68k", "mips", "mips-le", "mips64", "mips64-le",
+	"parisc", "parisc64", "ppc", "ppc-le", "ppc64", "ppc64-le", "riscv32",
+	"riscv64", "s390", "s390x", "sh", "sh64", "sparc", "sparc64", "tilegx",
+	"x86", "x86-64",
+}
+
+// ociArchitectures maps the OCI architecture names to the systemd ones.
+var ociArchitectures = map[string]string{
+	"386":      "x86",
+	"amd64":    "x86-64",
+	"arm64":    "arm64",
+	"ppc64le":  "ppc64-le",
+	"loong64":  "loongarch64",
+	"mips64le": "mips64-le",
+	"mipsle":   "mips-le",
+}
+
+// normalizeArchitecture will validate input architecture, translating OCI
+// names like amd64 to the systemd ones.
+func normalizeArchitecture(architecture string) (string, error) {
+	if architecture == anyArchitecture {
+		return architecture, nil
+	}
+
+	if systemdArchitecture, ok := ociArchitectures[architecture]; ok {
+		return systemdArchitecture, nil
+	}
+
+	for _, known := range systemdArchitectures {
+		if architecture == known {
+			return architecture, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown architecture %q, use _any for architecture independent sysexts", architecture)
+}
+
+// releaseFieldSystemdVersion maps extension-release fields to the systemd
+// version that introduced them.
+var releaseFieldSystemdVersion = map[string]int{
+	"SYSEXT_SCOPE":             250,
+	"EXTENSION_RELOAD_MANAGER": 255,
+}
+
+// checkSystemdVersion will warn about release fields that are not supported
+// by input minimum systemd version.
+func checkSystemdVersion(releaseFields []string, minSystemdVersion int) {
+	keys := []string{}
+	for _, field := range releaseFields {
+		key, _, _ := strings.Cut(field, "=")
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		required, ok := releaseFieldSystemdVersion[key]
+		if ok && required > minSystemdVersion {
+			logging.LogWarning("%s requires systemd %d, but the minimum targeted version is %d",
+				key, required, minSystemdVersion)
+		}
+	}
+}
+
+// validateSysextLevel will ensure input SYSEXT_LEVEL only uses the
+// characters os-release allows: lowercase letters, digits, ".", "_" and "-".
+func validateSysextLevel(level string) error {
+	for _, char := range level {
+		if (char < 'a' || char > 'z') && (char < '0' || char > '9') &&
+			char != '.' && char != '_' && char != '-' {
+			return fmt.Errorf("invalid SYSEXT_LEVEL %q: only a-z, 0-9, \".\", \"_\" and \"-\" are allowed", level)
+		}
+	}
+
+	return nil
+}
+
+// validateReleaseField will ensure input field is a KEY=VALUE assignment valid
+// for an extension-release file: the key must only contain uppercase letters,
+// digits and underscores, and not start with a digit, while the value cannot
+// span multiple lines, nor start a quote it doesn't end.
+func validateReleaseField(field string) error {
+	key, value, found := strings.Cut(field, "=")
+	if !found {
+		return fmt.Errorf("invalid release field %q: expected KEY=VALUE", field)
+	}
+
+	if key == "" || (key[0] >= '0' && key[0] <= '9') {
+		return fmt.Errorf("invalid release field key %q", key)
+	}
+
+	for _, char := range key {
+		if (char < 'A' || char > 'Z') && (char < '0' || char > '9') && char != '_' {
+			return fmt.Errorf("invalid release field key %q: only A-Z, 0-9 and _ are allowed", key)
+		}
+	}
+
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid release field value for %s: newlines are not allowed", key)
+	}
+
+	// an unterminated quote would swallow the next lines when systemd parses
+	// the file.
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'") {
+		if len(value) < 2 || value[len(value)-1] != value[0] {
+			return fmt.Errorf("invalid release field value for %s: unterminated quote", key)
+		}
+	}
+
+	return nil
+}
+
+// anyIgnoredReleaseFields are the extension-release fields systemd doesn't
+// look at when ID=_any, as the extension then matches any host OS. Note that
+// ARCHITECTURE is checked before ID, so it's honored even with ID=_any.
+var anyIgnoredReleaseFields = []string{"VERSION_ID", "SYSEXT_LEVEL"}
+
+// checkReleaseMatching will warn about input extension-release fields that
+// contradict each other according to the rules systemd uses to match an
+// extension against the host, as they'd be silently ignored.
+// Later assignments of the same key win, as in systemd.
+// If strict is true, a contradiction is an error.
+func checkReleaseMatching(fields []string, strict bool) error {
+	values := map[string]string{}
+
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		values[key] = value
+	}
+
+	if values["ID"] == "" {
+		// systemd refuses extensions without an ID
+		return errors.New("the extension-release file must set ID, use ID=_any to match any host")
+	}
+
+	if values["ID"] != "_any" {
+		if values["SYSEXT_LEVEL"] != "" || values["VERSION_ID"] != "" {
+			return nil
+		}
+
+		// systemd falls back from SYSEXT_LEVEL to VERSION_ID, and refuses
+		// extensions with neither on hosts setting VERSION_ID.
+		if strict {
+			return fmt.Errorf("ID=%s needs SYSEXT_LEVEL or VERSION_ID to match the host version",
+				values["ID"])
+		}
+
+		logging.LogWarning("ID=%s without SYSEXT_LEVEL nor VERSION_ID, systemd will refuse "+
+			"to merge the sysext on hosts setting VERSION_ID", values["ID"])
+
+		return nil
+	}
+
+	for _, key := range anyIgnoredReleaseFields {
+		if values[key] == "" {
+			continue
+		}
+
+		if strict {
+			return fmt.Errorf("%s=%s has no effect with ID=_any, set ID to the host OS to match on it",
+				key, values[key])
+		}
+
+		logging.LogWarning("%s=%s has no effect with ID=_any, systemd will merge the sysext on any host",
+			key, values[key])
+	}
+
+	return nil
+}
+
+// checkReleaseFields will run the checks of input extension-release fields
+// configured by input options.
+func checkReleaseFields(fields []string, opts CreateOptions) error {
+	err := checkReleaseMatching(fields, opts.Strict)
+	if err != nil {
+		return err
+	}
+
+	err = checkMinimalRelease(fields, opts.FailOnEmptyRelease)
+	if err != nil {
+		return err
+	}
+
+	if opts.MinSystemdVersion != 0 {
+		checkSystemdVersion(fields, opts.MinSystemdVersion)
+	}
+
+	return nil
+}
+
+// checkMinimalRelease will warn if input extension-release fields don't
+// restrict the hosts the sysext is merged on at all, that is ID=_any without
+// ARCHITECTURE, as it will be merged whatever the host OS, version and
+// architecture. With ID=_any systemd ignores VERSION_ID and SYSEXT_LEVEL, so
+// they don't restrict anything, see checkReleaseMatching.
+// If fail is true, that's an error.
+func checkMinimalRelease(fields []string, fail bool) error {
+	values := map[string]string{}
+
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		values[key] = value
+	}
+
+	if values["ID"] != "_any" {
+		return nil
+	}
+
+	if values["ARCHITECTURE"] != "" && values["ARCHITECTURE"] != anyArchitecture {
+		return nil
+	}
+
+	message := "the extension-release only sets ID=_any, so the sysext matches any host OS, version " +
+		"and architecture, and may break hosts it wasn't built for. Use --match-host to restrict it to " +
+		"the ID and VERSION_ID or SYSEXT_LEVEL of the build host, --release-id with --sysext-level or " +
+		"--release-field VERSION_ID=..., or --architecture"
+
+	if fail {
+		return errors.New(message)
+	}
+
+	logging.LogWarning("%s", message)
+
+	return nil
+}
+
+// parseMtime will parse input value into a time, value can be:
+//   - now: the current time
+//   - source-date: the time set in the SOURCE_DATE_EPOCH environment variable
+//   - an RFC3339 formatted time
+//   - a unix timestamp in seconds
+func parseMtime(value string) (time.Time, error) {
+	switch value {
+	case "now":
+		return time.Now(), nil
+	case "source-date":
+		epoch := os.Getenv("SOURCE_DATE_EPOCH")
+		if epoch == "" {
+			return time.Time{}, errors.New("source-date mtime requested but SOURCE_DATE_EPOCH is not set")
+		}
+
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", epoch, err)
+		}
+
+		return time.Unix(seconds, 0), nil
+	}
+
+	mtime, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return mtime, nil
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	return time.Time{}, fmt.Errorf(
+		"invalid mtime %q: expected now, source-date, an RFC3339 time or a unix timestamp", value)
+}
+
+// PackOptions holds the settings used by PackRootfs.
+type PackOptions struct {
+	// TmpDir is the TMPDIR the packing tools are run with, so that any
+	// temporary space they need is taken from there instead of a possibly
+	// small /tmp. If empty, a directory in SysextRootfsDir is used.
+	TmpDir string
+	// Compression is the compression algorithm to use, see
+	// compressionAlgorithms for the ones supported by each fs.
+	Compression string
+	// CompressionLevel, if not zero, is the level of Compression.
+	CompressionLevel int
+	// BlockSize, if not empty, is the squashfs block size, e.g. 4K.
+	BlockSize string
+	// NoFragments disables packing the tail ends of files together in
+	// squashfs fragment blocks.
+	NoFragments bool
+	// Progress shows the progress of mksquashfs, with an ETA.
+	Progress bool
+	// Reproducible lays out the files of squashfs images in a fixed order,
+	// see writeSortFile, and sets their creation time to MkfsTime unless
+	// SOURCE_DATE_EPOCH is set, which mksquashfs uses itself.
+	Reproducible bool
+	// MkfsTime is the creation time of reproducible images, in seconds
+	// since the epoch.
+	MkfsTime int64
+}
+
+// PackRootfs will pack input rootfs directory into a raw image at target,
+// using input fs as the filesystem of the image, with input options.
+// On failure, the partial raw image is removed, and the error includes the
+// output of the failing tool.
+func PackRootfs(rootfsDIR string, target string, fs string, opts PackOptions) error {
+	err := packRootfs(rootfsDIR, target, fs, opts)
+	if err != nil {
+		_ = os.Remove(target)
+
+		return err
+	}
+
+	return nil
+}
+
+// packRootfs will pack input rootfs into target, see PackRootfs.
+func packRootfs(rootfsDIR string, target string, fs string, opts PackOptions) error {
+	tmpDIR, compression, level := opts.TmpDir, opts.Compression, opts.CompressionLevel
+
+	err := validateCompression(fs, compression, level)
+	if err != nil {
+		return err
+	}
+
+	if (opts.BlockSize != "" || opts.NoFragments) && fs != "squashfs" {
+		return fmt.Errorf("block size and fragments can only be set for squashfs, not %s", fs)
+	}
+
+	if tmpDIR == "" {
+		tmpDIR = filepath.Join(SysextRootfsDir, ".tmp")
+	}
+
+	err = os.MkdirAll(tmpDIR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("", "")
+
+	if fs == "squashfs" {
+		args := []string{
+			rootfsDIR,
+			target,
+		}
+		if compression != "" {
+			args = append(args, "-comp", compression)
+		}
+
+		if level != 0 {
+			args = append(args, "-Xcompression-level", strconv.Itoa(level))
+		}
+
+		if opts.BlockSize != "" {
+			args = append(args, "-b", opts.BlockSize)
+		}
+
+		if opts.NoFragments {
+			args = append(args, "-no-fragments")
+		}
+
+		if opts.Reproducible {
+			sortFile, err := writeSortFile(rootfsDIR, tmpDIR)
+			if err != nil {
+				return err
+			}
+
+			defer func() { _ = os.Remove(sortFile) }()
+
+			args = append(args, "-sort", sortFile)
+
+			// mksquashfs refuses both.
+			if os.Getenv("SOURCE_DATE_EPOCH") == "" {
+				args = append(args, "-mkfs-time", strconv.FormatInt(opts.MkfsTime, 10))
+			}
+		}
+
+		cmd = packCommand(tmpDIR, "mksquashfs", args...)
+	} else if fs == "btrfs" {
+		if compression != "" && compression != "no" && level != 0 {
+			compression = fmt.Sprintf("%s:%d", compression, level)
+		}
+
+		return packBtrfs(rootfsDIR, target, tmpDIR, compression)
+	} else if fs == "ext4" {
+		size, err := fileutils.DiscUsageMegaBytes(rootfsDIR)
+		if err != nil {
+			return err
+		}
+
+		logging.Log("creating image of size %s", size)
+		err = runPackTool(tmpDIR, "truncate", "-s", size, target)
+		if err != nil {
+			return err
+		}
+
+		logging.Log("mkfs.ext4")
+		err = runPackTool(tmpDIR, "mkfs.ext4", "-E", "root_owner=0:0", "-d", rootfsDIR, target)
+		if err != nil {
+			return err
+		}
+
+		logging.Log("resize2fs")
+
+		return runPackTool(tmpDIR, "resize2fs", "-M", target)
+	} else {
+		return errors.New("Unsupported fs type")
+	}
+
+	return runPackCommand(cmd, target, opts.Progress)
+}
+
+// compressionAlgorithm is a compression algorithm supported by a fs, with
+// the range of levels it accepts, both zero if its level can't be set, and
+// the first kernel version able to mount it, empty if mainline kernels
+// can't mount it at all, like lzma on squashfs.
+type compressionAlgorithm struct {
+	name      string
+	minLevel  int
+	maxLevel  int
+	minKernel string
+}
+
+// compressionAlgorithms lists the compression algorithms supported by each fs,
+// levels are the ones accepted by mksquashfs and mkfs.btrfs.
+var compressionAlgorithms = map[string][]compressionAlgorithm{
+	"squashfs": {
+		{name: "gzip", minLevel: 1, maxLevel: 9, minKernel: "2.6.29"},
+		{name: "lzo", minLevel: 1, maxLevel: 9, minKernel: "2.6.36"},
+		{name: "lz4", minKernel: "3.19"},
+		{name: "xz", minKernel: "2.6.38"},
+		{name: "zstd", minLevel: 1, maxLevel: 22, minKernel: "4.14"},
+		{name: "lzma"},
+	},
+	"btrfs": {
+		{name: "no", minKernel: "2.6.29"},
+		{name: "zlib", minLevel: 1, maxLevel: 9, minKernel: "2.6.29"},
+		{name: "lzo", minKernel: "2.6.38"},
+		{name: "zstd", minLevel: 1, maxLevel: 15, minKernel: "4.14"},
+	},
+	"ext4": {},
+}
+
+// findCompression returns input compression algorithm of input fs, if supported.
+func findCompression(fs string, compression string) (compressionAlgorithm, bool) {
+	for _, algorithm := range compressionAlgorithms[fs] {
+		if algorithm.name == compression {
+			return algorithm, true
+		}
+	}
+
+	return compressionAlgorithm{}, false
+}
+
+// parseKernelVersion returns the numeric MAJOR.MINOR[.PATCH] prefix of input
+// kernel version, like 6.1 or 5.10.0-18-amd64.
+func parseKernelVersion(version string) ([3]int, error) {
+	parsed := [3]int{}
+
+	release, _, _ := strings.Cut(version, "-")
+	parts := strings.Split(release, ".")
+
+	if len(parts) < 2 || len(parts) > 3 {
+		return parsed, fmt.Errorf("invalid kernel version %q, expected MAJOR.MINOR[.PATCH]", version)
+	}
+
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return parsed, fmt.Errorf("invalid kernel version %q, expected MAJOR.MINOR[.PATCH]", version)
+		}
+
+		parsed[i] = number
+	}
+
+	return parsed, nil
+}
+
+// checkKernelCompression will warn if input compression of input fs can't be
+// mounted by input target kernel version, see compressionAlgorithm.
+// If strict is true, that's an error.
+func checkKernelCompression(fs string, compression string, targetKernel string, strict bool) error {
+	if targetKernel == "" {
+		return nil
+	}
+
+	target, err := parseKernelVersion(targetKernel)
+	if err != nil || compression == "" {
+		return err
+	}
+
+	algorithm, found := findCompression(fs, compression)
+	if !found {
+		return nil
+	}
+
+	var message string
+
+	if algorithm.minKernel == "" {
+		message = fmt.Sprintf("%s compressed %s can't be mounted by mainline kernels", compression, fs)
+	} else {
+		minimum, err := parseKernelVersion(algorithm.minKernel)
+		if err != nil {
+			return err
+		}
+
+		if !kernelVersionLess(target, minimum) {
+			return nil
+		}
+
+		message = fmt.Sprintf("%s compressed %s needs kernel %s, but the target kernel is %s",
+			compression, fs, algorithm.minKernel, targetKernel)
+	}
+
+	if strict {
+		return errors.New(message)
+	}
+
+	logging.LogWarning("%s", message)
+
+	return nil
+}
+
+// kernelVersionLess returns whether kernel version a predates b.
+func kernelVersionLess(a [3]int, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+
+	return false
+}
+
+// validateCompression returns an error if input compression algorithm is
+// not supported by input fs, or if input level, when not zero, is out of the
+// algorithm's range. An empty compression is always valid.
+func validateCompression(fs string, compression string, level int) error {
+	if compression == "" {
+		if level != 0 {
+			return fmt.Errorf("a compression level needs a compression algorithm for %s", fs)
+		}
+
+		return nil
+	}
+
+	algorithm, found := findCompression(fs, compression)
+	if !found {
+		if len(compressionAlgorithms[fs]) == 0 {
+			return fmt.Errorf("%s doesn't support compression", fs)
+		}
+
+		names := []string{}
+		for _, algorithm := range compressionAlgorithms[fs] {
+			names = append(names, algorithm.name)
+		}
+
+		return fmt.Errorf("unsupported compression %q for %s, supported: %s",
+			compression, fs, strings.Join(names, ", "))
+	}
+
+	if level == 0 {
+		return nil
+	}
+
+	if algorithm.maxLevel == 0 {
+		return fmt.Errorf("the level of %s compression can't be set for %s", compression, fs)
+	}
+
+	if level < algorithm.minLevel || level > algorithm.maxLevel {
+		return fmt.Errorf("invalid %s compression level %d for %s, must be between %d and %d",
+			compression, level, fs, algorithm.minLevel, algorithm.maxLevel)
+	}
+
+	return nil
+}
+
+// Boot optimized sysexts are packed with bootCompression, the squashfs
+// compression enabled by default in kernels, and page sized blocks without
+// fragments, so that files can be read from the initrd without decompressing
+// unrelated data.
+const (
+	bootCompression = "gzip"
+	bootBlockSize   = "4K"
+)
+
+// resolveCompression returns the compression algorithm for input options:
+// the requested one, bootCompression for boot optimized sysexts, or the one
+// configured for their fs.
+func resolveCompression(opts CreateOptions) (string, error) {
+	if opts.Compression != "" {
+		return opts.Compression, nil
+	}
+
+	if opts.BootOptimized {
+		return bootCompression, nil
+	}
+
+	return defaultCompression(opts.Fs)
+}
+
+// packOptions returns the PackOptions for input options, packed with input
+// compression.
+func packOptions(opts CreateOptions, compression string) PackOptions {
+	pack := PackOptions{
+		TmpDir:           opts.TmpDir,
+		Compression:      compression,
+		CompressionLevel: opts.CompressionLevel,
+		Progress:         !opts.Quiet,
+	}
+
+	if opts.BootOptimized {
+		pack.BlockSize = bootBlockSize
+		pack.NoFragments = true
+	}
+
+	if opts.Reproducible {
+		pack.Reproducible = true
+
+		// Mtime is already validated.
+		if opts.Mtime != "" {
+			mtime, err := parseMtime(opts.Mtime)
+			if err == nil {
+				pack.MkfsTime = mtime.Unix()
+			}
+		}
+	}
+
+	return pack
+}
+
+// sortFileMaxPriority and sortFileMinPriority are the range of the
+// priorities of a mksquashfs sort file, higher priority files come first.
+const (
+	sortFileMaxPriority = 32767
+	sortFileMinPriority = -32768
+)
+
+// writeSortFile will write in input directory a mksquashfs sort file placing
+// the regular files of input rootfs in the order of their paths, so that the
+// layout of the image doesn't depend on the order the staging directory is
+// read in, and return its path. Files past the range of priorities all get
+// the lowest one, and keep the order of mksquashfs, as do files whose name
+// can't be written in a sort file.
+func writeSortFile(rootfsDIR string, dir string) (string, error) {
+	paths := []string{}
+
+	// WalkDir visits the entries of each directory in lexical order.
+	err := filepath.WalkDir(rootfsDIR, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(rootfsDIR, path)
+		if err != nil {
+			return err
+		}
+
+		if strings.ContainsAny(relative, " \t\n\\\"") {
+			logging.LogDebug("leaving %s out of the sort file", relative)
+
+			return nil
+		}
+
+		paths = append(paths, relative)
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var content strings.Builder
+
+	for i, path := range paths {
+		priority := sortFileMaxPriority - i
+		if priority < sortFileMinPriority {
+			priority = sortFileMinPriority
+		}
+
+		fmt.Fprintf(&content, "%s %d\n", path, priority)
+	}
+
+	sortFile, err := os.CreateTemp(dir, "mksquashfs-sort-*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = sortFile.WriteString(content.String())
+	if closeErr := sortFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(sortFile.Name())
+
+		return "", err
+	}
+
+	return sortFile.Name(), nil
+}
+
+// defaultCompression returns the compression configured for input fs in the
+// configuration file, as compression.<fs> = <algorithm>, if any.
+// The compression of every fs is validated, so that a wrong default is
+// reported even before building a sysext with that fs.
+func defaultCompression(fs string) (string, error) {
+	config, err := utils.ReadConfig()
+	if err != nil {
+		return "", err
+	}
+
+	err = validateCompressionConfig(config)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", utils.GetConfigPath(), err)
+	}
+
+	return config["compression."+fs], nil
+}
+
+// validateCompressionConfig will ensure the compression.<fs> keys of input
+// configuration name supported filesystems and algorithms.
+func validateCompressionConfig(config map[string]string) error {
+	keys := []string{}
+
+	for key := range config {
+		if strings.HasPrefix(key, "compression.") {
+			keys = append(keys, key)
+		}
+	}
+
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		fs := strings.TrimPrefix(key, "compression.")
+
+		_, found := compressionAlgorithms[fs]
+		if !found {
+			return fmt.Errorf("%s: unsupported fs %q", key, fs)
+		}
+
+		err := validateCompression(fs, config[key], 0)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// btrfsMinSize is the size a btrfs image is padded to when it's too small for
+// mkfs.btrfs, it's above the minimum of both mixed and non-mixed filesystems.
+const btrfsMinSize = "256M"
+
+// packBtrfs will pack input rootfs directory into a btrfs raw image at
+// target, shrunk to fit its content.
+// Very small rootfs can fall below the minimum size of a btrfs filesystem, in
+// that case the image is padded to btrfsMinSize, as a sparse file.
+func packBtrfs(rootfsDIR string, target string, tmpDIR string, compression string) error {
+	args := []string{
+		"--mixed",
+		"-m",
+		"single",
+		"-d",
+		"single",
+		"--rootdir",
+		rootfsDIR,
+	}
+	if compression != "" && compression != "no" {
+		args = append(args, "--compress", compression)
+	}
+
+	out, err := packCommand(tmpDIR, "mkfs.btrfs", append(append(args, "--shrink"), target)...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	if !strings.Contains(string(out), "too small") && !strings.Contains(string(out), "minimum size") {
+		return packToolError("mkfs.btrfs", err, out)
+	}
+
+	logging.LogWarning("rootfs is too small for btrfs, padding the image to %s", btrfsMinSize)
+
+	_ = os.Remove(target)
+
+	err = runPackTool(tmpDIR, "truncate", "-s", btrfsMinSize, target)
+	if err != nil {
+		return err
+	}
+
+	return runPackTool(tmpDIR, "mkfs.btrfs", append(args, target)...)
+}
+
+// runPackTool will run input packing tool with TMPDIR set to tmpDIR, see
+// packCommand, returning its output in the error if it fails.
+func runPackTool(tmpDIR string, name string, args ...string) error {
+	out, err := packCommand(tmpDIR, name, args...).CombinedOutput()
+	if err != nil {
+		return packToolError(name, err, out)
+	}
+
+	return nil
+}
+
+// packToolError returns the error of a failed packing tool, with its output.
+func packToolError(name string, err error, out []byte) error {
+	output := strings.TrimSpace(string(out))
+	if output == "" {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+
+	return fmt.Errorf("%s failed: %w: %s", name, err, output)
+}
+
+// packCommand returns a command for input packing tool, with TMPDIR set to tmpDIR.
+func packCommand(tmpDIR string, name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), "TMPDIR="+tmpDIR)
+
+	return cmd
+}
+
+// ConvertSysext will repack an existing sysext with input name into a new
+// raw image using input fs, saving it as output.
+// The existing raw image is loop-mounted read-only and its content copied in
+// a staging rootfs, so that the extension-release file can be renamed to match
+// the new output name if needed.
+func ConvertSysext(name string, fs string, output string) error {
+	if fs != "squashfs" && fs != "btrfs" && fs != "ext4" {
+		return errors.New("Unsupported fs type")
+	}
+
+	if output == "" {
+		output = name
+	}
+
+	source := GetRawPath(name)
+	if !fileutils.Exist(source) {
+		return fmt.Errorf("sysext %s not found in %s", name, SysextDir)
+	}
+
+	mountDIR, err := os.MkdirTemp("", "oci-sysext-convert-")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.RemoveAll(mountDIR) }()
+
+	logging.Log("mounting %s", source)
+	out, err := exec.Command("mount", []string{"-o", "loop,ro", source, mountDIR}...).CombinedOutput()
+	if err != nil {
+		logging.LogError(string(out))
+		return err
+	}
+
+	sysextRootfsDIR := filepath.Join(SysextRootfsDir, getID(output))
+
+	// removed on every path, copyRootfs can fail halfway.
+	defer func() { _ = os.RemoveAll(sysextRootfsDIR) }()
+
+	err = copyRootfs(mountDIR, sysextRootfsDIR)
+
+	logging.Log("unmounting %s", source)
+	umountOut, umountErr := exec.Command("umount", mountDIR).CombinedOutput()
+	if umountErr != nil {
+		logging.LogError(string(umountOut))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if umountErr != nil {
+		return umountErr
+	}
+
+	// the extension-release file has to match the image name, so rename it
+	// if we're saving the converted image under a different name.
+	releaseDIR := filepath.Join(sysextRootfsDIR, "/usr/lib/extension-release.d/")
+	if output != name && fileutils.Exist(filepath.Join(releaseDIR, "extension-release."+name)) {
+		logging.Log("renaming extension-release.%s to extension-release.%s", name, output)
+
+		err = os.Rename(filepath.Join(releaseDIR, "extension-release."+name),
+			filepath.Join(releaseDIR, "extension-release."+output))
+		if err != nil {
+			return err
+		}
+	}
+
+	// converting in place keeps the output name of the raw image, a new
+	// sysext gets the default one.
+	target := GetRawPath(name)
+	if output != name {
+		target = GetOutputPath(output, "")
+	}
+
+	err = checkOutputCollision(target, name, output)
+	if err != nil {
+		return err
+	}
+
+	// pack in a temporary file first, so that we never leave the
+	// original image broken if we're converting in place.
+	tmpTarget := target + ".tmp"
+	_ = os.Remove(tmpTarget)
+
+	logging.Log("creating raw file")
+	compression, err := defaultCompression(fs)
+	if err != nil {
+		return err
+	}
+
+	err = PackRootfs(sysextRootfsDIR, tmpTarget, fs, PackOptions{Compression: compression})
+	if err != nil {
+		_ = os.Remove(tmpTarget)
+		return err
+	}
+
+	err = os.Rename(tmpTarget, target)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := ReadMetadata(name)
+	if err != nil {
+		logging.LogWarning("no metadata found for %s, skipping", name)
+
+		return nil
+	}
+
+	// a new sysext has none of the fs variants, converting in place keeps
+	// the ones in other filesystems.
+	variants := []string{}
+
+	for _, variant := range metadata.Variants {
+		if output != name || variant == fs {
+			continue
+		}
+
+		variants = append(variants, variant)
+	}
+
+	if output != name {
+		metadata.Options.OutputName = ""
+	}
+
+	if output == name && slices.Contains(metadata.Variants, fs) {
+		_ = os.Remove(getFsVariantPath(target, fs))
+	}
+
+	metadata.Name = output
+	metadata.Fs = fs
+	metadata.Variants = variants
+	metadata.Options.Name = output
+	metadata.Options.Fs = strings.Join(append([]string{fs}, variants...), ",")
+
+	// the image is packed with the defaults of the new fs, the recorded
+	// packing options could be invalid for it and fail the next rebuild.
+	metadata.Options.Compression = ""
+	metadata.Options.CompressionLevel = 0
+	metadata.Options.Reproducible = false
+
+	if metadata.Options.BootOptimized {
+		// keep the initrd scope in the extension-release
+		metadata.Options.BootOptimized = false
+		metadata.Options.ReleaseFields = append(metadata.Options.ReleaseFields, "SYSEXT_SCOPE=initrd")
+	}
+
+	return WriteMetadata(metadata)
+}
+
+// copyRootfs will copy the content of source directory into a clean target
+// directory, preserving ownership, permissions and links.
+func copyRootfs(source string, target string) error {
+	err := os.RemoveAll(target)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(target, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	logging.Log("copying %s to %s", source, target)
+	out, err := exec.Command("cp", []string{"-a", "--sparse=always", source + "/.", target}...).CombinedOutput()
+	if err != nil {
+		logging.LogError(string(out))
+		return err
+	}
+
+	return nil
 }
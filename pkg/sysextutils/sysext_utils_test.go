@@ -0,0 +1,1285 @@
+package sysextutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	"github.com/89luca89/oci-sysext/pkg/utils"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestCheckMinimalRelease(t *testing.T) {
+	tests := []struct {
+		fields     []string
+		restricted bool
+	}{
+		{[]string{"ID=_any"}, false},
+		{[]string{"ID=_any", "EXTENSION_RELOAD_MANAGER=1"}, false},
+		// systemd ignores VERSION_ID and SYSEXT_LEVEL with ID=_any
+		{[]string{"ID=_any", "VERSION_ID=40"}, false},
+		{[]string{"ID=_any", "SYSEXT_LEVEL=1.0"}, false},
+		{[]string{"ID=_any", "ARCHITECTURE=" + anyArchitecture}, false},
+		{[]string{"ID=_any", "ARCHITECTURE=x86-64"}, true},
+		{[]string{"ID=fedora", "VERSION_ID=40"}, true},
+		{[]string{"ID=fedora"}, true},
+	}
+
+	for _, test := range tests {
+		err := checkMinimalRelease(test.fields, true)
+		if (err == nil) != test.restricted {
+			t.Errorf("checkMinimalRelease(%q) = %v, expected restricted %v", test.fields, err, test.restricted)
+		}
+
+		// the hint names the flags restricting the hosts
+		if err != nil && (!strings.Contains(err.Error(), "--match-host") ||
+			!strings.Contains(err.Error(), "--release-field VERSION_ID=")) {
+			t.Errorf("checkMinimalRelease(%q) = %v, expected a hint to --match-host and VERSION_ID", test.fields, err)
+		}
+
+		err = checkMinimalRelease(test.fields, false)
+		if err != nil {
+			t.Errorf("checkMinimalRelease(%q) without fail = %v, expected a warning only", test.fields, err)
+		}
+	}
+}
+
+func TestEnsureImageExportsStorageAgain(t *testing.T) {
+	withTestDirs(t)
+
+	layoutDIR := withFakePodman(t)
+	image := imageutils.ContainersStoragePrefix + "localhost/app:latest"
+
+	for _, version := range []string{"1", "2"} {
+		err := os.RemoveAll(layoutDIR)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exported := writeTestLayout(t, layoutDIR, []testFile{{Path: "usr/bin/app", Content: version}})
+
+		// the tag now points to another image, it has to be exported again
+		err = ensureImage(image, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected, err := exported.RawManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		saved, err := os.ReadFile(filepath.Join(imageutils.GetPath(image), "manifest.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(saved, expected) {
+			t.Errorf("version %s: the saved manifest is not the exported one", version)
+		}
+	}
+}
+
+func TestCreateSysextNoCache(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	layoutDIR := withFakePodman(t)
+	image := imageutils.ContainersStoragePrefix + "localhost/nocache:latest"
+
+	exported := writeTestLayout(t, layoutDIR,
+		[]testFile{{Path: "usr/bin/base", Content: "base\n"}},
+		[]testFile{{Path: "usr/bin/top", Content: "top\n"}})
+
+	layers, err := exported.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layerFile, err := imageutils.GetLayerFileName(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layerPath := filepath.Join(imageutils.GetPath(image), layerFile)
+
+	opts := CreateOptions{Image: image, Name: "nocache", Fs: "ext4", Incremental: true, Quiet: true}
+
+	for _, noCache := range []bool{false, true} {
+		// the first build fills the caches, the second reuses them
+		err = CreateSysext(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cached, err := os.Stat(layerPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a corrupted snapshot is only noticed by a build not using it
+		writeTestFile(t, getBaseSnapshotPath(image, 1), "usr/bin/base", "corrupted\n", 0o644)
+
+		opts.NoCache = noCache
+
+		err = CreateSysext(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pulled, err := os.Stat(layerPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reused := os.SameFile(cached, pulled)
+		if reused == noCache {
+			t.Errorf("no cache %v: cached layer reused %v, expected %v", noCache, reused, !noCache)
+		}
+
+		mountDIR, unmount, err := mountRaw(GetRawPath("nocache"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := os.ReadFile(filepath.Join(mountDIR, "usr/bin/base"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		unmount()
+
+		expected := "corrupted\n"
+		if noCache {
+			expected = "base\n"
+		}
+
+		if string(content) != expected {
+			t.Errorf("no cache %v: got %q, expected %q from the snapshot", noCache, content, expected)
+		}
+
+		opts.NoCache = false
+	}
+}
+
+func TestCreateSysextOffline(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	imageutils.Offline = true
+	t.Cleanup(func() { imageutils.Offline = false })
+
+	writeTestImage(t, "localhost/offline:1", nil, []testFile{{Path: "usr/bin/tool", Content: "tool\n"}})
+
+	err := CreateSysext(CreateOptions{Image: "localhost/offline:1", Name: "offline", Fs: "ext4"})
+	if err != nil {
+		t.Fatalf("a cached image should build offline: %v", err)
+	}
+
+	err = CreateSysext(CreateOptions{Image: "localhost/missing:1", Name: "missing", Fs: "ext4"})
+	if !errors.Is(err, imageutils.ErrOffline) {
+		t.Errorf("got %v, expected %v", err, imageutils.ErrOffline)
+	}
+}
+
+func TestCreateSysextSparse(t *testing.T) {
+	requireTools(t, "mkfs.ext4", "fallocate")
+	withTestDirs(t)
+
+	size := 8 * 1024 * 1024
+
+	writeTestImage(t, "localhost/sparse:1", nil, []testFile{
+		{Path: "usr/lib/db/prealloc", Content: string(make([]byte, size))},
+		{Path: "usr/bin/tool", Content: "tool\n"},
+	})
+
+	err := CreateSysext(CreateOptions{Image: "localhost/sparse:1", Name: "sparse", Fs: "ext4", Sparse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mountDIR, unmount, err := mountRaw(GetRawPath("sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer unmount()
+
+	info, err := os.Stat(filepath.Join(mountDIR, "usr/lib/db/prealloc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != int64(size) {
+		t.Errorf("got size %d, expected %d", info.Size(), size)
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		t.Fatal("no stat for the packed file")
+	}
+
+	if stat.Blocks*512 >= int64(size)/2 {
+		t.Errorf("%d bytes allocated for a zero-filled file of %d bytes, it should be sparse", stat.Blocks*512, size)
+	}
+}
+
+func TestCreateSysextNoContent(t *testing.T) {
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/scratch:1", nil)
+	writeTestImage(t, "localhost/empty:1", nil, []testFile{})
+	writeTestImage(t, "localhost/base:1", nil, []testFile{{Path: "usr/bin/tool", Content: "tool\n"}})
+	writeTestImage(t, "localhost/retag:1", nil, []testFile{{Path: "usr/bin/tool", Content: "tool\n"}})
+
+	tests := []struct {
+		image       string
+		imageSource string
+	}{
+		{"localhost/scratch:1", ""},
+		{"localhost/empty:1", ""},
+		// no layers left once the source ones are skipped
+		{"localhost/retag:1", "localhost/base:1"},
+	}
+
+	for _, test := range tests {
+		err := CreateSysext(CreateOptions{Image: test.image, ImageSource: test.imageSource, Name: "nocontent", Fs: "ext4"})
+		if !errors.Is(err, ErrNoContent) {
+			t.Errorf("%s: got %v, expected %v", test.image, err, ErrNoContent)
+		}
+
+		if fileExists(GetOutputPath("nocontent", "")) {
+			t.Errorf("%s: a raw image was packed", test.image)
+		}
+	}
+}
+
+func TestCalcSkipLayers(t *testing.T) {
+	withTestDirs(t)
+
+	base := []testFile{{Path: "usr/lib/base", Content: "base\n"}}
+
+	writeTestImage(t, "localhost/base:1", nil, base)
+	writeTestImage(t, "localhost/app:1", nil, base,
+		[]testFile{{Path: "usr/bin/first", Content: "first\n"}},
+		[]testFile{{Path: "usr/bin/second", Content: "second\n"}})
+
+	tests := []struct {
+		image       string
+		imageSource string
+		expected    int
+	}{
+		{"localhost/app:1", "", 0},
+		{"localhost/app:1", "localhost/app:1", 0},
+		// only the layers added on top of the source are extracted
+		{"localhost/app:1", "localhost/base:1", 1},
+		{"localhost/base:1", "localhost/app:1", 3},
+	}
+
+	for _, test := range tests {
+		skip, err := calcSkipLayers(test.image, test.imageSource)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if skip != test.expected {
+			t.Errorf("%s on %q: got %d layers to skip, expected %d", test.image, test.imageSource, skip, test.expected)
+		}
+	}
+}
+
+func TestCreateSysextTarExcludes(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/excludes:1", nil, []testFile{
+		{Path: "usr/bin/tool", Content: "tool\n"},
+		{Path: "usr/share/doc/tool/README", Content: "readme\n"},
+		{Path: "dev/console", Content: "console\n"},
+		{Path: "proc/1/status", Content: "status\n"},
+		{Path: "sys/kernel/notes", Content: "notes\n"},
+		{Path: "run/lock/tool", Content: "lock\n"},
+		{Path: "tmp/cache", Content: "cache\n"},
+	})
+
+	tests := []struct {
+		excludes []string
+		present  []string
+		absent   []string
+	}{
+		{nil, []string{"usr/bin/tool", "usr/share/doc/tool/README"},
+			[]string{"dev/console", "proc/1/status", "sys/kernel/notes", "run/lock/tool", "tmp/cache"}},
+		{[]string{"usr/share/doc", "tmp/*"}, []string{"usr/bin/tool", "dev/console", "run/lock/tool"},
+			[]string{"usr/share/doc/tool/README", "tmp/cache"}},
+	}
+
+	for _, test := range tests {
+		err := CreateSysext(CreateOptions{Image: "localhost/excludes:1", Name: "excludes", Fs: "ext4",
+			TarExcludes: test.excludes})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mountDIR, unmount, err := mountRaw(GetRawPath("excludes"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, path := range test.present {
+			if !fileExists(filepath.Join(mountDIR, path)) {
+				t.Errorf("excludes %q: /%s is missing", test.excludes, path)
+			}
+		}
+
+		for _, path := range test.absent {
+			if fileExists(filepath.Join(mountDIR, path)) {
+				t.Errorf("excludes %q: /%s should not be extracted", test.excludes, path)
+			}
+		}
+
+		unmount()
+	}
+}
+
+func TestCreateSysextCheckSymlinks(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	// /etc isn't merged by systemd-sysext, links into it dangle on the host
+	files := []testFile{
+		{Path: "etc/ssl/cert.pem", Content: "cert\n"},
+		{Path: "etc/tool.conf", Content: "conf\n"},
+		{Path: "usr/bin/tool", Content: "tool\n"},
+		{Path: "usr/share/ssl", Link: "/etc/ssl"},
+		{Path: "usr/lib/tool.conf", Link: "../../etc/tool.conf"},
+		{Path: "usr/bin/alias", Link: "tool"},
+	}
+
+	writeTestImage(t, "localhost/symlinks:1", nil, files)
+
+	digest, err := imageutils.GetDigest("localhost/symlinks:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// strict builds need a pinned image
+	image := "localhost/symlinks@" + digest
+	writeTestImage(t, image, nil, files)
+
+	opts := CreateOptions{Image: image, Name: "symlinks", Fs: "ext4", CheckSymlinks: true}
+
+	warnings := captureWarnings(t, func() {
+		err = CreateSysext(opts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, link := range []string{"/usr/share/ssl", "/usr/lib/tool.conf"} {
+		if !slices.ContainsFunc(warnings, func(warning string) bool { return strings.Contains(warning, link+" ") }) {
+			t.Errorf("no warning about %s in %q", link, warnings)
+		}
+	}
+
+	opts.Strict = true
+
+	err = CreateSysext(opts)
+	if err == nil || !strings.Contains(err.Error(), "broken symlinks") {
+		t.Errorf("got %v, broken symlinks should fail a strict build", err)
+	}
+
+	opts.PruneBrokenSymlinks = true
+
+	err = CreateSysext(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mountDIR, unmount, err := mountRaw(GetRawPath("symlinks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer unmount()
+
+	for path, expected := range map[string]bool{
+		"usr/share/ssl":     false,
+		"usr/lib/tool.conf": false,
+		"usr/bin/alias":     true,
+		"usr/bin/tool":      true,
+	} {
+		if fileExists(filepath.Join(mountDIR, path)) != expected {
+			t.Errorf("/%s exists: %v, expected %v", path, !expected, expected)
+		}
+	}
+}
+
+func TestWriteSortFile(t *testing.T) {
+	rootfsDIR := t.TempDir()
+
+	// created out of order, so that the directory order differs from the
+	// lexical one on most filesystems
+	for _, path := range []string{"usr/lib/z", "usr/bin/b", "usr/lib/a", "usr/bin/a", "usr/lib/with space"} {
+		writeTestFile(t, rootfsDIR, path, path, 0o644)
+	}
+
+	err := os.Symlink("a", filepath.Join(rootfsDIR, "usr/bin/link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sortFile, err := writeSortFile(rootfsDIR, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(sortFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := fmt.Sprintf("usr/bin/a %d\nusr/bin/b %d\nusr/lib/a %d\nusr/lib/z %d\n",
+		sortFileMaxPriority, sortFileMaxPriority-1, sortFileMaxPriority-2, sortFileMaxPriority-3)
+
+	if string(content) != expected {
+		t.Errorf("got sort file:\n%s\nexpected:\n%s", content, expected)
+	}
+}
+
+func TestCreateSysextReproducible(t *testing.T) {
+	requireTools(t, "mksquashfs")
+	withTestDirs(t)
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+
+	files := []testFile{{Path: "usr/bin/tool", Content: "tool\n", Mode: 0o755}}
+	for i := 0; i < 50; i++ {
+		files = append(files, testFile{Path: fmt.Sprintf("usr/share/tool/%02d", 49-i), Content: strings.Repeat("x", i*100)})
+	}
+
+	writeTestImage(t, "localhost/reproducible:1", nil, files)
+
+	opts := CreateOptions{Image: "localhost/reproducible:1", Name: "reproducible", Fs: "squashfs", Reproducible: true}
+
+	builds := [][]byte{}
+
+	for i := 0; i < 2; i++ {
+		// the staging rootfs is extracted again by each build
+		err := CreateSysext(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := os.ReadFile(GetRawPath("reproducible"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		builds = append(builds, content)
+	}
+
+	if !bytes.Equal(builds[0], builds[1]) {
+		t.Error("two builds of the same image gave different squashfs images")
+	}
+}
+
+// testACL returns a system.posix_acl_access xattr granting read access to
+// user 1000, in the binary format of the kernel.
+func testACL() string {
+	var acl bytes.Buffer
+
+	// version, then tag, permissions and id of each entry
+	_ = binary.Write(&acl, binary.LittleEndian, uint32(2))
+
+	for _, entry := range []struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}{
+		{0x01, 6, 0xffffffff}, // ACL_USER_OBJ
+		{0x02, 4, 1000},       // ACL_USER
+		{0x04, 4, 0xffffffff}, // ACL_GROUP_OBJ
+		{0x10, 4, 0xffffffff}, // ACL_MASK
+		{0x20, 4, 0xffffffff}, // ACL_OTHER
+	} {
+		_ = binary.Write(&acl, binary.LittleEndian, entry)
+	}
+
+	return acl.String()
+}
+
+func TestCreateSysextACLs(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	acl := testACL()
+
+	writeTestImage(t, "localhost/acls:1", nil, []testFile{
+		{Path: "usr/share/tool/shared.conf", Content: "shared\n", Xattrs: map[string]string{
+			"system.posix_acl_access": acl,
+		}},
+	})
+
+	for _, dropACLs := range []bool{false, true} {
+		err := CreateSysext(CreateOptions{Image: "localhost/acls:1", Name: "acls", Fs: "ext4", DropACLs: dropACLs})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mountDIR, unmount, err := mountRaw(GetRawPath("acls"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value := make([]byte, 1024)
+
+		size, err := syscall.Getxattr(filepath.Join(mountDIR, "usr/share/tool/shared.conf"),
+			"system.posix_acl_access", value)
+
+		unmount()
+
+		if dropACLs {
+			if err == nil {
+				t.Error("the ACL should be dropped")
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("the ACL didn't survive into the image: %v", err)
+		}
+
+		if string(value[:size]) != acl {
+			t.Errorf("got ACL %x, expected %x", value[:size], acl)
+		}
+	}
+}
+
+func TestFsList(t *testing.T) {
+	tests := []struct {
+		fs           string
+		onlySquashfs bool
+	}{
+		{"squashfs", true},
+		{" squashfs ", true},
+		{"ext4", false},
+		{"squashfs,ext4", false},
+		{"btrfs,squashfs", false},
+	}
+
+	for _, test := range tests {
+		opts := CreateOptions{Fs: test.fs, BootOptimized: true, Reproducible: true}
+
+		if onlySquashfs(opts) != test.onlySquashfs {
+			t.Errorf("onlySquashfs(%q) = %v, expected %v", test.fs, !test.onlySquashfs, test.onlySquashfs)
+		}
+
+		// every fs of the list is packed, ACLs are kept for the others
+		if preserveACLs(opts) == test.onlySquashfs {
+			t.Errorf("preserveACLs(%q) = %v, expected %v", test.fs, !test.onlySquashfs, !test.onlySquashfs)
+		}
+
+		err := validateFlags(opts)
+		if (err == nil) != test.onlySquashfs {
+			t.Errorf("validateFlags(%q) = %v, expected a conflict %v", test.fs, err, !test.onlySquashfs)
+		}
+	}
+}
+
+func TestRemoveStaleVariants(t *testing.T) {
+	withTestDirs(t)
+
+	writeTestFile(t, SysextDir, "tools.raw", "", 0o644)
+	writeTestFile(t, SysextDir, "ext4/tools.raw", "", 0o644)
+	writeTestFile(t, SysextDir, "btrfs/tools.raw", "", 0o644)
+
+	err := WriteMetadata(Metadata{Name: "tools", Fs: "squashfs", Variants: []string{"ext4", "btrfs"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removeStaleVariants("tools", []string{"squashfs", "btrfs"})
+
+	if fileutils.Exist(filepath.Join(SysextDir, "ext4/tools.raw")) {
+		t.Error("the ext4 variant isn't built anymore, it should have been removed")
+	}
+
+	for _, kept := range []string{"tools.raw", "btrfs/tools.raw"} {
+		if !fileutils.Exist(filepath.Join(SysextDir, kept)) {
+			t.Errorf("%s should have been kept", kept)
+		}
+	}
+}
+
+func TestCreateSysextVariants(t *testing.T) {
+	requireTools(t, "mkfs.ext4", "mksquashfs")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/variants:1", nil, []testFile{
+		{Path: "usr/bin/tool", Content: "tool\n", Mode: 0o755},
+	})
+
+	err := CreateSysext(CreateOptions{Image: "localhost/variants:1", Name: "variants", Fs: "squashfs,ext4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := ReadMetadata("variants")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metadata.Fs != "squashfs" || len(metadata.Variants) != 1 || metadata.Variants[0] != "ext4" {
+		t.Fatalf("got fs %s and variants %v, expected squashfs and ext4", metadata.Fs, metadata.Variants)
+	}
+
+	err = SetExtensionRelease("variants", []string{"FOO=bar"}, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, raw := range []string{GetRawPath("variants"), getFsVariantPath(GetRawPath("variants"), "ext4")} {
+		mountDIR, unmount, err := mountRaw(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := os.ReadFile(filepath.Join(mountDIR, "usr/lib/extension-release.d/extension-release.variants"))
+
+		unmount()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(content), "FOO=bar\n") {
+			t.Errorf("the extension-release of %s wasn't updated:\n%s", raw, content)
+		}
+	}
+}
+
+// withFakeDepmod puts first in PATH a depmod printing input help, and writing
+// modules.dep where depmod would for its -b and --moduledir arguments.
+func withFakeDepmod(t *testing.T, help string) {
+	t.Helper()
+
+	binDIR := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = --help ]; then echo '" + help + "'; exit 0; fi\n" +
+		"base=$2; shift 2\n" +
+		"dir=/lib/modules\n" +
+		"if [ \"$1\" = --moduledir ]; then dir=$2; shift 2; fi\n" +
+		"echo deps > \"$base$dir/$1/modules.dep\"\n"
+
+	err := os.WriteFile(filepath.Join(binDIR, "depmod"), []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", binDIR+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRunDepmod(t *testing.T) {
+	outside := t.TempDir()
+	writeTestFile(t, outside, "modules/6.1.0/kernel", "", 0o644)
+
+	tests := []struct {
+		name   string
+		help   string
+		lib    string
+		failed bool
+	}{
+		{"moduledir", "-m, --moduledir=DIR", "", false},
+		{"moduledir ignoring lib", "-m, --moduledir=DIR", outside, false},
+		{"no lib", "", "", false},
+		{"relative lib", "", "usr/lib", false},
+		{"lib outside", "", outside, true},
+	}
+
+	for _, test := range tests {
+		withFakeDepmod(t, test.help)
+
+		rootfsDIR := t.TempDir()
+		writeTestFile(t, rootfsDIR, "usr/lib/modules/6.1.0/kernel", "", 0o644)
+
+		if test.lib != "" {
+			err := os.Symlink(test.lib, filepath.Join(rootfsDIR, "lib"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := runDepmod(rootfsDIR, "")
+		if (err != nil) != test.failed {
+			t.Errorf("%s: got %v, expected a failure %v", test.name, err, test.failed)
+		}
+
+		if fileExists(filepath.Join(outside, "modules/6.1.0/modules.dep")) {
+			t.Fatalf("%s: depmod wrote outside of the rootfs", test.name)
+		}
+
+		if !test.failed && !fileExists(filepath.Join(rootfsDIR, "usr/lib/modules/6.1.0/modules.dep")) {
+			t.Errorf("%s: modules.dep was not written in /usr/lib/modules", test.name)
+		}
+
+		if test.lib == "" && fileExists(filepath.Join(rootfsDIR, "lib")) {
+			t.Errorf("%s: the temporary /lib symlink was left behind", test.name)
+		}
+	}
+}
+
+func TestCreateSysextSplitOpt(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/split:1", nil, []testFile{
+		{Path: "etc/os-release", Content: "ID=fedora\n"},
+		{Path: "usr/bin/tool", Content: "tool\n", Mode: 0o755},
+		{Path: "opt/app/app", Content: "app\n", Mode: 0o755},
+		{Path: "var/lib/state", Content: "state\n"},
+	})
+
+	err := CreateSysext(CreateOptions{Image: "localhost/split:1", Name: "split", Fs: "ext4", SplitOpt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		present []string
+		absent  []string
+	}{
+		{"split", []string{"usr/bin/tool", "usr/lib/extension-release.d/extension-release.split"},
+			[]string{"opt", "etc", "var"}},
+		{"split-opt", []string{"opt/app/app", "usr/lib/extension-release.d/extension-release.split-opt"},
+			[]string{"usr/bin", "etc", "var"}},
+	}
+
+	for _, test := range tests {
+		_, err = ReadMetadata(test.name)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		mountDIR, unmount, err := mountRaw(GetRawPath(test.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, path := range test.present {
+			if !fileutils.Exist(filepath.Join(mountDIR, path)) {
+				t.Errorf("%s: /%s is missing", test.name, path)
+			}
+		}
+
+		for _, path := range test.absent {
+			if fileutils.Exist(filepath.Join(mountDIR, path)) {
+				t.Errorf("%s: /%s should not be packed", test.name, path)
+			}
+		}
+
+		unmount()
+	}
+}
+
+func TestCheckPinned(t *testing.T) {
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/pinned:latest", nil, []testFile{{Path: "usr/bin/tool", Content: "tool\n"}})
+
+	digest, err := imageutils.GetDigest("localhost/pinned:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := "localhost/pinned@" + digest
+
+	tests := []struct {
+		image  string
+		pinned bool
+	}{
+		{"localhost/pinned:latest", false},
+		{"localhost/pinned@" + digest, true},
+		{imageutils.ContainersStoragePrefix + "localhost/pinned:latest", true},
+	}
+
+	for _, test := range tests {
+		var err error
+
+		warnings := captureWarnings(t, func() {
+			err = checkPinned(test.image, false)
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", test.image, err)
+		}
+
+		if (len(warnings) == 0) != test.pinned {
+			t.Errorf("%s: got warnings %q, expected pinned %v", test.image, warnings, test.pinned)
+		}
+
+		err = checkPinned(test.image, true)
+		if (err == nil) != test.pinned {
+			t.Errorf("%s: strict check = %v, expected pinned %v", test.image, err, test.pinned)
+		}
+
+		// the error tells the digest to pin the image with
+		if err != nil && !strings.Contains(err.Error(), pinned) {
+			t.Errorf("%s: %q doesn't suggest %s", test.image, err, pinned)
+		}
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	type compressionTest struct {
+		fs          string
+		compression string
+		level       int
+		valid       bool
+	}
+
+	tests := []compressionTest{
+		{"squashfs", "zstd", 99, false},
+		{"squashfs", "gzip", 10, false},
+		{"btrfs", "zstd", 16, false},
+		{"btrfs", "zstd", 15, true},
+		{"squashfs", "xz", 6, false},
+		{"squashfs", "brotli", 0, false},
+		{"ext4", "gzip", 0, false},
+		{"squashfs", "", 3, false},
+		{"squashfs", "", 0, true},
+	}
+
+	// every algorithm accepts its whole range, and nothing out of it
+	for fs, algorithms := range compressionAlgorithms {
+		for _, algorithm := range algorithms {
+			tests = append(tests, compressionTest{fs, algorithm.name, 0, true},
+				compressionTest{fs, algorithm.name, -1, false},
+				compressionTest{fs, algorithm.name, algorithm.maxLevel + 1, false})
+
+			for level := max(algorithm.minLevel, 1); level <= algorithm.maxLevel; level++ {
+				tests = append(tests, compressionTest{fs, algorithm.name, level, true})
+			}
+
+			if algorithm.minLevel > 1 {
+				tests = append(tests, compressionTest{fs, algorithm.name, algorithm.minLevel - 1, false})
+			}
+		}
+	}
+
+	for _, test := range tests {
+		err := validateCompression(test.fs, test.compression, test.level)
+		if (err == nil) != test.valid {
+			t.Errorf("validateCompression(%s, %q, %d) = %v, expected valid %v",
+				test.fs, test.compression, test.level, err, test.valid)
+		}
+	}
+}
+
+func TestCheckKernelCompression(t *testing.T) {
+	tests := []struct {
+		fs          string
+		compression string
+		kernel      string
+		supported   bool
+	}{
+		{"squashfs", "zstd", "4.14", true},
+		{"squashfs", "zstd", "4.9.0-13-amd64", false},
+		{"squashfs", "lz4", "3.19", true},
+		{"squashfs", "lz4", "3.18.140", false},
+		{"squashfs", "lzma", "6.1", false},
+		{"squashfs", "", "2.6.0", true},
+		{"btrfs", "zstd", "5.10.0-18-amd64", true},
+		{"btrfs", "lzo", "2.6.37", false},
+		{"ext4", "", "2.6.0", true},
+	}
+
+	for _, test := range tests {
+		err := checkKernelCompression(test.fs, test.compression, test.kernel, true)
+		if (err == nil) != test.supported {
+			t.Errorf("checkKernelCompression(%s, %s, %s) = %v, expected supported %v",
+				test.fs, test.compression, test.kernel, err, test.supported)
+		}
+
+		// without strict it's only a warning
+		err = checkKernelCompression(test.fs, test.compression, test.kernel, false)
+		if err != nil {
+			t.Errorf("checkKernelCompression(%s, %s, %s) without strict = %v",
+				test.fs, test.compression, test.kernel, err)
+		}
+	}
+
+	err := checkKernelCompression("squashfs", "zstd", "six", false)
+	if err == nil {
+		t.Error("an invalid kernel version should be refused")
+	}
+
+	// every algorithm mainline kernels can mount has a valid minimum version
+	for fs, algorithms := range compressionAlgorithms {
+		for _, algorithm := range algorithms {
+			if algorithm.minKernel == "" {
+				continue
+			}
+
+			_, err = parseKernelVersion(algorithm.minKernel)
+			if err != nil {
+				t.Errorf("%s %s: %v", fs, algorithm.name, err)
+			}
+		}
+	}
+}
+
+func TestLayerHistory(t *testing.T) {
+	config := v1.ConfigFile{History: []v1.History{
+		{CreatedBy: "ADD rootfs.tar /"},
+		{CreatedBy: "ENV PATH=/usr/bin", EmptyLayer: true},
+		{CreatedBy: "RUN apk add tools"},
+		{CreatedBy: "CMD [\"sh\"]", EmptyLayer: true},
+		{CreatedBy: "COPY app /opt/app"},
+	}}
+
+	history := layerHistory(config)
+
+	createdBy := []string{}
+	for _, entry := range history {
+		createdBy = append(createdBy, entry.CreatedBy)
+	}
+
+	expected := []string{"ADD rootfs.tar /", "RUN apk add tools", "COPY app /opt/app"}
+	if !reflect.DeepEqual(createdBy, expected) {
+		t.Errorf("got %q, expected %q", createdBy, expected)
+	}
+}
+
+func TestCreateSysextUpToLayer(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	layers := [][]testFile{}
+	for _, layer := range []string{"1", "2", "3", "4"} {
+		layers = append(layers, []testFile{{Path: "usr/share/layer" + layer, Content: layer}})
+	}
+
+	writeTestImage(t, "localhost/uptolayer:1", nil, layers...)
+
+	for _, invalid := range []int{-1, 5} {
+		err := CreateSysext(CreateOptions{Image: "localhost/uptolayer:1", Name: "uptolayer", Fs: "ext4",
+			UpToLayer: invalid})
+		if err == nil {
+			t.Errorf("building up to layer %d of 4 should fail", invalid)
+		}
+	}
+
+	err := CreateSysext(CreateOptions{Image: "localhost/uptolayer:1", Name: "uptolayer", Fs: "ext4", UpToLayer: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mountDIR, unmount, err := mountRaw(GetRawPath("uptolayer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer unmount()
+
+	for layer, expected := range map[string]bool{"1": true, "2": true, "3": false, "4": false} {
+		if fileutils.Exist(filepath.Join(mountDIR, "usr/share/layer"+layer)) != expected {
+			t.Errorf("layer %s extracted: %v, expected %v", layer, !expected, expected)
+		}
+	}
+}
+
+func TestDefaultCompression(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected map[string]string
+		invalid  bool
+	}{
+		{"", map[string]string{"squashfs": "", "btrfs": "", "ext4": ""}, false},
+		{"compression.squashfs = zstd\ncompression.btrfs = zlib\n",
+			map[string]string{"squashfs": "zstd", "btrfs": "zlib", "ext4": ""}, false},
+		// every fs is validated, not only the one built
+		{"compression.squashfs = zstd\ncompression.btrfs = xz\n", nil, true},
+		{"compression.ext4 = zstd\n", nil, true},
+		{"compression.erofs = lz4\n", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Setenv("OCI_SYSEXT_HOME", t.TempDir())
+		writeTestFile(t, filepath.Dir(utils.GetConfigPath()), "config.conf", test.config, 0o644)
+
+		for _, fs := range []string{"squashfs", "btrfs", "ext4"} {
+			compression, err := defaultCompression(fs)
+			if (err != nil) != test.invalid {
+				t.Errorf("config %q, fs %s: got %v, expected invalid %v", test.config, fs, err, test.invalid)
+			}
+
+			if !test.invalid && compression != test.expected[fs] {
+				t.Errorf("config %q, fs %s: got %q, expected %q", test.config, fs, compression, test.expected[fs])
+			}
+		}
+	}
+}
+
+func TestCreateSysextPackFailure(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/pack:1", nil, []testFile{
+		{Path: "usr/bin/tool", Content: "tool\n", Mode: 0o755},
+	})
+
+	// a mksquashfs failing halfway through its output
+	binDIR := t.TempDir()
+	writeTestFile(t, binDIR, "mksquashfs", "#!/bin/sh\necho partial > \"$2\"\necho mksquashfs failed >&2\nexit 1\n", 0o755)
+	t.Setenv("PATH", binDIR+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// alone, and as a variant packed after the ext4 image
+	for _, fs := range []string{"squashfs", "ext4,squashfs"} {
+		err := CreateSysext(CreateOptions{Image: "localhost/pack:1", Name: "pack", Fs: fs})
+		if err == nil || !strings.Contains(err.Error(), "mksquashfs failed") {
+			t.Fatalf("%s: got %v, expected the output of the failing tool", fs, err)
+		}
+
+		err = filepath.WalkDir(SysextDir, func(path string, entry os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if strings.HasSuffix(path, ".raw") || strings.HasSuffix(path, ".tmp") {
+				t.Errorf("%s: partial artifact %s left behind", fs, path)
+			}
+
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+
+		if fileExists(filepath.Join(SysextRootfsDir, getID("pack"))) {
+			t.Errorf("%s: the staging rootfs was left behind", fs)
+		}
+	}
+}
+
+func TestPackBtrfsMinSize(t *testing.T) {
+	requireTools(t, "mkfs.btrfs")
+
+	minSize, err := utils.ParseSize(btrfsMinSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	minimal := t.TempDir()
+	writeTestFile(t, minimal, "usr/lib/extension-release.d/extension-release.tiny", "ID=_any\n", 0o644)
+
+	for _, rootfsDIR := range []string{t.TempDir(), minimal} {
+		target := filepath.Join(t.TempDir(), "tiny.raw")
+
+		var err error
+
+		warnings := captureWarnings(t, func() {
+			err = PackRootfs(rootfsDIR, target, "btrfs", PackOptions{TmpDir: t.TempDir()})
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", rootfsDIR, err)
+		}
+
+		info, err := os.Stat(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if uint64(info.Size()) < minSize {
+			t.Errorf("%s: got a %d bytes image, expected at least %s", rootfsDIR, info.Size(), btrfsMinSize)
+		}
+
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "padding") {
+			t.Errorf("%s: got warnings %q, expected the padding one", rootfsDIR, warnings)
+		}
+	}
+}
+
+func TestCreateSysextMaxUncompressedSize(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	// a few KB compressed, 3 MB extracted each
+	zeros := strings.Repeat("\x00", 3<<20)
+
+	writeTestImage(t, "localhost/bomb:1", nil,
+		[]testFile{{Path: "usr/lib/first", Content: zeros}},
+		[]testFile{{Path: "usr/lib/second", Content: zeros}},
+	)
+
+	for _, limit := range []uint64{2 << 20, 5 << 20} {
+		err := CreateSysext(CreateOptions{Image: "localhost/bomb:1", Name: "bomb", Fs: "ext4", MaxUncompressedSize: limit})
+		if err == nil || !strings.Contains(err.Error(), "exceeds the maximum uncompressed size") {
+			t.Fatalf("limit %d: got %v, expected the limit to be exceeded", limit, err)
+		}
+
+		if fileExists(filepath.Join(SysextRootfsDir, getID("bomb"))) || fileExists(GetRawPath("bomb")) {
+			t.Errorf("limit %d: the partial build was left behind", limit)
+		}
+	}
+
+	err := CreateSysext(CreateOptions{Image: "localhost/bomb:1", Name: "bomb", Fs: "ext4", MaxUncompressedSize: 8 << 20})
+	if err != nil {
+		t.Errorf("the layers fit in the limit: %v", err)
+	}
+}
+
+func TestCreateSysextHardlinks(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	// busybox-style applets, all linked to one binary
+	applets := []string{"usr/bin/ls", "usr/bin/cat", "usr/sbin/init"}
+	files := []testFile{{Path: "usr/bin/busybox", Content: strings.Repeat("busybox", 1024), Mode: 0o755}}
+
+	for _, applet := range applets {
+		files = append(files, testFile{Path: applet, Hardlink: "usr/bin/busybox"})
+	}
+
+	writeTestImage(t, "localhost/busybox:1", nil, files)
+
+	for _, breakHardlinks := range []bool{false, true} {
+		err := CreateSysext(CreateOptions{Image: "localhost/busybox:1", Name: "busybox", Fs: "ext4",
+			BreakHardlinks: breakHardlinks})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mountDIR, unmount, err := mountRaw(GetRawPath("busybox"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inodes := map[uint64]bool{}
+
+		for _, path := range append([]string{"usr/bin/busybox"}, applets...) {
+			var stat syscall.Stat_t
+
+			err = syscall.Stat(filepath.Join(mountDIR, path), &stat)
+			if err != nil {
+				unmount()
+				t.Fatal(err)
+			}
+
+			inodes[stat.Ino] = true
+		}
+
+		unmount()
+
+		expected := 1
+		if breakHardlinks {
+			expected = len(applets) + 1
+		}
+
+		if len(inodes) != expected {
+			t.Errorf("breaking hard links %v: got %d inodes, expected %d", breakHardlinks, len(inodes), expected)
+		}
+	}
+}
+
+func TestParseMtime(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+
+	tests := []struct {
+		value    string
+		expected int64
+		valid    bool
+	}{
+		{"source-date", 1700000000, true},
+		{"2024-02-29T12:30:00Z", 1709209800, true},
+		{"2024-02-29T14:30:00+02:00", 1709209800, true},
+		{"1709209800", 1709209800, true},
+		{"0", 0, true},
+		{"2024-02-29", 0, false},
+		{"yesterday", 0, false},
+		{"", 0, false},
+		{"1709209800.5", 0, false},
+	}
+
+	for _, test := range tests {
+		mtime, err := parseMtime(test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("parseMtime(%q) = %v, expected valid %v", test.value, err, test.valid)
+
+			continue
+		}
+
+		if test.valid && mtime.Unix() != test.expected {
+			t.Errorf("parseMtime(%q) = %d, expected %d", test.value, mtime.Unix(), test.expected)
+		}
+	}
+
+	before := time.Now().Add(-time.Second)
+
+	mtime, err := parseMtime("now")
+	if err != nil || mtime.Before(before) || mtime.After(time.Now()) {
+		t.Errorf("parseMtime(now) = %v, %v", mtime, err)
+	}
+
+	for _, epoch := range []string{"", "soon"} {
+		t.Setenv("SOURCE_DATE_EPOCH", epoch)
+
+		_, err = parseMtime("source-date")
+		if err == nil {
+			t.Errorf("SOURCE_DATE_EPOCH %q should be refused", epoch)
+		}
+	}
+}
+
+func TestCreateSysextMtime(t *testing.T) {
+	requireTools(t, "mkfs.ext4")
+	withTestDirs(t)
+
+	writeTestImage(t, "localhost/mtime:1", nil, []testFile{
+		{Path: "usr/bin/tool", Content: "tool\n", Mode: 0o755},
+		{Path: "opt/tool/data", Content: "data\n"},
+	})
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+
+	for value, expected := range map[string]int64{"2024-02-29T12:30:00Z": 1709209800, "source-date": 1700000000} {
+		err := CreateSysext(CreateOptions{Image: "localhost/mtime:1", Name: "mtime", Fs: "ext4",
+			SplitOpt: true, Mtime: value})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every raw image packed by the build
+		for _, raw := range []string{GetRawPath("mtime"), GetRawPath("mtime-opt")} {
+			info, err := os.Stat(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.ModTime().Unix() != expected {
+				t.Errorf("%s: %s has mtime %d, expected %d", value, raw, info.ModTime().Unix(), expected)
+			}
+		}
+	}
+
+	err := CreateSysext(CreateOptions{Image: "localhost/mtime:1", Name: "mtime", Fs: "ext4", Mtime: "tomorrow"})
+	if err == nil {
+		t.Error("an invalid mtime should be refused")
+	}
+}
@@ -0,0 +1,261 @@
+package sysextutils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+)
+
+// TrySysext will run input command, or else a shell, in a transient
+// systemd-nspawn container of input base image with the sysext of input name
+// merged, along with the sysexts it requires, see resolveRequires. The base
+// defaults to the image source the sysext was built against. Like systemd-sysext does, only the sysextDirs of the sysext are
+// overlaid, each on the same dir of the base, with a writable layer on top:
+// the container and anything it changes are discarded on exit.
+func TrySysext(name string, base string, command []string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("try needs root privileges to mount the sysext and run systemd-nspawn")
+	}
+
+	_, err := exec.LookPath("systemd-nspawn")
+	if err != nil {
+		return fmt.Errorf("try needs systemd-nspawn, usually packaged as systemd-container: %w", err)
+	}
+
+	rawFile := GetRawPath(name)
+	if !fileutils.Exist(rawFile) {
+		return fmt.Errorf("sysext %s not found in %s", name, SysextDir)
+	}
+
+	if base == "" {
+		metadata, err := ReadMetadata(name)
+		if err != nil || metadata.ImageSource == "" {
+			return fmt.Errorf("%s was built without an image source to use as base, use --base", name)
+		}
+
+		base = metadata.ImageSource
+	}
+
+	base, err = imageutils.ResolveShortName(base)
+	if err != nil {
+		return err
+	}
+
+	err = ensureImage(base, false, false)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := readManifest(base)
+	if err != nil {
+		return err
+	}
+
+	baseDIR, err := extractBaseRootfs(base, manifest.Layers, ".try-base", nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.RemoveAll(baseDIR) }()
+
+	mountDIR, unmount, err := mountRaw(rawFile)
+	if err != nil {
+		return err
+	}
+
+	defer unmount()
+
+	err = checkTryBase(name, mountDIR, baseDIR)
+	if err != nil {
+		return err
+	}
+
+	tryDIR, err := os.MkdirTemp("", "oci-sysext-try-")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.RemoveAll(tryDIR) }()
+
+	// the sysexts it requires are merged along, like they'd have to be on
+	// the host.
+	requires, err := resolveRequires(name)
+	if err != nil {
+		return err
+	}
+
+	mountDIRs := []string{mountDIR}
+
+	for _, required := range requires {
+		requiredDIR, unmountRequired, err := mountRaw(GetRawPath(required))
+		if err != nil {
+			return err
+		}
+
+		defer unmountRequired()
+
+		logging.Log("merging %s, required by %s", required, name)
+
+		mountDIRs = append(mountDIRs, requiredDIR)
+	}
+
+	for _, dir := range sysextDirs {
+		sysextDIRs := []string{}
+
+		for _, mounted := range mountDIRs {
+			if fileutils.Exist(filepath.Join(mounted, dir)) {
+				sysextDIRs = append(sysextDIRs, filepath.Join(mounted, dir))
+			}
+		}
+
+		if len(sysextDIRs) == 0 {
+			continue
+		}
+
+		unmountDir, err := overlayDir(sysextDIRs, baseDIR, dir, filepath.Join(tryDIR, dir))
+		if err != nil {
+			return err
+		}
+
+		defer unmountDir()
+	}
+
+	args := []string{"--quiet", "--register=no", "--directory", baseDIR}
+	if len(command) > 0 {
+		args = append(append(args, "--"), command...)
+	}
+
+	logging.Log("starting a container of %s with %s merged", base, name)
+
+	nspawn := exec.Command("systemd-nspawn", args...)
+	nspawn.Stdin = os.Stdin
+	nspawn.Stdout = os.Stdout
+	nspawn.Stderr = os.Stderr
+
+	err = nspawn.Run()
+	if err != nil {
+		return fmt.Errorf("the container of %s exited with an error: %w", name, err)
+	}
+
+	return nil
+}
+
+// overlayDir will mount an overlay of input sysext dirs, the first one on top,
+// on top of input dir of the base rootfs, over the base dir itself, with its
+// writable layer in stateDIR, and return the function to unmount it. The base
+// dir is resolved inside the base rootfs, so that a symlink can't make it
+// mount elsewhere.
+func overlayDir(sysextDIRs []string, baseRootfs string, dir string, stateDIR string) (func(), error) {
+	resolved, _, err := fileutils.ResolveInRootfs(baseRootfs, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		resolved, err = dir, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	baseDIR := filepath.Join(baseRootfs, resolved)
+	upperDIR := filepath.Join(stateDIR, "upper")
+	workDIR := filepath.Join(stateDIR, "work")
+
+	for _, path := range []string{baseDIR, upperDIR, workDIR} {
+		err := os.MkdirAll(path, 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the first lowerdir is the topmost, so the base goes last
+	lowerDIRs := strings.Join(append(append([]string{}, sysextDIRs...), baseDIR), ":")
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDIRs, upperDIR, workDIR)
+
+	logging.LogDebug("overlaying %s on %s", strings.Join(sysextDIRs, ", "), baseDIR)
+
+	out, err := exec.Command("mount", "-t", "overlay", "overlay", "-o", options, baseDIR).CombinedOutput()
+	if err != nil {
+		logging.LogError(string(out))
+
+		return nil, err
+	}
+
+	return func() {
+		out, err := exec.Command("umount", baseDIR).CombinedOutput()
+		if err != nil {
+			logging.LogError(string(out))
+		}
+	}, nil
+}
+
+// checkTryBase will warn if the extension-release of the sysext of input
+// name, mounted at mountDIR, sets an ID other than the one of the base rootfs:
+// systemd-sysext would refuse to merge it on such a host.
+func checkTryBase(name string, mountDIR string, baseDIR string) error {
+	content, err := os.ReadFile(filepath.Join(mountDIR, "usr/lib/extension-release.d", "extension-release."+name))
+	if err != nil {
+		return fmt.Errorf("cannot read the extension-release of %s: %w", name, err)
+	}
+
+	_, release := collapseReleaseFields(strings.Split(strings.TrimRight(string(content), "\n"), "\n"))
+
+	fields, err := readOSReleaseFields(baseDIR)
+	if err != nil {
+		return err
+	}
+
+	_, host := collapseReleaseFields(fields)
+
+	if release["ID"] != "" && release["ID"] != "_any" && release["ID"] != host["ID"] {
+		logging.LogWarning("%s sets ID=%s but the base is ID=%s, systemd-sysext would refuse to merge it",
+			name, release["ID"], host["ID"])
+	}
+
+	return nil
+}
+
+// resolveRequires returns the sysexts required by the one of input name,
+// recorded in their metadata, and the ones they require in turn, each once.
+// A required sysext missing from SysextDir is an error, as the sysext can't
+// work without it.
+func resolveRequires(name string) ([]string, error) {
+	requires := []string{}
+	seen := map[string]bool{name: true}
+	queue := []string{name}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		metadata, err := ReadMetadata(current)
+		if err != nil {
+			// sysexts built elsewhere have no metadata, and so no
+			// requirements recorded.
+			continue
+		}
+
+		for _, required := range metadata.Options.Requires {
+			if seen[required] {
+				continue
+			}
+
+			seen[required] = true
+
+			if !fileutils.Exist(GetRawPath(required)) {
+				return nil, fmt.Errorf("sysext %s requires %s, not found in %s", current, required, SysextDir)
+			}
+
+			requires = append(requires, required)
+			queue = append(queue, required)
+		}
+	}
+
+	return requires, nil
+}
@@ -0,0 +1,140 @@
+package sysextutils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+)
+
+// hostShellLayer returns a layer with the shell of the host and the libraries
+// it needs, along with the path of the shell.
+func hostShellLayer(t *testing.T) ([]testFile, string) {
+	t.Helper()
+
+	shell, err := filepath.EvalSymlinks("/bin/sh")
+	if err != nil {
+		t.Skipf("no shell on the host: %v", err)
+	}
+
+	closure, err := fileutils.ResolveELFClosure("/", []string{shell})
+	if err != nil || len(closure.Missing) > 0 {
+		t.Skipf("cannot resolve the libraries of %s: %v %v", shell, err, closure.Missing)
+	}
+
+	paths := closure.Files
+	sort.Slice(paths, func(i, j int) bool { return len(paths[i]) < len(paths[j]) })
+
+	files := []testFile{{Path: "usr/lib/os-release", Content: "ID=trybase\n"}}
+
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		file := testFile{Path: strings.TrimPrefix(path, "/"), Mode: int64(info.Mode().Perm())}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			file.Link, err = os.Readlink(path)
+		} else {
+			var content []byte
+
+			content, err = os.ReadFile(path)
+			file.Content = string(content)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files = append(files, file)
+	}
+
+	return files, shell
+}
+
+func TestTrySysext(t *testing.T) {
+	requireTools(t, "systemd-nspawn", "mkfs.ext4", "mount")
+	withTestDirs(t)
+
+	base, shell := hostShellLayer(t)
+
+	writeTestImage(t, "localhost/trybase:1", nil, base)
+	writeTestImage(t, "localhost/runtime:1", nil, []testFile{
+		{Path: "usr/share/runtime/greeting", Content: "hello-from-sysext\n"},
+	})
+	writeTestImage(t, "localhost/tools:1", nil, []testFile{
+		{Path: "usr/bin/hello", Content: "#!" + shell + "\nread greeting < /usr/share/runtime/greeting\n" +
+			"echo $greeting\n", Mode: 0o755},
+		{Path: "etc/leak", Content: "not merged\n"},
+	})
+
+	err := CreateSysext(CreateOptions{Image: "localhost/tools:1", Name: "tools", Fs: "ext4",
+		Requires: []string{"runtime"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = TrySysext("tools", "localhost/trybase:1", []string{shell, "-c", "true"})
+	if err == nil {
+		t.Fatal("try should fail while the required runtime sysext is missing")
+	}
+
+	err = CreateSysext(CreateOptions{Image: "localhost/runtime:1", Name: "runtime", Fs: "ext4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sysext /usr is merged along with the required one, its /etc is not
+	err = TrySysext("tools", "localhost/trybase:1",
+		[]string{shell, "-c", `test "$(/usr/bin/hello)" = hello-from-sysext && test ! -e /etc/leak`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = TrySysext("tools", "localhost/trybase:1", []string{shell, "-c", "exit 3"})
+	if err == nil {
+		t.Fatal("a failing command should fail try")
+	}
+}
+
+func TestResolveRequires(t *testing.T) {
+	withTestDirs(t)
+
+	for name, requires := range map[string][]string{
+		"plugin":  {"runtime", "libs"},
+		"runtime": {"libs", "plugin"},
+		"libs":    nil,
+	} {
+		writeTestFile(t, SysextDir, name+".raw", "", 0o644)
+
+		err := WriteMetadata(Metadata{Name: name, Options: CreateOptions{Requires: requires}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requires, err := resolveRequires("plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(requires, []string{"runtime", "libs"}) {
+		t.Errorf("got requires %v, expected runtime and libs once", requires)
+	}
+
+	err = os.Remove(filepath.Join(SysextDir, "libs.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = resolveRequires("plugin")
+	if err == nil {
+		t.Error("a missing required sysext should be an error")
+	}
+}
@@ -0,0 +1,84 @@
+package sysextutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/imageutils"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// readImageConfig returns the OCI config of input image, already pulled.
+func readImageConfig(image string) (v1.Config, error) {
+	configFile, err := fileutils.ReadFile(filepath.Join(imageutils.GetPath(image), "config.json"))
+	if err != nil {
+		return v1.Config{}, err
+	}
+
+	var config v1.ConfigFile
+
+	err = json.Unmarshal(configFile, &config)
+	if err != nil {
+		return v1.Config{}, err
+	}
+
+	return config.Config, nil
+}
+
+// WriteUnit will write at path a basic systemd service unit running the
+// entrypoint and command recorded in input metadata, with its environment.
+func WriteUnit(path string, metadata Metadata) error {
+	command := append(append([]string{}, metadata.Entrypoint...), metadata.Cmd...)
+	if len(command) == 0 {
+		return errors.New("the image has neither an entrypoint nor a command to generate a unit for")
+	}
+
+	lines := []string{
+		"[Unit]",
+		fmt.Sprintf("Description=%s from %s", metadata.Name, escapeUnitValue(metadata.Image)),
+		"",
+		"[Service]",
+	}
+
+	for _, env := range metadata.Env {
+		lines = append(lines, "Environment="+quoteUnitArgument(env))
+	}
+
+	arguments := []string{}
+	for _, argument := range command {
+		arguments = append(arguments, quoteUnitArgument(argument))
+	}
+
+	lines = append(lines,
+		"ExecStart="+strings.Join(arguments, " "),
+		"",
+		"[Install]",
+		"WantedBy=multi-user.target",
+	)
+
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return fileutils.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+}
+
+// escapeUnitValue escapes the specifiers and variables systemd would expand
+// in input value.
+func escapeUnitValue(value string) string {
+	return strings.NewReplacer("%", "%%", "$", "$$").Replace(value)
+}
+
+// quoteUnitArgument returns input value as a double quoted unit file
+// argument, so that spaces and special characters are kept as they are.
+func quoteUnitArgument(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(escapeUnitValue(value))
+
+	return `"` + value + `"`
+}
@@ -0,0 +1,165 @@
+package sysextutils
+
+import (
+	"errors"
+	"strings"
+)
+
+// FlagConflictError is returned for create options that can't be used
+// together, it names the flags involved and why they conflict.
+type FlagConflictError struct {
+	// Flags are the names of the conflicting flags, without dashes.
+	Flags []string
+	// Reason explains the conflict.
+	Reason string
+}
+
+func (e *FlagConflictError) Error() string {
+	return "--" + strings.Join(e.Flags, " and --") + ": " + e.Reason
+}
+
+// flagRule is a constraint between create options, broken returns whether
+// input options violate it.
+type flagRule struct {
+	flags  []string
+	reason string
+	broken func(opts CreateOptions) bool
+}
+
+// flagRules lists the combinations of create options that are mutually
+// exclusive, or that require each other.
+var flagRules = []flagRule{
+	{
+		flags:  []string{"auto-source", "image-source"},
+		reason: "the image source is either detected or given",
+		broken: func(opts CreateOptions) bool {
+			return opts.AutoSource && opts.ImageSource != ""
+		},
+	},
+	{
+		flags:  []string{"minimal-diff", "image-source"},
+		reason: "a minimal diff needs an image source to diff against, given or detected with --auto-source",
+		broken: func(opts CreateOptions) bool {
+			return opts.MinimalDiff && opts.ImageSource == "" && !opts.AutoSource
+		},
+	},
+	{
+		flags:  []string{"boot-optimized", "fs"},
+		reason: "boot-optimized sysexts are only supported on squashfs",
+		broken: func(opts CreateOptions) bool {
+			return opts.BootOptimized && !onlySquashfs(opts)
+		},
+	},
+	{
+		flags:  []string{"reproducible", "fs"},
+		reason: "reproducible sysexts are only supported on squashfs",
+		broken: func(opts CreateOptions) bool {
+			return opts.Reproducible && !onlySquashfs(opts)
+		},
+	},
+	{
+		flags:  []string{"boot-optimized", "release-field"},
+		reason: "SYSEXT_SCOPE can't be set by both",
+		broken: func(opts CreateOptions) bool {
+			return opts.BootOptimized && hasReleaseField(opts.ReleaseFields, "SYSEXT_SCOPE")
+		},
+	},
+	{
+		flags:  []string{"architecture", "release-field"},
+		reason: "ARCHITECTURE can't be set by both",
+		broken: func(opts CreateOptions) bool {
+			return opts.Architecture != "" && hasReleaseField(opts.ReleaseFields, "ARCHITECTURE")
+		},
+	},
+	{
+		flags:  []string{"release-id", "release-field"},
+		reason: "ID can't be set by both",
+		broken: func(opts CreateOptions) bool {
+			return opts.ReleaseID != "" && hasReleaseField(opts.ReleaseFields, "ID")
+		},
+	},
+	{
+		flags:  []string{"release-id", "match-host"},
+		reason: "--match-host sets ID to the host one",
+		broken: func(opts CreateOptions) bool {
+			return opts.ReleaseID != "" && opts.MatchHost
+		},
+	},
+	{
+		flags:  []string{"sysext-level", "release-field"},
+		reason: "SYSEXT_LEVEL can't be set by both",
+		broken: func(opts CreateOptions) bool {
+			return opts.SysextLevel != "" && hasReleaseField(opts.ReleaseFields, "SYSEXT_LEVEL")
+		},
+	},
+	{
+		flags:  []string{"portable", "release-field"},
+		reason: "PORTABLE_PREFIXES can't be set by both",
+		broken: func(opts CreateOptions) bool {
+			return opts.Portable && hasReleaseField(opts.ReleaseFields, "PORTABLE_PREFIXES")
+		},
+	},
+	{
+		flags:  []string{"no-extension-reload", "release-field"},
+		reason: "EXTENSION_RELOAD_MANAGER can't be both omitted and set",
+		broken: func(opts CreateOptions) bool {
+			return opts.NoExtensionReload && hasReleaseField(opts.ReleaseFields, "EXTENSION_RELOAD_MANAGER")
+		},
+	},
+	{
+		flags:  []string{"version", "release-field"},
+		reason: "SYSEXT_VERSION_ID can't be set by both",
+		broken: func(opts CreateOptions) bool {
+			return opts.Version != "" && hasReleaseField(opts.ReleaseFields, "SYSEXT_VERSION_ID")
+		},
+	},
+	{
+		flags:  []string{"compress-snapshot", "incremental"},
+		reason: "only the incremental builds save a snapshot",
+		broken: func(opts CreateOptions) bool {
+			return opts.CompressSnapshot && !opts.Incremental
+		},
+	},
+	{
+		flags:  []string{"prune-broken-symlinks", "check-symlinks"},
+		reason: "only the symlinks found by the check are pruned",
+		broken: func(opts CreateOptions) bool {
+			return opts.PruneBrokenSymlinks && !opts.CheckSymlinks
+		},
+	},
+	{
+		flags:  []string{"entrypoint", "minimize"},
+		reason: "the entrypoints are only used to minimize the rootfs",
+		broken: func(opts CreateOptions) bool {
+			return len(opts.Entrypoints) > 0 && !opts.Minimize
+		},
+	},
+	{
+		flags:  []string{"minimize", "portable"},
+		reason: "portable services need their unit files, which are removed by the minimization",
+		broken: func(opts CreateOptions) bool {
+			return opts.Minimize && opts.Portable
+		},
+	},
+	{
+		flags:  []string{"kernel-version", "depmod"},
+		reason: "the kernel version is only used by depmod",
+		broken: func(opts CreateOptions) bool {
+			return opts.KernelVersion != "" && !opts.Depmod
+		},
+	},
+}
+
+// validateFlags will check the combinations of input options against
+// flagRules, returning a FlagConflictError for each broken rule.
+func validateFlags(opts CreateOptions) error {
+	errs := []error{}
+
+	for _, rule := range flagRules {
+		if rule.broken(opts) {
+			errs = append(errs, &FlagConflictError{Flags: rule.flags, Reason: rule.reason})
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,92 @@
+package sysextutils
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateFlags(t *testing.T) {
+	tests := []struct {
+		opts  CreateOptions
+		flags []string
+	}{
+		{CreateOptions{AutoSource: true, ImageSource: "localhost/base:1"}, []string{"auto-source", "image-source"}},
+		{CreateOptions{MinimalDiff: true}, []string{"minimal-diff", "image-source"}},
+		{CreateOptions{BootOptimized: true, Fs: "squashfs,ext4"}, []string{"boot-optimized", "fs"}},
+		{CreateOptions{Reproducible: true, Fs: "ext4"}, []string{"reproducible", "fs"}},
+		{CreateOptions{BootOptimized: true, Fs: "squashfs", ReleaseFields: []string{"SYSEXT_SCOPE=system"}},
+			[]string{"boot-optimized", "release-field"}},
+		{CreateOptions{Architecture: "x86-64", ReleaseFields: []string{"ARCHITECTURE=arm64"}},
+			[]string{"architecture", "release-field"}},
+		{CreateOptions{ReleaseID: "fedora", ReleaseFields: []string{"ID=_any"}}, []string{"release-id", "release-field"}},
+		{CreateOptions{ReleaseID: "fedora", MatchHost: true}, []string{"release-id", "match-host"}},
+		{CreateOptions{SysextLevel: "1.0", ReleaseFields: []string{"SYSEXT_LEVEL=2.0"}},
+			[]string{"sysext-level", "release-field"}},
+		{CreateOptions{Portable: true, ReleaseFields: []string{"PORTABLE_PREFIXES=foo"}},
+			[]string{"portable", "release-field"}},
+		{CreateOptions{NoExtensionReload: true, ReleaseFields: []string{"EXTENSION_RELOAD_MANAGER=1"}},
+			[]string{"no-extension-reload", "release-field"}},
+		{CreateOptions{Version: "1.0.0", ReleaseFields: []string{"SYSEXT_VERSION_ID=2.0.0"}},
+			[]string{"version", "release-field"}},
+		{CreateOptions{CompressSnapshot: true}, []string{"compress-snapshot", "incremental"}},
+		{CreateOptions{PruneBrokenSymlinks: true}, []string{"prune-broken-symlinks", "check-symlinks"}},
+		{CreateOptions{Entrypoints: []string{"/usr/bin/tool"}}, []string{"entrypoint", "minimize"}},
+		{CreateOptions{Minimize: true, Portable: true}, []string{"minimize", "portable"}},
+		{CreateOptions{KernelVersion: "6.1.0"}, []string{"kernel-version", "depmod"}},
+	}
+
+	if len(tests) != len(flagRules) {
+		t.Fatalf("%d cases for %d rules, every rule needs one", len(tests), len(flagRules))
+	}
+
+	for _, test := range tests {
+		err := validateFlags(test.opts)
+		if err == nil {
+			t.Errorf("--%s: expected a conflict", strings.Join(test.flags, " and --"))
+
+			continue
+		}
+
+		errs := []error{err}
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			errs = joined.Unwrap()
+		}
+
+		var conflict *FlagConflictError
+		if len(errs) != 1 || !errors.As(errs[0], &conflict) {
+			t.Errorf("--%s: got %v, expected a single conflict", strings.Join(test.flags, " and --"), err)
+
+			continue
+		}
+
+		if !reflect.DeepEqual(conflict.Flags, test.flags) {
+			t.Errorf("got a conflict of %q, expected %q", conflict.Flags, test.flags)
+		}
+
+		for _, flag := range test.flags {
+			if !strings.Contains(err.Error(), "--"+flag) {
+				t.Errorf("%q doesn't name --%s", err, flag)
+			}
+		}
+	}
+
+	// the flags of each rule are fine on their own or together when allowed
+	for _, opts := range []CreateOptions{
+		{},
+		{AutoSource: true, MinimalDiff: true},
+		{ImageSource: "localhost/base:1", MinimalDiff: true},
+		{BootOptimized: true, Reproducible: true, Fs: "squashfs"},
+		{ReleaseID: "fedora", ReleaseFields: []string{"FOO=bar"}},
+		{Incremental: true, CompressSnapshot: true},
+		{CheckSymlinks: true, PruneBrokenSymlinks: true},
+		{Minimize: true, Entrypoints: []string{"/usr/bin/tool"}},
+		{Depmod: true, KernelVersion: "6.1.0"},
+	} {
+		err := validateFlags(opts)
+		if err != nil {
+			t.Errorf("%+v: unexpected conflict %v", opts, err)
+		}
+	}
+}
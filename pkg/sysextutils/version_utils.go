@@ -0,0 +1,132 @@
+package sysextutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/89luca89/oci-sysext/pkg/fileutils"
+	"github.com/89luca89/oci-sysext/pkg/logging"
+	"github.com/89luca89/oci-sysext/pkg/utils"
+)
+
+// SysextVersionsDir keeps the versioned builds of each sysext, as
+// <name>/<version>.raw along with their <version>.json metadata.
+// It's kept out of SysextDir, where systemd-sysext would take any directory
+// for an extension.
+var SysextVersionsDir = filepath.Join(utils.GetOciSysextHome(), "sysext-versions")
+
+// GetVersionPath returns the path of the raw image of input version of a
+// sysext.
+func GetVersionPath(name string, version string) string {
+	return filepath.Join(SysextVersionsDir, name, version+".raw")
+}
+
+// saveVersion will keep input raw image as the version of its sysext in
+// SysextVersionsDir, hard linked if possible so that it takes no space until
+// the sysext is built again. The fs variants recorded in the metadata are kept
+// along with it, see getFsVariantPath.
+func saveVersion(metadata Metadata, rawFile string) error {
+	target := GetVersionPath(metadata.Name, metadata.Version)
+
+	sources := append([]string{rawFile}, getFsVariantPaths(rawFile, metadata.Variants)...)
+	targets := append([]string{target}, getFsVariantPaths(target, metadata.Variants)...)
+
+	for i, source := range sources {
+		err := os.MkdirAll(filepath.Dir(targets[i]), os.ModePerm)
+		if err != nil {
+			return err
+		}
+
+		_ = os.Remove(targets[i])
+
+		err = os.Link(source, targets[i])
+		if err != nil {
+			logging.LogDebug("cannot link %s, copying it: %v", source, err)
+
+			out, err := exec.Command("cp", "--sparse=always", "--reflink=auto", source, targets[i]).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("cannot save version %s of %s: %w: %s", metadata.Version, metadata.Name, err, out)
+			}
+		}
+	}
+
+	metadataFile, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fileutils.WriteFile(strings.TrimSuffix(target, ".raw")+".json", append(metadataFile, '\n'), 0o644)
+}
+
+// ListVersions returns the metadata of the saved versions of input sysext,
+// from the highest to the lowest semantic version.
+func ListVersions(name string) ([]Metadata, error) {
+	entries, err := os.ReadDir(filepath.Join(SysextVersionsDir, name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no versions of %s found in %s", name, SysextVersionsDir)
+		}
+
+		return nil, err
+	}
+
+	versions := []Metadata{}
+	semvers := map[string]utils.Semver{}
+
+	for _, entry := range entries {
+		version, found := strings.CutSuffix(entry.Name(), ".json")
+		if !found || entry.IsDir() {
+			continue
+		}
+
+		semver, err := utils.ParseSemver(version)
+		if err != nil {
+			logging.LogWarning("ignoring %s: %v", entry.Name(), err)
+
+			continue
+		}
+
+		metadataFile, err := fileutils.ReadFile(filepath.Join(SysextVersionsDir, name, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var metadata Metadata
+
+		err = json.Unmarshal(metadataFile, &metadata)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+
+		metadata.Version = version
+		semvers[version] = semver
+		versions = append(versions, metadata)
+	}
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no versions of %s found in %s", name, SysextVersionsDir)
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return semvers[versions[i].Version].Compare(semvers[versions[j].Version]) > 0
+	})
+
+	return versions, nil
+}
+
+// LatestVersion returns the metadata of the highest saved version of input
+// sysext.
+func LatestVersion(name string) (Metadata, error) {
+	versions, err := ListVersions(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return versions[0], nil
+}
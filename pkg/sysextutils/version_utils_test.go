@@ -0,0 +1,50 @@
+package sysextutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveVersionVariants(t *testing.T) {
+	withTestDirs(t)
+
+	previous := SysextVersionsDir
+	SysextVersionsDir = filepath.Join(t.TempDir(), "sysext-versions")
+
+	t.Cleanup(func() { SysextVersionsDir = previous })
+
+	rawFile := filepath.Join(SysextDir, "tools.raw")
+	writeTestFile(t, SysextDir, "tools.raw", "squashfs", 0o644)
+	writeTestFile(t, SysextDir, "ext4/tools.raw", "ext4", 0o644)
+
+	metadata := Metadata{Name: "tools", Version: "1.0.0", Fs: "squashfs", Variants: []string{"ext4"}}
+
+	err := saveVersion(metadata, rawFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{
+		GetVersionPath("tools", "1.0.0"):                           "squashfs",
+		getFsVariantPath(GetVersionPath("tools", "1.0.0"), "ext4"): "ext4",
+	} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(content) != expected {
+			t.Errorf("%s contains %q, expected %q", path, content, expected)
+		}
+	}
+
+	versions, err := ListVersions("tools")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 1 || len(versions[0].Variants) != 1 {
+		t.Errorf("got versions %+v, expected one with the ext4 variant", versions)
+	}
+}
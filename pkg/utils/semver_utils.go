@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// semverPattern is the regular expression suggested by semver.org for
+// MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD] versions.
+var semverPattern = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+	`(?:-((?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*))?` +
+	`(?:\+([0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*))?$`)
+
+// Semver is a parsed semantic version, see https://semver.org.
+type Semver struct {
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	Prerelease []string
+	Build      string
+}
+
+// ParseSemver will parse input MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD] version.
+func ParseSemver(version string) (Semver, error) {
+	match := semverPattern.FindStringSubmatch(version)
+	if match == nil {
+		return Semver{}, fmt.Errorf("invalid semantic version %q, expected MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD]", version)
+	}
+
+	var (
+		semver Semver
+		err    error
+	)
+
+	for i, part := range []*uint64{&semver.Major, &semver.Minor, &semver.Patch} {
+		*part, err = strconv.ParseUint(match[i+1], 10, 64)
+		if err != nil {
+			return Semver{}, fmt.Errorf("invalid semantic version %q: %w", version, err)
+		}
+	}
+
+	if match[4] != "" {
+		semver.Prerelease = strings.Split(match[4], ".")
+	}
+
+	semver.Build = match[5]
+
+	return semver, nil
+}
+
+// Compare returns -1, 0 or 1 if v has a lower, the same or a higher precedence
+// than other. Build metadata is not considered, as per the specification.
+func (v Semver) Compare(other Semver) int {
+	for _, pair := range [][2]uint64{{v.Major, other.Major}, {v.Minor, other.Minor}, {v.Patch, other.Patch}} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	// a prerelease has a lower precedence than the release
+	switch {
+	case len(v.Prerelease) == 0 && len(other.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(other.Prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.Prerelease) && i < len(other.Prerelease); i++ {
+		result := comparePrereleaseIdentifier(v.Prerelease[i], other.Prerelease[i])
+		if result != 0 {
+			return result
+		}
+	}
+
+	switch {
+	case len(v.Prerelease) < len(other.Prerelease):
+		return -1
+	case len(v.Prerelease) > len(other.Prerelease):
+		return 1
+	}
+
+	return 0
+}
+
+// comparePrereleaseIdentifier compares two dot separated prerelease
+// identifiers: numeric ones are compared numerically and have a lower
+// precedence than alphanumeric ones, compared in ASCII order.
+func comparePrereleaseIdentifier(a string, b string) int {
+	numberA, errA := strconv.ParseUint(a, 10, 64)
+	numberB, errB := strconv.ParseUint(b, 10, 64)
+
+	switch {
+	case errA == nil && errB == nil:
+		switch {
+		case numberA < numberB:
+			return -1
+		case numberA > numberB:
+			return 1
+		}
+
+		return 0
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
@@ -2,8 +2,11 @@
 package utils
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // OciSysextBinPath is the bin path internally used by oci-sysext.
@@ -12,12 +15,19 @@ var OciSysextBinPath = filepath.Join(GetOciSysextHome(), "bin")
 // GetOciSysextHome will return where the program will save data.
 // This function will search the environment or:
 //
+// OCI_SYSEXT_HOME
 // OCI-SYSEXT_HOME
 // XDG_DATA_HOME
 // HOME
 //
 // These variable are searched in this order.
+// The result is not guaranteed to be an absolute path, use CheckOciSysextHome
+// to validate it.
 func GetOciSysextHome() string {
+	if os.Getenv("OCI_SYSEXT_HOME") != "" {
+		return filepath.Join(os.Getenv("OCI_SYSEXT_HOME"), "oci-sysext")
+	}
+
 	if os.Getenv("OCI-SYSEXT_HOME") != "" {
 		return filepath.Join(os.Getenv("OCI-SYSEXT_HOME"), "oci-sysext")
 	}
@@ -28,3 +38,85 @@ func GetOciSysextHome() string {
 
 	return filepath.Join(os.Getenv("HOME"), ".local/share/oci-sysext")
 }
+
+// CheckOciSysextHome will return an error if the path returned by
+// GetOciSysextHome is not absolute, for example when HOME is unset.
+func CheckOciSysextHome() error {
+	home := GetOciSysextHome()
+	if !filepath.IsAbs(home) {
+		return fmt.Errorf(
+			"cannot determine where to save data (got relative path %q): set OCI_SYSEXT_HOME to an absolute path",
+			home)
+	}
+
+	return nil
+}
+
+// ParseSize will parse a human readable size, like 512M or 10G, into bytes.
+// Supported suffixes are K, M, G and T, as powers of 1024. A plain number is
+// taken as bytes.
+func ParseSize(size string) (uint64, error) {
+	multipliers := map[string]uint64{
+		"K": 1 << 10,
+		"M": 1 << 20,
+		"G": 1 << 30,
+		"T": 1 << 40,
+	}
+
+	input := size
+	size = strings.ToUpper(strings.TrimSpace(size))
+	size = strings.TrimSuffix(strings.TrimSuffix(size, "B"), "I")
+
+	multiplier := uint64(1)
+
+	if len(size) > 0 {
+		if value, ok := multipliers[size[len(size)-1:]]; ok {
+			multiplier = value
+			size = size[:len(size)-1]
+		}
+	}
+
+	value, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", input)
+	}
+
+	return value * multiplier, nil
+}
+
+// GetConfigPath returns the path of the configuration file.
+func GetConfigPath() string {
+	return filepath.Join(GetOciSysextHome(), "config.conf")
+}
+
+// ReadConfig will return the key = value settings from the configuration
+// file, empty lines and lines starting with # are ignored.
+// A missing configuration file is not an error.
+func ReadConfig() (map[string]string, error) {
+	config := map[string]string{}
+
+	content, err := os.ReadFile(GetConfigPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+
+		return nil, err
+	}
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected key = value", GetConfigPath(), i+1)
+		}
+
+		config[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+
+	return config, nil
+}
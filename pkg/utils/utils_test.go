@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestGetOciSysextHome(t *testing.T) {
+	tests := []struct {
+		env      map[string]string
+		expected string
+	}{
+		{map[string]string{"OCI_SYSEXT_HOME": "/data", "OCI-SYSEXT_HOME": "/legacy", "XDG_DATA_HOME": "/xdg", "HOME": "/home/user"},
+			"/data/oci-sysext"},
+		{map[string]string{"OCI-SYSEXT_HOME": "/legacy", "XDG_DATA_HOME": "/xdg", "HOME": "/home/user"},
+			"/legacy/oci-sysext"},
+		{map[string]string{"XDG_DATA_HOME": "/xdg", "HOME": "/home/user"},
+			"/xdg/oci-sysext"},
+		{map[string]string{"HOME": "/home/user"},
+			"/home/user/.local/share/oci-sysext"},
+	}
+
+	for _, test := range tests {
+		for _, name := range []string{"OCI_SYSEXT_HOME", "OCI-SYSEXT_HOME", "XDG_DATA_HOME", "HOME"} {
+			t.Setenv(name, test.env[name])
+		}
+
+		home := GetOciSysextHome()
+		if home != test.expected {
+			t.Errorf("%v: got %s, expected %s", test.env, home, test.expected)
+		}
+
+		err := CheckOciSysextHome()
+		if err != nil {
+			t.Errorf("%v: %v", test.env, err)
+		}
+	}
+
+	// all unset
+	for _, name := range []string{"OCI_SYSEXT_HOME", "OCI-SYSEXT_HOME", "XDG_DATA_HOME", "HOME"} {
+		t.Setenv(name, "")
+	}
+
+	err := CheckOciSysextHome()
+	if err == nil {
+		t.Errorf("got %s, expected an error without any of the variables", GetOciSysextHome())
+	}
+
+	// a relative path is refused too
+	t.Setenv("OCI_SYSEXT_HOME", "data")
+
+	err = CheckOciSysextHome()
+	if err == nil {
+		t.Error("a relative OCI_SYSEXT_HOME should be refused")
+	}
+}